@@ -17,6 +17,7 @@
 package dejavu
 
 import (
+	"context"
 	"github.com/siyuan-note/dejavu/cloud"
 	"os"
 	"path"
@@ -27,19 +28,37 @@ import (
 	"github.com/siyuan-note/logging"
 )
 
-func (repo *Repo) DownloadIndex(id string, context map[string]interface{}) (downloadFileCount, downloadChunkCount int, downloadBytes int64, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (repo *Repo) DownloadIndex(ctx context.Context, id string) (downloadFileCount, downloadChunkCount int, downloadBytes int64, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	runlockCloud, err := repo.tryRLockCloud(ctx)
+	if nil != err {
+		return
+	}
+	defer runlockCloud()
+	defer repo.cacheCloudPacks()()
 
-	downloadFileCount, downloadChunkCount, downloadBytes, err = repo.downloadIndex(id, context)
+	downloadFileCount, downloadChunkCount, downloadBytes, err = repo.downloadIndex(ctx, id)
 	return
 }
 
-func (repo *Repo) DownloadTagIndex(tag, id string, context map[string]interface{}) (downloadFileCount, downloadChunkCount int, downloadBytes int64, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (repo *Repo) DownloadTagIndex(ctx context.Context, tag, id string) (downloadFileCount, downloadChunkCount int, downloadBytes int64, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	runlockCloud, err := repo.tryRLockCloud(ctx)
+	if nil != err {
+		return
+	}
+	defer runlockCloud()
+	defer repo.cacheCloudPacks()()
 
-	downloadFileCount, downloadChunkCount, downloadBytes, err = repo.downloadIndex(id, context)
+	downloadFileCount, downloadChunkCount, downloadBytes, err = repo.downloadIndex(ctx, id)
 
 	// 更新本地标签
 	err = repo.AddTag(id, tag)
@@ -51,9 +70,9 @@ func (repo *Repo) DownloadTagIndex(tag, id string, context map[string]interface{
 	return
 }
 
-func (repo *Repo) downloadIndex(id string, context map[string]interface{}) (downloadFileCount, downloadChunkCount int, downloadBytes int64, err error) {
+func (repo *Repo) downloadIndex(ctx context.Context, id string) (downloadFileCount, downloadChunkCount int, downloadBytes int64, err error) {
 	// 从云端下载标签指向的索引
-	length, index, err := repo.downloadCloudIndex(id, context)
+	length, index, err := repo.downloadCloudIndex(ctx, id)
 	if nil != err {
 		logging.LogErrorf("download cloud index failed: %s", err)
 		return
@@ -71,7 +90,7 @@ func (repo *Repo) downloadIndex(id string, context map[string]interface{}) (down
 	}
 
 	// 下载缺失文件并入库
-	downloadStat, fetchedFiles, err := repo.downloadCloudFilesPut(fetchFileIDs, context)
+	downloadStat, fetchedFiles, err := repo.downloadCloudFilesPut(ctx, fetchFileIDs)
 	if nil != err {
 		logging.LogErrorf("download cloud files put failed: %s", err)
 		return
@@ -79,7 +98,7 @@ func (repo *Repo) downloadIndex(id string, context map[string]interface{}) (down
 	downloadBytes += downloadStat.CloudBytes + downloadStat.PeerBytes
 	cloudDownloadBytes += downloadStat.CloudBytes
 	downloadFileCount += len(fetchFileIDs)
-	apiGet += len(fetchFileIDs) - downloadStat.PeerCount
+	apiGet += downloadStat.cloudGets(len(fetchFileIDs))
 
 	// 从文件列表中得到去重后的分块列表
 	cloudChunkIDs := repo.getChunks(fetchedFiles)
@@ -92,7 +111,7 @@ func (repo *Repo) downloadIndex(id string, context map[string]interface{}) (down
 	}
 
 	// 下载分块并入库
-	downloadStat, downloadErr := repo.downloadCloudChunksPut(fetchChunkIDs, context)
+	downloadStat, downloadErr := repo.downloadCloudChunksPut(ctx, fetchChunkIDs)
 	err = downloadErr
 	if nil != err {
 		logging.LogErrorf("download chunks put failed: %s", err)
@@ -101,7 +120,7 @@ func (repo *Repo) downloadIndex(id string, context map[string]interface{}) (down
 	downloadBytes += downloadStat.CloudBytes + downloadStat.PeerBytes
 	cloudDownloadBytes += downloadStat.CloudBytes
 	downloadChunkCount = len(fetchChunkIDs)
-	apiGet += downloadChunkCount - downloadStat.PeerCount
+	apiGet += downloadStat.cloudGets(downloadChunkCount)
 
 	// 更新本地索引
 	err = repo.store.PutIndex(index)
@@ -115,11 +134,13 @@ func (repo *Repo) downloadIndex(id string, context map[string]interface{}) (down
 	return
 }
 
-func (repo *Repo) UploadTagIndex(tag, id string, context map[string]interface{}) (uploadFileCount, uploadChunkCount int, uploadBytes int64, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (repo *Repo) UploadTagIndex(ctx context.Context, tag, id string) (uploadFileCount, uploadChunkCount int, uploadBytes int64, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 
-	uploadFileCount, uploadChunkCount, uploadBytes, err = repo.uploadTagIndex(tag, id, context)
+	uploadFileCount, uploadChunkCount, uploadBytes, err = repo.uploadTagIndex(ctx, tag, id)
 	if e, ok := err.(*os.PathError); ok && os.IsNotExist(err) {
 		p := e.Path
 		if !strings.Contains(p, "objects") {
@@ -133,7 +154,7 @@ func (repo *Repo) UploadTagIndex(tag, id string, context map[string]interface{})
 	return
 }
 
-func (repo *Repo) uploadTagIndex(tag, id string, context map[string]interface{}) (uploadFileCount, uploadChunkCount int, uploadBytes int64, err error) {
+func (repo *Repo) uploadTagIndex(ctx context.Context, tag, id string) (uploadFileCount, uploadChunkCount int, uploadBytes int64, err error) {
 	index, err := repo.store.GetIndex(id)
 	if nil != err {
 		logging.LogErrorf("get index failed: %s", err)
@@ -165,7 +186,7 @@ func (repo *Repo) uploadTagIndex(tag, id string, context map[string]interface{})
 	apiGet := 1
 	var uploadFiles []*entity.File
 	var uploadChunkIDs []string
-	_, cloudLatest, latestErr := repo.downloadCloudLatest(context)
+	_, cloudLatest, latestErr := repo.downloadCloudLatest(ctx)
 	cloudLatestMatched := nil == latestErr && nil != cloudLatest && "" != index.ID && index.ID == cloudLatest.ID
 	if nil != latestErr {
 		logging.LogWarnf("download cloud latest before uploading tag index failed: %s", latestErr)
@@ -207,30 +228,38 @@ func (repo *Repo) uploadTagIndex(tag, id string, context map[string]interface{})
 			return
 		}
 		apiGet += len(uploadChunkIDs)
+
+		// 排除已经位于云端包文件中的分块
+		var packGets int
+		uploadChunkIDs, packGets, err = repo.excludeCloudPacked(uploadChunkIDs)
+		if nil != err {
+			logging.LogErrorf("get cloud repo packed chunks failed: %s", err)
+			return
+		}
+		apiGet += packGets
 	}
 
 	// 上传分块
-	length, err := repo.uploadChunks(uploadChunkIDs, context)
+	length, apiPut, err := repo.uploadChunks(ctx, uploadChunkIDs, nil)
 	if nil != err {
 		logging.LogErrorf("upload chunks failed: %s", err)
 		return
 	}
 	uploadChunkCount = len(uploadChunkIDs)
 	uploadBytes += length
-	apiPut := uploadChunkCount
 
 	// 上传文件
-	length, err = repo.uploadFiles(uploadFiles, context)
+	length, puts, err := repo.uploadFiles(ctx, uploadFiles, nil)
 	if nil != err {
 		logging.LogErrorf("upload files failed: %s", err)
 		return
 	}
 	uploadFileCount = len(uploadFiles)
 	uploadBytes += length
-	apiPut += uploadFileCount
+	apiPut += puts
 
 	// 上传索引
-	length, err = repo.uploadIndex(index, context)
+	length, err = repo.uploadIndex(ctx, index)
 	if nil != err {
 		logging.LogErrorf("upload index failed: %s", err)
 		return
@@ -239,8 +268,17 @@ func (repo *Repo) uploadTagIndex(tag, id string, context map[string]interface{})
 	uploadBytes += length
 	apiPut++
 
+	// 锁定标签引用的索引和对象
+	gets, puts, err := repo.retainTagObjects(ctx, index)
+	if nil != err {
+		logging.LogErrorf("retain tag objects failed: %s", err)
+		return
+	}
+	apiGet += gets
+	apiPut += puts
+
 	// 上传标签
-	length, err = repo.updateCloudRef("refs/tags/"+tag, context)
+	length, err = repo.updateCloudRef(ctx, "refs/tags/"+tag)
 	if nil != err {
 		logging.LogErrorf("update cloud tag ref failed: %s", err)
 		return
@@ -254,6 +292,59 @@ func (repo *Repo) uploadTagIndex(tag, id string, context map[string]interface{})
 	return
 }
 
+// retainTagObjects 用于为标签索引 index 引用的索引、文件、分块和包文件设置锁定保留期，避免其他设备清理或者误删后标签无法恢复。
+// 存储服务不支持对象锁定时不做任何处理。
+func (repo *Repo) retainTagObjects(ctx context.Context, index *entity.Index) (apiGet, apiPut int, err error) {
+	retainer, ok := cloud.Unwrap(repo.cloud).(cloud.Retainer)
+	if !ok {
+		return
+	}
+
+	keys := []string{path.Join("indexes", index.ID)}
+	if "" != index.CheckIndexID {
+		keys = append(keys, path.Join("check", "indexes", index.CheckIndexID))
+	}
+
+	objectIDs := map[string]bool{}
+	var files []*entity.File
+	for _, fileID := range index.Files {
+		var file *entity.File
+		file, err = repo.store.GetFile(fileID)
+		if nil != err {
+			logging.LogErrorf("get file failed: %s", err)
+			return
+		}
+		files = append(files, file)
+		objectIDs[fileID] = true
+	}
+	for _, chunkID := range repo.getChunks(files) {
+		objectIDs[chunkID] = true
+	}
+	for objectID := range objectIDs {
+		keys = append(keys, path.Join("objects", objectID[:2], objectID[2:]))
+	}
+
+	// 已经聚合到包文件中的对象需要锁定包文件
+	packs, apiGet, _, err := repo.cloudPacks()
+	if nil != err {
+		return
+	}
+	for packID, pack := range packs {
+		for _, obj := range pack.Objects {
+			if objectIDs[obj.ID] {
+				keys = append(keys, path.Join("packs", packID), path.Join("packs", packID+packIndexExt))
+				break
+			}
+		}
+	}
+
+	if err = retainer.RetainObjects(ctx, keys); nil != err {
+		return
+	}
+	apiPut = len(keys)
+	return
+}
+
 func (repo *Repo) getCloudRepoStat() (repoSize int64, backupCount int, err error) {
 	repoStat, err := repo.cloud.GetStat()
 	if nil != err {
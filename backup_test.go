@@ -17,8 +17,8 @@
 package dejavu
 
 import (
+	"context"
 	"errors"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync/atomic"
@@ -36,6 +36,12 @@ type trackingLocalCloud struct {
 	indexUploads      atomic.Int32
 	tagUploads        atomic.Int32
 	failIndexUpload   atomic.Bool
+	retainedKeys      []string
+}
+
+func (tracking *trackingLocalCloud) RetainObjects(ctx context.Context, keys []string) (err error) {
+	tracking.retainedKeys = append(tracking.retainedKeys, keys...)
+	return
 }
 
 func (tracking *trackingLocalCloud) GetRefsFiles() (fileIDs []string, refs []*cloud.Ref, err error) {
@@ -62,7 +68,7 @@ func TestUploadTagIndexUsesCloudLatestFastPath(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	uploadFileCount, uploadChunkCount, uploadBytes, err := repo.UploadTagIndex("tag-fast", index.ID, map[string]interface{}{})
+	uploadFileCount, uploadChunkCount, uploadBytes, err := repo.UploadTagIndex(context.Background(), "tag-fast", index.ID)
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -84,7 +90,7 @@ func TestUploadTagIndexDoesNotUpdateRefAfterIndexUploadFailure(t *testing.T) {
 	}
 	tracking.failIndexUpload.Store(true)
 
-	_, _, _, err := repo.UploadTagIndex("tag-fail", index.ID, map[string]interface{}{})
+	_, _, _, err := repo.UploadTagIndex(context.Background(), "tag-fail", index.ID)
 	if !errors.Is(err, errTestIndexUpload) {
 		t.Fatalf("unexpected upload error [%v]", err)
 	}
@@ -93,35 +99,55 @@ func TestUploadTagIndexDoesNotUpdateRefAfterIndexUploadFailure(t *testing.T) {
 	}
 }
 
-func newUploadTagIndexTestRepo(t *testing.T) (repo *Repo, index *entity.Index, tracking *trackingLocalCloud) {
-	t.Helper()
-	tempDir := t.TempDir()
-	dataPath := filepath.Join(tempDir, "data")
-	repoPath := filepath.Join(tempDir, "repo")
-	if err := os.MkdirAll(dataPath, 0755); nil != err {
+func TestUploadTagIndexRetainsObjects(t *testing.T) {
+	repo, index, tracking := newUploadTagIndexTestRepo(t)
+	if err := repo.AddTag(index.ID, "tag-retain"); nil != err {
 		t.Fatal(err)
 	}
-	if err := os.WriteFile(filepath.Join(dataPath, "doc.txt"), []byte("data"), 0644); nil != err {
+
+	if _, _, _, err := repo.UploadTagIndex(context.Background(), "tag-retain", index.ID); nil != err {
 		t.Fatal(err)
 	}
+	retained := map[string]bool{}
+	for _, key := range tracking.retainedKeys {
+		retained[key] = true
+	}
+	wantKeys := []string{"indexes/" + index.ID}
+	for _, fileID := range index.Files {
+		file, err := repo.store.GetFile(fileID)
+		if nil != err {
+			t.Fatal(err)
+		}
+		wantKeys = append(wantKeys, "objects/"+fileID[:2]+"/"+fileID[2:])
+		for _, chunkID := range file.Chunks {
+			wantKeys = append(wantKeys, "objects/"+chunkID[:2]+"/"+chunkID[2:])
+		}
+	}
+	for _, key := range wantKeys {
+		if !retained[key] {
+			t.Fatalf("object [%s] referenced by tag is not retained", key)
+		}
+	}
+	if retained["refs/latest"] {
+		t.Fatal("latest ref should not be retained")
+	}
+}
+
+func newUploadTagIndexTestRepo(t *testing.T) (repo *Repo, index *entity.Index, tracking *trackingLocalCloud) {
+	t.Helper()
+	tempDir := t.TempDir()
+	repo = newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	tracking = &trackingLocalCloud{Local: repo.cloud.(*cloud.Local)}
+	tracking.GetConf().PackObjects = false
+	repo.cloud = tracking
+	writeTestDataFile(t, repo, "doc.txt", "data")
 
-	tracking = &trackingLocalCloud{Local: cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
-		Dir:           "main",
-		RepoPath:      repoPath,
-		AvailableSize: 1024 * 1024 * 1024,
-		Local:         &cloud.ConfLocal{Endpoint: filepath.Join(tempDir, "cloud")},
-	}})}
 	var err error
-	repo, err = NewRepo(dataPath, repoPath, filepath.Join(tempDir, "history"), filepath.Join(tempDir, "temp"),
-		"device", "Device", "windows", []byte("0123456789abcdef0123456789abcdef"), nil, tracking)
-	if nil != err {
-		t.Fatal(err)
-	}
-	index, err = repo.Index("Initial index", false, map[string]interface{}{})
+	index, err = repo.Index(context.Background(), "Initial index", false)
 	if nil != err {
 		t.Fatal(err)
 	}
-	if _, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+	if _, _, err = repo.Sync(context.Background()); nil != err {
 		t.Fatal(err)
 	}
 	tracking.getRefsFilesCalls.Store(0)
@@ -44,4 +44,11 @@ type chunkDownloadStat struct {
 	PeerBytes         int64
 	PeerCount         int
 	PeerFallbackCount int
+	PackCount         int // 从云端包文件中获取的对象数
+	PackGets          int // 获取云端包文件和包索引的请求数
+}
+
+// cloudGets 返回下载 total 个对象时向云端发起的 GET 请求数。
+func (stat *chunkDownloadStat) cloudGets(total int) int {
+	return total - stat.PeerCount - stat.PackCount + stat.PackGets
 }
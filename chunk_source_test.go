@@ -17,6 +17,7 @@
 package dejavu
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"path"
@@ -97,7 +98,8 @@ func (source *testChunkSource) DownloadObjectValidated(id string, validate func(
 }
 
 func TestDownloadChunksFromSource(t *testing.T) {
-	repo, _ := newChunkSourceTestRepo(t)
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
 	data := []byte("peer chunk")
 	id := util.Hash(data)
 	encoded, err := repo.store.encodeData(data)
@@ -106,7 +108,7 @@ func TestDownloadChunksFromSource(t *testing.T) {
 	}
 	repo.SetChunkSource(&testChunkSource{chunks: map[string][]byte{id: encoded}})
 
-	stat, err := repo.downloadCloudChunksPut([]string{id}, map[string]interface{}{})
+	stat, err := repo.downloadCloudChunksPut(context.Background(), []string{id})
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -123,7 +125,8 @@ func TestDownloadChunksFromSource(t *testing.T) {
 }
 
 func TestDownloadFilesFromSource(t *testing.T) {
-	repo, _ := newChunkSourceTestRepo(t)
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
 	file := entity.NewFile("data/test.sy", 42, time.Now().UnixMilli())
 	file.Chunks = []string{util.Hash([]byte("chunk"))}
 	data, err := json.Marshal(file)
@@ -136,7 +139,7 @@ func TestDownloadFilesFromSource(t *testing.T) {
 	}
 	repo.SetChunkSource(&testChunkSource{chunks: map[string][]byte{file.ID: encoded}})
 
-	stat, files, err := repo.downloadCloudFilesPut([]string{file.ID}, map[string]interface{}{})
+	stat, files, err := repo.downloadCloudFilesPut(context.Background(), []string{file.ID})
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -156,7 +159,9 @@ func TestDownloadFilesFromSource(t *testing.T) {
 }
 
 func TestDownloadFilesFallsBackToCloud(t *testing.T) {
-	repo, localCloud := newChunkSourceTestRepo(t)
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	localCloud := repo.cloud.(*cloud.Local)
 	file := entity.NewFile("data/cloud.sy", 42, time.Now().UnixMilli())
 	data, err := json.Marshal(file)
 	if nil != err {
@@ -180,7 +185,7 @@ func TestDownloadFilesFallsBackToCloud(t *testing.T) {
 	}
 	repo.SetChunkSource(&testChunkSource{chunks: map[string][]byte{file.ID: invalidEncoded}})
 
-	stat, files, err := repo.downloadCloudFilesPut([]string{file.ID}, map[string]interface{}{})
+	stat, files, err := repo.downloadCloudFilesPut(context.Background(), []string{file.ID})
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -193,7 +198,9 @@ func TestDownloadFilesFallsBackToCloud(t *testing.T) {
 }
 
 func TestDownloadChunksFallsBackToCloud(t *testing.T) {
-	repo, localCloud := newChunkSourceTestRepo(t)
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	localCloud := repo.cloud.(*cloud.Local)
 	data := []byte("cloud chunk")
 	id := util.Hash(data)
 	encoded, err := repo.store.encodeData(data)
@@ -210,7 +217,7 @@ func TestDownloadChunksFallsBackToCloud(t *testing.T) {
 	}
 	repo.SetChunkSource(&testChunkSource{chunks: map[string][]byte{id: invalidData}})
 
-	stat, err := repo.downloadCloudChunksPut([]string{id}, map[string]interface{}{})
+	stat, err := repo.downloadCloudChunksPut(context.Background(), []string{id})
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -227,7 +234,9 @@ func TestDownloadChunksFallsBackToCloud(t *testing.T) {
 }
 
 func TestDownloadChunksFallsBackWhenSourceQueryFails(t *testing.T) {
-	repo, localCloud := newChunkSourceTestRepo(t)
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	localCloud := repo.cloud.(*cloud.Local)
 	data := []byte("cloud only chunk")
 	id := util.Hash(data)
 	encoded, err := repo.store.encodeData(data)
@@ -239,7 +248,7 @@ func TestDownloadChunksFallsBackWhenSourceQueryFails(t *testing.T) {
 	}
 	repo.SetChunkSource(&testChunkSource{chunks: map[string][]byte{}, hasErr: errors.New("unavailable")})
 
-	stat, err := repo.downloadCloudChunksPut([]string{id}, map[string]interface{}{})
+	stat, err := repo.downloadCloudChunksPut(context.Background(), []string{id})
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -249,7 +258,8 @@ func TestDownloadChunksFallsBackWhenSourceQueryFails(t *testing.T) {
 }
 
 func TestDownloadChunksLimitsSourceConcurrency(t *testing.T) {
-	repo, _ := newChunkSourceTestRepo(t)
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
 	chunks := map[string][]byte{}
 	ids := make([]string, 0, 6)
 	for i := 0; i < 6; i++ {
@@ -269,7 +279,7 @@ func TestDownloadChunksLimitsSourceConcurrency(t *testing.T) {
 	}
 	repo.SetChunkSource(source)
 
-	stat, err := repo.downloadCloudChunksPut(ids, map[string]interface{}{})
+	stat, err := repo.downloadCloudChunksPut(context.Background(), ids)
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -277,24 +287,3 @@ func TestDownloadChunksLimitsSourceConcurrency(t *testing.T) {
 		t.Fatalf("unexpected source concurrency or stat: max=%d, stat=%+v", source.maxActive.Load(), stat)
 	}
 }
-
-func newChunkSourceTestRepo(t *testing.T) (repo *Repo, localCloud *cloud.Local) {
-	t.Helper()
-	tempDir := t.TempDir()
-	repoPath := filepath.Join(tempDir, "repo")
-	cloudPath := filepath.Join(tempDir, "cloud")
-	localCloud = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
-		Dir:           "main",
-		RepoPath:      repoPath,
-		AvailableSize: 1024 * 1024 * 1024,
-		Local:         &cloud.ConfLocal{Endpoint: cloudPath},
-	}})
-	var err error
-	repo, err = NewRepo(filepath.Join(tempDir, "data"), repoPath, filepath.Join(tempDir, "history"),
-		filepath.Join(tempDir, "temp"), "device", "Device", "windows",
-		[]byte("0123456789abcdef0123456789abcdef"), nil, localCloud)
-	if nil != err {
-		t.Fatal(err)
-	}
-	return
-}
@@ -0,0 +1,428 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/siyuan-note/logging"
+)
+
+// ConfBandwidth 用于描述传输带宽限制。
+type ConfBandwidth struct {
+	UploadRate   int64                    // 上传速率上限，单位：字节/秒，0 表示不限制
+	DownloadRate int64                    // 下载速率上限，单位：字节/秒，0 表示不限制
+	Schedules    []*ConfBandwidthSchedule // 分时段限速，按顺序使用第一个匹配当前时间的时段，均不匹配时使用上面的速率
+}
+
+// ConfBandwidthSchedule 用于描述某个时段的带宽限制。
+type ConfBandwidthSchedule struct {
+	Start        string         // 开始时间（包含），本地时间，格式为 HH:MM
+	End          string         // 结束时间（不包含），格式为 HH:MM，早于开始时间时表示跨越零点，等于开始时间时表示全天
+	Weekdays     []time.Weekday // 生效的星期，为空表示每天，跨越零点的时段按开始时间所在的星期计算
+	UploadRate   int64          // 上传速率上限，单位：字节/秒，0 表示不限制
+	DownloadRate int64          // 下载速率上限，单位：字节/秒，0 表示不限制
+}
+
+// BandwidthStat 描述了限速器累计的传输统计，传输时长仅计算有数据在传输的时间，并发传输的时间不重复计算。
+type BandwidthStat struct {
+	UploadBytes      int64
+	UploadDuration   time.Duration
+	DownloadBytes    int64
+	DownloadDuration time.Duration
+}
+
+// UploadRate 返回 stat 相对于更早的统计 since 的实际上传速率，单位：字节/秒。
+func (stat *BandwidthStat) UploadRate(since *BandwidthStat) int64 {
+	return transferRate(stat.UploadBytes-since.UploadBytes, stat.UploadDuration-since.UploadDuration)
+}
+
+// DownloadRate 返回 stat 相对于更早的统计 since 的实际下载速率，单位：字节/秒。
+func (stat *BandwidthStat) DownloadRate(since *BandwidthStat) int64 {
+	return transferRate(stat.DownloadBytes-since.DownloadBytes, stat.DownloadDuration-since.DownloadDuration)
+}
+
+func transferRate(bytes int64, duration time.Duration) int64 {
+	if 1 > bytes || 0 >= duration {
+		return 0
+	}
+	return int64(float64(bytes) / duration.Seconds())
+}
+
+// BandwidthLimiter 描述了传输带宽限速器，使用同一个限速器的并发传输共享带宽，并统计实际传输速率。
+//
+// 所有方法都可以在 nil 限速器上调用，此时不限速也不统计。
+type BandwidthLimiter struct {
+	conf      *ConfBandwidth
+	schedules []*bandwidthSchedule
+	upload    *bandwidthBucket
+	download  *bandwidthBucket
+	now       func() time.Time
+}
+
+// bandwidthSchedule 描述了解析后的限速时段，时间为一天中的分钟数。
+type bandwidthSchedule struct {
+	start, end   int
+	weekdays     []time.Weekday
+	uploadRate   int64
+	downloadRate int64
+}
+
+// NewBandwidthLimiter 根据带宽限制配置 conf 创建限速器，conf 为空时仅统计传输速率，格式错误的时段会被忽略。
+func NewBandwidthLimiter(conf *ConfBandwidth) (ret *BandwidthLimiter) {
+	if nil == conf {
+		conf = &ConfBandwidth{}
+	}
+	ret = &BandwidthLimiter{conf: conf, upload: &bandwidthBucket{}, download: &bandwidthBucket{}, now: time.Now}
+	for _, schedule := range conf.Schedules {
+		if nil == schedule {
+			continue
+		}
+		start, err := parseDayMinute(schedule.Start)
+		if nil != err {
+			logging.LogWarnf("ignored bandwidth schedule [%s-%s]: %s", schedule.Start, schedule.End, err)
+			continue
+		}
+		end, err := parseDayMinute(schedule.End)
+		if nil != err {
+			logging.LogWarnf("ignored bandwidth schedule [%s-%s]: %s", schedule.Start, schedule.End, err)
+			continue
+		}
+		ret.schedules = append(ret.schedules, &bandwidthSchedule{
+			start:        start,
+			end:          end,
+			weekdays:     schedule.Weekdays,
+			uploadRate:   schedule.UploadRate,
+			downloadRate: schedule.DownloadRate,
+		})
+	}
+	return
+}
+
+func parseDayMinute(hhmm string) (ret int, err error) {
+	t, err := time.Parse("15:04", hhmm)
+	if nil != err {
+		err = fmt.Errorf("invalid time of day [%s]", hhmm)
+		return
+	}
+	ret = t.Hour()*60 + t.Minute()
+	return
+}
+
+// Rates 返回时间 t 生效的上传和下载速率上限，单位：字节/秒，0 表示不限制。
+func (limiter *BandwidthLimiter) Rates(t time.Time) (upload, download int64) {
+	if nil == limiter {
+		return
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	weekday := t.Weekday()
+	for _, schedule := range limiter.schedules {
+		if schedule.matches(minute, weekday) {
+			return schedule.uploadRate, schedule.downloadRate
+		}
+	}
+	return limiter.conf.UploadRate, limiter.conf.DownloadRate
+}
+
+func (schedule *bandwidthSchedule) matches(minute int, weekday time.Weekday) bool {
+	onDay := func(day time.Weekday) bool {
+		return 1 > len(schedule.weekdays) || slices.Contains(schedule.weekdays, day)
+	}
+
+	switch {
+	case schedule.start == schedule.end:
+		return onDay(weekday)
+	case schedule.start < schedule.end:
+		return schedule.start <= minute && minute < schedule.end && onDay(weekday)
+	default: // 跨越零点，零点之后的部分属于前一天开始的时段
+		if schedule.start <= minute {
+			return onDay(weekday)
+		}
+		return minute < schedule.end && onDay((weekday+6)%7)
+	}
+}
+
+// Stat 返回限速器累计的传输统计。
+func (limiter *BandwidthLimiter) Stat() (ret *BandwidthStat) {
+	ret = &BandwidthStat{}
+	if nil == limiter {
+		return
+	}
+
+	now := limiter.now()
+	ret.UploadBytes, ret.UploadDuration = limiter.upload.stat(now)
+	ret.DownloadBytes, ret.DownloadDuration = limiter.download.stat(now)
+	return
+}
+
+// UploadReader 返回按上传速率限速读取 reader 的数据流，可回退重读的 reader 返回的数据流也可以回退重读。
+//
+// 上传结束后需要关闭返回的数据流以结束统计，关闭时不会关闭 reader。
+func (limiter *BandwidthLimiter) UploadReader(ctx context.Context, reader io.Reader) io.ReadCloser {
+	return limiter.newReader(ctx, reader, nil, true)
+}
+
+// DownloadReader 返回按下载速率限速读取 reader 的数据流，关闭时会一并关闭 reader。
+func (limiter *BandwidthLimiter) DownloadReader(ctx context.Context, reader io.ReadCloser) io.ReadCloser {
+	return limiter.newReader(ctx, reader, reader, false)
+}
+
+func (limiter *BandwidthLimiter) newReader(ctx context.Context, reader io.Reader, closer io.Closer, upload bool) io.ReadCloser {
+	if nil == limiter {
+		if nil == closer {
+			return io.NopCloser(reader)
+		}
+		return &throttledReader{ctx: ctx, reader: reader, closer: closer}
+	}
+
+	ret := &throttledReader{ctx: ctx, reader: reader, closer: closer, limiter: limiter, upload: upload}
+	if seeker, ok := reader.(io.Seeker); ok {
+		return &throttledReadSeeker{throttledReader: ret, seeker: seeker}
+	}
+	return ret
+}
+
+// throttledHTTPClient 描述了对请求体和响应体限速的 HTTP 客户端，用于无法直接在数据流上限速的存储服务 SDK。
+type throttledHTTPClient struct {
+	client  *http.Client
+	limiter *BandwidthLimiter
+}
+
+func (client *throttledHTTPClient) Do(request *http.Request) (response *http.Response, err error) {
+	ctx := request.Context()
+	if nil != request.Body && 0 < request.ContentLength { // 包装后的空请求体会被视为长度未知，只对有数据的请求体限速
+		request.Body = client.limiter.newReader(ctx, request.Body, request.Body, true)
+		if getBody := request.GetBody; nil != getBody {
+			request.GetBody = func() (body io.ReadCloser, err error) {
+				if body, err = getBody(); nil != err {
+					return
+				}
+				body = client.limiter.newReader(ctx, body, body, true)
+				return
+			}
+		}
+	}
+
+	httpClient := client.client
+	if nil == httpClient {
+		httpClient = http.DefaultClient
+	}
+	if response, err = httpClient.Do(request); nil != err {
+		return
+	}
+	response.Body = client.limiter.DownloadReader(ctx, response.Body)
+	return
+}
+
+// throttleReadSize 为限速时单次读取的最大字节数，避免一次读取过多数据导致速率波动过大。
+const throttleReadSize = 32 * 1024
+
+// wait 用于在传输 n 字节后按当前速率等待。
+func (limiter *BandwidthLimiter) wait(ctx context.Context, n int, upload bool) (err error) {
+	now := limiter.now()
+	uploadRate, downloadRate := limiter.Rates(now)
+	bucket, rate := limiter.download, downloadRate
+	if upload {
+		bucket, rate = limiter.upload, uploadRate
+	}
+
+	delay := bucket.take(n, rate, now)
+	if 0 >= delay {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+	}
+	return
+}
+
+// bandwidthBucket 描述了单个传输方向的令牌桶，同时统计传输字节数和传输时长。
+type bandwidthBucket struct {
+	lock   sync.Mutex
+	rate   int64     // 当前令牌生成速率，0 表示不限制
+	tokens float64   // 可用令牌数，为负数时表示已经预支的字节数
+	last   time.Time // 上次生成令牌的时间
+
+	bytes  int64         // 累计传输字节数
+	active int           // 正在传输的数据流数
+	since  time.Time     // 本段连续传输的开始时间
+	busy   time.Duration // 累计传输时长
+}
+
+// take 用于消耗 n 个令牌，返回令牌不足时需要等待的时长，rate 为当前速率上限。
+func (bucket *bandwidthBucket) take(n int, rate int64, now time.Time) (delay time.Duration) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
+	bucket.bytes += int64(n)
+	if 1 > rate {
+		bucket.rate, bucket.tokens = 0, 0
+		return
+	}
+
+	if bucket.rate != rate { // 速率变化（比如进入新的时段）时重新开始计算令牌
+		bucket.rate, bucket.tokens, bucket.last = rate, 0, now
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * float64(rate)
+	if burst := float64(rate); burst < bucket.tokens {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+	bucket.tokens -= float64(n)
+	if 0 > bucket.tokens {
+		delay = time.Duration(-bucket.tokens / float64(rate) * float64(time.Second))
+	}
+	return
+}
+
+func (bucket *bandwidthBucket) begin(now time.Time) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
+	if 0 == bucket.active {
+		bucket.since = now
+	}
+	bucket.active++
+}
+
+func (bucket *bandwidthBucket) end(now time.Time) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
+	bucket.active--
+	if 0 == bucket.active {
+		bucket.busy += now.Sub(bucket.since)
+	}
+}
+
+func (bucket *bandwidthBucket) stat(now time.Time) (bytes int64, busy time.Duration) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
+	bytes, busy = bucket.bytes, bucket.busy
+	if 0 < bucket.active {
+		busy += now.Sub(bucket.since)
+	}
+	return
+}
+
+// throttledReader 描述了限速数据流，第一次读取时开始统计传输时长，读取完毕或者关闭时结束统计。
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	closer  io.Closer
+	limiter *BandwidthLimiter
+	upload  bool
+
+	lock    sync.Mutex
+	started bool
+	ended   bool
+}
+
+func (reader *throttledReader) Read(p []byte) (n int, err error) {
+	if err = reader.ctx.Err(); nil != err {
+		return
+	}
+	if nil == reader.limiter {
+		return reader.reader.Read(p)
+	}
+
+	reader.start()
+	if throttleReadSize < len(p) {
+		p = p[:throttleReadSize]
+	}
+	n, err = reader.reader.Read(p)
+	if 0 < n {
+		if waitErr := reader.limiter.wait(reader.ctx, n, reader.upload); nil != waitErr {
+			err = waitErr
+		}
+	}
+	if io.EOF == err {
+		reader.finish()
+	}
+	return
+}
+
+func (reader *throttledReader) Close() (err error) {
+	reader.finish()
+	if nil != reader.closer {
+		err = reader.closer.Close()
+	}
+	return
+}
+
+func (reader *throttledReader) bucket() *bandwidthBucket {
+	if reader.upload {
+		return reader.limiter.upload
+	}
+	return reader.limiter.download
+}
+
+func (reader *throttledReader) start() {
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+
+	if reader.started || reader.ended {
+		return
+	}
+	reader.started = true
+	reader.bucket().begin(reader.limiter.now())
+}
+
+func (reader *throttledReader) finish() {
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+
+	if !reader.started || reader.ended {
+		reader.ended = true
+		return
+	}
+	reader.ended = true
+	reader.bucket().end(reader.limiter.now())
+}
+
+// throttledReadSeeker 描述了可回退重读的限速数据流，回退后重新开始统计传输时长。
+type throttledReadSeeker struct {
+	*throttledReader
+	seeker io.Seeker
+}
+
+func (reader *throttledReadSeeker) Seek(offset int64, whence int) (ret int64, err error) {
+	if ret, err = reader.seeker.Seek(offset, whence); nil != err {
+		return
+	}
+
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+	if reader.started && !reader.ended {
+		reader.bucket().end(reader.limiter.now())
+	}
+	reader.started, reader.ended = false, false
+	return
+}
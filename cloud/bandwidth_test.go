@@ -0,0 +1,190 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBandwidthSchedules(t *testing.T) {
+	limiter := NewBandwidthLimiter(&ConfBandwidth{
+		UploadRate:   100,
+		DownloadRate: 200,
+		Schedules: []*ConfBandwidthSchedule{
+			{Start: "09:00", End: "18:00", Weekdays: []time.Weekday{time.Monday, time.Tuesday}, UploadRate: 10, DownloadRate: 20},
+			{Start: "23:00", End: "07:00", Weekdays: []time.Weekday{time.Sunday}, UploadRate: 0, DownloadRate: 0},
+			{Start: "25:00", End: "26:00", UploadRate: 1, DownloadRate: 1},
+		},
+	})
+
+	monday := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.Local)
+	cases := []struct {
+		t                time.Time
+		upload, download int64
+	}{
+		{monday.Add(9 * time.Hour), 10, 20},
+		{monday.Add(17*time.Hour + 59*time.Minute), 10, 20},
+		{monday.Add(18 * time.Hour), 100, 200},
+		{monday.Add(2 * 24 * time.Hour).Add(10 * time.Hour), 100, 200}, // 周三
+		{monday.Add(-time.Hour), 0, 0},                                 // 周日 23:00
+		{monday.Add(6 * time.Hour), 0, 0},                              // 周日开始的时段延续到周一
+		{monday.Add(7 * time.Hour), 100, 200},
+		{monday.Add(-24*time.Hour + 6*time.Hour), 100, 200}, // 周日 06:00 属于周六开始的时段
+	}
+	for i, c := range cases {
+		upload, download := limiter.Rates(c.t)
+		if c.upload != upload || c.download != download {
+			t.Fatalf("case [%d] at [%s] got rates [%d/%d], expected [%d/%d]", i, c.t, upload, download, c.upload, c.download)
+		}
+	}
+
+	if 2 != len(limiter.schedules) {
+		t.Fatalf("invalid schedule should be ignored, got [%d] schedules", len(limiter.schedules))
+	}
+}
+
+func TestBandwidthBucket(t *testing.T) {
+	now := time.Now()
+	bucket := &bandwidthBucket{}
+	if delay := bucket.take(1000, 0, now); 0 != delay {
+		t.Fatalf("unlimited transfer delayed [%s]", delay)
+	}
+	if delay := bucket.take(500, 1000, now); 500*time.Millisecond != delay {
+		t.Fatalf("unexpected delay [%s]", delay)
+	}
+	if delay := bucket.take(500, 1000, now); time.Second != delay {
+		t.Fatalf("concurrent transfer should queue behind previous one, got delay [%s]", delay)
+	}
+	if delay := bucket.take(500, 1000, now.Add(10*time.Second)); 0 != delay {
+		t.Fatalf("idle bucket should have tokens, got delay [%s]", delay)
+	}
+	if delay := bucket.take(1000, 1000, now.Add(10*time.Second)); 500*time.Millisecond != delay {
+		t.Fatalf("burst should be capped to one second, got delay [%s]", delay)
+	}
+	if 3500 != bucket.bytes {
+		t.Fatalf("unexpected transferred bytes [%d]", bucket.bytes)
+	}
+}
+
+func TestLocalBandwidthLimit(t *testing.T) {
+	tempDir := t.TempDir()
+	local := NewLocal(&BaseCloud{Conf: &Conf{
+		Dir:       "main",
+		RepoPath:  filepath.Join(tempDir, "repo"),
+		Local:     &ConfLocal{Endpoint: filepath.Join(tempDir, "cloud")},
+		Bandwidth: &ConfBandwidth{UploadRate: 256 * 1024, DownloadRate: 512 * 1024},
+	}})
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 128*1024/16)
+	start := time.Now()
+	if _, err := local.UploadBytes("objects/test", data, true); nil != err {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); 400*time.Millisecond > elapsed {
+		t.Fatalf("upload was not throttled, elapsed [%s]", elapsed)
+	}
+
+	start = time.Now()
+	downloaded, err := local.DownloadObject("objects/test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, downloaded) {
+		t.Fatal("downloaded data mismatch")
+	}
+	if elapsed := time.Since(start); 200*time.Millisecond > elapsed {
+		t.Fatalf("download was not throttled, elapsed [%s]", elapsed)
+	}
+
+	stat := local.GetBandwidthLimiter().Stat()
+	if int64(len(data)) != stat.UploadBytes || int64(len(data)) != stat.DownloadBytes {
+		t.Fatalf("unexpected transferred bytes [%d/%d]", stat.UploadBytes, stat.DownloadBytes)
+	}
+	if rate := stat.UploadRate(&BandwidthStat{}); 1 > rate || 300*1024 < rate {
+		t.Fatalf("unexpected upload rate [%d]", rate)
+	}
+	if rate := stat.DownloadRate(&BandwidthStat{}); 1 > rate || 600*1024 < rate {
+		t.Fatalf("unexpected download rate [%d]", rate)
+	}
+}
+
+func TestThrottledReaderSeek(t *testing.T) {
+	limiter := NewBandwidthLimiter(nil)
+	reader := limiter.UploadReader(context.Background(), bytes.NewReader([]byte("data")))
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		t.Fatal("throttled reader of a seekable reader should be seekable")
+	}
+	if _, err := io.ReadAll(reader); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); nil != err {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "data" != string(data) {
+		t.Fatalf("unexpected data after seek [%s]", data)
+	}
+	reader.Close()
+
+	if _, ok = limiter.UploadReader(context.Background(), io.LimitReader(bytes.NewReader(nil), 0)).(io.Seeker); ok {
+		t.Fatal("throttled reader of a non-seekable reader should not be seekable")
+	}
+	if stat := limiter.Stat(); 8 != stat.UploadBytes {
+		t.Fatalf("unexpected uploaded bytes [%d]", stat.UploadBytes)
+	}
+}
+
+func TestThrottledHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		writer.Write(append(body, body...))
+	}))
+	defer server.Close()
+
+	limiter := NewBandwidthLimiter(nil)
+	client := &throttledHTTPClient{client: server.Client(), limiter: limiter}
+	request, err := http.NewRequest(http.MethodPut, server.URL, bytes.NewReader([]byte("data")))
+	if nil != err {
+		t.Fatal(err)
+	}
+	response, err := client.Do(request)
+	if nil != err {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "datadata" != string(data) {
+		t.Fatalf("unexpected response [%s]", data)
+	}
+	if stat := limiter.Stat(); 4 != stat.UploadBytes || 8 != stat.DownloadBytes {
+		t.Fatalf("unexpected transferred bytes [%d/%d]", stat.UploadBytes, stat.DownloadBytes)
+	}
+}
@@ -17,10 +17,15 @@
 package cloud
 
 import (
+	"context"
 	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 
-	"github.com/dgraph-io/ristretto"
 	"github.com/klauspost/compress/zstd"
 	"github.com/siyuan-note/dejavu/entity"
 )
@@ -42,6 +47,20 @@ type Conf struct {
 	// 本地存储服务配置
 	Local *ConfLocal
 
+	// SFTP 协议所需配置
+	SFTP *ConfSFTP
+
+	// REST 协议所需配置
+	REST *ConfREST
+
+	PackObjects bool // 是否将小对象聚合为包文件上传，读取时总是兼容包文件和松散对象
+
+	// 传输带宽限制，为空时不限制
+	Bandwidth *ConfBandwidth
+
+	// 访问存储服务使用的代理，为空时直连或者使用环境变量中配置的代理
+	Proxy *ConfProxy
+
 	// 以下值非官方存储服务不必传入
 	Token         string // 云端接口鉴权令牌
 	AvailableSize int64  // 云端存储可用空间字节数
@@ -57,8 +76,24 @@ type ConfS3 struct {
 	Bucket         string // 存储空间
 	PathStyle      bool   // 是否使用路径风格寻址
 	SkipTlsVerify  bool   //  是否跳过 TLS 验证
-	Timeout        int    // 超时时间，单位：秒
+	Timeout        int    // 超时时间，单位：秒，分片上传时为每个分片请求的超时时间
 	ConcurrentReqs int    // 并发请求数
+
+	TLS *ConfTLS // 自定义 CA、固定证书指纹和客户端证书，为空时使用系统 CA 校验
+
+	MultipartThreshold   int64 // 分片上传阈值，单位：字节，对象大小不小于该值时使用分片上传，默认为 64MB，小于 0 时不使用分片上传
+	MultipartPartSize    int64 // 分片大小，单位：字节，默认为 8MB，最小为 5MB
+	MultipartConcurrency int   // 单个对象并发上传的分片数，默认为 4
+
+	StorageClass   string            // 存储类型，比如 STANDARD、STANDARD_IA，为空时使用存储空间的默认存储类型
+	StorageClasses map[string]string // 按对象类型指定的存储类型，键为对象路径的第一级目录或者文件名，比如 objects、packs、indexes、refs，未指定的使用 StorageClass
+
+	SSE            string // 服务端加密方式：AES256（SSE-S3）、aws:kms（SSE-KMS）或者 SSE-C，为空时不指定
+	SSEKMSKeyID    string // SSE-KMS 使用的密钥 ID，为空时使用默认密钥
+	SSECustomerKey string // SSE-C 使用的 256 位密钥，可以是 32 字节的原始密钥或者其 base64 编码，读取对象时也需要使用该密钥
+
+	ObjectLockMode string // 标签引用的对象锁定模式：GOVERNANCE 或者 COMPLIANCE，为空时不锁定，需要存储空间启用对象锁定
+	ObjectLockDays int    // 标签引用的对象锁定天数，标签引用锁定期间其引用的索引和对象不会被清理
 }
 
 // ConfWebDAV 用于描述 WebDAV 协议所需配置。
@@ -69,6 +104,11 @@ type ConfWebDAV struct {
 	SkipTlsVerify  bool   // 是否跳过 TLS 验证
 	Timeout        int    // 超时时间，单位：秒
 	ConcurrentReqs int    // 并发请求数
+
+	ChunkedUploadThreshold int64 // 服务端为 Nextcloud/ownCloud 时大于等于该字节数的对象使用分块上传，默认 10MB，小于 0 时不使用分块上传
+	ChunkSize              int64 // 分块上传的块字节数，默认 10MB，最小 5MB
+
+	TLS *ConfTLS // 自定义 CA、固定证书指纹和客户端证书，为空时使用系统 CA 校验
 }
 
 // ConfLocal 用于描述本地存储服务配置信息。
@@ -82,6 +122,32 @@ type ConfLocal struct {
 	ConcurrentReqs int // 并发请求数
 }
 
+// ConfSFTP 用于描述 SFTP 协议所需配置。
+type ConfSFTP struct {
+	Host              string // 主机地址
+	Port              int    // 端口，默认为 22
+	Username          string // 用户名
+	Password          string // 密码
+	PrivateKey        string // PEM 格式的私钥，和密码至少配置一项
+	Passphrase        string // 私钥密码
+	KnownHosts        string // known_hosts 文件路径或者文件内容，用于校验主机密钥
+	SkipHostKeyVerify bool   // 是否跳过主机密钥校验
+	Dir               string // 服务端存放仓库的目录，比如 /home/user/siyuan
+	Timeout           int    // 超时时间，单位：秒
+	ConcurrentReqs    int    // 并发请求数
+}
+
+// ConfREST 用于描述 REST 协议所需配置，服务端见 rest 包。
+type ConfREST struct {
+	Endpoint       string // 服务端点，比如 https://sync.example.com:6806
+	Username       string // HTTP Basic 认证用户名
+	Password       string // HTTP Basic 认证密码
+	Token          string // Bearer 令牌，配置后优先于用户名和密码
+	SkipTlsVerify  bool   // 是否跳过 TLS 验证
+	Timeout        int    // 超时时间，单位：秒
+	ConcurrentReqs int    // 并发请求数
+}
+
 // Cloud 描述了云端存储服务，接入云端存储服务时需要实现该接口。
 type Cloud interface {
 
@@ -138,6 +204,46 @@ type Cloud interface {
 
 	// GetConcurrentReqs 用于获取配置的并发请求数。
 	GetConcurrentReqs() int
+
+	// GetBandwidthLimiter 用于获取传输带宽限速器，上传和下载对象时都会经过该限速器。
+	GetBandwidthLimiter() *BandwidthLimiter
+
+	// GetCapabilities 用于获取存储服务支持的能力，可以通过 SelfTest 验证。
+	GetCapabilities() *Capabilities
+
+	// 以下为流式对象接口，key 为相对于云端仓库的对象路径，如 objects/xx/id。
+	// 上面的 UploadObject、UploadBytes、DownloadObject、RemoveObject 和 ListObjects 均基于这些接口实现。
+
+	// Put 用于从 reader 流式上传对象 key，size 为数据长度字节数，已有对象会被覆盖。
+	Put(ctx context.Context, key string, reader io.Reader, size int64) (err error)
+
+	// Get 用于流式下载对象 key，调用方读取完毕后需要关闭 reader，对象不存在时返回 ErrCloudObjectNotFound。
+	Get(ctx context.Context, key string) (reader io.ReadCloser, err error)
+
+	// Stat 用于获取对象 key 的信息，对象不存在时返回 ErrCloudObjectNotFound。
+	Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error)
+
+	// Delete 用于删除对象 key，对象不存在时不返回错误。
+	Delete(ctx context.Context, key string) (err error)
+
+	// List 用于列出指定前缀 pathPrefix 的对象。
+	List(ctx context.Context, pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error)
+
+	// 以下为条件读写接口，用于基于比较并交换（CAS）实现云端锁，不支持的存储服务返回 ErrUnsupported。
+
+	// GetWithETag 用于下载对象 key 的数据及其 ETag，对象不存在时返回 ErrCloudObjectNotFound。
+	GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error)
+
+	// PutIfMatch 用于条件上传对象 key：etag 为空时仅在对象不存在时上传，否则仅在对象当前的 ETag 等于 etag 时上传，条件不满足时返回 ErrCloudPreconditionFailed。
+	PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error)
+}
+
+// Capabilities 描述了存储服务支持的能力。
+type Capabilities struct {
+	ConditionalWrite  bool  `json:"conditionalWrite"`  // 是否支持条件读写（GetWithETag 和 PutIfMatch），用于云端锁，兼容协议的存储服务可能不支持
+	AtomicRename      bool  `json:"atomicRename"`      // 是否支持原子重命名，支持时上传过程中不会读到不完整的对象
+	ConsistentListing bool  `json:"consistentListing"` // 写入和删除后列出对象是否立即可见
+	MaxObjectSize     int64 `json:"maxObjectSize"`     // 单个对象的最大字节数，为 0 时不限制或者未知
 }
 
 // Traffic 描述了流量信息。
@@ -202,6 +308,9 @@ type Index struct {
 type BaseCloud struct {
 	*Conf
 	Cloud
+
+	limiterOnce sync.Once
+	limiter     *BandwidthLimiter
 }
 
 func (baseCloud *BaseCloud) CreateRepo(name string) (err error) {
@@ -277,10 +386,56 @@ func (baseCloud *BaseCloud) GetIndex(id string) (index *entity.Index, err error)
 	return
 }
 
+func (baseCloud *BaseCloud) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	err = ErrUnsupported
+	return
+}
+
+func (baseCloud *BaseCloud) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	err = ErrUnsupported
+	return
+}
+
+func (baseCloud *BaseCloud) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	err = ErrUnsupported
+	return
+}
+
+func (baseCloud *BaseCloud) Delete(ctx context.Context, key string) (err error) {
+	err = ErrUnsupported
+	return
+}
+
+func (baseCloud *BaseCloud) List(ctx context.Context, pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
+	err = ErrUnsupported
+	return
+}
+
+func (baseCloud *BaseCloud) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	err = ErrUnsupported
+	return
+}
+
+func (baseCloud *BaseCloud) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error) {
+	err = ErrUnsupported
+	return
+}
+
 func (baseCloud *BaseCloud) GetConcurrentReqs() int {
 	return 8
 }
 
+func (baseCloud *BaseCloud) GetBandwidthLimiter() *BandwidthLimiter {
+	baseCloud.limiterOnce.Do(func() {
+		baseCloud.limiter = NewBandwidthLimiter(baseCloud.Conf.Bandwidth)
+	})
+	return baseCloud.limiter
+}
+
+func (baseCloud *BaseCloud) GetCapabilities() *Capabilities {
+	return &Capabilities{}
+}
+
 func (baseCloud *BaseCloud) GetConf() *Conf {
 	return baseCloud.Conf
 }
@@ -304,6 +459,9 @@ var (
 	ErrCloudForbidden          = errors.New("cloud forbidden")           // ErrCloudForbidden 描述了云端存储服务禁止访问的错误
 	ErrCloudTooManyRequests    = errors.New("cloud too many requests")   // ErrCloudTooManyRequests 描述了云端存储服务请求过多的错误
 	ErrDecryptFailed           = errors.New("decrypt failed")            // ErrDecryptFailed 描述了解密失败的错误
+	ErrCloudPreconditionFailed = errors.New("cloud precondition failed") // ErrCloudPreconditionFailed 描述了云端存储服务条件写入不满足条件的错误
+	ErrCloudQuotaExceeded      = errors.New("cloud quota exceeded")      // ErrCloudQuotaExceeded 描述了云端存储服务空间不足或者超出配额的错误
+	ErrCloudObjectLocked       = errors.New("cloud object locked")       // ErrCloudObjectLocked 描述了云端存储服务中的对象被锁定无法删除的错误
 )
 
 func IsValidCloudDirName(cloudDirName string) bool {
@@ -335,10 +493,7 @@ func stripCtlFromUTF8(str string) string {
 	}, str)
 }
 
-var (
-	compressDecoder *zstd.Decoder
-	cache           *ristretto.Cache
-)
+var compressDecoder *zstd.Decoder
 
 func init() {
 	var err error
@@ -346,15 +501,120 @@ func init() {
 	if nil != err {
 		panic(err)
 	}
+}
 
-	cache, err = ristretto.NewCache(&ristretto.Config{
-		NumCounters: 200000,
-		MaxCost:     1000 * 1000 * 32,
-		BufferItems: 64,
-	})
+// ListRepoKeys 用于列出云端仓库 c 中的全部数据对象及其大小，包括对象、索引、包文件、校验索引、引用和 indexes-v2.json，不包括锁对象。
+//
+// 返回的对象路径统一为相对于云端仓库的路径（如 objects/xx/id），兼容各存储服务列出对象时的差异。
+func ListRepoKeys(ctx context.Context, c Cloud) (ret map[string]int64, err error) {
+	ret = map[string]int64{}
+	add := func(prefix string, infos map[string]*entity.ObjectInfo) {
+		for p, info := range infos {
+			ret[path.Join(prefix, p)] = info.Size
+		}
+	}
+
+	infos, err := c.List(ctx, "objects/")
 	if nil != err {
-		panic(err)
+		return
+	}
+	for p, info := range infos {
+		if strings.Contains(p, "/") {
+			ret[path.Join("objects", p)] = info.Size
+			continue
+		}
+
+		// 部分存储服务（比如 WebDAV）只列出一级目录，需要逐个列出 objects/xx/
+		subInfos, listErr := c.List(ctx, path.Join("objects", p)+"/")
+		if nil != listErr {
+			err = listErr
+			return
+		}
+		add(path.Join("objects", p), subInfos)
+	}
+
+	for _, prefix := range []string{"indexes", "packs", "check/indexes", "refs/tags"} {
+		if infos, err = c.List(ctx, prefix+"/"); nil != err {
+			return
+		}
+		for p, info := range infos {
+			ret[path.Join(prefix, path.Base(p))] = info.Size
+		}
+	}
+
+	for _, key := range []string{"refs/latest", "indexes-v2.json"} {
+		info, statErr := c.Stat(ctx, key)
+		if nil != statErr {
+			if errors.Is(statErr, ErrCloudObjectNotFound) {
+				continue
+			}
+			err = statErr
+			return
+		}
+		ret[key] = info.Size
+	}
+	return
+}
+
+// putFile 用于通过 put 将本地仓库 repoPath 中的文件 filePath 流式上传到云端。
+func putFile(ctx context.Context, put func(ctx context.Context, key string, reader io.Reader, size int64) error, repoPath, filePath string) (length int64, err error) {
+	file, err := os.Open(filepath.Join(repoPath, filePath))
+	if nil != err {
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if nil != err {
+		return
+	}
+	if err = put(ctx, filePath, file, info.Size()); nil != err {
+		return
+	}
+	length = info.Size()
+	return
+}
+
+// getBytes 用于通过 get 下载对象 key 的全部数据。
+func getBytes(ctx context.Context, get func(ctx context.Context, key string) (io.ReadCloser, error), key string) (data []byte, err error) {
+	reader, err := get(ctx, key)
+	if nil != err {
+		return
+	}
+	defer reader.Close()
+	data, err = io.ReadAll(reader)
+	return
+}
+
+// ctxReader 描述了可取消的数据流，用于不支持上下文的存储协议，上下文取消后读取会立即返回错误。
+type ctxReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (reader *ctxReader) Read(p []byte) (n int, err error) {
+	if err = reader.ctx.Err(); nil != err {
+		return
+	}
+	return reader.reader.Read(p)
+}
+
+// ctxReadCloser 描述了可取消的下载数据流，关闭时会一并释放请求上下文。
+type ctxReadCloser struct {
+	ctxReader
+	closer io.Closer
+	cancel context.CancelFunc
+}
+
+func newCtxReadCloser(ctx context.Context, body io.ReadCloser, cancel context.CancelFunc) *ctxReadCloser {
+	return &ctxReadCloser{ctxReader: ctxReader{ctx: ctx, reader: body}, closer: body, cancel: cancel}
+}
+
+func (reader *ctxReadCloser) Close() error {
+	if nil != reader.cancel {
+		defer reader.cancel()
 	}
+	return reader.closer.Close()
 }
 
 // objectInfo 描述了对象信息，用于内部处理。
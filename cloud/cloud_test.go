@@ -0,0 +1,74 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+// shallowListLocal 像 WebDAV 一样只列出一级目录。
+type shallowListLocal struct {
+	*Local
+}
+
+func (local *shallowListLocal) List(ctx context.Context, pathPrefix string) (ret map[string]*entity.ObjectInfo, err error) {
+	infos, err := local.Local.List(ctx, pathPrefix)
+	if nil != err {
+		return
+	}
+	ret = map[string]*entity.ObjectInfo{}
+	for p, info := range infos {
+		p = strings.Split(p, "/")[0]
+		ret[p] = &entity.ObjectInfo{Path: p, Size: info.Size}
+	}
+	return
+}
+
+func TestListRepoKeys(t *testing.T) {
+	tempDir := t.TempDir()
+	local := NewLocal(&BaseCloud{Conf: &Conf{
+		Dir:      "main",
+		RepoPath: filepath.Join(tempDir, "repo"),
+		Local:    &ConfLocal{Endpoint: filepath.Join(tempDir, "cloud")},
+	}})
+	for _, key := range []string{"objects/ab/cdef", "objects/12/3456", "indexes/idx", "packs/p1.idx", "refs/latest", "refs/tags/v1", "indexes-v2.json", "lock-sync", "lock-read/device-1"} {
+		if _, err := local.UploadBytes(key, []byte(key), true); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"objects/ab/cdef", "objects/12/3456", "indexes/idx", "packs/p1.idx", "refs/latest", "refs/tags/v1", "indexes-v2.json"}
+	for _, c := range []Cloud{local, &shallowListLocal{Local: local}} {
+		keys, err := ListRepoKeys(context.Background(), c)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if len(expected) != len(keys) {
+			t.Fatalf("unexpected keys %v", keys)
+		}
+		for _, key := range expected {
+			if size, ok := keys[key]; !ok || int64(len(key)) != size {
+				t.Fatalf("key [%s] missing or wrong size in %v", key, keys)
+			}
+		}
+	}
+}
@@ -17,12 +17,16 @@
 package cloud
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"math"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/88250/gulu"
 	"github.com/siyuan-note/dejavu/entity"
@@ -67,120 +71,129 @@ func (local *Local) GetRepos() (repos []*Repo, size int64, err error) {
 }
 
 func (local *Local) UploadObject(filePath string, overwrite bool) (length int64, err error) {
-	absFilePath := filepath.Join(local.Conf.RepoPath, filePath)
-	info, err := os.Stat(absFilePath)
-	if err != nil {
-		return
-	}
-
-	if overwrite {
-		data, readErr := os.ReadFile(absFilePath)
-		if readErr != nil {
-			err = readErr
+	ctx := context.Background()
+	if !overwrite {
+		if _, err = local.Stat(ctx, filePath); err == nil {
+			return
+		} else if !errors.Is(err, ErrCloudObjectNotFound) {
 			return
 		}
-		length, err = local.UploadBytes(filePath, data, true)
-		return
 	}
 
-	key := path.Join(local.getCurrentRepoDirPath(), filePath)
-	if _, statErr := os.Stat(key); statErr == nil {
-		length = 0
-		return
-	} else if !os.IsNotExist(statErr) {
-		err = statErr
+	length, err = putFile(ctx, local.Put, local.Conf.RepoPath, filePath)
+	return
+}
+
+func (local *Local) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	if err = local.Put(context.Background(), filePath, bytes.NewReader(data), int64(len(data))); err != nil {
 		return
 	}
+	length = int64(len(data))
+	return
+}
 
-	if err = os.MkdirAll(path.Dir(key), 0755); err != nil {
+func (local *Local) DownloadObject(filePath string) (data []byte, err error) {
+	data, err = getBytes(context.Background(), local.Get, filePath)
+	return
+}
+
+func (local *Local) RemoveObject(filePath string) (err error) {
+	err = local.Delete(context.Background(), filePath)
+	return
+}
+
+func (local *Local) ListObjects(pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
+	objects, err = local.List(context.Background(), pathPrefix)
+	return
+}
+
+func (local *Local) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	absPath := path.Join(local.getCurrentRepoDirPath(), key)
+	if err = os.MkdirAll(path.Dir(absPath), 0755); err != nil {
+		logging.LogErrorf("upload object [%s] failed: %s", absPath, err)
 		return
 	}
 
-	file, openErr := os.Open(absFilePath)
-	if openErr != nil {
-		err = openErr
+	throttled := local.GetBandwidthLimiter().UploadReader(ctx, reader)
+	defer throttled.Close()
+	err = gulu.File.WriteFileSaferByReader(absPath, throttled, 0644)
+	if err != nil {
+		logging.LogErrorf("upload object [%s] failed: %s", absPath, err)
 		return
 	}
-	defer file.Close()
 
-	err = gulu.File.WriteFileSaferByReader(key, file, 0644)
-	if nil == err {
-		length = info.Size()
-	}
+	//logging.LogInfof("uploaded object [%s]", absPath)
 	return
 }
 
-func (local *Local) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
-	key := path.Join(local.getCurrentRepoDirPath(), filePath)
-	folder := path.Dir(key)
-	err = os.MkdirAll(folder, 0755)
-	if err != nil {
+func (local *Local) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	if err = ctx.Err(); err != nil {
 		return
 	}
 
-	if !overwrite { // not overwrite the file
-		_, err = os.Stat(key)
-		if err != nil {
-			if os.IsNotExist(err) { // file not exist
-				// do nothing and continue
-				err = nil
-			} else { // other error
-				logging.LogErrorf("upload object [%s] failed: %s", key, err)
-				return
-			}
-		}
-	}
-
-	err = os.WriteFile(key, data, 0644)
+	absPath := path.Join(local.getCurrentRepoDirPath(), key)
+	file, err := os.Open(absPath)
 	if err != nil {
-		logging.LogErrorf("upload object [%s] failed: %s", key, err)
+		if os.IsNotExist(err) {
+			err = ErrCloudObjectNotFound
+		}
 		return
 	}
+	reader = local.GetBandwidthLimiter().DownloadReader(ctx, file)
 
-	length = int64(len(data))
-
-	//logging.LogInfof("uploaded object [%s]", key)
+	//logging.LogInfof("downloaded object [%s]", absPath)
 	return
 }
 
-func (local *Local) DownloadObject(filePath string) (data []byte, err error) {
-	key := path.Join(local.getCurrentRepoDirPath(), filePath)
-	data, err = os.ReadFile(key)
+func (local *Local) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	fileInfo, err := os.Stat(path.Join(local.getCurrentRepoDirPath(), key))
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = ErrCloudObjectNotFound
 		}
 		return
 	}
-
-	//logging.LogInfof("downloaded object [%s]", key)
+	info = &entity.ObjectInfo{Path: key, Size: fileInfo.Size(), Updated: fileInfo.ModTime()}
 	return
 }
 
-func (local *Local) RemoveObject(filePath string) (err error) {
-	key := path.Join(local.getCurrentRepoDirPath(), filePath)
-	err = os.Remove(key)
+func (local *Local) Delete(ctx context.Context, key string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	absPath := path.Join(local.getCurrentRepoDirPath(), key)
+	err = os.Remove(absPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = nil
 		} else {
-			logging.LogErrorf("remove object [%s] failed: %s", key, err)
+			logging.LogErrorf("remove object [%s] failed: %s", absPath, err)
 		}
 		return
 	}
 
-	//logging.LogInfof("removed object [%s]", key)
+	//logging.LogInfof("removed object [%s]", absPath)
 	return
 }
 
-func (local *Local) ListObjects(pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
+func (local *Local) List(ctx context.Context, pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
 	objects = map[string]*entity.ObjectInfo{}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
 	// objects/ 为两级目录 objects/XX/<id>，需递归列出以匹配 PurgeCloud 与 S3 的路径格式
 	isObjectsDir := strings.HasPrefix(pathPrefix, "objects")
 	absPathPrefix := path.Join(local.getCurrentRepoDirPath(), pathPrefix)
 	entries, err := os.ReadDir(absPathPrefix)
 	if err != nil {
 		if os.IsNotExist(err) {
+			err = nil
 			return
 		}
 		logging.LogErrorf("list objects [%s] failed: %s", absPathPrefix, err)
@@ -233,6 +246,139 @@ func (local *Local) ListObjects(pathPrefix string) (objects map[string]*entity.O
 	return
 }
 
+func (local *Local) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	absPath := path.Join(local.getCurrentRepoDirPath(), key)
+	data, err = os.ReadFile(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrCloudObjectNotFound
+		}
+		return
+	}
+	etag = util.Hash(data)
+	return
+}
+
+// PutIfMatch 通过 O_EXCL 创建的互斥文件保证比较和写入的原子性，写入时使用原子替换，读取时不会读到写了一半的数据。
+func (local *Local) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error) {
+	absPath := path.Join(local.getCurrentRepoDirPath(), key)
+	if err = os.MkdirAll(path.Dir(absPath), 0755); err != nil {
+		logging.LogErrorf("upload object [%s] failed: %s", absPath, err)
+		return
+	}
+
+	unlock, err := lockLocalFile(ctx, absPath)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	current, err := os.ReadFile(absPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.LogErrorf("read object [%s] failed: %s", absPath, err)
+			return
+		}
+		err = nil
+		if "" != etag {
+			err = ErrCloudPreconditionFailed
+			return
+		}
+	} else if "" == etag || util.Hash(current) != etag {
+		err = ErrCloudPreconditionFailed
+		return
+	}
+
+	if err = gulu.File.WriteFileSafer(absPath, data, 0644); err != nil {
+		logging.LogErrorf("upload object [%s] failed: %s", absPath, err)
+		return
+	}
+	return
+}
+
+// localFileLockTimeout 为互斥文件的最长持有时间，超时的互斥文件视为持有者异常退出后残留的。
+const localFileLockTimeout = 30 * time.Second
+
+// lockLocalFile 使用 O_EXCL 创建互斥文件 absPath.cas，返回的函数用于解锁。
+//
+// 互斥文件中写入随机令牌，清理残留的互斥文件时先将其重命名（只有一个等待者能够成功），再校验令牌确认重命名的是观察到的残留文件，
+// 如果重命名的是其他等待者刚刚创建的互斥文件则将其恢复。解锁时同样校验令牌，避免删除超时后被其他持有者重新创建的互斥文件。
+func lockLocalFile(ctx context.Context, absPath string) (unlock func(), err error) {
+	lockPath := absPath + ".cas"
+	token := []byte(util.RandHash())
+	for {
+		var file *os.File
+		file, err = os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = file.Write(token)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				logging.LogErrorf("write lock file [%s] failed: %s", lockPath, err)
+				os.Remove(lockPath)
+				return
+			}
+			unlock = func() {
+				if held, readErr := os.ReadFile(lockPath); readErr != nil || !bytes.Equal(token, held) {
+					logging.LogWarnf("lock file [%s] is no longer held", lockPath)
+					return
+				}
+				if removeErr := os.Remove(lockPath); removeErr != nil {
+					logging.LogErrorf("remove lock file [%s] failed: %s", lockPath, removeErr)
+				}
+			}
+			return
+		}
+		if !os.IsExist(err) {
+			logging.LogErrorf("create lock file [%s] failed: %s", lockPath, err)
+			return
+		}
+
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > localFileLockTimeout {
+			removeStaleLocalLock(lockPath)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// removeStaleLocalLock 用于清理残留的互斥文件 lockPath。
+func removeStaleLocalLock(lockPath string) {
+	stale, err := os.ReadFile(lockPath)
+	if err != nil {
+		return
+	}
+
+	stalePath := lockPath + "." + util.RandHash()
+	if err = os.Rename(lockPath, stalePath); err != nil {
+		// 其他等待者已经清理
+		return
+	}
+	defer os.Remove(stalePath)
+
+	renamed, err := os.ReadFile(stalePath)
+	if err == nil && bytes.Equal(stale, renamed) {
+		logging.LogWarnf("removed stale lock file [%s]", lockPath)
+		return
+	}
+
+	// 重命名的是其他等待者在读取和重命名之间新建的互斥文件，使用硬链接恢复，目标存在时不会覆盖
+	if err = os.Link(stalePath, lockPath); err != nil {
+		logging.LogErrorf("restore lock file [%s] failed: %s", lockPath, err)
+	}
+}
+
 func (local *Local) GetTags() (tags []*Ref, err error) {
 	tags, err = local.listRepoRefs("tags")
 	if err != nil {
@@ -349,6 +495,10 @@ func (local *Local) GetIndex(id string) (index *entity.Index, err error) {
 	return
 }
 
+func (local *Local) GetCapabilities() *Capabilities {
+	return &Capabilities{ConditionalWrite: true, AtomicRename: true, ConsistentListing: true}
+}
+
 func (local *Local) GetConcurrentReqs() (ret int) {
 	ret = local.Local.ConcurrentReqs
 	if ret < 1 {
@@ -17,9 +17,16 @@
 package cloud
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestLocalUploadObject(t *testing.T) {
@@ -89,3 +96,188 @@ func TestLocalUploadObject(t *testing.T) {
 		t.Fatalf("overwrite upload did not change data [%s]", data)
 	}
 }
+
+func TestLocalStreamObjects(t *testing.T) {
+	tempDir := t.TempDir()
+	local := NewLocal(&BaseCloud{Conf: &Conf{
+		Dir:      "main",
+		RepoPath: filepath.Join(tempDir, "repo"),
+		Local:    &ConfLocal{Endpoint: filepath.Join(tempDir, "cloud")},
+	}})
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("stream"), 1024)
+	if err := local.Put(ctx, "objects/ab/cdef", bytes.NewReader(data), int64(len(data))); nil != err {
+		t.Fatal(err)
+	}
+	info, err := local.Stat(ctx, "objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != info.Size {
+		t.Fatalf("unexpected object size [%d]", info.Size)
+	}
+	objects, err := local.List(ctx, "objects")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := objects["ab/cdef"]; !ok || 1 != len(objects) {
+		t.Fatalf("unexpected listed objects [%v]", objects)
+	}
+
+	reader, err := local.Get(ctx, "objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("downloaded data not match")
+	}
+
+	if err = local.Delete(ctx, "objects/ab/cdef"); nil != err {
+		t.Fatal(err)
+	}
+	if err = local.Delete(ctx, "objects/ab/cdef"); nil != err {
+		t.Fatalf("delete missing object failed: %s", err)
+	}
+	if _, err = local.Stat(ctx, "objects/ab/cdef"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("stat deleted object should return not found, got [%v]", err)
+	}
+	if _, err = local.Get(ctx, "objects/ab/cdef"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("get deleted object should return not found, got [%v]", err)
+	}
+}
+
+func TestLocalStreamCancel(t *testing.T) {
+	tempDir := t.TempDir()
+	local := NewLocal(&BaseCloud{Conf: &Conf{
+		Dir:      "main",
+		RepoPath: filepath.Join(tempDir, "repo"),
+		Local:    &ConfLocal{Endpoint: filepath.Join(tempDir, "cloud")},
+	}})
+
+	data := bytes.Repeat([]byte("cancel"), 1024)
+	if err := local.Put(context.Background(), "objects/ab/cdef", bytes.NewReader(data), int64(len(data))); nil != err {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := local.Get(ctx, "objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err = reader.Read(make([]byte, 16)); nil != err {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err = io.ReadAll(reader); !errors.Is(err, context.Canceled) {
+		t.Fatalf("read after cancel should fail, got [%v]", err)
+	}
+
+	if err = local.Put(ctx, "objects/ab/0123", bytes.NewReader(data), int64(len(data))); !errors.Is(err, context.Canceled) {
+		t.Fatalf("put with canceled context should fail, got [%v]", err)
+	}
+	if _, err = os.Stat(filepath.Join(tempDir, "cloud", "main", "objects", "ab", "0123")); !os.IsNotExist(err) {
+		t.Fatalf("canceled put should not leave object, got [%v]", err)
+	}
+}
+
+func TestLocalPutIfMatch(t *testing.T) {
+	tempDir := t.TempDir()
+	local := NewLocal(&BaseCloud{Conf: &Conf{
+		Dir:      "main",
+		RepoPath: filepath.Join(tempDir, "repo"),
+		Local:    &ConfLocal{Endpoint: filepath.Join(tempDir, "cloud")},
+	}})
+	ctx := context.Background()
+
+	if _, _, err := local.GetWithETag(ctx, "lock-sync"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("get missing object should fail with not found: %v", err)
+	}
+	if err := local.PutIfMatch(ctx, "lock-sync", []byte("first"), ""); nil != err {
+		t.Fatal(err)
+	}
+	if err := local.PutIfMatch(ctx, "lock-sync", []byte("other"), ""); !errors.Is(err, ErrCloudPreconditionFailed) {
+		t.Fatalf("create existing object should fail with precondition failed: %v", err)
+	}
+
+	data, etag, err := local.GetWithETag(ctx, "lock-sync")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "first" != string(data) || "" == etag {
+		t.Fatalf("unexpected object [%s, etag=%s]", data, etag)
+	}
+	if err = local.PutIfMatch(ctx, "lock-sync", []byte("second"), etag); nil != err {
+		t.Fatal(err)
+	}
+	if err = local.PutIfMatch(ctx, "lock-sync", []byte("third"), etag); !errors.Is(err, ErrCloudPreconditionFailed) {
+		t.Fatalf("put with stale etag should fail with precondition failed: %v", err)
+	}
+
+	// 残留的互斥文件超时后会被清理
+	casPath := filepath.Join(tempDir, "cloud", "main", "lock-sync.cas")
+	if err = os.WriteFile(casPath, nil, 0644); nil != err {
+		t.Fatal(err)
+	}
+	staleTime := time.Now().Add(-2 * localFileLockTimeout)
+	if err = os.Chtimes(casPath, staleTime, staleTime); nil != err {
+		t.Fatal(err)
+	}
+	_, etag, err = local.GetWithETag(ctx, "lock-sync")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = local.PutIfMatch(ctx, "lock-sync", []byte("fourth"), etag); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(casPath); !os.IsNotExist(err) {
+		t.Fatalf("lock file should be removed: %v", err)
+	}
+}
+
+func TestLockLocalFileStale(t *testing.T) {
+	absPath := filepath.Join(t.TempDir(), "lock-sync")
+	lockPath := absPath + ".cas"
+	if err := os.WriteFile(lockPath, []byte("stale"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	staleTime := time.Now().Add(-2 * localFileLockTimeout)
+	if err := os.Chtimes(lockPath, staleTime, staleTime); nil != err {
+		t.Fatal(err)
+	}
+
+	// 多个等待者同时清理残留的互斥文件时只能有一个持有者
+	var holders atomic.Int32
+	var overlapped atomic.Bool
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			unlock, err := lockLocalFile(context.Background(), absPath)
+			if nil != err {
+				t.Error(err)
+				return
+			}
+			if 1 < holders.Add(1) {
+				overlapped.Store(true)
+			}
+			time.Sleep(5 * time.Millisecond)
+			holders.Add(-1)
+			unlock()
+		}()
+	}
+	waitGroup.Wait()
+	if overlapped.Load() {
+		t.Fatal("lock held concurrently")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(absPath)); 0 != len(entries) {
+		t.Fatalf("unexpected files left [%v]", entries)
+	}
+}
@@ -0,0 +1,699 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// MemoryStore 描述了内存存储，多个 Memory 可以共享同一个存储来模拟多台设备同步同一个云端仓库。
+type MemoryStore struct {
+	lock    sync.Mutex
+	objects map[string]*memoryObject // 键为 <仓库名>/<对象路径>
+	repos   map[string]time.Time
+}
+
+type memoryObject struct {
+	data    []byte
+	prev    []byte // 覆盖前的数据，用于模拟读到旧数据
+	hasPrev bool
+	updated time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: map[string]*memoryObject{}, repos: map[string]time.Time{}}
+}
+
+// Keys 用于列出存储中的全部对象路径（<仓库名>/<对象路径>），按字典序排列。
+func (store *MemoryStore) Keys() (ret []string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for key := range store.objects {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return
+}
+
+// MemoryFaultKind 描述了注入的故障类型。
+type MemoryFaultKind string
+
+const (
+	MemoryFaultError        MemoryFaultKind = "error"         // 返回错误
+	MemoryFaultLatency      MemoryFaultKind = "latency"       // 增加延迟，之后正常处理
+	MemoryFaultPartialList  MemoryFaultKind = "partial-list"  // List 只返回部分对象
+	MemoryFaultLostWrite    MemoryFaultKind = "lost-write"    // Put、PutIfMatch、Delete 返回成功但是没有生效
+	MemoryFaultPartialWrite MemoryFaultKind = "partial-write" // Put、PutIfMatch 只写入部分数据后返回错误
+	MemoryFaultStaleRead    MemoryFaultKind = "stale-read"    // Get、GetWithETag、Stat 返回覆盖前的旧数据，没有旧数据时返回 ErrCloudObjectNotFound
+)
+
+// MemoryFault 描述了 Memory 上注入的故障。
+type MemoryFault struct {
+	Method  string          `json:"method"`  // 方法名，比如 Put、Get、Stat、Delete、List、GetWithETag、PutIfMatch，为空或者 * 时匹配全部方法
+	Key     string          `json:"key"`     // 对象路径前缀，比如 refs/latest，为空时匹配全部对象
+	Kind    MemoryFaultKind `json:"kind"`    // 故障类型，为空时为 error
+	Nth     int             `json:"nth"`     // 从第 Nth 次匹配的调用开始触发，为 0 时每次匹配的调用都触发
+	Times   int             `json:"times"`   // 最多触发的次数，为 0 时 Nth 大于 0 则触发一次，否则不限次数
+	Error   string          `json:"error"`   // 返回的错误：unavailable（默认）、not-found、auth、forbidden、quota、too-many-requests、precondition、locked
+	Latency int             `json:"latency"` // 延迟，单位：毫秒
+	Keep    int             `json:"keep"`    // partial-list 保留的对象数、partial-write 写入的字节数，为 0 时保留一半
+
+	matched   int
+	triggered int
+}
+
+// trigger 用于记录一次匹配的调用，返回本次调用是否触发故障。
+func (fault *MemoryFault) trigger() bool {
+	fault.matched++
+	if 0 < fault.Nth && fault.matched < fault.Nth {
+		return false
+	}
+
+	times := fault.Times
+	if 0 < fault.Nth && 1 > times {
+		times = 1
+	}
+	if 0 < times && times <= fault.triggered {
+		return false
+	}
+	fault.triggered++
+	return true
+}
+
+func (fault *MemoryFault) err() error {
+	switch fault.Error {
+	case "not-found":
+		return ErrCloudObjectNotFound
+	case "auth":
+		return ErrCloudAuthFailed
+	case "forbidden":
+		return ErrCloudForbidden
+	case "quota":
+		return ErrCloudQuotaExceeded
+	case "too-many-requests":
+		return ErrCloudTooManyRequests
+	case "precondition":
+		return ErrCloudPreconditionFailed
+	case "locked":
+		return ErrCloudObjectLocked
+	}
+	return ErrCloudServiceUnavailable
+}
+
+func (fault *MemoryFault) keep(n int) int {
+	if 0 < fault.Keep && fault.Keep < n {
+		return fault.Keep
+	}
+	if 0 < fault.Keep {
+		return n
+	}
+	return n / 2
+}
+
+// memoryAvailableSize 为未配置可用空间时 Memory 返回的可用空间。
+const memoryAvailableSize = 1024 * 1024 * 1024 * 1024
+
+// Memory 描述了内存云端存储服务实现，用于测试和模拟，支持注入故障。
+type Memory struct {
+	*BaseCloud
+	Store *MemoryStore
+
+	lock   sync.Mutex
+	faults []*MemoryFault
+	calls  map[string]int
+}
+
+// NewMemory 用于创建使用 store 存储数据的 Memory，store 为空时创建新的存储。
+func NewMemory(baseCloud *BaseCloud, store *MemoryStore) (ret *Memory) {
+	if nil == store {
+		store = NewMemoryStore()
+	}
+	ret = &Memory{BaseCloud: baseCloud, Store: store, calls: map[string]int{}}
+	return
+}
+
+// AddFault 用于注入故障。
+func (memory *Memory) AddFault(faults ...*MemoryFault) {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+	memory.faults = append(memory.faults, faults...)
+}
+
+// ClearFaults 用于清除全部故障。
+func (memory *Memory) ClearFaults() {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+	memory.faults = nil
+}
+
+// Calls 用于获取方法 method 被调用的次数。
+func (memory *Memory) Calls(method string) int {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+	return memory.calls[method]
+}
+
+// inject 用于记录调用并返回本次调用触发的故障，延迟故障在这里直接等待，错误故障直接返回错误。
+func (memory *Memory) inject(ctx context.Context, method, key string) (fault *MemoryFault, err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	var latency time.Duration
+	memory.lock.Lock()
+	memory.calls[method]++
+	for _, f := range memory.faults {
+		if "" != f.Method && "*" != f.Method && method != f.Method {
+			continue
+		}
+		if !strings.HasPrefix(key, f.Key) {
+			continue
+		}
+		if !f.trigger() {
+			continue
+		}
+
+		if MemoryFaultLatency == f.Kind {
+			latency += time.Duration(f.Latency) * time.Millisecond
+			continue
+		}
+		if nil == fault {
+			fault = f
+		}
+	}
+	memory.lock.Unlock()
+
+	if 0 < latency {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(latency):
+		}
+	}
+	if nil != fault && ("" == fault.Kind || MemoryFaultError == fault.Kind) {
+		err = fault.err()
+		logging.LogWarnf("memory cloud injected fault [%s %s]: %s", method, key, err)
+		fault = nil
+	}
+	return
+}
+
+func (memory *Memory) CreateRepo(name string) (err error) {
+	memory.Store.lock.Lock()
+	defer memory.Store.lock.Unlock()
+	memory.Store.repos[name] = time.Now()
+	return
+}
+
+func (memory *Memory) RemoveRepo(name string) (err error) {
+	memory.Store.lock.Lock()
+	defer memory.Store.lock.Unlock()
+
+	delete(memory.Store.repos, name)
+	for key := range memory.Store.objects {
+		if strings.HasPrefix(key, name+"/") {
+			delete(memory.Store.objects, key)
+		}
+	}
+	return
+}
+
+func (memory *Memory) GetRepos() (repos []*Repo, size int64, err error) {
+	memory.Store.lock.Lock()
+	defer memory.Store.lock.Unlock()
+
+	updated := map[string]time.Time{}
+	sizes := map[string]int64{}
+	for name, t := range memory.Store.repos {
+		updated[name] = t
+	}
+	for key, obj := range memory.Store.objects {
+		i := strings.Index(key, "/")
+		if 0 > i {
+			continue
+		}
+		name := key[:i]
+		sizes[name] += int64(len(obj.data))
+		if obj.updated.After(updated[name]) {
+			updated[name] = obj.updated
+		}
+	}
+
+	for name, t := range updated {
+		repos = append(repos, &Repo{
+			Name:    name,
+			Size:    sizes[name],
+			Updated: t.Local().Format("2006-01-02 15:04:05"),
+		})
+		size += sizes[name]
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	return
+}
+
+func (memory *Memory) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	ctx := context.Background()
+	if !overwrite {
+		if _, err = memory.Stat(ctx, filePath); nil == err {
+			return
+		} else if !errors.Is(err, ErrCloudObjectNotFound) {
+			return
+		}
+	}
+
+	length, err = putFile(ctx, memory.Put, memory.Conf.RepoPath, filePath)
+	return
+}
+
+func (memory *Memory) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	if err = memory.Put(context.Background(), filePath, bytes.NewReader(data), int64(len(data))); nil != err {
+		return
+	}
+	length = int64(len(data))
+	return
+}
+
+func (memory *Memory) DownloadObject(filePath string) (data []byte, err error) {
+	data, err = getBytes(context.Background(), memory.Get, filePath)
+	return
+}
+
+func (memory *Memory) RemoveObject(filePath string) (err error) {
+	err = memory.Delete(context.Background(), filePath)
+	return
+}
+
+func (memory *Memory) ListObjects(pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
+	objects, err = memory.List(context.Background(), pathPrefix)
+	return
+}
+
+func (memory *Memory) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	fault, err := memory.inject(ctx, "Put", key)
+	if nil != err {
+		return
+	}
+
+	throttled := memory.GetBandwidthLimiter().UploadReader(ctx, reader)
+	defer throttled.Close()
+	data, err := io.ReadAll(throttled)
+	if nil != err {
+		return
+	}
+
+	err = memory.write(fault, "Put", key, data)
+	return
+}
+
+func (memory *Memory) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	fault, err := memory.inject(ctx, "Get", key)
+	if nil != err {
+		return
+	}
+
+	data, _, err := memory.read(fault, key)
+	if nil != err {
+		return
+	}
+	reader = memory.GetBandwidthLimiter().DownloadReader(ctx, io.NopCloser(bytes.NewReader(data)))
+	return
+}
+
+func (memory *Memory) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	fault, err := memory.inject(ctx, "Stat", key)
+	if nil != err {
+		return
+	}
+
+	data, updated, err := memory.read(fault, key)
+	if nil != err {
+		return
+	}
+	info = &entity.ObjectInfo{Path: key, Size: int64(len(data)), Updated: updated}
+	return
+}
+
+func (memory *Memory) Delete(ctx context.Context, key string) (err error) {
+	fault, err := memory.inject(ctx, "Delete", key)
+	if nil != err {
+		return
+	}
+	if nil != fault && MemoryFaultLostWrite == fault.Kind {
+		logging.LogWarnf("memory cloud injected fault [Delete %s]: lost write", key)
+		return
+	}
+
+	memory.Store.lock.Lock()
+	defer memory.Store.lock.Unlock()
+	delete(memory.Store.objects, memory.storeKey(key))
+	return
+}
+
+// List 和 Local 一样列出前缀 pathPrefix 下一级的对象，objects/ 会递归列出 objects/XX/<id>。
+func (memory *Memory) List(ctx context.Context, pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
+	objects = map[string]*entity.ObjectInfo{}
+	fault, err := memory.inject(ctx, "List", pathPrefix)
+	if nil != err {
+		return
+	}
+
+	isObjectsDir := strings.HasPrefix(pathPrefix, "objects")
+	prefix := memory.storeKey(pathPrefix) + "/"
+	var keys []string
+	memory.Store.lock.Lock()
+	for key, obj := range memory.Store.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		relPath := strings.TrimPrefix(key, prefix)
+		depth := strings.Count(relPath, "/")
+		if 0 < depth && !(isObjectsDir && 1 == depth) {
+			continue
+		}
+		objects[relPath] = &entity.ObjectInfo{Path: relPath, Size: int64(len(obj.data))}
+		keys = append(keys, relPath)
+	}
+	memory.Store.lock.Unlock()
+
+	if nil != fault && MemoryFaultPartialList == fault.Kind {
+		sort.Strings(keys)
+		for _, key := range keys[fault.keep(len(keys)):] {
+			delete(objects, key)
+		}
+		logging.LogWarnf("memory cloud injected fault [List %s]: partial list [%d/%d]", pathPrefix, len(objects), len(keys))
+	}
+	return
+}
+
+func (memory *Memory) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	fault, err := memory.inject(ctx, "GetWithETag", key)
+	if nil != err {
+		return
+	}
+
+	data, _, err = memory.read(fault, key)
+	if nil != err {
+		return
+	}
+	etag = util.Hash(data)
+	return
+}
+
+func (memory *Memory) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error) {
+	fault, err := memory.inject(ctx, "PutIfMatch", key)
+	if nil != err {
+		return
+	}
+
+	memory.Store.lock.Lock()
+	obj := memory.Store.objects[memory.storeKey(key)]
+	matched := (nil == obj && "" == etag) || (nil != obj && "" != etag && util.Hash(obj.data) == etag)
+	if !matched {
+		memory.Store.lock.Unlock()
+		err = ErrCloudPreconditionFailed
+		return
+	}
+	// 比较和写入需要在同一个临界区内完成
+	err = memory.writeLocked(fault, "PutIfMatch", key, data)
+	memory.Store.lock.Unlock()
+	return
+}
+
+func (memory *Memory) write(fault *MemoryFault, method, key string, data []byte) (err error) {
+	memory.Store.lock.Lock()
+	defer memory.Store.lock.Unlock()
+	err = memory.writeLocked(fault, method, key, data)
+	return
+}
+
+func (memory *Memory) writeLocked(fault *MemoryFault, method, key string, data []byte) (err error) {
+	if nil != fault {
+		switch fault.Kind {
+		case MemoryFaultLostWrite:
+			logging.LogWarnf("memory cloud injected fault [%s %s]: lost write", method, key)
+			return
+		case MemoryFaultPartialWrite:
+			data = data[:fault.keep(len(data))]
+			err = fault.err()
+			logging.LogWarnf("memory cloud injected fault [%s %s]: partial write [%d bytes]", method, key, len(data))
+		}
+	}
+
+	storeKey := memory.storeKey(key)
+	obj := &memoryObject{data: bytes.Clone(data), updated: time.Now()}
+	if old := memory.Store.objects[storeKey]; nil != old {
+		obj.prev, obj.hasPrev = old.data, true
+	}
+	memory.Store.objects[storeKey] = obj
+	return
+}
+
+func (memory *Memory) read(fault *MemoryFault, key string) (data []byte, updated time.Time, err error) {
+	memory.Store.lock.Lock()
+	defer memory.Store.lock.Unlock()
+
+	obj := memory.Store.objects[memory.storeKey(key)]
+	if nil == obj {
+		err = ErrCloudObjectNotFound
+		return
+	}
+
+	data, updated = obj.data, obj.updated
+	if nil != fault && MemoryFaultStaleRead == fault.Kind {
+		if !obj.hasPrev {
+			err = ErrCloudObjectNotFound
+			return
+		}
+		data = obj.prev
+		logging.LogWarnf("memory cloud injected fault [%s]: stale read", key)
+	}
+	data = bytes.Clone(data)
+	return
+}
+
+func (memory *Memory) GetTags() (tags []*Ref, err error) {
+	tags, err = memory.listRepoRefs("tags")
+	if nil != err {
+		return
+	}
+	if 1 > len(tags) {
+		tags = []*Ref{}
+	}
+	return
+}
+
+func (memory *Memory) GetIndexes(page int) (indexes []*entity.Index, pageCount, totalCount int, err error) {
+	data, err := memory.DownloadObject("indexes-v2.json")
+	if nil != err {
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+
+	data, err = compressDecoder.DecodeAll(data, nil)
+	if nil != err {
+		return
+	}
+
+	indexesJSON := &Indexes{}
+	if err = gulu.JSON.UnmarshalJSON(data, indexesJSON); nil != err {
+		return
+	}
+
+	totalCount = len(indexesJSON.Indexes)
+	pageCount = int(math.Ceil(float64(totalCount) / float64(pageSize)))
+	start := (page - 1) * pageSize
+	end := page * pageSize
+	if end > totalCount {
+		end = totalCount
+	}
+
+	for i := start; i < end; i++ {
+		index, getErr := memory.repoIndex(indexesJSON.Indexes[i].ID)
+		if nil != getErr {
+			logging.LogWarnf("get repo index [%s] failed: %s", indexesJSON.Indexes[i], getErr)
+			continue
+		}
+		if nil == index {
+			continue
+		}
+
+		index.Files = nil // Optimize the performance of obtaining cloud snapshots https://github.com/siyuan-note/siyuan/issues/8387
+		indexes = append(indexes, index)
+	}
+	return
+}
+
+func (memory *Memory) GetRefsFiles() (fileIDs []string, refs []*Ref, err error) {
+	refs, err = memory.listRepoRefs("")
+	if nil != err {
+		return
+	}
+
+	var files []string
+	for _, ref := range refs {
+		index, getErr := memory.repoIndex(ref.ID)
+		if nil != getErr {
+			err = getErr
+			return
+		}
+		if nil == index {
+			continue
+		}
+
+		files = append(files, index.Files...)
+	}
+
+	fileIDs = gulu.Str.RemoveDuplicatedElem(files)
+	if 1 > len(fileIDs) {
+		fileIDs = []string{}
+	}
+	return
+}
+
+func (memory *Memory) GetChunks(checkChunkIDs []string) (chunkIDs []string, err error) {
+	for _, chunkID := range checkChunkIDs {
+		key := path.Join("objects", chunkID[:2], chunkID[2:])
+		if _, statErr := memory.Stat(context.Background(), key); nil != statErr {
+			if !errors.Is(statErr, ErrCloudObjectNotFound) {
+				err = statErr
+				return
+			}
+			chunkIDs = append(chunkIDs, chunkID)
+		}
+	}
+
+	chunkIDs = gulu.Str.RemoveDuplicatedElem(chunkIDs)
+	if 1 > len(chunkIDs) {
+		chunkIDs = []string{}
+	}
+	return
+}
+
+func (memory *Memory) GetIndex(id string) (index *entity.Index, err error) {
+	index, err = memory.repoIndex(id)
+	if nil != err {
+		logging.LogErrorf("get repo index [%s] failed: %s", id, err)
+		return
+	}
+	if nil == index {
+		err = ErrCloudObjectNotFound
+		return
+	}
+	return
+}
+
+func (memory *Memory) GetCapabilities() *Capabilities {
+	return &Capabilities{ConditionalWrite: true, ConsistentListing: true}
+}
+
+func (memory *Memory) GetConf() *Conf {
+	return memory.Conf
+}
+
+func (memory *Memory) GetAvailableSize() int64 {
+	if 0 < memory.Conf.AvailableSize {
+		return memory.Conf.AvailableSize
+	}
+	return memoryAvailableSize
+}
+
+func (memory *Memory) AddTraffic(*Traffic) {
+	return
+}
+
+func (memory *Memory) listRepoRefs(refPrefix string) (refs []*Ref, err error) {
+	ctx := context.Background()
+	prefix := path.Join("refs", refPrefix)
+	infos, err := memory.List(ctx, prefix)
+	if nil != err {
+		return
+	}
+
+	var names []string
+	for name := range infos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fault, injectErr := memory.inject(ctx, "Get", path.Join(prefix, name))
+		if nil != injectErr {
+			err = injectErr
+			return
+		}
+		data, updated, readErr := memory.read(fault, path.Join(prefix, name))
+		if nil != readErr {
+			if errors.Is(readErr, ErrCloudObjectNotFound) {
+				continue
+			}
+			err = readErr
+			return
+		}
+
+		refs = append(refs, &Ref{
+			Name:    name,
+			ID:      string(data),
+			Updated: updated.Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+	return
+}
+
+func (memory *Memory) repoIndex(id string) (index *entity.Index, err error) {
+	data, err := memory.DownloadObject(path.Join("indexes", id))
+	if nil != err {
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+	if 1 > len(data) {
+		return
+	}
+
+	data, err = compressDecoder.DecodeAll(data, nil)
+	if nil != err {
+		return
+	}
+
+	index = &entity.Index{}
+	err = gulu.JSON.UnmarshalJSON(data, index)
+	return
+}
+
+func (memory *Memory) storeKey(key string) string {
+	return path.Join(memory.Dir, key)
+}
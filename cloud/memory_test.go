@@ -0,0 +1,193 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestMemory(store *MemoryStore) *Memory {
+	return NewMemory(&BaseCloud{Conf: &Conf{Dir: "main"}}, store)
+}
+
+func TestMemoryObjects(t *testing.T) {
+	store := NewMemoryStore()
+	memory := newTestMemory(store)
+
+	ctx := context.Background()
+	for _, key := range []string{"objects/ab/cdef", "objects/ab/0123", "refs/latest", "refs/tags/v1", "indexes-v2.json"} {
+		if err := memory.Put(ctx, key, bytes.NewReader([]byte(key)), int64(len(key))); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	objects, err := memory.List(ctx, "objects/")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(objects) || nil == objects["ab/cdef"] || int64(len("objects/ab/cdef")) != objects["ab/cdef"].Size {
+		t.Fatalf("unexpected objects [%v]", objects)
+	}
+	refs, err := memory.List(ctx, "refs")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(refs) || nil == refs["latest"] {
+		t.Fatalf("unexpected refs [%v]", refs)
+	}
+	tags, err := memory.GetTags()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(tags) || "refs/tags/v1" != tags[0].ID {
+		t.Fatalf("unexpected tags [%+v]", tags)
+	}
+	keys, err := ListRepoKeys(ctx, memory)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 5 != len(keys) {
+		t.Fatalf("unexpected repo keys [%v]", keys)
+	}
+
+	// 共享存储的另一个客户端可以读到相同的数据
+	other := newTestMemory(store)
+	data, err := other.DownloadObject("refs/latest")
+	if nil != err || "refs/latest" != string(data) {
+		t.Fatalf("unexpected shared data [%s, %v]", data, err)
+	}
+
+	chunks, err := memory.GetChunks([]string{"abcdef", "ab9999"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(chunks) || "ab9999" != chunks[0] {
+		t.Fatalf("unexpected missing chunks [%v]", chunks)
+	}
+
+	if err = memory.PutIfMatch(ctx, "lock-sync", []byte("a"), ""); nil != err {
+		t.Fatal(err)
+	}
+	if err = memory.PutIfMatch(ctx, "lock-sync", []byte("b"), ""); !errors.Is(err, ErrCloudPreconditionFailed) {
+		t.Fatalf("expected precondition failed, got [%v]", err)
+	}
+	_, etag, err := memory.GetWithETag(ctx, "lock-sync")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = memory.PutIfMatch(ctx, "lock-sync", []byte("b"), etag); nil != err {
+		t.Fatal(err)
+	}
+
+	repos, _, err := memory.GetRepos()
+	if nil != err || 1 != len(repos) || "main" != repos[0].Name {
+		t.Fatalf("unexpected repos [%+v, %v]", repos, err)
+	}
+	if err = memory.RemoveRepo("main"); nil != err {
+		t.Fatal(err)
+	}
+	if 0 != len(store.Keys()) {
+		t.Fatalf("unexpected keys after remove repo [%v]", store.Keys())
+	}
+}
+
+func TestMemoryFaults(t *testing.T) {
+	memory := newTestMemory(nil)
+	ctx := context.Background()
+
+	// 第 2 次上传 refs/ 下的对象时失败一次
+	memory.AddFault(&MemoryFault{Method: "Put", Key: "refs/", Nth: 2, Error: "quota"})
+	for i, want := range []error{nil, ErrCloudQuotaExceeded, nil} {
+		if _, err := memory.UploadBytes("refs/latest", []byte("v"+string(rune('1'+i))), true); !errors.Is(err, want) {
+			t.Fatalf("put [%d] expected [%v], got [%v]", i+1, want, err)
+		}
+	}
+	if _, err := memory.UploadBytes("objects/ab/cdef", []byte("object"), true); nil != err {
+		t.Fatal(err)
+	}
+	if 4 != memory.Calls("Put") {
+		t.Fatalf("unexpected put calls [%d]", memory.Calls("Put"))
+	}
+	memory.ClearFaults()
+
+	// 上传到一半中断，云端留下半个 latest
+	memory.AddFault(&MemoryFault{Method: "Put", Key: "refs/latest", Kind: MemoryFaultPartialWrite, Nth: 1})
+	if _, err := memory.UploadBytes("refs/latest", []byte("0123456789"), true); !errors.Is(err, ErrCloudServiceUnavailable) {
+		t.Fatalf("expected partial write error, got [%v]", err)
+	}
+	data, err := memory.DownloadObject("refs/latest")
+	if nil != err || "01234" != string(data) {
+		t.Fatalf("unexpected partial data [%s, %v]", data, err)
+	}
+
+	// 读到覆盖前的旧数据
+	memory.AddFault(&MemoryFault{Method: "Get", Key: "refs/latest", Kind: MemoryFaultStaleRead, Nth: 1})
+	if data, err = memory.DownloadObject("refs/latest"); nil != err || "v3" != string(data) {
+		t.Fatalf("unexpected stale data [%s, %v]", data, err)
+	}
+	if data, err = memory.DownloadObject("refs/latest"); nil != err || "01234" != string(data) {
+		t.Fatalf("unexpected data after stale read [%s, %v]", data, err)
+	}
+
+	// 写入和删除丢失
+	memory.AddFault(&MemoryFault{Method: "*", Key: "objects/", Kind: MemoryFaultLostWrite, Times: 2})
+	if _, err = memory.UploadBytes("objects/cd/ef", []byte("lost"), true); nil != err {
+		t.Fatal(err)
+	}
+	if err = memory.RemoveObject("objects/ab/cdef"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = memory.Stat(ctx, "objects/cd/ef"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("expected lost write, got [%v]", err)
+	}
+	if _, err = memory.Stat(ctx, "objects/ab/cdef"); nil != err {
+		t.Fatalf("expected lost delete, got [%v]", err)
+	}
+	memory.ClearFaults()
+
+	// 只列出部分对象
+	for _, key := range []string{"objects/cd/01", "objects/cd/02", "objects/cd/03"} {
+		if _, err = memory.UploadBytes(key, []byte(key), true); nil != err {
+			t.Fatal(err)
+		}
+	}
+	memory.AddFault(&MemoryFault{Method: "List", Kind: MemoryFaultPartialList, Keep: 1})
+	objects, err := memory.List(ctx, "objects")
+	if nil != err || 1 != len(objects) || nil == objects["ab/cdef"] {
+		t.Fatalf("unexpected partial list [%v, %v]", objects, err)
+	}
+	memory.ClearFaults()
+
+	// 延迟后正常返回，上下文取消时立即返回
+	memory.AddFault(&MemoryFault{Kind: MemoryFaultLatency, Latency: 50})
+	start := time.Now()
+	if _, err = memory.Stat(ctx, "objects/ab/cdef"); nil != err {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); 50*time.Millisecond > elapsed {
+		t.Fatalf("latency not injected [%s]", elapsed)
+	}
+	cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = memory.Stat(cancelCtx, "objects/ab/cdef"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got [%v]", err)
+	}
+}
@@ -0,0 +1,579 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// MirrorDivergenceKind 描述了镜像之间不一致的类型。
+type MirrorDivergenceKind string
+
+const (
+	MirrorDivergenceMissing MirrorDivergenceKind = "missing" // 镜像中缺少该对象
+	MirrorDivergenceStale   MirrorDivergenceKind = "stale"   // 镜像中该对象的内容和主存储不同，比如引用没有更新
+	MirrorDivergenceExtra   MirrorDivergenceKind = "extra"   // 镜像中该对象删除失败
+)
+
+// MirrorDivergence 描述了镜像之间不一致的对象。
+type MirrorDivergence struct {
+	Mirror int                  // 镜像序号，0 为主存储，副存储从 1 开始
+	Key    string               // 对象路径，如 objects/xx/id
+	Kind   MirrorDivergenceKind // 不一致的类型
+	Time   time.Time            // 发现时间
+}
+
+func (divergence *MirrorDivergence) String() string {
+	return fmt.Sprintf("mirror [%d] %s [%s]", divergence.Mirror, divergence.Kind, divergence.Key)
+}
+
+// MirrorReconcileResult 描述了镜像对账的结果。
+type MirrorReconcileResult struct {
+	Checked   int                 // 比较的对象数
+	Copied    int                 // 复制到缺少该对象或者内容过期的镜像的次数
+	Removed   int                 // 从镜像中删除残留对象的次数
+	Remaining []*MirrorDivergence // 对账后仍然不一致的对象
+}
+
+// Mirror 描述了镜像存储服务，比如以 S3 为主存储、以 NAS 上的 Local 为副存储。
+//
+// 写入和删除时先操作主存储再依次操作所有副存储，主存储失败时返回错误，副存储失败时只记录不一致，由 Reconcile 修复，
+// 所以主存储总是最新的。读取时优先读取主存储，主存储失败或者对象不存在时依次回退到副存储，列出对象时返回所有镜像的并集。
+// 云端锁使用的条件读写（GetWithETag、PutIfMatch）只在主存储上进行，主存储丢失时需要将一个副存储作为新的主存储。
+type Mirror struct {
+	Cloud // 主存储
+
+	Secondaries []Cloud // 副存储
+
+	lock        sync.Mutex
+	divergences map[string]*MirrorDivergence
+}
+
+// NewMirror 创建以 primary 为主存储、secondaries 为副存储的镜像存储服务。
+func NewMirror(primary Cloud, secondaries ...Cloud) *Mirror {
+	return &Mirror{Cloud: primary, Secondaries: secondaries, divergences: map[string]*MirrorDivergence{}}
+}
+
+// GetCapabilities 返回主存储的能力，对象需要写入全部镜像，所以单个对象的最大字节数取全部镜像中的最小值。
+func (mirror *Mirror) GetCapabilities() *Capabilities {
+	ret := *mirror.Cloud.GetCapabilities()
+	for _, secondary := range mirror.Secondaries {
+		if size := secondary.GetCapabilities().MaxObjectSize; 0 < size && (1 > ret.MaxObjectSize || size < ret.MaxObjectSize) {
+			ret.MaxObjectSize = size
+		}
+	}
+	return &ret
+}
+
+// Unwrap 返回主存储。
+func (mirror *Mirror) Unwrap() Cloud {
+	return mirror.Cloud
+}
+
+// RetryCount 返回所有镜像累计的重试次数。
+func (mirror *Mirror) RetryCount() (ret int64) {
+	for _, c := range mirror.mirrors() {
+		if retry, ok := c.(interface{ RetryCount() int64 }); ok {
+			ret += retry.RetryCount()
+		}
+	}
+	return
+}
+
+func (mirror *Mirror) mirrors() []Cloud {
+	return append([]Cloud{mirror.Cloud}, mirror.Secondaries...)
+}
+
+// Divergences 返回读写时发现的、尚未修复的镜像不一致。
+func (mirror *Mirror) Divergences() (ret []*MirrorDivergence) {
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+
+	for _, divergence := range mirror.divergences {
+		d := *divergence
+		ret = append(ret, &d)
+	}
+	sortMirrorDivergences(ret)
+	return
+}
+
+func sortMirrorDivergences(divergences []*MirrorDivergence) {
+	sort.Slice(divergences, func(i, j int) bool {
+		if divergences[i].Mirror != divergences[j].Mirror {
+			return divergences[i].Mirror < divergences[j].Mirror
+		}
+		return divergences[i].Key < divergences[j].Key
+	})
+}
+
+func (mirror *Mirror) diverged(index int, key string, kind MirrorDivergenceKind, err error) {
+	if nil != err {
+		logging.LogWarnf("mirror [%d] diverged on [%s]: %s", index, key, err)
+	} else {
+		logging.LogWarnf("mirror [%d] diverged on [%s]: %s", index, key, kind)
+	}
+	if "" == key { // 创建和删除仓库等非对象操作只记录日志
+		return
+	}
+
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+	mirror.divergences[divergenceKey(index, key)] = &MirrorDivergence{Mirror: index, Key: key, Kind: kind, Time: time.Now()}
+}
+
+func (mirror *Mirror) converged(index int, key string) {
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+	delete(mirror.divergences, divergenceKey(index, key))
+}
+
+func divergenceKey(index int, key string) string {
+	return fmt.Sprintf("%d:%s", index, key)
+}
+
+// write 用于在所有镜像上执行写入操作 fn。
+func (mirror *Mirror) write(key string, kind MirrorDivergenceKind, fn func(c Cloud) error) (err error) {
+	if err = fn(mirror.Cloud); nil != err {
+		return
+	}
+	mirror.converged(0, key)
+
+	for i, secondary := range mirror.Secondaries {
+		if writeErr := fn(secondary); nil != writeErr {
+			mirror.diverged(i+1, key, kind, writeErr)
+			continue
+		}
+		mirror.converged(i+1, key)
+	}
+	return
+}
+
+// readObject 用于读取单个对象，主存储失败时依次回退到副存储，主存储中对象不存在而副存储中存在时记录不一致。
+func (mirror *Mirror) readObject(key string, fn func(c Cloud) error) (err error) {
+	if err = fn(mirror.Cloud); nil == err {
+		return
+	}
+
+	primaryErr := err
+	for i, secondary := range mirror.Secondaries {
+		if err = fn(secondary); nil == err {
+			if errors.Is(primaryErr, ErrCloudObjectNotFound) {
+				mirror.diverged(0, key, MirrorDivergenceMissing, nil)
+			} else {
+				logging.LogWarnf("read [%s] from mirror [%d] failed, read from mirror [%d]: %s", key, 0, i+1, primaryErr)
+			}
+			return
+		}
+	}
+	err = primaryErr
+	return
+}
+
+// read 用于读取列表等非单个对象的数据，只在主存储失败时回退到副存储。
+func (mirror *Mirror) read(name string, fn func(c Cloud) error) (err error) {
+	if err = fn(mirror.Cloud); nil == err || errors.Is(err, ErrUnsupported) {
+		return
+	}
+
+	primaryErr := err
+	for i, secondary := range mirror.Secondaries {
+		if err = fn(secondary); nil == err {
+			logging.LogWarnf("%s from mirror [%d] failed, read from mirror [%d]: %s", name, 0, i+1, primaryErr)
+			return
+		}
+	}
+	err = primaryErr
+	return
+}
+
+// list 用于列出对象，返回所有镜像列表的并集，这样主存储丢失的对象也可以通过副存储读取。
+// 读写时记录为删除失败的残留对象不会被列出，所有镜像都失败时返回主存储的错误。
+func (mirror *Mirror) list(pathPrefix string, fn func(c Cloud) (map[string]*entity.ObjectInfo, error)) (ret map[string]*entity.ObjectInfo, err error) {
+	var succeeded bool
+	for i, c := range mirror.mirrors() {
+		infos, listErr := fn(c)
+		if nil != listErr {
+			if 0 == i {
+				err = listErr
+			}
+			logging.LogWarnf("list objects [%s] from mirror [%d] failed: %s", pathPrefix, i, listErr)
+			continue
+		}
+
+		if !succeeded {
+			ret, succeeded = map[string]*entity.ObjectInfo{}, true
+		}
+		for p, info := range infos {
+			if _, ok := ret[p]; !ok && !mirror.removed(path.Join(pathPrefix, p)) {
+				ret[p] = info
+			}
+		}
+	}
+	if succeeded {
+		err = nil
+	}
+	return
+}
+
+// removed 判断对象 key 是否被记录为删除失败的残留对象。
+func (mirror *Mirror) removed(key string) bool {
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+
+	for _, divergence := range mirror.divergences {
+		if key == divergence.Key && MirrorDivergenceExtra == divergence.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (mirror *Mirror) CreateRepo(name string) (err error) {
+	err = mirror.write("", MirrorDivergenceMissing, func(c Cloud) error {
+		return c.CreateRepo(name)
+	})
+	return
+}
+
+func (mirror *Mirror) RemoveRepo(name string) (err error) {
+	err = mirror.write("", MirrorDivergenceExtra, func(c Cloud) error {
+		return c.RemoveRepo(name)
+	})
+	return
+}
+
+func (mirror *Mirror) GetRepos() (repos []*Repo, size int64, err error) {
+	err = mirror.read("get repos", func(c Cloud) (e error) {
+		repos, size, e = c.GetRepos()
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	err = mirror.write(filePath, MirrorDivergenceMissing, func(c Cloud) (e error) {
+		var l int64
+		if l, e = c.UploadObject(filePath, overwrite); nil == e && 0 < l {
+			length = l
+		}
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	err = mirror.write(filePath, MirrorDivergenceMissing, func(c Cloud) (e error) {
+		var l int64
+		if l, e = c.UploadBytes(filePath, data, overwrite); nil == e && 0 < l {
+			length = l
+		}
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) DownloadObject(filePath string) (data []byte, err error) {
+	err = mirror.readObject(filePath, func(c Cloud) (e error) {
+		data, e = c.DownloadObject(filePath)
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) RemoveObject(filePath string) (err error) {
+	err = mirror.write(filePath, MirrorDivergenceExtra, func(c Cloud) error {
+		return c.RemoveObject(filePath)
+	})
+	return
+}
+
+func (mirror *Mirror) GetTags() (tags []*Ref, err error) {
+	err = mirror.read("get tags", func(c Cloud) (e error) {
+		tags, e = c.GetTags()
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) GetIndexes(page int) (indexes []*entity.Index, pageCount, totalCount int, err error) {
+	err = mirror.read("get indexes", func(c Cloud) (e error) {
+		indexes, pageCount, totalCount, e = c.GetIndexes(page)
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) GetRefsFiles() (fileIDs []string, refs []*Ref, err error) {
+	err = mirror.read("get refs files", func(c Cloud) (e error) {
+		fileIDs, refs, e = c.GetRefsFiles()
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) GetChunks(checkChunkIDs []string) (chunkIDs []string, err error) {
+	err = mirror.read("get chunks", func(c Cloud) (e error) {
+		chunkIDs, e = c.GetChunks(checkChunkIDs)
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) GetStat() (stat *Stat, err error) {
+	err = mirror.read("get stat", func(c Cloud) (e error) {
+		stat, e = c.GetStat()
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) ListObjects(pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
+	objInfos, err = mirror.list(pathPrefix, func(c Cloud) (map[string]*entity.ObjectInfo, error) {
+		return c.ListObjects(pathPrefix)
+	})
+	return
+}
+
+func (mirror *Mirror) GetIndex(id string) (index *entity.Index, err error) {
+	err = mirror.readObject(path.Join("indexes", id), func(c Cloud) (e error) {
+		index, e = c.GetIndex(id)
+		return
+	})
+	return
+}
+
+// Put 写入所有镜像，reader 不能回退重读时会先读入内存。
+func (mirror *Mirror) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		var data []byte
+		if data, err = io.ReadAll(reader); nil != err {
+			return
+		}
+		seeker = bytes.NewReader(data)
+		reader = seeker.(io.Reader)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if nil != err {
+		return
+	}
+
+	err = mirror.write(key, MirrorDivergenceMissing, func(c Cloud) error {
+		if _, seekErr := seeker.Seek(start, io.SeekStart); nil != seekErr {
+			return seekErr
+		}
+		return c.Put(ctx, key, reader, size)
+	})
+	return
+}
+
+func (mirror *Mirror) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	err = mirror.readObject(key, func(c Cloud) (e error) {
+		reader, e = c.Get(ctx, key)
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	err = mirror.readObject(key, func(c Cloud) (e error) {
+		info, e = c.Stat(ctx, key)
+		return
+	})
+	return
+}
+
+func (mirror *Mirror) Delete(ctx context.Context, key string) (err error) {
+	err = mirror.write(key, MirrorDivergenceExtra, func(c Cloud) error {
+		return c.Delete(ctx, key)
+	})
+	return
+}
+
+func (mirror *Mirror) List(ctx context.Context, pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
+	objInfos, err = mirror.list(pathPrefix, func(c Cloud) (map[string]*entity.ObjectInfo, error) {
+		return c.List(ctx, pathPrefix)
+	})
+	return
+}
+
+// mutableMirrorKey 判断对象 key 的内容是否会变化，内容会变化的对象在对账时需要比较内容，其他对象按内容寻址，只需要比较是否存在。
+func mutableMirrorKey(key string) bool {
+	return strings.HasPrefix(key, "refs/") || "indexes-v2.json" == key
+}
+
+// Check 用于完整比较所有镜像，返回不一致的对象。
+//
+// 按内容寻址的对象（分块、文件、索引和包文件）只要在任意镜像中存在，其他镜像中缺少时都视为缺少；引用等内容会变化的对象以主存储为准。
+func (mirror *Mirror) Check(ctx context.Context) (ret []*MirrorDivergence, err error) {
+	_, ret, err = mirror.check(ctx)
+	return
+}
+
+func (mirror *Mirror) check(ctx context.Context) (checked int, ret []*MirrorDivergence, err error) {
+	mirrors := mirror.mirrors()
+	keys := make([]map[string]int64, len(mirrors))
+	all := map[string]bool{}
+	for i, c := range mirrors {
+		if keys[i], err = ListRepoKeys(ctx, c); nil != err {
+			err = fmt.Errorf("list mirror [%d] failed: %w", i, err)
+			return
+		}
+		for key := range keys[i] {
+			all[key] = true
+		}
+	}
+
+	now := time.Now()
+	for key := range all {
+		checked++
+		var primaryData []byte
+		_, inPrimary := keys[0][key]
+		if inPrimary && mutableMirrorKey(key) {
+			if primaryData, err = getBytes(ctx, mirror.Cloud.Get, key); nil != err {
+				return
+			}
+		}
+
+		for i := range mirrors {
+			if _, ok := keys[i][key]; !ok {
+				ret = append(ret, &MirrorDivergence{Mirror: i, Key: key, Kind: MirrorDivergenceMissing, Time: now})
+				continue
+			}
+			if 0 == i || nil == primaryData {
+				continue
+			}
+
+			data, getErr := getBytes(ctx, mirrors[i].Get, key)
+			if nil != getErr {
+				err = getErr
+				return
+			}
+			if !bytes.Equal(primaryData, data) {
+				ret = append(ret, &MirrorDivergence{Mirror: i, Key: key, Kind: MirrorDivergenceStale, Time: now})
+			}
+		}
+	}
+	sortMirrorDivergences(ret)
+	return
+}
+
+// Reconcile 用于修复镜像之间的不一致：先删除读写时记录的、在主存储中已经不存在的残留对象，
+// 再将缺少的对象从第一个有该对象的镜像复制过去，将过期的对象从主存储复制过去。
+func (mirror *Mirror) Reconcile(ctx context.Context) (ret *MirrorReconcileResult, err error) {
+	ret = &MirrorReconcileResult{}
+	mirrors := mirror.mirrors()
+	for _, divergence := range mirror.Divergences() {
+		if MirrorDivergenceExtra != divergence.Kind {
+			continue
+		}
+		if _, statErr := mirror.Cloud.Stat(ctx, divergence.Key); nil == statErr || !errors.Is(statErr, ErrCloudObjectNotFound) {
+			// 主存储中又写入了该对象或者无法确认，此时保留对象
+			mirror.converged(divergence.Mirror, divergence.Key)
+			continue
+		}
+		if removeErr := mirrors[divergence.Mirror].Delete(ctx, divergence.Key); nil != removeErr {
+			logging.LogErrorf("remove [%s] from mirror [%d] failed: %s", divergence.Key, divergence.Mirror, removeErr)
+			ret.Remaining = append(ret.Remaining, divergence)
+			continue
+		}
+		mirror.converged(divergence.Mirror, divergence.Key)
+		ret.Removed++
+	}
+
+	removing := map[string]bool{}
+	for _, divergence := range ret.Remaining {
+		removing[divergence.Key] = true
+	}
+
+	checked, divergences, err := mirror.check(ctx)
+	if nil != err {
+		return
+	}
+	ret.Checked = checked
+
+	for _, divergence := range divergences {
+		if removing[divergence.Key] { // 残留对象删除失败时不能复制到其他镜像
+			continue
+		}
+
+		var source Cloud
+		if MirrorDivergenceStale == divergence.Kind {
+			source = mirror.Cloud
+		} else {
+			for i, c := range mirrors {
+				if !hasMirrorDivergence(divergences, i, divergence.Key) {
+					source = c
+					break
+				}
+			}
+		}
+		if nil == source {
+			ret.Remaining = append(ret.Remaining, divergence)
+			continue
+		}
+
+		if copyErr := copyMirrorObject(ctx, source, mirrors[divergence.Mirror], divergence.Key); nil != copyErr {
+			logging.LogErrorf("copy [%s] to mirror [%d] failed: %s", divergence.Key, divergence.Mirror, copyErr)
+			if err = ctx.Err(); nil != err {
+				return
+			}
+			ret.Remaining = append(ret.Remaining, divergence)
+			continue
+		}
+		ret.Copied++
+	}
+
+	// 完整比较后已经一致或者已经修复的记录不再保留
+	for _, divergence := range mirror.Divergences() {
+		if !hasMirrorDivergence(ret.Remaining, divergence.Mirror, divergence.Key) {
+			mirror.converged(divergence.Mirror, divergence.Key)
+		}
+	}
+	sortMirrorDivergences(ret.Remaining)
+	return
+}
+
+func hasMirrorDivergence(divergences []*MirrorDivergence, index int, key string) bool {
+	for _, divergence := range divergences {
+		if index == divergence.Mirror && key == divergence.Key {
+			return true
+		}
+	}
+	return false
+}
+
+func copyMirrorObject(ctx context.Context, from, to Cloud, key string) (err error) {
+	data, err := getBytes(ctx, from.Get, key)
+	if nil != err {
+		return
+	}
+	err = to.Put(ctx, key, bytes.NewReader(data), int64(len(data)))
+	return
+}
@@ -0,0 +1,171 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// brokenLocal 在 broken 为 true 时写入和删除都返回错误。
+type brokenLocal struct {
+	*Local
+	broken bool
+}
+
+func (local *brokenLocal) UploadBytes(filePath string, data []byte, overwrite bool) (int64, error) {
+	if local.broken {
+		return 0, ErrCloudServiceUnavailable
+	}
+	return local.Local.UploadBytes(filePath, data, overwrite)
+}
+
+func (local *brokenLocal) RemoveObject(filePath string) error {
+	if local.broken {
+		return ErrCloudServiceUnavailable
+	}
+	return local.Local.RemoveObject(filePath)
+}
+
+func newMirrorTestLocal(t *testing.T, tempDir, name string) *Local {
+	return NewLocal(&BaseCloud{Conf: &Conf{
+		Dir:      "main",
+		RepoPath: filepath.Join(tempDir, "repo"),
+		Local:    &ConfLocal{Endpoint: filepath.Join(tempDir, name)},
+	}})
+}
+
+func TestMirrorReadFallback(t *testing.T) {
+	tempDir := t.TempDir()
+	primary, secondary := newMirrorTestLocal(t, tempDir, "primary"), newMirrorTestLocal(t, tempDir, "secondary")
+	mirror := NewMirror(primary, secondary)
+	if _, err := mirror.UploadBytes("objects/ab/cdef", []byte("chunk"), true); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := mirror.UploadBytes("refs/latest", []byte("index1"), true); nil != err {
+		t.Fatal(err)
+	}
+	for _, c := range []Cloud{primary, secondary} {
+		if data, err := c.DownloadObject("objects/ab/cdef"); nil != err || "chunk" != string(data) {
+			t.Fatalf("object not written to every mirror [%s, %v]", data, err)
+		}
+	}
+
+	// 主存储丢失全部数据
+	if err := os.RemoveAll(filepath.Join(tempDir, "primary")); nil != err {
+		t.Fatal(err)
+	}
+	data, err := mirror.DownloadObject("objects/ab/cdef")
+	if nil != err || "chunk" != string(data) {
+		t.Fatalf("read should fall back to secondary [%s, %v]", data, err)
+	}
+	divergences := mirror.Divergences()
+	if 1 != len(divergences) || 0 != divergences[0].Mirror || MirrorDivergenceMissing != divergences[0].Kind {
+		t.Fatalf("unexpected divergences %v", divergences)
+	}
+	if _, err = mirror.DownloadObject("objects/ab/none"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("unexpected error [%v]", err)
+	}
+
+	result, err := mirror.Reconcile(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != result.Checked || 2 != result.Copied || 0 != len(result.Remaining) {
+		t.Fatalf("unexpected reconcile result %+v", result)
+	}
+	if data, err = primary.DownloadObject("refs/latest"); nil != err || "index1" != string(data) {
+		t.Fatalf("primary not restored [%s, %v]", data, err)
+	}
+	if 0 != len(mirror.Divergences()) {
+		t.Fatalf("divergences not cleared %v", mirror.Divergences())
+	}
+}
+
+func TestMirrorReconcile(t *testing.T) {
+	tempDir := t.TempDir()
+	primary := newMirrorTestLocal(t, tempDir, "primary")
+	secondary := &brokenLocal{Local: newMirrorTestLocal(t, tempDir, "secondary")}
+	mirror := NewMirror(primary, secondary)
+	if _, err := mirror.UploadBytes("objects/ab/old", []byte("old"), true); nil != err {
+		t.Fatal(err)
+	}
+
+	secondary.broken = true
+	if _, err := mirror.UploadBytes("objects/ab/new", []byte("new"), true); nil != err {
+		t.Fatalf("secondary failure should not fail the write: %s", err)
+	}
+	if _, err := mirror.UploadBytes("refs/latest", []byte("index2"), true); nil != err {
+		t.Fatal(err)
+	}
+	if err := mirror.RemoveObject("objects/ab/old"); nil != err {
+		t.Fatal(err)
+	}
+	if 3 != len(mirror.Divergences()) {
+		t.Fatalf("unexpected divergences %v", mirror.Divergences())
+	}
+
+	secondary.broken = false
+	if _, err := secondary.Local.UploadBytes("refs/latest", []byte("index1"), true); nil != err {
+		t.Fatal(err)
+	}
+	divergences, err := mirror.Check(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	// 删除失败的对象在完整比较时表现为主存储缺少该对象，对账时会按记录删除而不是复制回主存储
+	if 3 != len(divergences) || 0 != divergences[0].Mirror || "objects/ab/old" != divergences[0].Key ||
+		"objects/ab/new" != divergences[1].Key || MirrorDivergenceMissing != divergences[1].Kind ||
+		"refs/latest" != divergences[2].Key || MirrorDivergenceStale != divergences[2].Kind {
+		t.Fatalf("unexpected divergences %v", divergences)
+	}
+
+	result, err := mirror.Reconcile(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != result.Copied || 1 != result.Removed || 0 != len(result.Remaining) {
+		t.Fatalf("unexpected reconcile result %+v", result)
+	}
+	if data, getErr := secondary.DownloadObject("refs/latest"); nil != getErr || "index2" != string(data) {
+		t.Fatalf("stale ref not fixed [%s, %v]", data, getErr)
+	}
+	if _, getErr := secondary.DownloadObject("objects/ab/old"); !errors.Is(getErr, ErrCloudObjectNotFound) {
+		t.Fatalf("removed object left on secondary [%v]", getErr)
+	}
+	if divergences, err = mirror.Check(context.Background()); nil != err || 0 != len(divergences) {
+		t.Fatalf("mirrors still diverged %v [%v]", divergences, err)
+	}
+
+	primaryErr := errors.New("primary failed")
+	failing := NewMirror(&failingCloud{Cloud: primary, err: primaryErr}, secondary)
+	if _, err = failing.UploadBytes("objects/ab/x", []byte("x"), true); !errors.Is(err, primaryErr) {
+		t.Fatalf("primary failure should fail the write [%v]", err)
+	}
+}
+
+type failingCloud struct {
+	Cloud
+	err error
+}
+
+func (c *failingCloud) UploadBytes(string, []byte, bool) (int64, error) {
+	return 0, c.err
+}
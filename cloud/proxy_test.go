@@ -0,0 +1,324 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cloud
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// proxyTestServer 描述了用于测试的 HTTP 和 SOCKS5 代理服务，按照 hosts 将虚构的主机映射到本机服务。
+type proxyTestServer struct {
+	listener net.Listener
+	url      string
+	hosts    map[string]string // 虚构的主机和端口到本机服务地址的映射
+	auth     *url.Userinfo
+
+	lock    sync.Mutex
+	targets []string // 经过代理访问的主机和端口
+}
+
+func newProxyTestServer(t *testing.T, scheme string, auth *url.Userinfo, hosts map[string]string) (ret *proxyTestServer) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	proxyURL := &url.URL{Scheme: scheme, Host: listener.Addr().String(), User: auth}
+	ret = &proxyTestServer{listener: listener, url: proxyURL.String(), hosts: hosts, auth: auth}
+	if "socks5" == scheme {
+		go ret.serveSOCKS5()
+	} else {
+		go http.Serve(listener, ret)
+	}
+	return
+}
+
+func (server *proxyTestServer) dialTarget(target string) (net.Conn, error) {
+	server.lock.Lock()
+	server.targets = append(server.targets, target)
+	server.lock.Unlock()
+
+	addr, ok := server.hosts[target]
+	if !ok {
+		return nil, errors.New("unknown host " + target)
+	}
+	return net.Dial("tcp", addr)
+}
+
+func (server *proxyTestServer) getTargets() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]string{}, server.targets...)
+}
+
+func (server *proxyTestServer) authorized(username, password string) bool {
+	if nil == server.auth {
+		return true
+	}
+	expected, _ := server.auth.Password()
+	return server.auth.Username() == username && expected == password
+}
+
+func (server *proxyTestServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	username, password, _ := (&http.Request{Header: http.Header{"Authorization": request.Header.Values("Proxy-Authorization")}}).BasicAuth()
+	if !server.authorized(username, password) {
+		writer.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	if http.MethodConnect != request.Method {
+		server.forward(writer, request)
+		return
+	}
+
+	conn, err := server.dialTarget(request.Host)
+	if nil != err {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	clientConn, clientBuf, err := writer.(http.Hijacker).Hijack()
+	if nil != err {
+		return
+	}
+	defer clientConn.Close()
+
+	// SSH 服务端会立即发送协议标识，可能和 CONNECT 响应一起被客户端读入缓冲区
+	clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go io.Copy(conn, clientBuf)
+	io.Copy(clientConn, conn)
+}
+
+// forward 用于转发 HTTP 代理请求。
+func (server *proxyTestServer) forward(writer http.ResponseWriter, request *http.Request) {
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return server.dialTarget(addr)
+	}}
+	defer transport.CloseIdleConnections()
+
+	outRequest := request.Clone(request.Context())
+	outRequest.RequestURI = ""
+	outRequest.Header.Del("Proxy-Authorization")
+	resp, err := transport.RoundTrip(outRequest)
+	if nil != err {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		writer.Header()[key] = values
+	}
+	writer.WriteHeader(resp.StatusCode)
+	io.Copy(writer, resp.Body)
+}
+
+func (server *proxyTestServer) serveSOCKS5() {
+	for {
+		conn, err := server.listener.Accept()
+		if nil != err {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			target, handshakeErr := server.handshakeSOCKS5(conn)
+			if nil != handshakeErr {
+				return
+			}
+			targetConn, dialErr := server.dialTarget(target)
+			if nil != dialErr {
+				conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer targetConn.Close()
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(targetConn, conn)
+			io.Copy(conn, targetConn)
+		}()
+	}
+}
+
+func (server *proxyTestServer) handshakeSOCKS5(conn net.Conn) (target string, err error) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(reader, header); nil != err {
+		return
+	}
+	if _, err = io.ReadFull(reader, make([]byte, header[1])); nil != err {
+		return
+	}
+
+	if nil == server.auth {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		readField := func() string {
+			length, _ := reader.ReadByte()
+			field := make([]byte, length)
+			io.ReadFull(reader, field)
+			return string(field)
+		}
+		reader.ReadByte()
+		username := readField()
+		password := readField()
+		if !server.authorized(username, password) {
+			conn.Write([]byte{1, 1})
+			err = errors.New("socks auth failed")
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err = io.ReadFull(reader, request); nil != err {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length, _ := reader.ReadByte()
+		name := make([]byte, length)
+		io.ReadFull(reader, name)
+		host = string(name)
+	default:
+		err = errors.New("unsupported address type")
+		return
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(reader, port); nil != err {
+		return
+	}
+	target = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return
+}
+
+func TestProxyFunc(t *testing.T) {
+	conf := &ConfProxy{URL: "http://proxy.test:3128", NoProxy: []string{"lan.test", "10.0.0.0/8"}}
+	proxyFunc := conf.proxyFunc()
+	cases := []struct {
+		url   string
+		proxy bool
+	}{
+		{"https://s3.example.com/bucket", true},
+		{"http://dav.example.com/remote.php", true},
+		{"https://lan.test/dav", false},
+		{"https://nas.lan.test/dav", false},
+		{"http://10.1.2.3:8080/", false},
+		{"http://127.0.0.1:6806/", false},
+		{"http://localhost/", false},
+	}
+	for _, c := range cases {
+		requestURL, _ := url.Parse(c.url)
+		proxyURL, err := proxyFunc(&http.Request{URL: requestURL})
+		if nil != err {
+			t.Fatal(err)
+		}
+		if c.proxy != (nil != proxyURL) {
+			t.Fatalf("proxy for [%s] got [%v]", c.url, proxyURL)
+		}
+	}
+
+	for _, invalid := range []string{"ftp://proxy.test", "http://", "://proxy"} {
+		requestURL, _ := url.Parse("https://s3.example.com")
+		if _, err := (&ConfProxy{URL: invalid}).proxyFunc()(&http.Request{URL: requestURL}); nil == err {
+			t.Fatalf("invalid proxy URL [%s] accepted", invalid)
+		}
+	}
+}
+
+func TestProxyS3(t *testing.T) {
+	stub := newS3Stub()
+	s3 := newS3StubCloud(t, stub)
+	server := newProxyTestServer(t, "http", url.UserPassword("user", "pass"), map[string]string{
+		"s3.test:80": strings.TrimPrefix(s3.Conf.S3.Endpoint, "http://"),
+	})
+
+	conf := *s3.Conf
+	conf.S3 = &ConfS3{}
+	*conf.S3 = *s3.Conf.S3
+	conf.S3.Endpoint = "http://s3.test"
+	conf.Proxy = &ConfProxy{URL: server.url}
+	proxied := NewS3(&BaseCloud{Conf: &conf}, nil)
+	if _, err := proxied.UploadBytes("refs/latest", []byte("data"), true); nil != err {
+		t.Fatal(err)
+	}
+	if got, err := proxied.DownloadObject("refs/latest"); nil != err || "data" != string(got) {
+		t.Fatalf("download via proxy got [%s], err [%v]", got, err)
+	}
+	if 2 > len(server.getTargets()) {
+		t.Fatalf("got [%d] requests via proxy", len(server.getTargets()))
+	}
+
+	conf.Proxy = &ConfProxy{URL: strings.Replace(server.url, "pass", "wrong", 1)}
+	if _, err := NewS3(&BaseCloud{Conf: &conf}, nil).DownloadObject("refs/latest"); nil == err {
+		t.Fatal("download with wrong proxy password succeeded")
+	}
+
+	// 匹配 NoProxy 的主机直连
+	conf.S3.Endpoint = s3.Conf.S3.Endpoint
+	conf.Proxy = &ConfProxy{URL: "http://127.0.0.1:1", NoProxy: []string{"127.0.0.1"}}
+	if _, err := NewS3(&BaseCloud{Conf: &conf}, nil).DownloadObject("refs/latest"); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestProxySFTP(t *testing.T) {
+	sftpServer := newSFTPTestServer(t, "secret")
+	target := net.JoinHostPort("sftp.test", strconv.Itoa(sftpServer.port))
+	hosts := map[string]string{target: sftpServer.listener.Addr().String()}
+
+	for _, scheme := range []string{"socks5", "http"} {
+		server := newProxyTestServer(t, scheme, url.UserPassword("user", "pass"), hosts)
+		sftp := sftpServer.newSFTP(t, t.TempDir(), "secret")
+		sftp.Conf.SFTP.Host = "sftp.test"
+		sftp.Conf.SFTP.KnownHosts = strings.Replace(sftpServer.knownHosts, sftpServer.host, "sftp.test", 1)
+		sftp.Conf.Proxy = &ConfProxy{URL: server.url}
+
+		if _, err := sftp.UploadBytes("refs/latest", []byte("data"), true); nil != err {
+			t.Fatalf("upload via [%s] proxy failed: %s", scheme, err)
+		}
+		if got, err := sftp.DownloadObject("refs/latest"); nil != err || "data" != string(got) {
+			t.Fatalf("download via [%s] proxy got [%s], err [%v]", scheme, got, err)
+		}
+		if targets := server.getTargets(); 1 != len(targets) || target != targets[0] {
+			t.Fatalf("got targets %v via [%s] proxy", targets, scheme)
+		}
+
+		sftp = sftpServer.newSFTP(t, t.TempDir(), "secret")
+		sftp.Conf.SFTP.Host = "sftp.test"
+		sftp.Conf.Proxy = &ConfProxy{URL: strings.Replace(server.url, "pass", "wrong", 1)}
+		if _, err := sftp.DownloadObject("refs/latest"); nil == err {
+			t.Fatalf("download via [%s] proxy with wrong password succeeded", scheme)
+		}
+	}
+}
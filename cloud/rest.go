@@ -0,0 +1,632 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// REST 描述了 REST 协议云端存储服务实现，服务端见 rest 包，仓库布局和 Local 一致。
+//
+// 协议约定：
+//
+//	GET    /                  列出仓库和服务端可用空间
+//	POST   /<repo>/           创建仓库
+//	DELETE /<repo>/           删除仓库
+//	GET    /<repo>/<prefix>/  列出前缀下的对象，objects/ 下会递归列出 objects/XX/<id>
+//	GET    /<repo>/<key>      下载对象，带 ?etag=1 参数时返回 ETag 响应头
+//	HEAD   /<repo>/<key>      获取对象大小
+//	PUT    /<repo>/<key>      上传对象，带 If-Match 或者 If-None-Match: * 请求头时为条件上传
+//	DELETE /<repo>/<key>      删除对象
+type REST struct {
+	*BaseCloud
+	HTTPClient *http.Client
+}
+
+func NewREST(baseCloud *BaseCloud, httpClient *http.Client) (ret *REST) {
+	if nil == httpClient {
+		timeout := baseCloud.Conf.REST.Timeout
+		if 1 > timeout {
+			timeout = 30
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: baseCloud.Conf.REST.SkipTlsVerify}
+		transport.ResponseHeaderTimeout = time.Duration(timeout) * time.Second
+		if !baseCloud.Conf.Proxy.isEmpty() {
+			transport.Proxy = baseCloud.Conf.Proxy.proxyFunc()
+		}
+		httpClient = &http.Client{Transport: transport}
+	} else if !baseCloud.Conf.Proxy.isEmpty() {
+		client := *httpClient
+		client.Transport = newHTTPTransport(client.Transport, nil, baseCloud.Conf.REST.SkipTlsVerify, baseCloud.Conf.Proxy)
+		httpClient = &client
+	}
+	ret = &REST{BaseCloud: baseCloud, HTTPClient: httpClient}
+	return
+}
+
+func (rest *REST) CreateRepo(name string) (err error) {
+	resp, err := rest.do(context.Background(), http.MethodPost, rest.repoURL(name)+"/", nil, -1, nil)
+	if nil != err {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (rest *REST) RemoveRepo(name string) (err error) {
+	resp, err := rest.do(context.Background(), http.MethodDelete, rest.repoURL(name)+"/", nil, -1, nil)
+	if nil != err {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (rest *REST) GetRepos() (repos []*Repo, size int64, err error) {
+	result, err := rest.listRepos()
+	if nil != err {
+		return
+	}
+
+	repos = result.Repos
+	for _, repo := range repos {
+		size += repo.Size
+	}
+	return
+}
+
+func (rest *REST) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	ctx := context.Background()
+	if !overwrite {
+		if _, err = rest.Stat(ctx, filePath); nil == err {
+			return
+		} else if !errors.Is(err, ErrCloudObjectNotFound) {
+			return
+		}
+	}
+
+	length, err = putFile(ctx, rest.Put, rest.Conf.RepoPath, filePath)
+	return
+}
+
+func (rest *REST) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	if err = rest.Put(context.Background(), filePath, bytes.NewReader(data), int64(len(data))); nil != err {
+		return
+	}
+	length = int64(len(data))
+	return
+}
+
+func (rest *REST) DownloadObject(filePath string) (data []byte, err error) {
+	data, err = getBytes(context.Background(), rest.Get, filePath)
+	return
+}
+
+func (rest *REST) RemoveObject(filePath string) (err error) {
+	err = rest.Delete(context.Background(), filePath)
+	return
+}
+
+func (rest *REST) ListObjects(pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
+	objects, err = rest.List(context.Background(), pathPrefix)
+	return
+}
+
+func (rest *REST) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	var body io.Reader = http.NoBody
+	if 0 != size {
+		throttled := rest.GetBandwidthLimiter().UploadReader(ctx, reader)
+		defer throttled.Close()
+		body = throttled
+	}
+
+	resp, err := rest.do(ctx, http.MethodPut, rest.keyURL(key), body, size, nil)
+	if nil != err {
+		logging.LogErrorf("upload object [%s] failed: %s", key, err)
+		return
+	}
+	resp.Body.Close()
+
+	//logging.LogInfof("uploaded object [%s]", key)
+	return
+}
+
+func (rest *REST) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	resp, err := rest.do(ctx, http.MethodGet, rest.keyURL(key), nil, -1, nil)
+	if nil != err {
+		return
+	}
+	reader = rest.GetBandwidthLimiter().DownloadReader(ctx, resp.Body)
+
+	//logging.LogInfof("downloaded object [%s]", key)
+	return
+}
+
+func (rest *REST) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	resp, err := rest.do(ctx, http.MethodHead, rest.keyURL(key), nil, -1, nil)
+	if nil != err {
+		return
+	}
+	resp.Body.Close()
+	info = &entity.ObjectInfo{Path: key, Size: resp.ContentLength}
+	info.Updated, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return
+}
+
+func (rest *REST) Delete(ctx context.Context, key string) (err error) {
+	resp, err := rest.do(ctx, http.MethodDelete, rest.keyURL(key), nil, -1, nil)
+	if nil != err {
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+			return
+		}
+		logging.LogErrorf("remove object [%s] failed: %s", key, err)
+		return
+	}
+	resp.Body.Close()
+
+	//logging.LogInfof("removed object [%s]", key)
+	return
+}
+
+func (rest *REST) List(ctx context.Context, pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
+	objects = map[string]*entity.ObjectInfo{}
+	listURL := rest.keyURL(pathPrefix)
+	if !strings.HasSuffix(listURL, "/") {
+		listURL += "/"
+	}
+	resp, err := rest.do(ctx, http.MethodGet, listURL, nil, -1, nil)
+	if nil != err {
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+			return
+		}
+		logging.LogErrorf("list objects [%s] failed: %s", pathPrefix, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if nil != err {
+		logging.LogErrorf("list objects [%s] failed: %s", pathPrefix, err)
+		return
+	}
+	if err = gulu.JSON.UnmarshalJSON(data, &objects); nil != err {
+		logging.LogErrorf("list objects [%s] failed: %s", pathPrefix, err)
+		return
+	}
+
+	//logging.LogInfof("list objects [%s]", pathPrefix)
+	return
+}
+
+func (rest *REST) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	resp, err := rest.do(ctx, http.MethodGet, rest.keyURL(key)+"?etag=1", nil, -1, nil)
+	if nil != err {
+		return
+	}
+	defer resp.Body.Close()
+
+	if data, err = io.ReadAll(resp.Body); nil != err {
+		return
+	}
+	etag = strings.Trim(resp.Header.Get("ETag"), "\"")
+	return
+}
+
+func (rest *REST) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error) {
+	header := http.Header{}
+	if "" == etag {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", "\""+etag+"\"")
+	}
+
+	resp, err := rest.do(ctx, http.MethodPut, rest.keyURL(key), bytes.NewReader(data), int64(len(data)), header)
+	if nil != err {
+		if !errors.Is(err, ErrCloudPreconditionFailed) {
+			logging.LogErrorf("upload object [%s] failed: %s", key, err)
+		}
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (rest *REST) GetTags() (tags []*Ref, err error) {
+	tags, err = rest.listRepoRefs("tags")
+	if nil != err {
+		logging.LogErrorf("list repo tags failed: %s", err)
+		return
+	}
+	if 1 > len(tags) {
+		tags = []*Ref{}
+	}
+	return
+}
+
+func (rest *REST) GetIndexes(page int) (indexes []*entity.Index, pageCount, totalCount int, err error) {
+	indexes = []*entity.Index{}
+	data, err := rest.DownloadObject("indexes-v2.json")
+	if nil != err {
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+
+	data, err = compressDecoder.DecodeAll(data, nil)
+	if nil != err {
+		return
+	}
+
+	indexesJSON := &Indexes{}
+	if err = gulu.JSON.UnmarshalJSON(data, indexesJSON); nil != err {
+		return
+	}
+
+	totalCount = len(indexesJSON.Indexes)
+	pageCount = int(math.Ceil(float64(totalCount) / float64(pageSize)))
+	start := (page - 1) * pageSize
+	end := page * pageSize
+	if end > totalCount {
+		end = totalCount
+	}
+
+	for i := start; i < end; i++ {
+		index, getErr := rest.repoIndex(indexesJSON.Indexes[i].ID)
+		if nil != getErr {
+			logging.LogWarnf("get repo index [%s] failed: %s", indexesJSON.Indexes[i], getErr)
+			continue
+		}
+		if nil == index {
+			continue
+		}
+
+		index.Files = nil // Optimize the performance of obtaining cloud snapshots https://github.com/siyuan-note/siyuan/issues/8387
+		indexes = append(indexes, index)
+	}
+	return
+}
+
+func (rest *REST) GetRefsFiles() (fileIDs []string, refs []*Ref, err error) {
+	refs, err = rest.listRepoRefs("")
+	if nil != err {
+		logging.LogErrorf("list repo refs failed: %s", err)
+		return
+	}
+
+	var files []string
+	for _, ref := range refs {
+		index, getErr := rest.repoIndex(ref.ID)
+		if nil != getErr {
+			err = getErr
+			return
+		}
+		if nil == index {
+			continue
+		}
+
+		files = append(files, index.Files...)
+	}
+
+	fileIDs = gulu.Str.RemoveDuplicatedElem(files)
+	if 1 > len(fileIDs) {
+		fileIDs = []string{}
+	}
+	return
+}
+
+func (rest *REST) GetChunks(checkChunkIDs []string) (chunkIDs []string, err error) {
+	var keys []string
+	for _, chunkID := range checkChunkIDs {
+		keys = append(keys, path.Join("objects", chunkID[:2], chunkID[2:]))
+	}
+
+	notFound, err := rest.getNotFound(keys)
+	if nil != err {
+		return
+	}
+
+	for _, key := range notFound {
+		chunkID := strings.TrimPrefix(key, "objects")
+		chunkIDs = append(chunkIDs, strings.ReplaceAll(chunkID, "/", ""))
+	}
+	chunkIDs = gulu.Str.RemoveDuplicatedElem(chunkIDs)
+	if 1 > len(chunkIDs) {
+		chunkIDs = []string{}
+	}
+	return
+}
+
+func (rest *REST) GetIndex(id string) (index *entity.Index, err error) {
+	index, err = rest.repoIndex(id)
+	if nil != err {
+		logging.LogErrorf("get index [%s] failed: %s", id, err)
+		return
+	}
+	if nil == index {
+		err = ErrCloudObjectNotFound
+		return
+	}
+	return
+}
+
+func (rest *REST) GetCapabilities() *Capabilities {
+	return &Capabilities{ConditionalWrite: true, ConsistentListing: true}
+}
+
+func (rest *REST) GetConcurrentReqs() (ret int) {
+	ret = rest.REST.ConcurrentReqs
+	if 1 > ret {
+		ret = 8
+	}
+	if 64 < ret {
+		ret = 64
+	}
+	return
+}
+
+func (rest *REST) GetConf() *Conf {
+	return rest.Conf
+}
+
+// GetAvailableSize 用于获取服务端的可用空间，获取失败时返回配置的可用空间。
+func (rest *REST) GetAvailableSize() int64 {
+	result, err := rest.listRepos()
+	if nil != err || 1 > result.AvailableSize {
+		return rest.Conf.AvailableSize
+	}
+	return result.AvailableSize
+}
+
+func (rest *REST) AddTraffic(*Traffic) {
+	return
+}
+
+// RESTRepos 描述了 REST 服务端返回的仓库列表。
+type RESTRepos struct {
+	Repos         []*Repo `json:"repos"`
+	AvailableSize int64   `json:"availableSize"` // 服务端可用空间字节数
+}
+
+func (rest *REST) listRepos() (ret *RESTRepos, err error) {
+	resp, err := rest.do(context.Background(), http.MethodGet, strings.TrimSuffix(rest.REST.Endpoint, "/")+"/", nil, -1, nil)
+	if nil != err {
+		logging.LogErrorf("list repos failed: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if nil != err {
+		logging.LogErrorf("list repos failed: %s", err)
+		return
+	}
+	ret = &RESTRepos{}
+	if err = gulu.JSON.UnmarshalJSON(data, ret); nil != err {
+		logging.LogErrorf("list repos failed: %s", err)
+		return
+	}
+	sort.Slice(ret.Repos, func(i, j int) bool { return ret.Repos[i].Name < ret.Repos[j].Name })
+	return
+}
+
+func (rest *REST) listRepoRefs(refPrefix string) (refs []*Ref, err error) {
+	ctx := context.Background()
+	prefix := path.Join("refs", refPrefix)
+	infos, err := rest.List(ctx, prefix)
+	if nil != err {
+		return
+	}
+
+	var names []string
+	for name := range infos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		resp, getErr := rest.do(ctx, http.MethodGet, rest.keyURL(path.Join(prefix, name)), nil, -1, nil)
+		if nil != getErr {
+			if errors.Is(getErr, ErrCloudObjectNotFound) {
+				// 服务端列出的子目录
+				continue
+			}
+			err = getErr
+			return
+		}
+		data, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if nil != readErr {
+			err = readErr
+			return
+		}
+
+		updated := time.Now()
+		if lastModified, parseErr := http.ParseTime(resp.Header.Get("Last-Modified")); nil == parseErr {
+			updated = lastModified
+		}
+		refs = append(refs, &Ref{
+			Name:    name,
+			ID:      string(data),
+			Updated: updated.Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+	return
+}
+
+func (rest *REST) repoIndex(id string) (index *entity.Index, err error) {
+	data, err := rest.DownloadObject(path.Join("indexes", id))
+	if nil != err {
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+	if 1 > len(data) {
+		return
+	}
+
+	data, err = compressDecoder.DecodeAll(data, nil)
+	if nil != err {
+		return
+	}
+
+	index = &entity.Index{}
+	err = gulu.JSON.UnmarshalJSON(data, index)
+	return
+}
+
+func (rest *REST) getNotFound(keys []string) (ret []string, err error) {
+	if 1 > len(keys) {
+		return
+	}
+
+	poolSize := rest.GetConcurrentReqs()
+	if poolSize > len(keys) {
+		poolSize = len(keys)
+	}
+
+	lock := sync.Mutex{}
+	waitGroup := &sync.WaitGroup{}
+	p, _ := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		key := arg.(string)
+		_, statErr := rest.Stat(context.Background(), key)
+		if nil == statErr {
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if errors.Is(statErr, ErrCloudObjectNotFound) {
+			ret = append(ret, key)
+		} else if nil == err {
+			// 服务端错误或者网络错误时无法确认对象是否存在，不能当作已经存在而跳过上传
+			logging.LogErrorf("stat [%s] failed: %s", key, statErr)
+			err = statErr
+		}
+	})
+	defer p.Release()
+
+	for _, key := range keys {
+		waitGroup.Add(1)
+		if invokeErr := p.Invoke(key); nil != invokeErr {
+			waitGroup.Done()
+			logging.LogErrorf("invoke failed: %s", invokeErr)
+			lock.Lock()
+			err = invokeErr
+			lock.Unlock()
+			break
+		}
+	}
+	waitGroup.Wait()
+	if nil != err {
+		ret = nil
+	}
+	return
+}
+
+// do 用于发送请求，响应状态码不是 2xx 时关闭响应并返回对应的错误。
+func (rest *REST) do(ctx context.Context, method, u string, body io.Reader, size int64, header http.Header) (resp *http.Response, err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if nil != err {
+		return
+	}
+	if 0 <= size && nil != body {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if "" != rest.REST.Token {
+		req.Header.Set("Authorization", "Bearer "+rest.REST.Token)
+	} else if "" != rest.REST.Username {
+		req.SetBasicAuth(rest.REST.Username, rest.REST.Password)
+	}
+
+	resp, err = rest.HTTPClient.Do(req)
+	if nil != err {
+		return
+	}
+	if 200 <= resp.StatusCode && 300 > resp.StatusCode {
+		return
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	err = rest.parseStatus(resp, strings.TrimSpace(string(msg)))
+	resp = nil
+	return
+}
+
+func (rest *REST) parseStatus(resp *http.Response, msg string) (err error) {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrCloudObjectNotFound
+	case http.StatusUnauthorized:
+		return ErrCloudAuthFailed
+	case http.StatusForbidden:
+		return ErrCloudForbidden
+	case http.StatusPreconditionFailed:
+		return ErrCloudPreconditionFailed
+	case http.StatusInsufficientStorage, http.StatusRequestEntityTooLarge:
+		return ErrCloudQuotaExceeded
+	case http.StatusTooManyRequests:
+		return newRetryAfterError(ErrCloudTooManyRequests, resp.Header)
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return newRetryAfterError(ErrCloudServiceUnavailable, resp.Header)
+	}
+	return fmt.Errorf("%s %s failed: %s %s", resp.Request.Method, resp.Request.URL.Path, strconv.Itoa(resp.StatusCode), msg)
+}
+
+func (rest *REST) repoURL(name string) string {
+	return strings.TrimSuffix(rest.REST.Endpoint, "/") + "/" + url.PathEscape(name)
+}
+
+func (rest *REST) keyURL(key string) string {
+	ret := rest.repoURL(rest.Dir)
+	for _, segment := range strings.Split(strings.Trim(key, "/"), "/") {
+		ret += "/" + url.PathEscape(segment)
+	}
+	return ret
+}
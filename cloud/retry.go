@@ -0,0 +1,516 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// ErrorClass 描述了存储服务错误的分类，用于决定是否重试。
+type ErrorClass int
+
+const (
+	ErrorClassPermanent ErrorClass = iota // 不可重试的错误，比如参数错误、条件写入不满足条件、不支持的操作或者操作已取消
+	ErrorClassTransient                   // 临时错误，比如网络错误、请求超时、服务不可用或者请求过多，可以重试
+	ErrorClassAuth                        // 鉴权失败或者禁止访问
+	ErrorClassNotFound                    // 对象不存在
+	ErrorClassQuota                       // 存储空间不足或者超出配额
+)
+
+func (class ErrorClass) String() string {
+	switch class {
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassAuth:
+		return "auth"
+	case ErrorClassNotFound:
+		return "not found"
+	case ErrorClassQuota:
+		return "quota"
+	default:
+		return "permanent"
+	}
+}
+
+// RetryAfterError 描述了存储服务要求在 After 之后再重试的错误，通常来自 HTTP 响应头 Retry-After。
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+func (err *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s, retry after [%s]", err.Err, err.After)
+}
+
+func (err *RetryAfterError) Unwrap() error {
+	return err.Err
+}
+
+// newRetryAfterError 用于根据 HTTP 响应头 Retry-After 包装错误 err，没有该响应头时返回 err。
+func newRetryAfterError(err error, header http.Header) error {
+	after, ok := parseRetryAfter(header.Get("Retry-After"), time.Now())
+	if !ok {
+		return err
+	}
+	return &RetryAfterError{Err: err, After: after}
+}
+
+// parseRetryAfter 用于解析 Retry-After，支持秒数和 HTTP 日期两种格式。
+func parseRetryAfter(value string, now time.Time) (ret time.Duration, ok bool) {
+	value = strings.TrimSpace(value)
+	if "" == value {
+		return
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); nil == err {
+		if 0 > seconds {
+			return
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); nil == err {
+		if ret = t.Sub(now); 0 > ret {
+			ret = 0
+		}
+		return ret, true
+	}
+	return
+}
+
+// ClassifyError 用于对存储服务返回的错误 err 分类。
+func ClassifyError(err error) ErrorClass {
+	if nil == err {
+		return ErrorClassPermanent
+	}
+
+	switch {
+	case errors.Is(err, ErrCloudAuthFailed), errors.Is(err, ErrCloudForbidden):
+		return ErrorClassAuth
+	case errors.Is(err, ErrCloudObjectNotFound):
+		return ErrorClassNotFound
+	case errors.Is(err, ErrCloudQuotaExceeded):
+		return ErrorClassQuota
+	case errors.Is(err, ErrCloudServiceUnavailable), errors.Is(err, ErrCloudTooManyRequests):
+		return ErrorClassTransient
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrUnsupported), errors.Is(err, ErrCloudPreconditionFailed),
+		errors.Is(err, ErrDecryptFailed), errors.Is(err, ErrSystemTimeIncorrect), errors.Is(err, ErrDeprecatedVersion), errors.Is(err, ErrCloudObjectLocked):
+		return ErrorClassPermanent
+	}
+
+	var retryAfterErr *RetryAfterError
+	if errors.As(err, &retryAfterErr) {
+		return ErrorClassTransient
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable", "Throttling", "ThrottlingException", "TooManyRequests":
+			return ErrorClassTransient
+		case "RequestTimeTooSkewed":
+			return ErrorClassPermanent
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+			return ErrorClassAuth
+		case "NoSuchKey", "NotFound", "NoSuchBucket":
+			return ErrorClassNotFound
+		case "QuotaExceeded", "InsufficientStorage", "EntityTooLarge":
+			return ErrorClassQuota
+		}
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		return classifyHTTPStatus(respErr.HTTPStatusCode())
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return ErrorClassTransient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorClassTransient
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, transientMsg := range transientErrMsgs {
+		if strings.Contains(msg, transientMsg) {
+			return ErrorClassTransient
+		}
+	}
+	return ErrorClassPermanent
+}
+
+// transientErrMsgs 为无法通过错误类型判断时视为临时错误的错误信息。
+var transientErrMsgs = []string{
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"timeout",
+	"i/o timeout",
+	"unexpected eof",
+	"tls handshake",
+	"no such host",
+	"service unavailable",
+	"too many requests",
+	"bad gateway",
+	"gateway timeout",
+}
+
+// classifyHTTPStatus 用于根据 HTTP 状态码 status 对错误分类。
+func classifyHTTPStatus(status int) ErrorClass {
+	switch {
+	case http.StatusUnauthorized == status || http.StatusForbidden == status:
+		return ErrorClassAuth
+	case http.StatusNotFound == status:
+		return ErrorClassNotFound
+	case http.StatusInsufficientStorage == status || http.StatusRequestEntityTooLarge == status:
+		return ErrorClassQuota
+	case http.StatusRequestTimeout == status || http.StatusTooManyRequests == status:
+		return ErrorClassTransient
+	case http.StatusNotImplemented == status || http.StatusHTTPVersionNotSupported == status:
+		return ErrorClassPermanent
+	case 500 <= status:
+		return ErrorClassTransient
+	}
+	return ErrorClassPermanent
+}
+
+// retryAfter 用于获取错误 err 中存储服务要求的重试等待时长。
+func retryAfter(err error) (ret time.Duration, ok bool) {
+	var retryAfterErr *RetryAfterError
+	if errors.As(err, &retryAfterErr) {
+		return retryAfterErr.After, true
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) && nil != respErr.Response && nil != respErr.Response.Response {
+		return parseRetryAfter(respErr.Response.Header.Get("Retry-After"), time.Now())
+	}
+	return
+}
+
+// ConfRetry 用于描述失败重试配置，零值字段使用默认值。
+type ConfRetry struct {
+	MaxAttempts   int           // 最大尝试次数（包含第一次请求），默认为 4
+	BaseDelay     time.Duration // 第一次重试前的等待时长，之后每次翻倍，默认为 500 毫秒
+	MaxDelay      time.Duration // 重试等待时长上限，默认为 30 秒
+	MaxRetryAfter time.Duration // 存储服务要求的等待时长（Retry-After）超过该值时不再重试，默认为 60 秒
+}
+
+func (conf *ConfRetry) withDefaults() (ret *ConfRetry) {
+	ret = &ConfRetry{}
+	if nil != conf {
+		*ret = *conf
+	}
+	if 1 > ret.MaxAttempts {
+		ret.MaxAttempts = 4
+	}
+	if 0 >= ret.BaseDelay {
+		ret.BaseDelay = 500 * time.Millisecond
+	}
+	if 0 >= ret.MaxDelay {
+		ret.MaxDelay = 30 * time.Second
+	}
+	if ret.MaxDelay < ret.BaseDelay {
+		ret.MaxDelay = ret.BaseDelay
+	}
+	if 0 >= ret.MaxRetryAfter {
+		ret.MaxRetryAfter = 60 * time.Second
+	}
+	return
+}
+
+// Retry 描述了为任意存储服务增加失败重试的装饰器。
+//
+// 只有临时错误（ErrorClassTransient）会按带随机抖动的指数退避重试，并遵循存储服务返回的 Retry-After。
+// 条件上传 PutIfMatch 不重试，因为无法确定失败的请求是否已经写入，重试可能误判为条件不满足。
+type Retry struct {
+	Cloud
+
+	conf    *ConfRetry
+	retries atomic.Int64
+	sleep   func(ctx context.Context, d time.Duration) error
+}
+
+// NewRetry 创建存储服务 cloud 的重试装饰器，conf 为空时使用默认配置。
+func NewRetry(cloud Cloud, conf *ConfRetry) *Retry {
+	return &Retry{Cloud: cloud, conf: conf.withDefaults(), sleep: sleepContext}
+}
+
+// Unwrap 返回被装饰的存储服务。
+func (retry *Retry) Unwrap() Cloud {
+	return retry.Cloud
+}
+
+// RetryCount 返回累计的重试次数。
+func (retry *Retry) RetryCount() int64 {
+	return retry.retries.Load()
+}
+
+// Unwrap 用于获取装饰器（比如 Retry）最内层的存储服务，用于判断存储服务的类型。
+func Unwrap(cloud Cloud) Cloud {
+	for {
+		wrapper, ok := cloud.(interface{ Unwrap() Cloud })
+		if !ok {
+			return cloud
+		}
+		cloud = wrapper.Unwrap()
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) (err error) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+	}
+	return
+}
+
+// delay 返回第 attempt 次重试前的等待时长，attempt 从 1 开始。
+func (retry *Retry) delay(attempt int, err error) (ret time.Duration, ok bool) {
+	if after, hasAfter := retryAfter(err); hasAfter {
+		if retry.conf.MaxRetryAfter < after {
+			return
+		}
+		return after, true
+	}
+
+	ret = retry.conf.MaxDelay
+	if shift := attempt - 1; 31 > shift {
+		if backoff := retry.conf.BaseDelay << shift; 0 < backoff && backoff < ret {
+			ret = backoff
+		}
+	}
+	// 在 [ret/2, ret] 之间随机抖动，避免多个设备同时重试
+	ret = ret/2 + rand.N(ret/2+1)
+	return ret, true
+}
+
+// do 用于执行请求 fn，遇到临时错误时重试，name 和 key 用于日志。
+func (retry *Retry) do(ctx context.Context, name, key string, fn func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = fn(); nil == err {
+			return
+		}
+		if ErrorClassTransient != ClassifyError(err) || retry.conf.MaxAttempts <= attempt || nil != ctx.Err() {
+			return
+		}
+
+		delay, ok := retry.delay(attempt, err)
+		if !ok {
+			return
+		}
+		logging.LogWarnf("%s [%s] failed: %s, retry [%d] after [%s]", name, key, err, attempt, delay)
+		if sleepErr := retry.sleep(ctx, delay); nil != sleepErr {
+			return
+		}
+		retry.retries.Add(1)
+	}
+}
+
+func (retry *Retry) CreateRepo(name string) (err error) {
+	err = retry.do(context.Background(), "create repo", name, func() error {
+		return retry.Cloud.CreateRepo(name)
+	})
+	return
+}
+
+func (retry *Retry) RemoveRepo(name string) (err error) {
+	err = retry.do(context.Background(), "remove repo", name, func() error {
+		return retry.Cloud.RemoveRepo(name)
+	})
+	return
+}
+
+func (retry *Retry) GetRepos() (repos []*Repo, size int64, err error) {
+	err = retry.do(context.Background(), "get repos", "", func() (e error) {
+		repos, size, e = retry.Cloud.GetRepos()
+		return
+	})
+	return
+}
+
+func (retry *Retry) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	err = retry.do(context.Background(), "upload object", filePath, func() (e error) {
+		length, e = retry.Cloud.UploadObject(filePath, overwrite)
+		return
+	})
+	return
+}
+
+func (retry *Retry) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	err = retry.do(context.Background(), "upload bytes", filePath, func() (e error) {
+		length, e = retry.Cloud.UploadBytes(filePath, data, overwrite)
+		return
+	})
+	return
+}
+
+func (retry *Retry) DownloadObject(filePath string) (data []byte, err error) {
+	err = retry.do(context.Background(), "download object", filePath, func() (e error) {
+		data, e = retry.Cloud.DownloadObject(filePath)
+		return
+	})
+	return
+}
+
+func (retry *Retry) RemoveObject(filePath string) (err error) {
+	err = retry.do(context.Background(), "remove object", filePath, func() error {
+		return retry.Cloud.RemoveObject(filePath)
+	})
+	return
+}
+
+func (retry *Retry) GetTags() (tags []*Ref, err error) {
+	err = retry.do(context.Background(), "get tags", "", func() (e error) {
+		tags, e = retry.Cloud.GetTags()
+		return
+	})
+	return
+}
+
+func (retry *Retry) GetIndexes(page int) (indexes []*entity.Index, pageCount, totalCount int, err error) {
+	err = retry.do(context.Background(), "get indexes", strconv.Itoa(page), func() (e error) {
+		indexes, pageCount, totalCount, e = retry.Cloud.GetIndexes(page)
+		return
+	})
+	return
+}
+
+func (retry *Retry) GetRefsFiles() (fileIDs []string, refs []*Ref, err error) {
+	err = retry.do(context.Background(), "get refs files", "", func() (e error) {
+		fileIDs, refs, e = retry.Cloud.GetRefsFiles()
+		return
+	})
+	return
+}
+
+func (retry *Retry) GetChunks(checkChunkIDs []string) (chunkIDs []string, err error) {
+	err = retry.do(context.Background(), "get chunks", strconv.Itoa(len(checkChunkIDs)), func() (e error) {
+		chunkIDs, e = retry.Cloud.GetChunks(checkChunkIDs)
+		return
+	})
+	return
+}
+
+func (retry *Retry) GetStat() (stat *Stat, err error) {
+	err = retry.do(context.Background(), "get stat", "", func() (e error) {
+		stat, e = retry.Cloud.GetStat()
+		return
+	})
+	return
+}
+
+func (retry *Retry) ListObjects(pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
+	err = retry.do(context.Background(), "list objects", pathPrefix, func() (e error) {
+		objInfos, e = retry.Cloud.ListObjects(pathPrefix)
+		return
+	})
+	return
+}
+
+func (retry *Retry) GetIndex(id string) (index *entity.Index, err error) {
+	err = retry.do(context.Background(), "get index", id, func() (e error) {
+		index, e = retry.Cloud.GetIndex(id)
+		return
+	})
+	return
+}
+
+// Put 只有在 reader 可以回退重读时才会重试。
+func (retry *Retry) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	seeker, seekable := reader.(io.Seeker)
+	if !seekable {
+		err = retry.Cloud.Put(ctx, key, reader, size)
+		return
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if nil != err {
+		return
+	}
+	attempt := 0
+	err = retry.do(ctx, "put object", key, func() error {
+		if attempt++; 1 < attempt {
+			if _, seekErr := seeker.Seek(start, io.SeekStart); nil != seekErr {
+				return seekErr
+			}
+		}
+		return retry.Cloud.Put(ctx, key, reader, size)
+	})
+	return
+}
+
+// Get 只重试打开数据流的请求，读取数据流时的错误由调用方处理。
+func (retry *Retry) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	err = retry.do(ctx, "get object", key, func() (e error) {
+		reader, e = retry.Cloud.Get(ctx, key)
+		return
+	})
+	return
+}
+
+func (retry *Retry) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	err = retry.do(ctx, "stat object", key, func() (e error) {
+		info, e = retry.Cloud.Stat(ctx, key)
+		return
+	})
+	return
+}
+
+func (retry *Retry) Delete(ctx context.Context, key string) (err error) {
+	err = retry.do(ctx, "delete object", key, func() error {
+		return retry.Cloud.Delete(ctx, key)
+	})
+	return
+}
+
+func (retry *Retry) List(ctx context.Context, pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
+	err = retry.do(ctx, "list objects", pathPrefix, func() (e error) {
+		objInfos, e = retry.Cloud.List(ctx, pathPrefix)
+		return
+	})
+	return
+}
+
+func (retry *Retry) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	err = retry.do(ctx, "get object with etag", key, func() (e error) {
+		data, etag, e = retry.Cloud.GetWithETag(ctx, key)
+		return
+	})
+	return
+}
@@ -0,0 +1,297 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestClassifyError(t *testing.T) {
+	s3Err := func(status int, header http.Header) error {
+		return &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status, Header: header}}, Err: errors.New("api error")}
+	}
+
+	cases := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{ErrCloudAuthFailed, ErrorClassAuth},
+		{ErrCloudForbidden, ErrorClassAuth},
+		{fmt.Errorf("download failed: %w", ErrCloudObjectNotFound), ErrorClassNotFound},
+		{ErrCloudQuotaExceeded, ErrorClassQuota},
+		{ErrCloudServiceUnavailable, ErrorClassTransient},
+		{ErrCloudTooManyRequests, ErrorClassTransient},
+		{ErrCloudPreconditionFailed, ErrorClassPermanent},
+		{context.Canceled, ErrorClassPermanent},
+		{context.DeadlineExceeded, ErrorClassTransient},
+		{syscall.ECONNRESET, ErrorClassTransient},
+		{io.ErrUnexpectedEOF, ErrorClassTransient},
+		{errors.New("read tcp 10.0.0.1:443: connection reset by peer"), ErrorClassTransient},
+		{errors.New("invalid argument"), ErrorClassPermanent},
+		{s3Err(503, nil), ErrorClassTransient},
+		{s3Err(429, nil), ErrorClassTransient},
+		{s3Err(403, nil), ErrorClassAuth},
+		{s3Err(404, nil), ErrorClassNotFound},
+		{s3Err(507, nil), ErrorClassQuota},
+		{s3Err(400, nil), ErrorClassPermanent},
+		{s3Err(501, nil), ErrorClassPermanent},
+		{&RetryAfterError{Err: errors.New("download failed [429]"), After: time.Second}, ErrorClassTransient},
+	}
+	for i, c := range cases {
+		if class := ClassifyError(c.err); c.class != class {
+			t.Fatalf("case [%d] error [%s] classified as [%s], expected [%s]", i, c.err, class, c.class)
+		}
+	}
+
+	after, ok := retryAfter(s3Err(503, http.Header{"Retry-After": []string{"7"}}))
+	if !ok || 7*time.Second != after {
+		t.Fatalf("unexpected retry after [%s, %v]", after, ok)
+	}
+}
+
+func TestClassifyBackendErrors(t *testing.T) {
+	var status atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if http.StatusTooManyRequests == status.Load() {
+			writer.Header().Set("Retry-After", "3")
+		}
+		writer.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	siyuan := NewSiYuan(&BaseCloud{Conf: &Conf{Dir: "main", UserID: "0", Endpoint: server.URL + "/", Server: server.URL}})
+	webdav := NewWebDAV(&BaseCloud{Conf: &Conf{Dir: "main", WebDAV: &ConfWebDAV{Endpoint: server.URL}}}, gowebdav.NewClient(server.URL, "", ""))
+	webdav.SetTransport(http.DefaultTransport)
+	rest := NewREST(&BaseCloud{Conf: &Conf{Dir: "main", REST: &ConfREST{Endpoint: server.URL}}}, nil)
+	ctx := context.Background()
+	backends := map[string]func() error{
+		"siyuan stat":   func() error { _, err := siyuan.Stat(ctx, "objects/ab/1"); return err },
+		"siyuan get":    func() error { _, err := siyuan.Get(ctx, "objects/ab/1"); return err },
+		"siyuan list":   func() error { _, err := siyuan.List(ctx, "objects/"); return err },
+		"siyuan delete": func() error { return siyuan.Delete(ctx, "objects/ab/1") },
+		"webdav stat":   func() error { _, err := webdav.Stat(ctx, "objects/ab/1"); return err },
+		"webdav get":    func() error { _, err := webdav.Get(ctx, "objects/ab/1"); return err },
+		"rest stat":     func() error { _, err := rest.Stat(ctx, "objects/ab/1"); return err },
+	}
+
+	cases := []struct {
+		status int
+		class  ErrorClass
+	}{
+		{http.StatusTooManyRequests, ErrorClassTransient},
+		{http.StatusInternalServerError, ErrorClassTransient},
+		{http.StatusBadGateway, ErrorClassTransient},
+		{http.StatusServiceUnavailable, ErrorClassTransient},
+		{http.StatusGatewayTimeout, ErrorClassTransient},
+		{http.StatusBadRequest, ErrorClassPermanent},
+	}
+	for _, c := range cases {
+		status.Store(int32(c.status))
+		for name, call := range backends {
+			if strings.HasPrefix(name, "rest") && http.StatusInternalServerError == c.status {
+				continue // REST 服务端的内部错误不重试
+			}
+
+			err := call()
+			if class := ClassifyError(err); c.class != class {
+				t.Fatalf("[%s] status [%d] error [%v] classified as [%s], expected [%s]", name, c.status, err, class, c.class)
+			}
+			if http.StatusTooManyRequests != c.status {
+				continue
+			}
+			if after, ok := retryAfter(err); !ok || 3*time.Second != after {
+				t.Fatalf("[%s] retry after not kept [%s, %v]: %v", name, after, ok, err)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		err   error
+		class ErrorClass
+	}{
+		{webdav.parseErr(&fs.PathError{Op: "Stat", Path: "main/siyuan/repo/objects/ab/1", Err: gowebdav.StatusError{Status: 503}}), ErrorClassTransient},
+		{webdav.parseErr(&fs.PathError{Op: "Stat", Path: "main/siyuan/repo/objects/ab/1", Err: gowebdav.StatusError{Status: 507}}), ErrorClassQuota},
+		{webdav.parseErr(&fs.PathError{Op: "Stat", Path: "main/siyuan/repo/objects/ab/1", Err: gowebdav.StatusError{Status: 404}}), ErrorClassNotFound},
+	} {
+		if class := ClassifyError(c.err); c.class != class {
+			t.Fatalf("error [%v] classified as [%s], expected [%s]", c.err, class, c.class)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 8, 0, 0, 0, time.UTC)
+	if after, ok := parseRetryAfter("120", now); !ok || 2*time.Minute != after {
+		t.Fatalf("unexpected seconds retry after [%s, %v]", after, ok)
+	}
+	if after, ok := parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now); !ok || 30*time.Second != after {
+		t.Fatalf("unexpected date retry after [%s, %v]", after, ok)
+	}
+	if after, ok := parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now); !ok || 0 != after {
+		t.Fatalf("past date should retry immediately, got [%s, %v]", after, ok)
+	}
+	for _, value := range []string{"", "-1", "soon"} {
+		if _, ok := parseRetryAfter(value, now); ok {
+			t.Fatalf("invalid retry after [%s] accepted", value)
+		}
+	}
+}
+
+// flakyLocal 在前 failures 次下载和上传时返回 errs 中的错误。
+type flakyLocal struct {
+	*Local
+	errs     []error
+	failures int
+	puts     int
+}
+
+func (local *flakyLocal) nextErr() error {
+	if local.failures >= len(local.errs) {
+		return nil
+	}
+	err := local.errs[local.failures]
+	local.failures++
+	return err
+}
+
+func (local *flakyLocal) DownloadObject(filePath string) (data []byte, err error) {
+	if err = local.nextErr(); nil != err {
+		return
+	}
+	return local.Local.DownloadObject(filePath)
+}
+
+func (local *flakyLocal) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	local.puts++
+	if err = local.nextErr(); nil != err {
+		io.CopyN(io.Discard, reader, 1) // 模拟上传了一部分数据后失败
+		return
+	}
+	return local.Local.Put(ctx, key, reader, size)
+}
+
+func newFlakyRetry(t *testing.T, conf *ConfRetry, errs ...error) (retry *Retry, flaky *flakyLocal, delays *[]time.Duration) {
+	tempDir := t.TempDir()
+	flaky = &flakyLocal{Local: NewLocal(&BaseCloud{Conf: &Conf{
+		Dir:      "main",
+		RepoPath: filepath.Join(tempDir, "repo"),
+		Local:    &ConfLocal{Endpoint: filepath.Join(tempDir, "cloud")},
+	}}), errs: errs}
+	retry = NewRetry(flaky, conf)
+	delays = &[]time.Duration{}
+	retry.sleep = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return ctx.Err()
+	}
+	return
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	retry, flaky, delays := newFlakyRetry(t, &ConfRetry{BaseDelay: 100 * time.Millisecond, MaxDelay: 150 * time.Millisecond},
+		ErrCloudServiceUnavailable, syscall.ECONNRESET, &RetryAfterError{Err: ErrCloudTooManyRequests, After: 3 * time.Second})
+	if _, err := flaky.Local.UploadBytes("objects/test", []byte("data"), true); nil != err {
+		t.Fatal(err)
+	}
+
+	data, err := retry.DownloadObject("objects/test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "data" != string(data) {
+		t.Fatalf("unexpected data [%s]", data)
+	}
+	if 3 != retry.RetryCount() || 3 != len(*delays) {
+		t.Fatalf("unexpected retries [%d], delays %v", retry.RetryCount(), *delays)
+	}
+	if d := (*delays)[0]; 50*time.Millisecond > d || 100*time.Millisecond < d {
+		t.Fatalf("unexpected first backoff [%s]", d)
+	}
+	if d := (*delays)[1]; 75*time.Millisecond > d || 150*time.Millisecond < d {
+		t.Fatalf("backoff should be capped to max delay, got [%s]", d)
+	}
+	if d := (*delays)[2]; 3*time.Second != d {
+		t.Fatalf("retry after should be honoured, got [%s]", d)
+	}
+}
+
+func TestRetryStops(t *testing.T) {
+	retry, _, delays := newFlakyRetry(t, nil, ErrCloudObjectNotFound)
+	if _, err := retry.DownloadObject("objects/test"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("unexpected error [%v]", err)
+	}
+	if 0 != len(*delays) {
+		t.Fatalf("not found error should not be retried, delays %v", *delays)
+	}
+
+	retry, _, delays = newFlakyRetry(t, &ConfRetry{MaxAttempts: 2}, ErrCloudServiceUnavailable, ErrCloudServiceUnavailable, ErrCloudServiceUnavailable)
+	if _, err := retry.DownloadObject("objects/test"); !errors.Is(err, ErrCloudServiceUnavailable) {
+		t.Fatalf("unexpected error [%v]", err)
+	}
+	if 1 != len(*delays) {
+		t.Fatalf("expected one retry, delays %v", *delays)
+	}
+
+	retry, _, delays = newFlakyRetry(t, &ConfRetry{MaxRetryAfter: time.Minute}, &RetryAfterError{Err: ErrCloudTooManyRequests, After: time.Hour})
+	if _, err := retry.DownloadObject("objects/test"); !errors.Is(err, ErrCloudTooManyRequests) {
+		t.Fatalf("unexpected error [%v]", err)
+	}
+	if 0 != len(*delays) {
+		t.Fatalf("too long retry after should not be waited, delays %v", *delays)
+	}
+}
+
+func TestRetryPutRewindsReader(t *testing.T) {
+	retry, flaky, _ := newFlakyRetry(t, nil, ErrCloudServiceUnavailable)
+	if err := retry.Put(context.Background(), "objects/test", bytes.NewReader([]byte("data")), 4); nil != err {
+		t.Fatal(err)
+	}
+	data, err := flaky.Local.DownloadObject("objects/test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "data" != string(data) || 2 != flaky.puts {
+		t.Fatalf("unexpected data [%s] after [%d] puts", data, flaky.puts)
+	}
+
+	retry, flaky, _ = newFlakyRetry(t, nil, ErrCloudServiceUnavailable)
+	if err = retry.Put(context.Background(), "objects/test", io.LimitReader(bytes.NewReader([]byte("data")), 4), 4); !errors.Is(err, ErrCloudServiceUnavailable) {
+		t.Fatalf("unexpected error [%v]", err)
+	}
+	if 1 != flaky.puts {
+		t.Fatalf("non-seekable reader should not be retried, got [%d] puts", flaky.puts)
+	}
+
+	if _, ok := Unwrap(retry).(*flakyLocal); !ok {
+		t.Fatal("unwrap should return the decorated cloud")
+	}
+}
@@ -24,9 +24,7 @@ import (
 	"io"
 	"math"
 	"net/http"
-	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -53,10 +51,20 @@ type S3 struct {
 	HTTPClient *http.Client
 	service    *as3.Client // 用于缓存 S3 客户端
 	mux        sync.Mutex  // 用于保护 service 字段的并发访问
+	partRetry  *Retry      // 用于分片上传时重试单个分片
 }
 
+// NewS3 创建 S3 存储服务，配置了 ConfS3.TLS 或者 Conf.Proxy 时会复制 httpClient 并替换其 HTTP 传输。
 func NewS3(baseCloud *BaseCloud, httpClient *http.Client) *S3 {
-	return &S3{BaseCloud: baseCloud, HTTPClient: httpClient}
+	if conf := baseCloud.Conf.S3; nil != conf && (!conf.TLS.isEmpty() || !baseCloud.Conf.Proxy.isEmpty()) {
+		client := &http.Client{}
+		if nil != httpClient {
+			*client = *httpClient
+		}
+		client.Transport = newHTTPTransport(client.Transport, conf.TLS, conf.SkipTlsVerify, baseCloud.Conf.Proxy)
+		httpClient = client
+	}
+	return &S3{BaseCloud: baseCloud, HTTPClient: httpClient, partRetry: NewRetry(nil, nil)}
 }
 
 func (s3 *S3) GetRepos() (repos []*Repo, size int64, err error) {
@@ -72,69 +80,143 @@ func (s3 *S3) GetRepos() (repos []*Repo, size int64, err error) {
 }
 
 func (s3 *S3) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	length, err = putFile(context.Background(), s3.Put, s3.Conf.RepoPath, filePath)
+	return
+}
+
+func (s3 *S3) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	if err = s3.Put(context.Background(), filePath, bytes.NewReader(data), int64(len(data))); nil != err {
+		return
+	}
+	length = int64(len(data))
+	return
+}
+
+func (s3 *S3) DownloadObject(filePath string) (data []byte, err error) {
+	data, err = getBytes(context.Background(), s3.Get, filePath)
+	return
+}
+
+func (s3 *S3) RemoveObject(key string) (err error) {
+	err = s3.Delete(context.Background(), key)
+	return
+}
+
+func (s3 *S3) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	opts := s3.writeOptions(key)
+	key = path.Join("repo", key)
+	// 需要锁定的标签引用很小，不使用分片上传，避免为每个分片计算校验和
+	if s3.useMultipart(size) && nil == opts.retainUntil {
+		err = s3.putMultipart(ctx, key, reader, size, opts)
+		return
+	}
+
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
 	defer cancelFn()
 
-	absFilePath := filepath.Join(s3.Conf.RepoPath, filePath)
-	info, err := os.Stat(absFilePath)
+	input := &as3.PutObjectInput{
+		Bucket:        aws.String(s3.Conf.S3.Bucket),
+		Key:           aws.String(key),
+		CacheControl:  aws.String("no-cache"),
+		Body:          reader,
+		ContentLength: aws.Int64(size),
+	}
+	opts.applyPutObject(input)
+	s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	_, err = svc.PutObject(ctx, input)
 	if nil != err {
-		logging.LogErrorf("stat failed: %s", err)
 		return
 	}
-	length = info.Size()
 
-	file, err := os.Open(absFilePath)
+	//logging.LogInfof("uploaded object [%s]", key)
+	return
+}
+
+func (s3 *S3) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+	key = path.Join("repo", key)
+	input := &as3.GetObjectInput{
+		Bucket:               aws.String(s3.Conf.S3.Bucket),
+		Key:                  aws.String(key),
+		ResponseCacheControl: aws.String("no-cache"),
+	}
+	s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	resp, err := svc.GetObject(ctx, input)
 	if nil != err {
+		cancelFn()
+		if s3.isErrNotFound(err) {
+			err = ErrCloudObjectNotFound
+		}
 		return
 	}
-	defer file.Close()
-	key := path.Join("repo", filePath)
-	_, err = svc.PutObject(ctx, &as3.PutObjectInput{
-		Bucket:       aws.String(s3.Conf.S3.Bucket),
-		Key:          aws.String(key),
-		CacheControl: aws.String("no-cache"),
-		Body:         file,
-	})
+	reader = newCtxReadCloser(ctx, resp.Body, cancelFn)
+
+	//logging.LogInfof("downloaded object [%s]", key)
+	return
+}
+
+func (s3 *S3) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+	defer cancelFn()
+
+	input := &as3.HeadObjectInput{
+		Bucket: aws.String(s3.Conf.S3.Bucket),
+		Key:    aws.String(path.Join("repo", key)),
+	}
+	s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	header, err := svc.HeadObject(ctx, input)
 	if nil != err {
+		if s3.isErrNotFound(err) {
+			err = ErrCloudObjectNotFound
+		}
 		return
 	}
 
-	//logging.LogInfof("uploaded object [%s]", key)
+	info = &entity.ObjectInfo{Path: key}
+	if nil != header.ContentLength {
+		info.Size = *header.ContentLength
+	}
+	if nil != header.LastModified {
+		info.Updated = *header.LastModified
+	}
 	return
 }
 
-func (s3 *S3) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
-	length = int64(len(data))
+// Delete 删除对象 key，对象处于锁定保留期时返回 ErrCloudObjectLocked。
+//
+// 启用版本控制的存储空间删除锁定的对象时只会写入删除标记，锁定的版本仍然保留，可以通过 ListObjectVersions 找回。
+func (s3 *S3) Delete(ctx context.Context, key string) (err error) {
+	objKey := path.Join("repo", key)
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
 	defer cancelFn()
-
-	key := path.Join("repo", filePath)
-	_, err = svc.PutObject(ctx, &as3.PutObjectInput{
-		Bucket:       aws.String(s3.Conf.S3.Bucket),
-		Key:          aws.String(key),
-		CacheControl: aws.String("no-cache"),
-		Body:         bytes.NewReader(data),
+	_, err = svc.DeleteObject(ctx, &as3.DeleteObjectInput{
+		Bucket: aws.String(s3.Conf.S3.Bucket),
+		Key:    aws.String(objKey),
 	})
 	if nil != err {
+		err = s3.parseDeleteErr(key, err)
 		return
 	}
 
-	//logging.LogInfof("uploaded object [%s]", key)
+	//logging.LogInfof("removed object [%s]", key)
 	return
 }
 
-func (s3 *S3) DownloadObject(filePath string) (data []byte, err error) {
+func (s3 *S3) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
 	defer cancelFn()
-	key := path.Join("repo", filePath)
+
 	input := &as3.GetObjectInput{
 		Bucket:               aws.String(s3.Conf.S3.Bucket),
-		Key:                  aws.String(key),
+		Key:                  aws.String(path.Join("repo", key)),
 		ResponseCacheControl: aws.String("no-cache"),
 	}
+	s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
 	resp, err := svc.GetObject(ctx, input)
 	if nil != err {
 		if s3.isErrNotFound(err) {
@@ -143,32 +225,64 @@ func (s3 *S3) DownloadObject(filePath string) (data []byte, err error) {
 		return
 	}
 	defer resp.Body.Close()
-	data, err = io.ReadAll(resp.Body)
-	if nil != err {
+
+	if data, err = io.ReadAll(resp.Body); nil != err {
 		return
 	}
-
-	//logging.LogInfof("downloaded object [%s]", key)
+	etag = aws.ToString(resp.ETag)
 	return
 }
 
-func (s3 *S3) RemoveObject(key string) (err error) {
-	key = path.Join("repo", key)
+func (s3 *S3) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error) {
 	svc := s3.getService()
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
 	defer cancelFn()
-	_, err = svc.DeleteObject(ctx, &as3.DeleteObjectInput{
-		Bucket: aws.String(s3.Conf.S3.Bucket),
-		Key:    aws.String(key),
-	})
+
+	input := &as3.PutObjectInput{
+		Bucket:        aws.String(s3.Conf.S3.Bucket),
+		Key:           aws.String(path.Join("repo", key)),
+		CacheControl:  aws.String("no-cache"),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	}
+	s3.writeOptions(key).applyPutObject(input)
+	s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	if "" == etag {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+	_, err = svc.PutObject(ctx, input)
 	if nil != err {
-		return
+		err = s3.parseConditionalErr(err)
 	}
-
-	//logging.LogInfof("removed object [%s]", key)
 	return
 }
 
+// parseConditionalErr 转换条件写入的错误，部分兼容 S3 的存储服务不支持条件写入，此时返回 ErrUnsupported。
+func (s3 *S3) parseConditionalErr(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrCloudPreconditionFailed
+		case "NotImplemented":
+			return ErrUnsupported
+		}
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return ErrCloudPreconditionFailed
+		case http.StatusNotImplemented:
+			return ErrUnsupported
+		}
+	}
+	return err
+}
+
 func (s3 *S3) GetTags() (tags []*Ref, err error) {
 	tags, err = s3.listRepoRefs("tags")
 	if nil != err {
@@ -296,6 +410,15 @@ func (s3 *S3) GetIndex(id string) (index *entity.Index, err error) {
 	return
 }
 
+func (s3 *S3) GetCapabilities() *Capabilities {
+	// S3 没有重命名请求，单次上传的对象不超过 5GB，分片上传的对象不超过 5TB
+	ret := &Capabilities{ConditionalWrite: true, ConsistentListing: true, MaxObjectSize: 5 * 1024 * 1024 * 1024 * 1024}
+	if 0 > s3.S3.MultipartThreshold {
+		ret.MaxObjectSize = 5 * 1024 * 1024 * 1024
+	}
+	return ret
+}
+
 func (s3 *S3) GetConcurrentReqs() (ret int) {
 	ret = s3.S3.ConcurrentReqs
 	if 1 > ret {
@@ -308,6 +431,11 @@ func (s3 *S3) GetConcurrentReqs() (ret int) {
 }
 
 func (s3 *S3) ListObjects(pathPrefix string) (ret map[string]*entity.ObjectInfo, err error) {
+	ret, err = s3.List(context.Background(), pathPrefix)
+	return
+}
+
+func (s3 *S3) List(ctx context.Context, pathPrefix string) (ret map[string]*entity.ObjectInfo, err error) {
 	ret = map[string]*entity.ObjectInfo{}
 	svc := s3.getService()
 
@@ -317,7 +445,7 @@ func (s3 *S3) ListObjects(pathPrefix string) (ret map[string]*entity.ObjectInfo,
 		pathPrefix += "/"
 	}
 	limit := int32(1000)
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	ctx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
 	defer cancelFn()
 
 	paginator := as3.NewListObjectsV2Paginator(svc, &as3.ListObjectsV2Input{
@@ -478,10 +606,12 @@ func (s3 *S3) statFile(key string) (info *objectInfo, err error) {
 	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
 	defer cancelFn()
 
-	header, err := svc.HeadObject(ctx, &as3.HeadObjectInput{
+	input := &as3.HeadObjectInput{
 		Bucket: &s3.Conf.S3.Bucket,
 		Key:    &key,
-	})
+	}
+	s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	header, err := svc.HeadObject(ctx, input)
 	if nil != err {
 		return
 	}
@@ -556,7 +686,7 @@ func (s3 *S3) getService() *as3.Client {
 		o.BaseEndpoint = aws.String(s3.Conf.S3.Endpoint)
 		o.Region = s3.Conf.S3.Region
 		o.UsePathStyle = s3.Conf.S3.PathStyle
-		o.HTTPClient = s3.HTTPClient
+		o.HTTPClient = &throttledHTTPClient{client: s3.HTTPClient, limiter: s3.GetBandwidthLimiter()}
 		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
 		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
 
@@ -612,6 +742,10 @@ func (s3 *S3) isErrNotFound(err error) bool {
 
 	var apiErr smithy.APIError
 	if errors.As(err, &apiErr) {
+		if "NoSuchKey" == apiErr.ErrorCode() {
+			return true
+		}
+
 		msg := strings.ToLower(apiErr.ErrorMessage())
 		return containsStr(msg, notFoundMsgs)
 	}
@@ -0,0 +1,293 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	as3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	as3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/logging"
+)
+
+const (
+	s3DefaultMultipartThreshold   = 64 * 1024 * 1024
+	s3DefaultMultipartPartSize    = 8 * 1024 * 1024
+	s3MinMultipartPartSize        = 5 * 1024 * 1024 // S3 要求除最后一个分片外每个分片不小于 5MB
+	s3MaxMultipartParts           = 10000           // S3 要求单个对象最多 10000 个分片
+	s3DefaultMultipartConcurrency = 4
+)
+
+// s3Part 描述了分片上传中的一个分片。
+type s3Part struct {
+	number int32
+	data   []byte
+}
+
+// useMultipart 用于判断大小为 size 的对象是否使用分片上传。
+func (s3 *S3) useMultipart(size int64) bool {
+	threshold := s3.S3.MultipartThreshold
+	if 0 > threshold {
+		return false
+	}
+	if 0 == threshold {
+		threshold = s3DefaultMultipartThreshold
+	}
+	return threshold <= size
+}
+
+// multipartPartSize 返回大小为 size 的对象分片上传时的分片大小，分片数超过上限时增大分片。
+func (s3 *S3) multipartPartSize(size int64) (ret int64) {
+	ret = s3.S3.MultipartPartSize
+	if 1 > ret {
+		ret = s3DefaultMultipartPartSize
+	}
+	if s3MinMultipartPartSize > ret {
+		ret = s3MinMultipartPartSize
+	}
+	if minSize := (size + s3MaxMultipartParts - 1) / s3MaxMultipartParts; minSize > ret {
+		ret = minSize
+	}
+	return
+}
+
+func (s3 *S3) multipartConcurrency() (ret int) {
+	ret = s3.S3.MultipartConcurrency
+	if 1 > ret {
+		ret = s3DefaultMultipartConcurrency
+	}
+	if 32 < ret {
+		ret = 32
+	}
+	return
+}
+
+func (s3 *S3) getPartRetry() *Retry {
+	if nil == s3.partRetry {
+		return NewRetry(nil, nil)
+	}
+	return s3.partRetry
+}
+
+// putMultipart 用于分片上传对象 key。
+//
+// 超时时间 ConfS3.Timeout 作用于每个分片请求，因此大文件在慢速网络下不会因为整体超时而从头重传；
+// 分片并发上传，失败的分片单独重试。上传失败时中止分片上传，避免已上传的分片残留占用存储空间。
+func (s3 *S3) putMultipart(ctx context.Context, key string, reader io.Reader, size int64, opts *s3WriteOptions) (err error) {
+	svc := s3.getService()
+	createCtx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+	input := &as3.CreateMultipartUploadInput{
+		Bucket:       aws.String(s3.Conf.S3.Bucket),
+		Key:          aws.String(key),
+		CacheControl: aws.String("no-cache"),
+	}
+	opts.applyCreateMultipartUpload(input)
+	s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	created, err := svc.CreateMultipartUpload(createCtx, input)
+	cancelFn()
+	if nil != err {
+		return
+	}
+	uploadID := created.UploadId
+
+	parts, err := s3.uploadParts(ctx, svc, key, uploadID, reader, size)
+	if nil == err {
+		completeCtx, completeCancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+		completeInput := &as3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s3.Conf.S3.Bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			MultipartUpload: &as3Types.CompletedMultipartUpload{Parts: parts},
+		}
+		s3.setSSECustomer(&completeInput.SSECustomerAlgorithm, &completeInput.SSECustomerKey, &completeInput.SSECustomerKeyMD5)
+		_, err = svc.CompleteMultipartUpload(completeCtx, completeInput)
+		completeCancelFn()
+		if nil == err {
+			return
+		}
+	}
+
+	// 上传可能因为 ctx 取消而失败，所以使用新的上下文中止
+	abortCtx, abortCancelFn := context.WithTimeout(context.Background(), time.Duration(s3.S3.Timeout)*time.Second)
+	defer abortCancelFn()
+	if _, abortErr := svc.AbortMultipartUpload(abortCtx, &as3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s3.Conf.S3.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	}); nil != abortErr {
+		logging.LogWarnf("abort multipart upload [%s] failed: %s", key, abortErr)
+	}
+	return
+}
+
+// uploadParts 用于从 reader 顺序读取分片并发上传，返回按分片号排序的已上传分片。
+//
+// 同时驻留内存的分片数不超过并发数加一。
+func (s3 *S3) uploadParts(ctx context.Context, svc *as3.Client, key string, uploadID *string, reader io.Reader, size int64) (parts []as3Types.CompletedPart, err error) {
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+
+	lock := sync.Mutex{}
+	setErr := func(e error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if nil == err {
+			err = e
+			cancelFn()
+		}
+	}
+
+	waitGroup := &sync.WaitGroup{}
+	p, _ := ants.NewPoolWithFunc(s3.multipartConcurrency(), func(arg interface{}) {
+		defer waitGroup.Done()
+		part := arg.(*s3Part)
+		etag, uploadErr := s3.uploadPart(ctx, svc, key, uploadID, part)
+		if nil != uploadErr {
+			setErr(uploadErr)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		parts = append(parts, as3Types.CompletedPart{ETag: etag, PartNumber: aws.Int32(part.number)})
+	})
+	defer p.Release()
+
+	partSize := s3.multipartPartSize(size)
+	for number, offset := int32(1), int64(0); offset < size && nil == ctx.Err(); number++ {
+		data := make([]byte, min(partSize, size-offset))
+		if _, readErr := io.ReadFull(reader, data); nil != readErr {
+			setErr(readErr)
+			break
+		}
+		offset += int64(len(data))
+
+		waitGroup.Add(1)
+		if invokeErr := p.Invoke(&s3Part{number: number, data: data}); nil != invokeErr {
+			waitGroup.Done()
+			logging.LogErrorf("invoke failed: %s", invokeErr)
+			setErr(invokeErr)
+			break
+		}
+	}
+	waitGroup.Wait()
+	if nil == err {
+		err = ctx.Err()
+	}
+	if nil != err {
+		return
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	return
+}
+
+// uploadPart 用于上传分片 part，遇到临时错误时重试该分片。
+func (s3 *S3) uploadPart(ctx context.Context, svc *as3.Client, key string, uploadID *string, part *s3Part) (etag *string, err error) {
+	err = s3.getPartRetry().do(ctx, "upload part", fmt.Sprintf("%s#%d", key, part.number), func() (err error) {
+		partCtx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+		defer cancelFn()
+		input := &as3.UploadPartInput{
+			Bucket:        aws.String(s3.Conf.S3.Bucket),
+			Key:           aws.String(key),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(part.number),
+			Body:          bytes.NewReader(part.data),
+			ContentLength: aws.Int64(int64(len(part.data))),
+		}
+		s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+		output, err := svc.UploadPart(partCtx, input, func(o *as3.Options) {
+			// 由分片重试负责重试，避免和 SDK 的重试叠加
+			o.RetryMaxAttempts = 1
+		})
+		if nil != err {
+			return
+		}
+		etag = output.ETag
+		return
+	})
+	return
+}
+
+// AbortIncompleteUploads 用于中止仓库下在 olderThan 之前发起的未完成分片上传，返回中止的数量。
+//
+// 上传过程中退出等原因中断的分片上传不会出现在对象列表中，但是已上传的分片仍然占用存储空间，需要在清理时中止。
+func (s3 *S3) AbortIncompleteUploads(ctx context.Context, olderThan time.Duration) (count int, err error) {
+	svc := s3.getService()
+	before := time.Now().Add(-olderThan)
+	input := &as3.ListMultipartUploadsInput{
+		Bucket: aws.String(s3.Conf.S3.Bucket),
+		Prefix: aws.String("repo/"),
+	}
+	for {
+		listCtx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+		output, listErr := svc.ListMultipartUploads(listCtx, input)
+		cancelFn()
+		if nil != listErr {
+			err = listErr
+			return
+		}
+
+		for _, upload := range output.Uploads {
+			if nil == upload.Key || nil == upload.UploadId {
+				continue
+			}
+			if nil != upload.Initiated && upload.Initiated.After(before) {
+				continue
+			}
+
+			abortCtx, abortCancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+			_, abortErr := svc.AbortMultipartUpload(abortCtx, &as3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s3.Conf.S3.Bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			abortCancelFn()
+			if nil != abortErr && !isErrNoSuchUpload(abortErr) {
+				logging.LogWarnf("abort multipart upload [%s, %s] failed: %s", *upload.Key, *upload.UploadId, abortErr)
+				continue
+			}
+			count++
+		}
+
+		if nil == output.IsTruncated || !*output.IsTruncated || nil == output.NextKeyMarker {
+			return
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+}
+
+func isErrNoSuchUpload(err error) bool {
+	var nsu *as3Types.NoSuchUpload
+	if errors.As(err, &nsu) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && "NoSuchUpload" == apiErr.ErrorCode()
+}
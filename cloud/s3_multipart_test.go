@@ -0,0 +1,340 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Stub 描述了用于测试的 S3 兼容服务，只支持路径风格寻址和测试用到的接口。
+type s3Stub struct {
+	lock      sync.Mutex
+	objects   map[string][]byte
+	headers   map[string]http.Header // 对象 -> 上传时的请求头
+	versions  map[string][]*s3StubVersion
+	uploads   map[string]*s3StubUpload
+	failParts map[int]int // 分片号 -> 剩余的失败次数
+	puts      int
+	creates   int
+	nextID    int
+}
+
+type s3StubVersion struct {
+	id      string
+	data    []byte
+	updated time.Time
+}
+
+type s3StubUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+func newS3Stub() *s3Stub {
+	return &s3Stub{objects: map[string][]byte{}, headers: map[string]http.Header{}, versions: map[string][]*s3StubVersion{}, uploads: map[string]*s3StubUpload{}, failParts: map[int]int{}}
+}
+
+func (stub *s3Stub) writeErr(writer http.ResponseWriter, status int, code string) {
+	writer.Header().Set("Content-Type", "application/xml")
+	writer.WriteHeader(status)
+	fmt.Fprintf(writer, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (stub *s3Stub) writeXML(writer http.ResponseWriter, v interface{}) {
+	writer.Header().Set("Content-Type", "application/xml")
+	data, _ := xml.Marshal(v)
+	writer.Write(data)
+}
+
+func (stub *s3Stub) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+
+	key := strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, "/"), "bucket")
+	key = strings.TrimPrefix(key, "/")
+	query := request.URL.Query()
+	body, _ := io.ReadAll(request.Body)
+	switch {
+	case http.MethodGet == request.Method && query.Has("versions"):
+		type version struct {
+			Key          string
+			VersionId    string
+			IsLatest     bool
+			LastModified string
+			Size         int
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListVersionsResult"`
+			Name        string
+			IsTruncated bool
+			Version     []version
+		}{Name: "bucket"}
+		for objKey, versions := range stub.versions {
+			if !strings.HasPrefix(objKey, query.Get("prefix")) {
+				continue
+			}
+			for i, v := range versions {
+				result.Version = append(result.Version, version{Key: objKey, VersionId: v.id, IsLatest: i == len(versions)-1,
+					LastModified: v.updated.UTC().Format("2006-01-02T15:04:05.000Z"), Size: len(v.data)})
+			}
+		}
+		stub.writeXML(writer, result)
+	case http.MethodGet == request.Method && query.Has("versionId"):
+		for _, v := range stub.versions[key] {
+			if v.id == query.Get("versionId") {
+				writer.Write(v.data)
+				return
+			}
+		}
+		stub.writeErr(writer, http.StatusNotFound, "NoSuchVersion")
+	case http.MethodGet == request.Method && query.Has("uploads"):
+		type upload struct {
+			Key       string
+			UploadId  string
+			Initiated string
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket      string
+			IsTruncated bool
+			Upload      []upload
+		}{Bucket: "bucket"}
+		for id, u := range stub.uploads {
+			if strings.HasPrefix(u.key, query.Get("prefix")) {
+				result.Upload = append(result.Upload, upload{Key: u.key, UploadId: id, Initiated: u.initiated.UTC().Format("2006-01-02T15:04:05.000Z")})
+			}
+		}
+		stub.writeXML(writer, result)
+	case http.MethodPost == request.Method && query.Has("uploads"):
+		stub.creates++
+		stub.nextID++
+		id := "upload-" + strconv.Itoa(stub.nextID)
+		stub.uploads[id] = &s3StubUpload{key: key, initiated: time.Now(), parts: map[int][]byte{}}
+		stub.writeXML(writer, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: "bucket", Key: key, UploadId: id})
+	case http.MethodPut == request.Method && query.Has("uploadId"):
+		upload := stub.uploads[query.Get("uploadId")]
+		if nil == upload {
+			stub.writeErr(writer, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if 0 < stub.failParts[number] {
+			stub.failParts[number]--
+			stub.writeErr(writer, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		upload.parts[number] = body
+		writer.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", number))
+	case http.MethodPost == request.Method && query.Has("uploadId"):
+		upload := stub.uploads[query.Get("uploadId")]
+		if nil == upload {
+			stub.writeErr(writer, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		completed := struct {
+			Part []struct{ PartNumber int }
+		}{}
+		if err := xml.Unmarshal(body, &completed); nil != err {
+			stub.writeErr(writer, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for i, part := range completed.Part {
+			if i+1 != part.PartNumber || nil == upload.parts[part.PartNumber] {
+				stub.writeErr(writer, http.StatusBadRequest, "InvalidPartOrder")
+				return
+			}
+			data = append(data, upload.parts[part.PartNumber]...)
+		}
+		stub.objects[upload.key] = data
+		delete(stub.uploads, query.Get("uploadId"))
+		stub.writeXML(writer, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+			ETag    string
+		}{Key: upload.key, ETag: "\"etag\""})
+	case http.MethodDelete == request.Method && query.Has("uploadId"):
+		if nil == stub.uploads[query.Get("uploadId")] {
+			stub.writeErr(writer, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(stub.uploads, query.Get("uploadId"))
+		writer.WriteHeader(http.StatusNoContent)
+	case http.MethodPut == request.Method && query.Has("retention"):
+		if _, ok := stub.objects[key]; !ok {
+			stub.writeErr(writer, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		retention := struct {
+			Mode            string
+			RetainUntilDate string
+		}{}
+		if err := xml.Unmarshal(body, &retention); nil != err {
+			stub.writeErr(writer, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		header := stub.headers[key]
+		header.Set("X-Amz-Object-Lock-Mode", retention.Mode)
+		header.Set("X-Amz-Object-Lock-Retain-Until-Date", retention.RetainUntilDate)
+	case http.MethodPut == request.Method:
+		stub.puts++
+		stub.objects[key] = body
+		stub.headers[key] = request.Header.Clone()
+		stub.nextID++
+		stub.versions[key] = append(stub.versions[key], &s3StubVersion{id: "v" + strconv.Itoa(stub.nextID), data: body, updated: time.Now()})
+	case http.MethodDelete == request.Method:
+		if until, err := time.Parse(time.RFC3339, stub.headers[key].Get("X-Amz-Object-Lock-Retain-Until-Date")); nil == err && time.Now().Before(until) {
+			stub.writeErr(writer, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		delete(stub.objects, key)
+		writer.WriteHeader(http.StatusNoContent)
+	case http.MethodGet == request.Method || http.MethodHead == request.Method:
+		data, ok := stub.objects[key]
+		if !ok {
+			stub.writeErr(writer, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		header := stub.headers[key]
+		if md5 := header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"); md5 != request.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") {
+			stub.writeErr(writer, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		for _, name := range []string{"X-Amz-Object-Lock-Mode", "X-Amz-Object-Lock-Retain-Until-Date"} {
+			if value := header.Get(name); "" != value {
+				writer.Header().Set(name, value)
+			}
+		}
+		writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if http.MethodGet == request.Method {
+			writer.Write(data)
+		}
+	default:
+		stub.writeErr(writer, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func newS3StubCloud(t *testing.T, stub *s3Stub) *S3 {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	s3 := NewS3(&BaseCloud{Conf: &Conf{
+		Dir:      "test",
+		RepoPath: t.TempDir(),
+		S3: &ConfS3{
+			Endpoint:           server.URL,
+			AccessKey:          "access",
+			SecretKey:          "secret",
+			Region:             "us-east-1",
+			Bucket:             "bucket",
+			PathStyle:          true,
+			Timeout:            30,
+			MultipartThreshold: 6 * 1024 * 1024,
+			MultipartPartSize:  s3MinMultipartPartSize,
+		},
+	}}, server.Client())
+	s3.partRetry.sleep = func(context.Context, time.Duration) error { return nil }
+	return s3
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	stub := newS3Stub()
+	s3 := newS3StubCloud(t, stub)
+
+	if _, err := s3.UploadBytes("small", []byte("small"), true); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != stub.puts || 0 != stub.creates {
+		t.Fatalf("small object uploaded by [%d] puts and [%d] multipart uploads", stub.puts, stub.creates)
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*s3MinMultipartPartSize+1024*1024)/16)
+	stub.failParts[2] = 2
+	if _, err := s3.UploadBytes("objects/ab/large", data, true); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != stub.puts || 1 != stub.creates {
+		t.Fatalf("large object uploaded by [%d] puts and [%d] multipart uploads", stub.puts, stub.creates)
+	}
+	if 0 != stub.failParts[2] {
+		t.Fatalf("failed part retried [%d] times less than expected", stub.failParts[2])
+	}
+	if 0 != len(stub.uploads) {
+		t.Fatalf("got [%d] incomplete uploads", len(stub.uploads))
+	}
+	if got, err := s3.DownloadObject("objects/ab/large"); nil != err || !bytes.Equal(data, got) {
+		t.Fatalf("download large object got [%d] bytes, err [%v]", len(got), err)
+	}
+}
+
+func TestS3MultipartUploadAbort(t *testing.T) {
+	stub := newS3Stub()
+	s3 := newS3StubCloud(t, stub)
+
+	stub.failParts[1] = 100
+	data := make([]byte, 2*s3MinMultipartPartSize)
+	if _, err := s3.UploadBytes("objects/ab/large", data, true); nil == err {
+		t.Fatal("upload should fail")
+	}
+	if 1 != stub.creates || 0 != len(stub.uploads) {
+		t.Fatalf("got [%d] multipart uploads, [%d] not aborted", stub.creates, len(stub.uploads))
+	}
+	if _, ok := stub.objects["repo/objects/ab/large"]; ok {
+		t.Fatal("object should not exist")
+	}
+}
+
+func TestS3AbortIncompleteUploads(t *testing.T) {
+	stub := newS3Stub()
+	s3 := newS3StubCloud(t, stub)
+
+	now := time.Now()
+	stub.uploads["stale"] = &s3StubUpload{key: "repo/objects/ab/stale", initiated: now.Add(-2 * time.Hour)}
+	stub.uploads["recent"] = &s3StubUpload{key: "repo/objects/ab/recent", initiated: now}
+	stub.uploads["other"] = &s3StubUpload{key: "other/stale", initiated: now.Add(-2 * time.Hour)}
+
+	count, err := s3.AbortIncompleteUploads(context.Background(), time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var remains []string
+	for id := range stub.uploads {
+		remains = append(remains, id)
+	}
+	sort.Strings(remains)
+	if 1 != count || "other,recent" != strings.Join(remains, ",") {
+		t.Fatalf("aborted [%d] uploads, remains %v", count, remains)
+	}
+}
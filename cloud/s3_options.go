@@ -0,0 +1,189 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	as3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	as3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/logging"
+)
+
+const s3SSECustomer = "SSE-C"
+
+// s3WriteOptions 描述了写入对象时按对象路径应用的存储类型、服务端加密和对象锁定选项。
+type s3WriteOptions struct {
+	storageClass as3Types.StorageClass
+	sse          as3Types.ServerSideEncryption
+	kmsKeyID     *string
+	lockMode     as3Types.ObjectLockMode
+	retainUntil  *time.Time
+}
+
+// writeOptions 返回写入对象 key 时使用的选项，key 为不包含 repo/ 前缀的对象路径。
+func (s3 *S3) writeOptions(key string) (ret *s3WriteOptions) {
+	ret = &s3WriteOptions{}
+	kind, _, _ := strings.Cut(key, "/")
+	if storageClass := s3.S3.StorageClasses[kind]; "" != storageClass {
+		ret.storageClass = as3Types.StorageClass(storageClass)
+	} else if "" != s3.S3.StorageClass {
+		ret.storageClass = as3Types.StorageClass(s3.S3.StorageClass)
+	}
+
+	switch sse := s3.S3.SSE; sse {
+	case "", s3SSECustomer:
+	case string(as3Types.ServerSideEncryptionAwsKms), string(as3Types.ServerSideEncryptionAwsKmsDsse):
+		ret.sse = as3Types.ServerSideEncryption(sse)
+		if "" != s3.S3.SSEKMSKeyID {
+			ret.kmsKeyID = aws.String(s3.S3.SSEKMSKeyID)
+		}
+	default:
+		ret.sse = as3Types.ServerSideEncryption(sse)
+	}
+
+	// 上传时只锁定标签引用，标签引用的索引和对象在上传标签时通过 RetainObjects 锁定
+	if "" != s3.S3.ObjectLockMode && 0 < s3.S3.ObjectLockDays && strings.HasPrefix(key, "refs/tags/") {
+		ret.lockMode = as3Types.ObjectLockMode(strings.ToUpper(s3.S3.ObjectLockMode))
+		ret.retainUntil = aws.Time(time.Now().AddDate(0, 0, s3.S3.ObjectLockDays).UTC())
+	}
+	return
+}
+
+func (opts *s3WriteOptions) applyPutObject(input *as3.PutObjectInput) {
+	input.StorageClass = opts.storageClass
+	input.ServerSideEncryption = opts.sse
+	input.SSEKMSKeyId = opts.kmsKeyID
+	if nil != opts.retainUntil {
+		input.ObjectLockMode = opts.lockMode
+		input.ObjectLockRetainUntilDate = opts.retainUntil
+		// 设置对象锁定时 S3 要求请求携带校验和
+		input.ChecksumAlgorithm = as3Types.ChecksumAlgorithmCrc32
+	}
+}
+
+func (opts *s3WriteOptions) applyCreateMultipartUpload(input *as3.CreateMultipartUploadInput) {
+	input.StorageClass = opts.storageClass
+	input.ServerSideEncryption = opts.sse
+	input.SSEKMSKeyId = opts.kmsKeyID
+}
+
+// setSSECustomer 用于在请求中设置 SSE-C 密钥，读写 SSE-C 加密的对象时都需要提供密钥。
+func (s3 *S3) setSSECustomer(algorithm, key, keyMD5 **string) {
+	if s3SSECustomer != s3.S3.SSE {
+		return
+	}
+
+	customerKey := []byte(s3.S3.SSECustomerKey)
+	if decoded, err := base64.StdEncoding.DecodeString(s3.S3.SSECustomerKey); nil == err && 32 == len(decoded) {
+		customerKey = decoded
+	}
+	sum := md5.Sum(customerKey)
+	*algorithm = aws.String(string(as3Types.ServerSideEncryptionAes256))
+	*key = aws.String(base64.StdEncoding.EncodeToString(customerKey))
+	*keyMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// Retainer 描述了支持为对象设置锁定保留期的存储服务，比如启用了对象锁定的 S3 存储空间。
+type Retainer interface {
+	// RetainObjects 为对象 keys 设置锁定保留期，未配置对象锁定时不做任何处理。
+	RetainObjects(ctx context.Context, keys []string) (err error)
+}
+
+// RetainObjects 用于为对象 keys 设置对象锁定保留期，配置了 ConfS3.ObjectLockMode 和 ConfS3.ObjectLockDays 时上传标签后调用，
+// keys 为标签引用的索引、文件、分块和包文件，不存在的对象（比如已经聚合到包文件中的分块）会被跳过。
+//
+// 保留期从调用时开始计算，后上传的标签会延长共用对象的保留期。
+func (s3 *S3) RetainObjects(ctx context.Context, keys []string) (err error) {
+	if "" == s3.S3.ObjectLockMode || 1 > s3.S3.ObjectLockDays || 1 > len(keys) {
+		return
+	}
+
+	retention := &as3Types.ObjectLockRetention{
+		Mode:            as3Types.ObjectLockRetentionMode(strings.ToUpper(s3.S3.ObjectLockMode)),
+		RetainUntilDate: aws.Time(time.Now().AddDate(0, 0, s3.S3.ObjectLockDays).UTC()),
+	}
+	svc := s3.getService()
+	poolSize := s3.GetConcurrentReqs()
+	if poolSize > len(keys) {
+		poolSize = len(keys)
+	}
+
+	lock := sync.Mutex{}
+	waitGroup := &sync.WaitGroup{}
+	p, _ := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		key := arg.(string)
+		reqCtx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+		defer cancelFn()
+		_, retainErr := svc.PutObjectRetention(reqCtx, &as3.PutObjectRetentionInput{
+			Bucket:            aws.String(s3.Conf.S3.Bucket),
+			Key:               aws.String(path.Join("repo", key)),
+			Retention:         retention,
+			ChecksumAlgorithm: as3Types.ChecksumAlgorithmCrc32,
+		})
+		if nil == retainErr || s3.isErrNotFound(retainErr) {
+			return
+		}
+
+		logging.LogErrorf("retain object [%s] failed: %s", key, retainErr)
+		lock.Lock()
+		if nil == err {
+			err = retainErr
+		}
+		lock.Unlock()
+	})
+	defer p.Release()
+
+	for _, key := range keys {
+		waitGroup.Add(1)
+		if invokeErr := p.Invoke(key); nil != invokeErr {
+			waitGroup.Done()
+			logging.LogErrorf("invoke failed: %s", invokeErr)
+			lock.Lock()
+			err = invokeErr
+			lock.Unlock()
+			break
+		}
+	}
+	waitGroup.Wait()
+	return
+}
+
+// parseDeleteErr 用于将删除锁定对象的错误转换为 ErrCloudObjectLocked，只在配置了 ConfS3.ObjectLockMode 时转换，否则 AccessDenied 为权限不足。
+func (s3 *S3) parseDeleteErr(key string, err error) error {
+	if nil == err || "" == s3.S3.ObjectLockMode {
+		return err
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && ("AccessDenied" == apiErr.ErrorCode() || "InvalidRequest" == apiErr.ErrorCode()) {
+		return fmt.Errorf("%w: [%s] %s", ErrCloudObjectLocked, key, apiErr.ErrorMessage())
+	}
+	return err
+}
@@ -21,10 +21,12 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	as3 "github.com/aws/aws-sdk-go-v2/service/s3"
 	as3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 type listObjectsV2Stub struct {
@@ -107,3 +109,161 @@ func TestListS3ObjectsReturnsPaginationError(t *testing.T) {
 		t.Fatalf("unexpected pagination error [%v]", err)
 	}
 }
+
+func TestS3ParseConditionalErr(t *testing.T) {
+	s3 := &S3{}
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{&smithy.GenericAPIError{Code: "PreconditionFailed"}, ErrCloudPreconditionFailed},
+		{&smithy.GenericAPIError{Code: "ConditionalRequestConflict"}, ErrCloudPreconditionFailed},
+		{&smithy.GenericAPIError{Code: "NotImplemented"}, ErrUnsupported},
+	}
+	for _, c := range cases {
+		if got := s3.parseConditionalErr(c.err); !errors.Is(got, c.want) {
+			t.Fatalf("parse [%s] got [%v], want [%v]", c.err, got, c.want)
+		}
+	}
+
+	other := errors.New("network down")
+	if got := s3.parseConditionalErr(other); other != got {
+		t.Fatalf("unexpected parsed error [%v]", got)
+	}
+}
+
+func TestS3WriteOptions(t *testing.T) {
+	stub := newS3Stub()
+	s3 := newS3StubCloud(t, stub)
+	s3.S3.StorageClass = "STANDARD"
+	s3.S3.StorageClasses = map[string]string{"objects": "STANDARD_IA"}
+	s3.S3.SSE = "aws:kms"
+	s3.S3.SSEKMSKeyID = "key-id"
+	s3.S3.ObjectLockMode = "governance"
+	s3.S3.ObjectLockDays = 30
+
+	for _, key := range []string{"objects/ab/cdef", "refs/latest", "refs/tags/v1"} {
+		if _, err := s3.UploadBytes(key, []byte(key), true); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		key          string
+		storageClass string
+		lockMode     string
+	}{
+		{"objects/ab/cdef", "STANDARD_IA", ""},
+		{"refs/latest", "STANDARD", ""},
+		{"refs/tags/v1", "STANDARD", "GOVERNANCE"},
+	}
+	for _, c := range cases {
+		header := stub.headers["repo/"+c.key]
+		if got := header.Get("X-Amz-Storage-Class"); c.storageClass != got {
+			t.Fatalf("object [%s] storage class [%s], want [%s]", c.key, got, c.storageClass)
+		}
+		if "aws:kms" != header.Get("X-Amz-Server-Side-Encryption") || "key-id" != header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") {
+			t.Fatalf("object [%s] missing SSE-KMS headers", c.key)
+		}
+		if got := header.Get("X-Amz-Object-Lock-Mode"); c.lockMode != got {
+			t.Fatalf("object [%s] lock mode [%s], want [%s]", c.key, got, c.lockMode)
+		}
+	}
+	until, err := time.Parse(time.RFC3339, stub.headers["repo/refs/tags/v1"].Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	if nil != err || 29*24*time.Hour > time.Until(until) {
+		t.Fatalf("unexpected retain until date [%s], err [%v]", until, err)
+	}
+
+	if err = s3.RemoveObject("refs/tags/v1"); !errors.Is(err, ErrCloudObjectLocked) {
+		t.Fatalf("remove locked tag got [%v]", err)
+	}
+	if _, ok := stub.objects["repo/refs/tags/v1"]; !ok {
+		t.Fatal("locked tag should not be removed")
+	}
+	if err = s3.RemoveObject("refs/latest"); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestS3RetainObjects(t *testing.T) {
+	stub := newS3Stub()
+	s3 := newS3StubCloud(t, stub)
+	if _, err := s3.UploadBytes("objects/ab/cdef", []byte("data"), true); nil != err {
+		t.Fatal(err)
+	}
+
+	// 未配置对象锁定时不设置保留期
+	if err := s3.RetainObjects(context.Background(), []string{"objects/ab/cdef"}); nil != err {
+		t.Fatal(err)
+	}
+	if "" != stub.headers["repo/objects/ab/cdef"].Get("X-Amz-Object-Lock-Mode") {
+		t.Fatal("object should not be retained without object lock")
+	}
+
+	s3.S3.ObjectLockMode = "compliance"
+	s3.S3.ObjectLockDays = 7
+	if err := s3.RetainObjects(context.Background(), []string{"objects/ab/cdef", "objects/ab/missing"}); nil != err {
+		t.Fatal(err)
+	}
+	header := stub.headers["repo/objects/ab/cdef"]
+	if "COMPLIANCE" != header.Get("X-Amz-Object-Lock-Mode") {
+		t.Fatalf("object lock mode [%s]", header.Get("X-Amz-Object-Lock-Mode"))
+	}
+	if err := s3.RemoveObject("objects/ab/cdef"); !errors.Is(err, ErrCloudObjectLocked) {
+		t.Fatalf("remove retained object got [%v]", err)
+	}
+	if _, ok := stub.objects["repo/objects/ab/cdef"]; !ok {
+		t.Fatal("retained object should not be removed")
+	}
+}
+
+func TestS3SSECustomer(t *testing.T) {
+	stub := newS3Stub()
+	s3 := newS3StubCloud(t, stub)
+	s3.S3.SSE = "SSE-C"
+	s3.S3.SSECustomerKey = "0123456789abcdef0123456789abcdef"
+
+	if _, err := s3.UploadBytes("indexes/abc", []byte("index"), true); nil != err {
+		t.Fatal(err)
+	}
+	header := stub.headers["repo/indexes/abc"]
+	if "AES256" != header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") || "" == header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") {
+		t.Fatal("missing SSE-C headers")
+	}
+	if data, err := s3.DownloadObject("indexes/abc"); nil != err || "index" != string(data) {
+		t.Fatalf("download SSE-C object got [%s], err [%v]", data, err)
+	}
+	if _, err := s3.Stat(context.Background(), "indexes/abc"); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestS3ObjectVersions(t *testing.T) {
+	stub := newS3Stub()
+	s3 := newS3StubCloud(t, stub)
+
+	for _, id := range []string{"first", "second"} {
+		if _, err := s3.UploadBytes("refs/latest", []byte(id), true); nil != err {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := s3.UploadBytes("refs/latest-1", []byte("other"), true); nil != err {
+		t.Fatal(err)
+	}
+
+	versions, err := s3.ListObjectVersions(context.Background(), "refs/latest")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(versions) || !versions[0].Latest || versions[1].Latest || !versions[0].Updated.After(versions[1].Updated) {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	data, err := s3.GetObjectVersion(context.Background(), "refs/latest", versions[1].VersionID)
+	if nil != err || "first" != string(data) {
+		t.Fatalf("get version got [%s], err [%v]", data, err)
+	}
+	if _, err = s3.GetObjectVersion(context.Background(), "refs/latest", "missing"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("get missing version got [%v]", err)
+	}
+}
@@ -0,0 +1,124 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	as3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// ObjectVersion 描述了对象的一个历史版本。
+type ObjectVersion struct {
+	VersionID    string    // 版本 ID
+	Updated      time.Time // 版本写入时间
+	Size         int64     // 大小
+	Latest       bool      // 是否为当前版本
+	DeleteMarker bool      // 是否为删除标记
+}
+
+// Versioned 描述了支持读取对象历史版本的存储服务，比如启用了版本控制的 S3 存储空间。
+type Versioned interface {
+	// ListObjectVersions 列出对象 key 的全部版本（包括删除标记），按写入时间从新到旧排列。
+	ListObjectVersions(ctx context.Context, key string) (versions []*ObjectVersion, err error)
+
+	// GetObjectVersion 下载对象 key 的版本 versionID。
+	GetObjectVersion(ctx context.Context, key, versionID string) (data []byte, err error)
+}
+
+// ListObjectVersions 列出对象 key 的全部版本，存储空间未启用版本控制时只会返回当前版本（版本 ID 为 null）。
+func (s3 *S3) ListObjectVersions(ctx context.Context, key string) (ret []*ObjectVersion, err error) {
+	svc := s3.getService()
+	key = path.Join("repo", key)
+	input := &as3.ListObjectVersionsInput{
+		Bucket: aws.String(s3.Conf.S3.Bucket),
+		Prefix: aws.String(key),
+	}
+	for {
+		listCtx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+		output, listErr := svc.ListObjectVersions(listCtx, input)
+		cancelFn()
+		if nil != listErr {
+			err = listErr
+			return
+		}
+
+		for _, version := range output.Versions {
+			if key != aws.ToString(version.Key) {
+				continue
+			}
+			ret = append(ret, &ObjectVersion{
+				VersionID: aws.ToString(version.VersionId),
+				Updated:   aws.ToTime(version.LastModified),
+				Size:      aws.ToInt64(version.Size),
+				Latest:    aws.ToBool(version.IsLatest),
+			})
+		}
+		for _, marker := range output.DeleteMarkers {
+			if key != aws.ToString(marker.Key) {
+				continue
+			}
+			ret = append(ret, &ObjectVersion{
+				VersionID:    aws.ToString(marker.VersionId),
+				Updated:      aws.ToTime(marker.LastModified),
+				Latest:       aws.ToBool(marker.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+
+		if !aws.ToBool(output.IsTruncated) || (nil == output.NextKeyMarker && nil == output.NextVersionIdMarker) {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Updated.After(ret[j].Updated) })
+	return
+}
+
+func (s3 *S3) GetObjectVersion(ctx context.Context, key, versionID string) (data []byte, err error) {
+	svc := s3.getService()
+	ctx, cancelFn := context.WithTimeout(ctx, time.Duration(s3.S3.Timeout)*time.Second)
+	defer cancelFn()
+
+	input := &as3.GetObjectInput{
+		Bucket:               aws.String(s3.Conf.S3.Bucket),
+		Key:                  aws.String(path.Join("repo", key)),
+		VersionId:            aws.String(versionID),
+		ResponseCacheControl: aws.String("no-cache"),
+	}
+	s3.setSSECustomer(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	resp, err := svc.GetObject(ctx, input)
+	if nil != err {
+		var apiErr smithy.APIError
+		if s3.isErrNotFound(err) || (errors.As(err, &apiErr) && "NoSuchVersion" == apiErr.ErrorCode()) {
+			err = ErrCloudObjectNotFound
+		}
+		return
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(resp.Body)
+	return
+}
@@ -0,0 +1,215 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/siyuan-note/logging"
+)
+
+// selfTestMaxClockSkew 为自检允许的最大时钟偏差，超过时部分存储服务会拒绝请求，云端锁的过期判断也会出错。
+const selfTestMaxClockSkew = 5 * time.Minute
+
+// 自检的操作。
+const (
+	SelfTestOpWrite       = "write"       // 上传探测对象
+	SelfTestOpStat        = "stat"        // 获取探测对象信息，用于计算时钟偏差
+	SelfTestOpRead        = "read"        // 下载探测对象并校验数据
+	SelfTestOpList        = "list"        // 列出探测对象
+	SelfTestOpConditional = "conditional" // 条件上传探测对象，仅在存储服务声明支持条件读写时执行
+	SelfTestOpDelete      = "delete"      // 删除探测对象并确认已经删除
+)
+
+// SelfTestStep 描述了自检中一个操作的结果。
+type SelfTestStep struct {
+	Op      string        `json:"op"`              // 操作，见 SelfTestOp 开头的常量
+	Latency time.Duration `json:"latency"`         // 耗时
+	Err     error         `json:"-"`               // 错误，成功时为空
+	Error   string        `json:"error,omitempty"` // 错误信息，成功时为空
+}
+
+// SelfTestResult 描述了自检的结果。
+type SelfTestResult struct {
+	Capabilities   *Capabilities   `json:"capabilities"`   // 存储服务声明的能力
+	Steps          []*SelfTestStep `json:"steps"`          // 各操作的结果，上传失败时跳过依赖探测对象的操作
+	Latency        time.Duration   `json:"latency"`        // 成功操作的平均耗时
+	ClockSkew      time.Duration   `json:"clockSkew"`      // 存储服务时间减去本机时间，存储服务不提供对象修改时间时为 0
+	PermissionGaps []string        `json:"permissionGaps"` // 因为鉴权失败或者权限不足而失败的操作
+	Err            error           `json:"-"`              // 自检失败的原因，时钟偏差过大时为 ErrSystemTimeIncorrect，否则为第一个失败操作的错误
+}
+
+// OK 用于判断自检是否通过。
+func (result *SelfTestResult) OK() bool {
+	return nil == result.Err
+}
+
+// Step 用于获取操作 op 的结果，未执行该操作时返回 nil。
+func (result *SelfTestResult) Step(op string) *SelfTestStep {
+	for _, step := range result.Steps {
+		if op == step.Op {
+			return step
+		}
+	}
+	return nil
+}
+
+// SelfTest 用于在保存存储服务配置时校验 c 是否可用。
+//
+// 自检依次上传、获取信息、下载、列出、条件上传和删除一个探测对象（位于 selftest/ 下），记录每个操作的耗时和错误，
+// 并根据探测对象的修改时间计算本机和存储服务之间的时钟偏差。自检不会中途停止，一次就能发现全部缺少的权限，
+// 比如只读的访问密钥会在上传和删除时失败而在列出时成功。
+func SelfTest(ctx context.Context, c Cloud) (ret *SelfTestResult) {
+	ret = &SelfTestResult{Capabilities: c.GetCapabilities(), PermissionGaps: []string{}}
+	key := "selftest/probe-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	data := []byte("dejavu self test " + key)
+
+	run := func(op string, fn func() error) (err error) {
+		start := time.Now()
+		err = fn()
+		step := &SelfTestStep{Op: op, Latency: time.Since(start), Err: err}
+		if nil != err {
+			step.Error = err.Error()
+			logging.LogWarnf("self test [%s] failed: %s", op, err)
+		}
+		ret.Steps = append(ret.Steps, step)
+		return
+	}
+
+	var writeStart time.Time
+	writeErr := run(SelfTestOpWrite, func() error {
+		writeStart = time.Now()
+		return c.Put(ctx, key, bytes.NewReader(data), int64(len(data)))
+	})
+	if nil == writeErr {
+		writeLatency := ret.Steps[len(ret.Steps)-1].Latency
+		run(SelfTestOpStat, func() error {
+			info, err := c.Stat(ctx, key)
+			if nil != err {
+				return err
+			}
+			if !info.Updated.IsZero() {
+				// 存储服务在处理上传请求期间记录修改时间，使用上传请求的中间时刻作为本机时间
+				ret.ClockSkew = info.Updated.Sub(writeStart.Add(writeLatency / 2)).Round(time.Second)
+			}
+			return nil
+		})
+		run(SelfTestOpRead, func() error {
+			reader, err := c.Get(ctx, key)
+			if nil != err {
+				return err
+			}
+			defer reader.Close()
+			got, err := io.ReadAll(reader)
+			if nil != err {
+				return err
+			}
+			if !bytes.Equal(data, got) {
+				return fmt.Errorf("probe object [%s] content mismatch", key)
+			}
+			return nil
+		})
+	}
+
+	run(SelfTestOpList, func() error {
+		infos, err := c.List(ctx, path.Dir(key)+"/")
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			// 探测对象上传失败时目录可能不存在
+			err = nil
+		}
+		if nil != err || nil != writeErr || !ret.Capabilities.ConsistentListing {
+			return err
+		}
+		for p := range infos {
+			if path.Base(p) == path.Base(key) {
+				return nil
+			}
+		}
+		return fmt.Errorf("probe object [%s] not listed", key)
+	})
+
+	if nil == writeErr {
+		if ret.Capabilities.ConditionalWrite {
+			run(SelfTestOpConditional, func() error {
+				_, etag, err := c.GetWithETag(ctx, key)
+				if nil != err {
+					return err
+				}
+				return c.PutIfMatch(ctx, key, data, etag)
+			})
+		}
+		run(SelfTestOpDelete, func() error {
+			if err := c.Delete(ctx, key); nil != err {
+				return err
+			}
+			if _, err := c.Stat(ctx, key); !errors.Is(err, ErrCloudObjectNotFound) {
+				if nil == err {
+					err = fmt.Errorf("probe object [%s] still exists after delete", key)
+				}
+				return err
+			}
+			return nil
+		})
+	}
+
+	var succeeded int
+	for _, step := range ret.Steps {
+		if nil == step.Err {
+			ret.Latency += step.Latency
+			succeeded++
+			continue
+		}
+
+		if ErrorClassAuth == ClassifyError(step.Err) {
+			ret.PermissionGaps = append(ret.PermissionGaps, step.Op)
+		}
+		if isErrTimeSkewed(step.Err) {
+			ret.Err = ErrSystemTimeIncorrect
+		} else if nil == ret.Err {
+			ret.Err = step.Err
+		}
+	}
+	if 0 < succeeded {
+		ret.Latency /= time.Duration(succeeded)
+	}
+	if selfTestMaxClockSkew < ret.ClockSkew.Abs() {
+		ret.Err = ErrSystemTimeIncorrect
+	}
+	return
+}
+
+// isErrTimeSkewed 用于判断 err 是否为存储服务因为时钟偏差过大而拒绝请求的错误。
+func isErrTimeSkewed(err error) bool {
+	if errors.Is(err, ErrSystemTimeIncorrect) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && "RequestTimeTooSkewed" == apiErr.ErrorCode() {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "requesttimetooskewed") || strings.Contains(msg, "request time and the current time is too large")
+}
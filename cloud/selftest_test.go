@@ -0,0 +1,109 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+// skewedTestCloud 模拟时钟比本机快 1 小时的存储服务。
+type skewedTestCloud struct {
+	Cloud
+}
+
+func (c *skewedTestCloud) Stat(ctx context.Context, key string) (ret *entity.ObjectInfo, err error) {
+	ret, err = c.Cloud.Stat(ctx, key)
+	if nil == err {
+		ret.Updated = ret.Updated.Add(time.Hour)
+	}
+	return
+}
+
+func TestSelfTest(t *testing.T) {
+	store := NewMemoryStore()
+	result := SelfTest(context.Background(), newTestMemory(store))
+	if !result.OK() {
+		t.Fatalf("self test failed [%v]", result.Err)
+	}
+	var ops []string
+	for _, step := range result.Steps {
+		ops = append(ops, step.Op)
+	}
+	want := []string{SelfTestOpWrite, SelfTestOpStat, SelfTestOpRead, SelfTestOpList, SelfTestOpConditional, SelfTestOpDelete}
+	if !reflect.DeepEqual(want, ops) {
+		t.Fatalf("unexpected steps [%v]", ops)
+	}
+	if 0 != len(result.PermissionGaps) || time.Minute < result.ClockSkew.Abs() {
+		t.Fatalf("unexpected result [%+v]", result)
+	}
+	if 0 != len(store.Keys()) {
+		t.Fatalf("probe object left behind [%v]", store.Keys())
+	}
+}
+
+func TestSelfTestPermissionGaps(t *testing.T) {
+	// 没有删除权限的访问密钥
+	memory := newTestMemory(nil)
+	memory.AddFault(&MemoryFault{Method: "Delete", Error: "forbidden"})
+	result := SelfTest(context.Background(), memory)
+	if result.OK() || !reflect.DeepEqual([]string{SelfTestOpDelete}, result.PermissionGaps) {
+		t.Fatalf("unexpected result [%+v]", result)
+	}
+
+	// 只读的访问密钥，上传失败时仍然检查列出
+	memory = newTestMemory(nil)
+	memory.AddFault(&MemoryFault{Method: "Put", Error: "auth"})
+	result = SelfTest(context.Background(), memory)
+	if !errors.Is(result.Err, ErrCloudAuthFailed) || !reflect.DeepEqual([]string{SelfTestOpWrite}, result.PermissionGaps) {
+		t.Fatalf("unexpected result [%+v, %v]", result, result.Err)
+	}
+	if step := result.Step(SelfTestOpList); nil == step || nil != step.Err || nil != result.Step(SelfTestOpRead) {
+		t.Fatalf("unexpected steps [%+v]", result.Steps)
+	}
+}
+
+func TestSelfTestClockSkew(t *testing.T) {
+	result := SelfTest(context.Background(), &skewedTestCloud{Cloud: newTestMemory(nil)})
+	if !errors.Is(result.Err, ErrSystemTimeIncorrect) {
+		t.Fatalf("expected system time incorrect, got [%v]", result.Err)
+	}
+	if 59*time.Minute > result.ClockSkew || 61*time.Minute < result.ClockSkew {
+		t.Fatalf("unexpected clock skew [%s]", result.ClockSkew)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	s3 := NewS3(&BaseCloud{Conf: &Conf{S3: &ConfS3{MultipartThreshold: -1}}}, nil)
+	if capabilities := s3.GetCapabilities(); 5*1024*1024*1024 != capabilities.MaxObjectSize || capabilities.AtomicRename || !capabilities.ConditionalWrite {
+		t.Fatalf("unexpected s3 capabilities [%+v]", capabilities)
+	}
+
+	local := NewLocal(&BaseCloud{Conf: &Conf{Local: &ConfLocal{}}})
+	mirror := NewMirror(local, s3)
+	capabilities := mirror.GetCapabilities()
+	if !capabilities.AtomicRename || 5*1024*1024*1024 != capabilities.MaxObjectSize {
+		t.Fatalf("unexpected mirror capabilities [%+v]", capabilities)
+	}
+	if 0 != local.GetCapabilities().MaxObjectSize {
+		t.Fatal("mirror changed primary capabilities")
+	}
+}
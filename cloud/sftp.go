@@ -0,0 +1,968 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/panjf2000/ants/v2"
+	psftp "github.com/pkg/sftp"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP 描述了 SFTP 云端存储服务实现，仓库布局和 Local 一致：Dir/<仓库名>/objects/...
+type SFTP struct {
+	*BaseCloud
+
+	lock       sync.Mutex
+	sshClient  *ssh.Client
+	sftpClient *psftp.Client
+}
+
+func NewSFTP(baseCloud *BaseCloud) (ret *SFTP) {
+	ret = &SFTP{
+		BaseCloud: baseCloud,
+	}
+	return
+}
+
+func (sftp *SFTP) CreateRepo(name string) (err error) {
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	err = sftp.parseErr(client, client.MkdirAll(path.Join(sftp.SFTP.Dir, name)))
+	return
+}
+
+func (sftp *SFTP) RemoveRepo(name string) (err error) {
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	err = client.RemoveAll(path.Join(sftp.SFTP.Dir, name))
+	if nil != err && os.IsNotExist(err) {
+		err = nil
+	}
+	err = sftp.parseErr(client, err)
+	return
+}
+
+func (sftp *SFTP) GetRepos() (repos []*Repo, size int64, err error) {
+	repos, err = sftp.listRepos()
+	if nil != err {
+		return
+	}
+
+	for _, repo := range repos {
+		size += repo.Size
+	}
+	return
+}
+
+func (sftp *SFTP) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	ctx := context.Background()
+	if !overwrite {
+		if _, err = sftp.Stat(ctx, filePath); nil == err {
+			return
+		} else if !errors.Is(err, ErrCloudObjectNotFound) {
+			return
+		}
+	}
+
+	length, err = putFile(ctx, sftp.Put, sftp.Conf.RepoPath, filePath)
+	return
+}
+
+func (sftp *SFTP) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	if err = sftp.Put(context.Background(), filePath, bytes.NewReader(data), int64(len(data))); nil != err {
+		return
+	}
+	length = int64(len(data))
+	return
+}
+
+func (sftp *SFTP) DownloadObject(filePath string) (data []byte, err error) {
+	data, err = getBytes(context.Background(), sftp.Get, filePath)
+	return
+}
+
+func (sftp *SFTP) RemoveObject(filePath string) (err error) {
+	err = sftp.Delete(context.Background(), filePath)
+	return
+}
+
+func (sftp *SFTP) ListObjects(pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
+	objects, err = sftp.List(context.Background(), pathPrefix)
+	return
+}
+
+// SFTP 客户端不支持上下文，以下流式接口在请求前检查上下文，并通过可取消的数据流中断传输。
+
+// Put 先写入同目录下的临时文件，写完后再原子替换目标文件，读取时不会读到写了一半的数据。
+func (sftp *SFTP) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	absPath := path.Join(sftp.getCurrentRepoDirPath(), key)
+	if err = client.MkdirAll(path.Dir(absPath)); nil != err {
+		err = sftp.parseErr(client, err)
+		logging.LogErrorf("upload object [%s] failed: %s", absPath, err)
+		return
+	}
+
+	throttled := sftp.GetBandwidthLimiter().UploadReader(ctx, &ctxReader{ctx: ctx, reader: reader})
+	defer throttled.Close()
+	if err = sftp.writeFile(client, absPath, throttled); nil != err {
+		err = sftp.parseErr(client, err)
+		logging.LogErrorf("upload object [%s] failed: %s", absPath, err)
+		return
+	}
+
+	//logging.LogInfof("uploaded object [%s]", absPath)
+	return
+}
+
+func (sftp *SFTP) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	absPath := path.Join(sftp.getCurrentRepoDirPath(), key)
+	file, err := client.Open(absPath)
+	if nil != err {
+		err = sftp.parseErr(client, err)
+		return
+	}
+	reader = sftp.GetBandwidthLimiter().DownloadReader(ctx, file)
+
+	//logging.LogInfof("downloaded object [%s]", absPath)
+	return
+}
+
+func (sftp *SFTP) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	fileInfo, err := client.Stat(path.Join(sftp.getCurrentRepoDirPath(), key))
+	if nil != err {
+		err = sftp.parseErr(client, err)
+		return
+	}
+	info = &entity.ObjectInfo{Path: key, Size: fileInfo.Size(), Updated: fileInfo.ModTime()}
+	return
+}
+
+func (sftp *SFTP) Delete(ctx context.Context, key string) (err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	absPath := path.Join(sftp.getCurrentRepoDirPath(), key)
+	if err = client.Remove(absPath); nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+			return
+		}
+		err = sftp.parseErr(client, err)
+		logging.LogErrorf("remove object [%s] failed: %s", absPath, err)
+		return
+	}
+
+	//logging.LogInfof("removed object [%s]", absPath)
+	return
+}
+
+func (sftp *SFTP) List(ctx context.Context, pathPrefix string) (objects map[string]*entity.ObjectInfo, err error) {
+	objects = map[string]*entity.ObjectInfo{}
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	// objects/ 为两级目录 objects/XX/<id>，和 Local 一样递归列出以匹配 PurgeCloud 与 S3 的路径格式
+	isObjectsDir := strings.HasPrefix(pathPrefix, "objects")
+	absPathPrefix := path.Join(sftp.getCurrentRepoDirPath(), pathPrefix)
+	entries, err := client.ReadDir(absPathPrefix)
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+			return
+		}
+		err = sftp.parseErr(client, err)
+		logging.LogErrorf("list objects [%s] failed: %s", absPathPrefix, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if isObjectsDir && entry.IsDir() {
+			subDir := path.Join(absPathPrefix, entry.Name())
+			subEntries, subErr := client.ReadDir(subDir)
+			if nil != subErr {
+				err = sftp.parseErr(client, subErr)
+				logging.LogErrorf("list objects [%s] failed: %s", subDir, err)
+				return
+			}
+			for _, subEntry := range subEntries {
+				if subEntry.IsDir() || isSFTPTempFile(subEntry.Name()) {
+					continue
+				}
+				relPath := path.Join(entry.Name(), subEntry.Name())
+				objects[relPath] = &entity.ObjectInfo{
+					Path: relPath,
+					Size: subEntry.Size(),
+				}
+			}
+			continue
+		}
+		if isSFTPTempFile(entry.Name()) {
+			continue
+		}
+
+		filePath := entry.Name()
+		objects[filePath] = &entity.ObjectInfo{
+			Path: filePath,
+			Size: entry.Size(),
+		}
+	}
+
+	//logging.LogInfof("list objects [%s]", pathPrefix)
+	return
+}
+
+func (sftp *SFTP) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	data, err = sftp.readFile(client, path.Join(sftp.getCurrentRepoDirPath(), key))
+	if nil != err {
+		err = sftp.parseErr(client, err)
+		return
+	}
+	etag = util.Hash(data)
+	return
+}
+
+// PutIfMatch 和 Local 一样通过 O_EXCL 创建的互斥文件保证比较和写入的原子性。
+func (sftp *SFTP) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error) {
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	absPath := path.Join(sftp.getCurrentRepoDirPath(), key)
+	if err = client.MkdirAll(path.Dir(absPath)); nil != err {
+		err = sftp.parseErr(client, err)
+		logging.LogErrorf("upload object [%s] failed: %s", absPath, err)
+		return
+	}
+
+	unlock, err := sftp.lockFile(ctx, client, absPath)
+	if nil != err {
+		return
+	}
+	defer unlock()
+
+	current, err := sftp.readFile(client, absPath)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			err = sftp.parseErr(client, err)
+			logging.LogErrorf("read object [%s] failed: %s", absPath, err)
+			return
+		}
+		err = nil
+		if "" != etag {
+			err = ErrCloudPreconditionFailed
+			return
+		}
+	} else if "" == etag || util.Hash(current) != etag {
+		err = ErrCloudPreconditionFailed
+		return
+	}
+
+	if err = sftp.writeFile(client, absPath, bytes.NewReader(data)); nil != err {
+		err = sftp.parseErr(client, err)
+		logging.LogErrorf("upload object [%s] failed: %s", absPath, err)
+		return
+	}
+	return
+}
+
+// lockFile 使用 O_EXCL 创建互斥文件 absPath.cas，返回的函数用于解锁。
+//
+// 服务端和本机的时钟可能不一致，所以不使用互斥文件的修改时间判断是否残留，而是在本机观察到互斥文件超过 localFileLockTimeout 未变化时才视为残留。
+func (sftp *SFTP) lockFile(ctx context.Context, client *psftp.Client, absPath string) (unlock func(), err error) {
+	lockPath := absPath + ".cas"
+	var seenModTime time.Time
+	var seenAt time.Time
+	for {
+		var file *psftp.File
+		file, err = client.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if nil == err {
+			file.Close()
+			unlock = func() {
+				if removeErr := client.Remove(lockPath); nil != removeErr {
+					logging.LogErrorf("remove lock file [%s] failed: %s", lockPath, removeErr)
+				}
+			}
+			return
+		}
+
+		info, statErr := client.Stat(lockPath)
+		if nil != statErr {
+			if !os.IsNotExist(statErr) {
+				err = sftp.parseErr(client, err)
+				logging.LogErrorf("create lock file [%s] failed: %s", lockPath, err)
+				return
+			}
+			// 互斥文件刚好被释放，立即重试
+			continue
+		}
+
+		if !info.ModTime().Equal(seenModTime) {
+			seenModTime, seenAt = info.ModTime(), time.Now()
+		} else if time.Since(seenAt) > localFileLockTimeout {
+			logging.LogWarnf("remove stale lock file [%s]", lockPath)
+			client.Remove(lockPath)
+			seenModTime = time.Time{}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (sftp *SFTP) GetTags() (tags []*Ref, err error) {
+	tags, err = sftp.listRepoRefs("tags")
+	if nil != err {
+		return
+	}
+	if 1 > len(tags) {
+		tags = []*Ref{}
+	}
+	return
+}
+
+func (sftp *SFTP) GetIndexes(page int) (indexes []*entity.Index, pageCount, totalCount int, err error) {
+	data, err := sftp.DownloadObject("indexes-v2.json")
+	if nil != err {
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+
+	data, err = compressDecoder.DecodeAll(data, nil)
+	if nil != err {
+		return
+	}
+
+	indexesJSON := &Indexes{}
+	if err = gulu.JSON.UnmarshalJSON(data, indexesJSON); nil != err {
+		return
+	}
+
+	totalCount = len(indexesJSON.Indexes)
+	pageCount = int(math.Ceil(float64(totalCount) / float64(pageSize)))
+	start := (page - 1) * pageSize
+	end := page * pageSize
+	if end > totalCount {
+		end = totalCount
+	}
+
+	for i := start; i < end; i++ {
+		index, getErr := sftp.repoIndex(indexesJSON.Indexes[i].ID)
+		if nil != getErr {
+			logging.LogWarnf("get repo index [%s] failed: %s", indexesJSON.Indexes[i], getErr)
+			continue
+		}
+		if nil == index {
+			continue
+		}
+
+		index.Files = nil // Optimize the performance of obtaining cloud snapshots https://github.com/siyuan-note/siyuan/issues/8387
+		indexes = append(indexes, index)
+	}
+	return
+}
+
+func (sftp *SFTP) GetRefsFiles() (fileIDs []string, refs []*Ref, err error) {
+	refs, err = sftp.listRepoRefs("")
+	if nil != err {
+		return
+	}
+
+	var files []string
+	for _, ref := range refs {
+		index, getErr := sftp.repoIndex(ref.ID)
+		if nil != getErr {
+			err = getErr
+			return
+		}
+		if nil == index {
+			continue
+		}
+
+		files = append(files, index.Files...)
+	}
+
+	fileIDs = gulu.Str.RemoveDuplicatedElem(files)
+	if 1 > len(fileIDs) {
+		fileIDs = []string{}
+	}
+	return
+}
+
+func (sftp *SFTP) GetChunks(checkChunkIDs []string) (chunkIDs []string, err error) {
+	repoObjectsPath := path.Join(sftp.getCurrentRepoDirPath(), "objects")
+	var keys []string
+	for _, chunkID := range checkChunkIDs {
+		key := path.Join(repoObjectsPath, chunkID[:2], chunkID[2:])
+		keys = append(keys, key)
+	}
+
+	notFound, err := sftp.getNotFound(keys)
+	if nil != err {
+		return
+	}
+
+	var notFoundChunkIDs []string
+	for _, key := range notFound {
+		chunkID := strings.TrimPrefix(key, repoObjectsPath)
+		chunkID = strings.ReplaceAll(chunkID, "/", "")
+		notFoundChunkIDs = append(notFoundChunkIDs, chunkID)
+	}
+
+	chunkIDs = append(chunkIDs, notFoundChunkIDs...)
+	chunkIDs = gulu.Str.RemoveDuplicatedElem(chunkIDs)
+	if 1 > len(chunkIDs) {
+		chunkIDs = []string{}
+	}
+	return
+}
+
+func (sftp *SFTP) GetIndex(id string) (index *entity.Index, err error) {
+	index, err = sftp.repoIndex(id)
+	if nil != err {
+		logging.LogErrorf("get repo index [%s] failed: %s", id, err)
+		return
+	}
+	if nil == index {
+		err = ErrCloudObjectNotFound
+		return
+	}
+	return
+}
+
+func (sftp *SFTP) GetCapabilities() (ret *Capabilities) {
+	// 上传时先写入临时文件再重命名，只有服务端支持 posix-rename@openssh.com 扩展时重命名才是原子的
+	ret = &Capabilities{ConditionalWrite: true, ConsistentListing: true}
+	if client, err := sftp.getClient(); nil == err {
+		ret.AtomicRename = sftpPosixRename(client)
+	}
+	return
+}
+
+func (sftp *SFTP) GetConcurrentReqs() (ret int) {
+	ret = sftp.SFTP.ConcurrentReqs
+	if 1 > ret {
+		ret = 8
+	}
+	if 64 < ret {
+		ret = 64
+	}
+	return
+}
+
+func (sftp *SFTP) GetConf() *Conf {
+	return sftp.Conf
+}
+
+// GetAvailableSize 通过 statvfs@openssh.com 扩展获取服务端的可用空间，服务端不支持时返回配置的可用空间。
+func (sftp *SFTP) GetAvailableSize() int64 {
+	client, err := sftp.getClient()
+	if nil != err {
+		return sftp.Conf.AvailableSize
+	}
+
+	vfs, err := client.StatVFS(sftp.SFTP.Dir)
+	if nil != err {
+		return sftp.Conf.AvailableSize
+	}
+	return int64(vfs.FreeSpace())
+}
+
+func (sftp *SFTP) AddTraffic(*Traffic) {
+	return
+}
+
+// Close 用于关闭 SFTP 连接，之后的请求会重新建立连接。
+func (sftp *SFTP) Close() (err error) {
+	sftp.lock.Lock()
+	defer sftp.lock.Unlock()
+
+	if nil == sftp.sshClient {
+		return
+	}
+
+	sftp.sftpClient.Close()
+	err = sftp.sshClient.Close()
+	sftp.sshClient, sftp.sftpClient = nil, nil
+	return
+}
+
+func (sftp *SFTP) listRepos() (repos []*Repo, err error) {
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	entries, err := client.ReadDir(sftp.SFTP.Dir)
+	if nil != err {
+		err = sftp.parseErr(client, err)
+		logging.LogErrorf("list repos [%s] failed: %s", sftp.SFTP.Dir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		repos = append(repos, &Repo{
+			Name:    entry.Name(),
+			Size:    entry.Size(),
+			Updated: entry.ModTime().Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	return
+}
+
+func (sftp *SFTP) listRepoRefs(refPrefix string) (refs []*Ref, err error) {
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	keyPath := path.Join(sftp.getCurrentRepoDirPath(), "refs", refPrefix)
+	entries, err := client.ReadDir(keyPath)
+	if nil != err {
+		err = sftp.parseErr(client, err)
+		logging.LogErrorf("list repo refs [%s] failed: %s", keyPath, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || isSFTPTempFile(entry.Name()) || strings.HasSuffix(entry.Name(), ".cas") {
+			continue
+		}
+
+		data, readErr := sftp.readFile(client, path.Join(keyPath, entry.Name()))
+		if nil != readErr {
+			err = sftp.parseErr(client, readErr)
+			logging.LogErrorf("get repo ref [%s] ID failed: %s", path.Join(keyPath, entry.Name()), err)
+			return
+		}
+
+		id := string(data)
+		ref := &Ref{
+			Name:    entry.Name(),
+			ID:      id,
+			Updated: entry.ModTime().Local().Format("2006-01-02 15:04:05"),
+		}
+		refs = append(refs, ref)
+	}
+	return
+}
+
+func (sftp *SFTP) repoIndex(id string) (index *entity.Index, err error) {
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	data, err := sftp.readFile(client, path.Join(sftp.getCurrentRepoDirPath(), "indexes", id))
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if 1 > len(data) {
+		return
+	}
+
+	data, err = compressDecoder.DecodeAll(data, nil)
+	if nil != err {
+		return
+	}
+
+	index = &entity.Index{}
+	err = gulu.JSON.UnmarshalJSON(data, index)
+	return
+}
+
+func (sftp *SFTP) getNotFound(keys []string) (ret []string, err error) {
+	if 1 > len(keys) {
+		return
+	}
+
+	client, err := sftp.getClient()
+	if nil != err {
+		return
+	}
+
+	poolSize := sftp.GetConcurrentReqs()
+	if poolSize > len(keys) {
+		poolSize = len(keys)
+	}
+
+	lock := sync.Mutex{}
+	waitGroup := &sync.WaitGroup{}
+	p, _ := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		key := arg.(string)
+		_, statErr := client.Stat(key)
+		if nil == statErr {
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if os.IsNotExist(statErr) {
+			ret = append(ret, key)
+		} else if nil == err {
+			// 连接断开或者没有权限时无法确认对象是否存在，不能当作已经存在而跳过上传
+			logging.LogErrorf("stat [%s] failed: %s", key, statErr)
+			err = statErr
+		}
+	})
+	defer p.Release()
+
+	for _, key := range keys {
+		waitGroup.Add(1)
+		if invokeErr := p.Invoke(key); nil != invokeErr {
+			waitGroup.Done()
+			logging.LogErrorf("invoke failed: %s", invokeErr)
+			lock.Lock()
+			err = invokeErr
+			lock.Unlock()
+			break
+		}
+	}
+	waitGroup.Wait()
+	if nil != err {
+		ret = nil
+	}
+	return
+}
+
+func (sftp *SFTP) readFile(client *psftp.Client, absPath string) (data []byte, err error) {
+	file, err := client.Open(absPath)
+	if nil != err {
+		return
+	}
+	defer file.Close()
+	data, err = io.ReadAll(file)
+	return
+}
+
+// writeFile 先写入临时文件再重命名为 absPath，服务端不支持 posix-rename@openssh.com 扩展时先删除目标文件再重命名。
+//
+// 支持该扩展时重命名失败（比如连接断开）直接返回错误，不能删除目标文件，否则 refs/latest 等文件会丢失。
+func (sftp *SFTP) writeFile(client *psftp.Client, absPath string, reader io.Reader) (err error) {
+	tmpPath := absPath + sftpTempFileSuffix + strconv.FormatInt(time.Now().UnixNano(), 36)
+	file, err := client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if nil != err {
+		return
+	}
+
+	if _, err = io.Copy(file, reader); nil != err {
+		file.Close()
+		client.Remove(tmpPath)
+		return
+	}
+	if err = file.Close(); nil != err {
+		client.Remove(tmpPath)
+		return
+	}
+
+	if sftpPosixRename(client) {
+		if err = client.PosixRename(tmpPath, absPath); nil != err {
+			client.Remove(tmpPath)
+		}
+		return
+	}
+
+	client.Remove(absPath)
+	if err = client.Rename(tmpPath, absPath); nil != err {
+		client.Remove(tmpPath)
+	}
+	return
+}
+
+// sftpPosixRename 用于判断服务端是否支持 posix-rename@openssh.com 扩展。
+func sftpPosixRename(client *psftp.Client) bool {
+	_, ok := client.HasExtension("posix-rename@openssh.com")
+	return ok
+}
+
+// getClient 返回 SFTP 客户端，首次调用或者连接断开后会重新建立连接。
+func (sftp *SFTP) getClient() (ret *psftp.Client, err error) {
+	sftp.lock.Lock()
+	defer sftp.lock.Unlock()
+
+	if nil != sftp.sftpClient {
+		ret = sftp.sftpClient
+		return
+	}
+
+	sshConf, err := sftp.sshClientConfig()
+	if nil != err {
+		logging.LogErrorf("create ssh client config failed: %s", err)
+		return
+	}
+
+	port := sftp.SFTP.Port
+	if 1 > port {
+		port = 22
+	}
+	addr := net.JoinHostPort(sftp.SFTP.Host, strconv.Itoa(port))
+	sshClient, err := sftp.dial(addr, sshConf)
+	if nil != err {
+		logging.LogErrorf("dial ssh [%s] failed: %s", addr, err)
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			err = ErrCloudAuthFailed
+		}
+		return
+	}
+
+	concurrency := sftp.GetConcurrentReqs()
+	sftpClient, err := psftp.NewClient(sshClient,
+		psftp.UseConcurrentWrites(true),
+		psftp.MaxConcurrentRequestsPerFile(concurrency),
+	)
+	if nil != err {
+		sshClient.Close()
+		logging.LogErrorf("create sftp client [%s] failed: %s", addr, err)
+		return
+	}
+
+	sftp.sshClient, sftp.sftpClient = sshClient, sftpClient
+	go func() {
+		// 连接断开后丢弃客户端，下次请求时重新建立连接
+		if waitErr := sshClient.Wait(); nil != waitErr {
+			logging.LogWarnf("ssh connection [%s] closed: %s", addr, waitErr)
+		}
+		sftp.dropClient(sftpClient)
+	}()
+	ret = sftpClient
+	return
+}
+
+// dial 用于通过 Conf.Proxy 建立到 addr 的 SSH 连接。
+func (sftp *SFTP) dial(addr string, sshConf *ssh.ClientConfig) (ret *ssh.Client, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sshConf.Timeout)
+	defer cancel()
+	conn, err := sftp.Conf.Proxy.dialContext(ctx, "tcp", addr)
+	if nil != err {
+		return
+	}
+
+	// 握手同样受连接超时限制，避免代理建立隧道后服务端无响应时一直等待
+	conn.SetDeadline(time.Now().Add(sshConf.Timeout))
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConf)
+	if nil != err {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	ret = ssh.NewClient(clientConn, chans, reqs)
+	return
+}
+
+// dropClient 用于关闭并丢弃 client，client 已经被替换为新连接时不做处理。
+func (sftp *SFTP) dropClient(client *psftp.Client) {
+	sftp.lock.Lock()
+	defer sftp.lock.Unlock()
+
+	if nil == client || sftp.sftpClient != client {
+		return
+	}
+
+	sftp.sftpClient.Close()
+	sftp.sshClient.Close()
+	sftp.sshClient, sftp.sftpClient = nil, nil
+}
+
+func (sftp *SFTP) sshClientConfig() (ret *ssh.ClientConfig, err error) {
+	var auths []ssh.AuthMethod
+	if "" != sftp.SFTP.PrivateKey {
+		var signer ssh.Signer
+		if "" != sftp.SFTP.Passphrase {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(sftp.SFTP.PrivateKey), []byte(sftp.SFTP.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(sftp.SFTP.PrivateKey))
+		}
+		if nil != err {
+			return
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if "" != sftp.SFTP.Password {
+		auths = append(auths, ssh.Password(sftp.SFTP.Password))
+	}
+	if 1 > len(auths) {
+		err = errors.New("password or private key is required")
+		return
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if sftp.SFTP.SkipHostKeyVerify {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else if hostKeyCallback, err = newKnownHostsCallback(sftp.SFTP.KnownHosts); nil != err {
+		return
+	}
+
+	timeout := sftp.SFTP.Timeout
+	if 1 > timeout {
+		timeout = 30
+	}
+	ret = &ssh.ClientConfig{
+		User:            sftp.SFTP.Username,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Duration(timeout) * time.Second,
+	}
+	return
+}
+
+// newKnownHostsCallback 用于根据 known_hosts 创建主机密钥校验函数，knownHosts 可以是文件路径，也可以是文件内容。
+func newKnownHostsCallback(knownHosts string) (ret ssh.HostKeyCallback, err error) {
+	knownHosts = strings.TrimSpace(knownHosts)
+	if "" == knownHosts {
+		err = errors.New("known hosts is required to verify host key")
+		return
+	}
+
+	if !strings.Contains(knownHosts, "\n") && gulu.File.IsExist(knownHosts) {
+		ret, err = knownhosts.New(knownHosts)
+		return
+	}
+
+	// knownhosts 只能从文件中解析，内容需要先写入临时文件
+	tmp, err := os.CreateTemp("", "dejavu-known-hosts-*")
+	if nil != err {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(knownHosts + "\n"); nil != err {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); nil != err {
+		return
+	}
+	ret, err = knownhosts.New(tmp.Name())
+	return
+}
+
+// parseErr 用于转换 client 返回的错误，连接断开时会丢弃 client，下次请求时重新建立连接。
+func (sftp *SFTP) parseErr(client *psftp.Client, err error) error {
+	if nil == err {
+		return nil
+	}
+
+	switch {
+	case os.IsNotExist(err):
+		return ErrCloudObjectNotFound
+	case os.IsPermission(err):
+		return ErrCloudForbidden
+	case errors.Is(err, psftp.ErrSSHFxConnectionLost), errors.Is(err, psftp.ErrSSHFxNoConnection):
+		sftp.dropClient(client)
+		return ErrCloudServiceUnavailable
+	}
+	return err
+}
+
+func (sftp *SFTP) getCurrentRepoDirPath() string {
+	return path.Join(sftp.SFTP.Dir, sftp.Dir)
+}
+
+// sftpTempFileSuffix 为上传时临时文件的后缀，列出对象时会忽略这些文件。
+const sftpTempFileSuffix = ".sftp-tmp-"
+
+func isSFTPTempFile(name string) bool {
+	return strings.Contains(name, sftpTempFileSuffix)
+}
@@ -0,0 +1,417 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	psftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpTestServer 描述了用于测试的进程内 SSH 服务，通过 sftp 子系统提供本地目录访问。
+type sftpTestServer struct {
+	listener   net.Listener
+	host       string
+	port       int
+	knownHosts string
+
+	lock  sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+func newSFTPTestServer(t *testing.T, password string) (ret *sftpTestServer) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	conf := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if "dejavu" == conn.User() && password == string(pass) {
+				return nil, nil
+			}
+			return nil, errors.New("password rejected")
+		},
+	}
+	conf.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	addr := listener.Addr().(*net.TCPAddr)
+	ret = &sftpTestServer{
+		listener:   listener,
+		host:       addr.IP.String(),
+		port:       addr.Port,
+		knownHosts: knownhosts.Line([]string{listener.Addr().String()}, signer.PublicKey()),
+	}
+	go ret.serve(conf)
+	return
+}
+
+func (server *sftpTestServer) serve(conf *ssh.ServerConfig) {
+	for {
+		conn, err := server.listener.Accept()
+		if nil != err {
+			return
+		}
+
+		go func() {
+			serverConn, channels, reqs, handshakeErr := ssh.NewServerConn(conn, conf)
+			if nil != handshakeErr {
+				conn.Close()
+				return
+			}
+			server.lock.Lock()
+			server.conns = append(server.conns, serverConn)
+			server.lock.Unlock()
+
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range channels {
+				if "session" != newChannel.ChannelType() {
+					newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+					continue
+				}
+				channel, requests, acceptErr := newChannel.Accept()
+				if nil != acceptErr {
+					continue
+				}
+				go func() {
+					for req := range requests {
+						ok := "subsystem" == req.Type && 4 < len(req.Payload) && "sftp" == string(req.Payload[4:])
+						req.Reply(ok, nil)
+						if !ok {
+							continue
+						}
+
+						sftpServer, serverErr := psftp.NewServer(channel)
+						if nil != serverErr {
+							channel.Close()
+							return
+						}
+						sftpServer.Serve()
+						sftpServer.Close()
+						return
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// dropConns 用于断开全部已建立的连接，模拟网络中断。
+func (server *sftpTestServer) dropConns() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.conns = nil
+}
+
+func (server *sftpTestServer) newSFTP(t *testing.T, rootDir, password string) (ret *SFTP) {
+	ret = NewSFTP(&BaseCloud{Conf: &Conf{
+		Dir:      "main",
+		RepoPath: filepath.Join(t.TempDir(), "repo"),
+		SFTP: &ConfSFTP{
+			Host:       server.host,
+			Port:       server.port,
+			Username:   "dejavu",
+			Password:   password,
+			KnownHosts: server.knownHosts,
+			Dir:        filepath.ToSlash(rootDir),
+		},
+	}})
+	t.Cleanup(func() { ret.Close() })
+	return
+}
+
+func TestSFTPStreamObjects(t *testing.T) {
+	server := newSFTPTestServer(t, "secret")
+	rootDir := t.TempDir()
+	sftp := server.newSFTP(t, rootDir, "secret")
+
+	if err := sftp.CreateRepo("main"); nil != err {
+		t.Fatal(err)
+	}
+	repos, _, err := sftp.GetRepos()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(repos) || "main" != repos[0].Name {
+		t.Fatalf("unexpected repos [%+v]", repos)
+	}
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("stream"), 64*1024)
+	if err = sftp.Put(ctx, "objects/ab/cdef", bytes.NewReader(data), int64(len(data))); nil != err {
+		t.Fatal(err)
+	}
+	info, err := sftp.Stat(ctx, "objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != info.Size {
+		t.Fatalf("unexpected object size [%d]", info.Size)
+	}
+	got, err := sftp.DownloadObject("objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("downloaded data mismatch")
+	}
+
+	objects, err := sftp.List(ctx, "objects")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := objects["ab/cdef"]; !ok || 1 != len(objects) {
+		t.Fatalf("unexpected objects [%v]", objects)
+	}
+
+	// 和 Local 的仓库布局一致，同一个目录可以直接作为 Local 的服务端点
+	local := NewLocal(&BaseCloud{Conf: &Conf{Dir: "main", Local: &ConfLocal{Endpoint: rootDir}}})
+	localData, err := local.DownloadObject("objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, localData) {
+		t.Fatal("local data mismatch")
+	}
+
+	chunks, err := sftp.GetChunks([]string{"abcdef", "0123456789"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(chunks) || "0123456789" != chunks[0] {
+		t.Fatalf("unexpected missing chunks [%v]", chunks)
+	}
+
+	if err = sftp.Delete(ctx, "objects/ab/cdef"); nil != err {
+		t.Fatal(err)
+	}
+	if err = sftp.Delete(ctx, "objects/ab/cdef"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = sftp.Get(ctx, "objects/ab/cdef"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("expected object not found, got [%v]", err)
+	}
+
+	if err = sftp.RemoveRepo("main"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(rootDir, "main")); !os.IsNotExist(err) {
+		t.Fatalf("repo still exists [%v]", err)
+	}
+}
+
+func TestSFTPUploadObject(t *testing.T) {
+	server := newSFTPTestServer(t, "secret")
+	sftp := server.newSFTP(t, t.TempDir(), "secret")
+	sourcePath := filepath.Join(sftp.Conf.RepoPath, "refs", "latest")
+	if err := os.MkdirAll(filepath.Dir(sourcePath), 0755); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sourcePath, []byte("first"), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	if _, err := sftp.UploadObject("refs/latest", false); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sourcePath, []byte("second"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	length, err := sftp.UploadObject("refs/latest", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != length {
+		t.Fatalf("non-overwrite upload returned length [%d]", length)
+	}
+	if length, err = sftp.UploadObject("refs/latest", true); nil != err {
+		t.Fatal(err)
+	}
+	if int64(len("second")) != length {
+		t.Fatalf("unexpected overwrite upload length [%d]", length)
+	}
+
+	refs, err := sftp.listRepoRefs("")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(refs) || "latest" != refs[0].Name || "second" != refs[0].ID {
+		t.Fatalf("unexpected refs [%+v]", refs)
+	}
+}
+
+func TestSFTPPutIfMatch(t *testing.T) {
+	server := newSFTPTestServer(t, "secret")
+	sftp := server.newSFTP(t, t.TempDir(), "secret")
+
+	ctx := context.Background()
+	if err := sftp.PutIfMatch(ctx, "lock-sync", []byte("first"), ""); nil != err {
+		t.Fatal(err)
+	}
+	if err := sftp.PutIfMatch(ctx, "lock-sync", []byte("second"), ""); !errors.Is(err, ErrCloudPreconditionFailed) {
+		t.Fatalf("expected precondition failed, got [%v]", err)
+	}
+	data, etag, err := sftp.GetWithETag(ctx, "lock-sync")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "first" != string(data) {
+		t.Fatalf("unexpected data [%s]", data)
+	}
+
+	var waitGroup sync.WaitGroup
+	var lock sync.Mutex
+	succeeded := 0
+	for i := 0; i < 8; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			if putErr := sftp.PutIfMatch(ctx, "lock-sync", []byte("next"+strconv.Itoa(i)), etag); nil == putErr {
+				lock.Lock()
+				succeeded++
+				lock.Unlock()
+			} else if !errors.Is(putErr, ErrCloudPreconditionFailed) {
+				t.Error(putErr)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+	if 1 != succeeded {
+		t.Fatalf("expected exactly one conditional put to succeed, got [%d]", succeeded)
+	}
+
+	objects, err := sftp.List(ctx, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(objects) {
+		t.Fatalf("unexpected leftover files [%v]", objects)
+	}
+}
+
+func TestSFTPReconnect(t *testing.T) {
+	server := newSFTPTestServer(t, "secret")
+	sftp := server.newSFTP(t, t.TempDir(), "secret")
+
+	if _, err := sftp.UploadBytes("refs/latest", []byte("first"), true); nil != err {
+		t.Fatal(err)
+	}
+	server.dropConns()
+
+	// 连接断开后的请求可能失败，之后的请求应该重新建立连接
+	var data []byte
+	var err error
+	for i := 0; i < 3; i++ {
+		if data, err = sftp.DownloadObject("refs/latest"); nil == err {
+			break
+		}
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "first" != string(data) {
+		t.Fatalf("unexpected data [%s]", data)
+	}
+}
+
+func TestSFTPAuth(t *testing.T) {
+	server := newSFTPTestServer(t, "secret")
+
+	sftp := server.newSFTP(t, t.TempDir(), "wrong")
+	if _, err := sftp.Stat(context.Background(), "refs/latest"); !errors.Is(err, ErrCloudAuthFailed) {
+		t.Fatalf("expected auth failed, got [%v]", err)
+	}
+
+	// 主机密钥和 known_hosts 不匹配时拒绝连接
+	other := newSFTPTestServer(t, "secret")
+	sftp = server.newSFTP(t, t.TempDir(), "secret")
+	sftp.SFTP.KnownHosts = other.knownHosts
+	_, err := sftp.Stat(context.Background(), "refs/latest")
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("expected host key error, got [%v]", err)
+	}
+
+	sftp.SFTP.KnownHosts = ""
+	if _, err = sftp.Stat(context.Background(), "refs/latest"); nil == err {
+		t.Fatal("expected missing known hosts to be rejected")
+	}
+
+	knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+	if err = os.WriteFile(knownHostsPath, []byte(server.knownHosts+"\n"), 0600); nil != err {
+		t.Fatal(err)
+	}
+	sftp.SFTP.KnownHosts = knownHostsPath
+	if _, err = sftp.Stat(context.Background(), "refs/latest"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("expected object not found, got [%v]", err)
+	}
+
+}
+
+func TestSFTPGetNotFoundStatError(t *testing.T) {
+	server := newSFTPTestServer(t, "secret")
+	rootDir := t.TempDir()
+	sftp := server.newSFTP(t, rootDir, "secret")
+	if err := os.WriteFile(filepath.Join(rootDir, "exists"), []byte("data"), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	root := filepath.ToSlash(rootDir)
+	notFound, err := sftp.getNotFound([]string{root + "/exists", root + "/missing"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(notFound) || root+"/missing" != notFound[0] {
+		t.Fatalf("unexpected not found [%v]", notFound)
+	}
+
+	// exists 不是目录，无法确认 exists/chunk 是否存在时应该返回错误而不是当作已经存在
+	if notFound, err = sftp.getNotFound([]string{root + "/exists/chunk"}); nil == err {
+		t.Fatalf("expected stat error, got not found [%v]", notFound)
+	}
+
+	// 测试服务端支持 posix-rename@openssh.com 扩展
+	if !sftp.GetCapabilities().AtomicRename {
+		t.Fatal("expected atomic rename")
+	}
+}
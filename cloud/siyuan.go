@@ -20,15 +20,16 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"os"
+	"io"
+	"net/http"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/88250/gulu"
+	"github.com/imroc/req/v3"
 	"github.com/qiniu/go-sdk/v7/client"
 	"github.com/qiniu/go-sdk/v7/storage"
 	"github.com/siyuan-note/dejavu/entity"
@@ -41,6 +42,10 @@ var clientInit = sync.Once{}
 // SiYuan 描述了思源笔记官方云端存储服务实现。
 type SiYuan struct {
 	*BaseCloud
+
+	uploadClientInit sync.Once
+	uploadClient     *client.Client // 使用 Conf.Proxy 的七牛上传客户端，未配置代理时为空
+	proxyClients     sync.Map       // 使用 Conf.Proxy 的请求客户端，键为原始 *req.Client，值为复制后的 *req.Client
 }
 
 func NewSiYuan(baseCloud *BaseCloud) *SiYuan {
@@ -52,14 +57,42 @@ func NewSiYuan(baseCloud *BaseCloud) *SiYuan {
 }
 
 func (siyuan *SiYuan) UploadObject(filePath string, overwrite bool) (length int64, err error) {
-	absFilePath := filepath.Join(siyuan.Conf.RepoPath, filePath)
-	info, err := os.Stat(absFilePath)
-	if nil != err {
-		logging.LogErrorf("stat failed: %s", err)
+	put := func(ctx context.Context, key string, reader io.Reader, size int64) error {
+		return siyuan.put(ctx, key, reader, size, overwrite)
+	}
+	length, err = putFile(context.Background(), put, siyuan.Conf.RepoPath, filePath)
+	return
+}
+
+func (siyuan *SiYuan) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	if err = siyuan.put(context.Background(), filePath, bytes.NewReader(data), int64(len(data)), overwrite); nil != err {
 		return
 	}
-	length = info.Size()
+	length = int64(len(data))
+	return
+}
+
+func (siyuan *SiYuan) DownloadObject(filePath string) (ret []byte, err error) {
+	ret, err = getBytes(context.Background(), siyuan.Get, filePath)
+	return
+}
+
+func (siyuan *SiYuan) RemoveObject(filePath string) (err error) {
+	err = siyuan.Delete(context.Background(), filePath)
+	return
+}
+
+func (siyuan *SiYuan) ListObjects(pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
+	objInfos, err = siyuan.List(context.Background(), pathPrefix)
+	return
+}
 
+func (siyuan *SiYuan) Put(ctx context.Context, filePath string, reader io.Reader, size int64) (err error) {
+	err = siyuan.put(ctx, filePath, reader, size, true)
+	return
+}
+
+func (siyuan *SiYuan) put(ctx context.Context, filePath string, reader io.Reader, size int64, overwrite bool) (err error) {
 	key := path.Join("siyuan", siyuan.Conf.UserID, "repo", siyuan.Conf.Dir, filePath)
 	keyUploadToken, scopeUploadToken, err := siyuan.requestScopeKeyUploadToken(key, overwrite)
 	if nil != err {
@@ -71,133 +104,151 @@ func (siyuan *SiYuan) UploadObject(filePath string, overwrite bool) (length int6
 		uploadToken = scopeUploadToken
 	}
 
-	formUploader := storage.NewFormUploader(&storage.Config{UseHTTPS: true})
-	ret := storage.PutRet{}
-	err = formUploader.PutFile(context.Background(), &ret, uploadToken, key, absFilePath, nil)
-	if nil != err {
-		if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
-			err = nil
-			return
-		}
-
-		logging.LogErrorf("upload object [%s] failed: %s", key, err)
-		if e, ok := err.(*client.ErrorInfo); ok {
-			if 614 == e.Code || strings.Contains(e.Err, "file exists") {
-				err = nil
-				return
-			}
-			logging.LogErrorf("error detail: %s", e.ErrorDetail())
-		}
+	throttled := siyuan.GetBandwidthLimiter().UploadReader(ctx, reader)
+	defer throttled.Close()
+	reader = throttled
 
-		time.Sleep(1 * time.Second)
-		err = formUploader.PutFile(context.Background(), &ret, uploadToken, key, absFilePath, nil)
-		if nil != err {
-			if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
-				err = nil
-				return
-			}
-
-			logging.LogErrorf("upload object [%s] failed: %s", key, err)
-			if e, ok := err.(*client.ErrorInfo); ok {
-				if 614 == e.Code || strings.Contains(e.Err, "file exists") {
-					err = nil
-					return
-				}
-
-				logging.LogErrorf("error detail: %s", e.ErrorDetail())
-			}
-		}
+	formUploader := siyuan.formUploader()
+	ret := storage.PutRet{}
+	err = formUploader.Put(ctx, &ret, uploadToken, key, reader, size, &storage.PutExtra{})
+	if err = siyuan.parseUploadErr(key, err); nil == err {
+		//logging.LogInfof("uploaded object [%s]", key)
 		return
 	}
 
-	//logging.LogInfof("uploaded object [%s]", key)
+	// 只有可以回退重读的数据流才能重试
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return
+	}
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case <-time.After(1 * time.Second):
+	}
+	if _, err = seeker.Seek(0, io.SeekStart); nil != err {
+		return
+	}
+	err = formUploader.Put(ctx, &ret, uploadToken, key, reader, size, &storage.PutExtra{})
+	err = siyuan.parseUploadErr(key, err)
 	return
 }
 
-func (siyuan *SiYuan) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
-	length = int64(len(data))
+// formUploader 返回七牛表单上传器，配置了 Conf.Proxy 时使用该代理而不是全局的七牛客户端。
+func (siyuan *SiYuan) formUploader() *storage.FormUploader {
+	cfg := &storage.Config{UseHTTPS: true}
+	if siyuan.Conf.Proxy.isEmpty() {
+		return storage.NewFormUploader(cfg)
+	}
 
-	key := path.Join("siyuan", siyuan.Conf.UserID, "repo", siyuan.Conf.Dir, filePath)
-	keyUploadToken, scopeUploadToken, err := siyuan.requestScopeKeyUploadToken(key, overwrite)
-	if nil != err {
-		return
+	siyuan.uploadClientInit.Do(func() {
+		httpClient := *httpclient.GetCloudFileClient2Min()
+		httpClient.Transport = newHTTPTransport(httpClient.Transport, nil, false, siyuan.Conf.Proxy)
+		siyuan.uploadClient = &client.Client{Client: &httpClient}
+	})
+	return storage.NewFormUploaderEx(cfg, siyuan.uploadClient)
+}
+
+func (siyuan *SiYuan) newCloudRequest30s() *req.Request {
+	return siyuan.proxied(httpclient.NewCloudRequest30s())
+}
+
+func (siyuan *SiYuan) newCloudFileRequest2m() *req.Request {
+	return siyuan.proxied(httpclient.NewCloudFileRequest2m())
+}
+
+// proxied 用于让 request 使用 Conf.Proxy，复制后的客户端按照原始客户端缓存以复用连接。
+func (siyuan *SiYuan) proxied(request *req.Request) *req.Request {
+	if siyuan.Conf.Proxy.isEmpty() {
+		return request
 	}
 
-	uploadToken := keyUploadToken
-	if !overwrite {
-		uploadToken = scopeUploadToken
+	base := request.GetClient()
+	proxyClient, ok := siyuan.proxyClients.Load(base)
+	if !ok {
+		proxyClient, _ = siyuan.proxyClients.LoadOrStore(base, base.Clone().SetProxy(siyuan.Conf.Proxy.proxyFunc()))
 	}
+	return request.SetClient(proxyClient.(*req.Client))
+}
 
-	formUploader := storage.NewFormUploader(&storage.Config{UseHTTPS: true})
-	ret := storage.PutRet{}
-	err = formUploader.Put(context.Background(), &ret, uploadToken, key, bytes.NewReader(data), length, &storage.PutExtra{})
-	if nil != err {
-		if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
-			err = nil
-			return
-		}
+// newStatusErr 用于根据响应 resp 的状态码生成操作 action 失败的错误。请求过多和服务端错误分别包装 ErrCloudTooManyRequests 和
+// ErrCloudServiceUnavailable，并保留响应头 Retry-After，以便 Retry 重试。
+func newStatusErr(resp *req.Response, action string) (err error) {
+	switch {
+	case http.StatusTooManyRequests == resp.StatusCode:
+		err = fmt.Errorf("%s failed [%d]: %w", action, resp.StatusCode, ErrCloudTooManyRequests)
+	case 500 <= resp.StatusCode && 600 > resp.StatusCode:
+		err = fmt.Errorf("%s failed [%d]: %w", action, resp.StatusCode, ErrCloudServiceUnavailable)
+	default:
+		return fmt.Errorf("%s failed [%d]", action, resp.StatusCode)
+	}
+	return newRetryAfterError(err, resp.Header)
+}
 
-		logging.LogErrorf("upload object [%s] failed: %s", key, err)
-		if e, ok := err.(*client.ErrorInfo); ok {
-			if 614 == e.Code || strings.Contains(e.Err, "file exists") {
-				err = nil
-				return
-			}
-			logging.LogErrorf("error detail: %s", e.ErrorDetail())
-		}
+// parseUploadErr 用于解析上传错误，对象已经存在时视为上传成功。
+func (siyuan *SiYuan) parseUploadErr(key string, err error) error {
+	if nil == err {
+		return nil
+	}
 
-		time.Sleep(1 * time.Second)
-		err = formUploader.Put(context.Background(), &ret, uploadToken, key, bytes.NewReader(data), length, &storage.PutExtra{})
-		if nil != err {
-			if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
-				err = nil
-				return
-			}
-
-			logging.LogErrorf("upload object [%s] failed: %s", key, err)
-			if e, ok := err.(*client.ErrorInfo); ok {
-				if 614 == e.Code || strings.Contains(e.Err, "file exists") {
-					err = nil
-					return
-				}
-
-				logging.LogErrorf("error detail: %s", e.ErrorDetail())
-			}
-		}
-		return
+	if msg := fmt.Sprintf("%s", err); strings.Contains(msg, "file exists") {
+		return nil
 	}
 
-	//logging.LogInfof("uploaded object [%s]", key)
-	return
+	logging.LogErrorf("upload object [%s] failed: %s", key, err)
+	if e, ok := err.(*client.ErrorInfo); ok {
+		if 614 == e.Code || strings.Contains(e.Err, "file exists") {
+			return nil
+		}
+		logging.LogErrorf("error detail: %s", e.ErrorDetail())
+	}
+	return err
 }
 
-func (siyuan *SiYuan) DownloadObject(filePath string) (ret []byte, err error) {
+func (siyuan *SiYuan) Get(ctx context.Context, filePath string) (reader io.ReadCloser, err error) {
 	key := path.Join("siyuan", siyuan.Conf.UserID, "repo", siyuan.Conf.Dir, filePath)
-	resp, err := httpclient.NewCloudFileRequest2m().Get(siyuan.Endpoint + key)
+	resp, err := siyuan.newCloudFileRequest2m().SetContext(ctx).DisableAutoReadResponse().Get(siyuan.Endpoint + key)
 	if nil != err {
 		err = fmt.Errorf("download object [%s] failed: %s", key, err)
 		return
 	}
 	if 200 != resp.StatusCode {
+		resp.Body.Close()
 		if 404 == resp.StatusCode {
 			err = ErrCloudObjectNotFound
 			return
 		}
-		err = fmt.Errorf("download object [%s] failed [%d]", key, resp.StatusCode)
+		err = newStatusErr(resp, "download object ["+key+"]")
 		return
 	}
+	reader = siyuan.GetBandwidthLimiter().DownloadReader(ctx, resp.Body)
 
-	ret, err = resp.ToBytes()
+	//logging.LogInfof("downloaded object [%s]", key)
+	return
+}
+
+func (siyuan *SiYuan) Stat(ctx context.Context, filePath string) (info *entity.ObjectInfo, err error) {
+	key := path.Join("siyuan", siyuan.Conf.UserID, "repo", siyuan.Conf.Dir, filePath)
+	resp, err := siyuan.newCloudRequest30s().SetContext(ctx).Head(siyuan.Endpoint + key)
 	if nil != err {
-		err = fmt.Errorf("download read data failed: %s", err)
+		err = fmt.Errorf("stat object [%s] failed: %s", key, err)
 		return
 	}
-
-	//logging.LogInfof("downloaded object [%s]", key)
+	if 200 != resp.StatusCode {
+		if 404 == resp.StatusCode {
+			err = ErrCloudObjectNotFound
+			return
+		}
+		err = newStatusErr(resp, "stat object ["+key+"]")
+		return
+	}
+	info = &entity.ObjectInfo{Path: filePath, Size: resp.ContentLength}
+	info.Updated, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
 	return
 }
 
-func (siyuan *SiYuan) RemoveObject(filePath string) (err error) {
+func (siyuan *SiYuan) Delete(ctx context.Context, filePath string) (err error) {
 	userId := siyuan.Conf.UserID
 	dir := siyuan.Conf.Dir
 	token := siyuan.Conf.Token
@@ -205,8 +256,9 @@ func (siyuan *SiYuan) RemoveObject(filePath string) (err error) {
 
 	key := path.Join("siyuan", userId, "repo", dir, filePath)
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
+		SetContext(ctx).
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token, "key": key}).
 		Post(server + "/apis/siyuan/dejavu/removeRepoObject?uid=" + userId)
@@ -219,7 +271,7 @@ func (siyuan *SiYuan) RemoveObject(filePath string) (err error) {
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("remove cloud repo object failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "remove cloud repo object")
 		return
 	}
 
@@ -232,7 +284,7 @@ func (siyuan *SiYuan) RemoveObject(filePath string) (err error) {
 	return
 }
 
-func (siyuan *SiYuan) ListObjects(pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
+func (siyuan *SiYuan) List(ctx context.Context, pathPrefix string) (objInfos map[string]*entity.ObjectInfo, err error) {
 	objInfos = map[string]*entity.ObjectInfo{}
 
 	token := siyuan.Conf.Token
@@ -241,8 +293,9 @@ func (siyuan *SiYuan) ListObjects(pathPrefix string) (objInfos map[string]*entit
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
+		SetContext(ctx).
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token, "pathPrefix": pathPrefix}).
 		Post(server + "/apis/siyuan/dejavu/listRepoObjects?uid=" + userId)
@@ -256,7 +309,7 @@ func (siyuan *SiYuan) ListObjects(pathPrefix string) (objInfos map[string]*entit
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("list cloud repo objects failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "list cloud repo objects")
 		return
 	}
 
@@ -290,7 +343,7 @@ func (siyuan *SiYuan) GetTags() (tags []*Ref, err error) {
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token}).
@@ -305,7 +358,7 @@ func (siyuan *SiYuan) GetTags() (tags []*Ref, err error) {
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("get cloud repo tags failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "get cloud repo tags")
 		return
 	}
 
@@ -339,7 +392,7 @@ func (siyuan *SiYuan) GetIndexes(page int) (indexes []*entity.Index, pageCount,
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]interface{}{"repo": dir, "token": token, "page": page}).
@@ -354,7 +407,7 @@ func (siyuan *SiYuan) GetIndexes(page int) (indexes []*entity.Index, pageCount,
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("get cloud repo indexes failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "get cloud repo indexes")
 		return
 	}
 
@@ -391,7 +444,7 @@ func (siyuan *SiYuan) GetRefsFiles() (fileIDs []string, refs []*Ref, err error)
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudFileRequest2m()
+	request := siyuan.newCloudFileRequest2m()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token}).
@@ -406,7 +459,7 @@ func (siyuan *SiYuan) GetRefsFiles() (fileIDs []string, refs []*Ref, err error)
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("get cloud repo refs files failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "get cloud repo refs files")
 		return
 	}
 
@@ -448,7 +501,7 @@ func (siyuan *SiYuan) GetChunks(excludeChunkIDs []string) (chunkIDs []string, er
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudFileRequest2m()
+	request := siyuan.newCloudFileRequest2m()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]interface{}{"repo": dir, "token": token, "chunks": excludeChunkIDs}).
@@ -462,7 +515,7 @@ func (siyuan *SiYuan) GetChunks(excludeChunkIDs []string) (chunkIDs []string, er
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("get cloud repo refs chunks failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "get cloud repo refs chunks")
 		return
 	}
 
@@ -479,6 +532,11 @@ func (siyuan *SiYuan) GetChunks(excludeChunkIDs []string) (chunkIDs []string, er
 	return
 }
 
+func (siyuan *SiYuan) GetCapabilities() *Capabilities {
+	// 对象通过七牛表单上传，单个文件不超过 1GB；对象列表由服务端接口提供，写入后可能不会立即列出
+	return &Capabilities{MaxObjectSize: 1024 * 1024 * 1024}
+}
+
 func (siyuan *SiYuan) GetStat() (stat *Stat, err error) {
 	token := siyuan.Conf.Token
 	dir := siyuan.Conf.Dir
@@ -486,7 +544,7 @@ func (siyuan *SiYuan) GetStat() (stat *Stat, err error) {
 	server := siyuan.Conf.Server
 
 	result := gulu.Ret.NewResult()
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"repo": dir, "token": token}).
@@ -501,7 +559,7 @@ func (siyuan *SiYuan) GetStat() (stat *Stat, err error) {
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("get cloud repo stat failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "get cloud repo stat")
 		return
 	}
 
@@ -535,7 +593,7 @@ func (siyuan *SiYuan) AddTraffic(traffic *Traffic) {
 	token := siyuan.Conf.Token
 	server := siyuan.Conf.Server
 
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetBody(map[string]interface{}{
 			"token":         token,
@@ -561,7 +619,7 @@ func (siyuan *SiYuan) RemoveRepo(name string) (err error) {
 	token := siyuan.Conf.Token
 	server := siyuan.Conf.Server
 
-	request := httpclient.NewCloudFileRequest2m()
+	request := siyuan.newCloudFileRequest2m()
 	resp, err := request.
 		SetBody(map[string]string{"name": name, "token": token}).
 		Post(server + "/apis/siyuan/dejavu/removeRepo")
@@ -575,7 +633,7 @@ func (siyuan *SiYuan) RemoveRepo(name string) (err error) {
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("remove cloud repo failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "remove cloud repo")
 		return
 	}
 	return
@@ -586,7 +644,7 @@ func (siyuan *SiYuan) CreateRepo(name string) (err error) {
 	server := siyuan.Conf.Server
 
 	result := map[string]interface{}{}
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetSuccessResult(&result).
 		SetBody(map[string]string{"name": name, "token": token}).
@@ -601,7 +659,7 @@ func (siyuan *SiYuan) CreateRepo(name string) (err error) {
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("create cloud repo failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "create cloud repo")
 		return
 	}
 
@@ -619,7 +677,7 @@ func (siyuan *SiYuan) GetRepos() (repos []*Repo, size int64, err error) {
 	userId := siyuan.Conf.UserID
 
 	result := map[string]interface{}{}
-	request := httpclient.NewCloudRequest30s()
+	request := siyuan.newCloudRequest30s()
 	resp, err := request.
 		SetBody(map[string]interface{}{"token": token}).
 		SetSuccessResult(&result).
@@ -634,7 +692,7 @@ func (siyuan *SiYuan) GetRepos() (repos []*Repo, size int64, err error) {
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("request cloud repo list failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "request cloud repo list")
 		return
 	}
 
@@ -715,7 +773,7 @@ func (siyuan *SiYuan) requestScopeKeyUploadToken(key string, overwrite bool) (ke
 	token := siyuan.Conf.Token
 	server := siyuan.Conf.Server
 	var result map[string]interface{}
-	req := httpclient.NewCloudRequest30s().SetSuccessResult(&result)
+	req := siyuan.newCloudRequest30s().SetSuccessResult(&result)
 	req.SetBody(map[string]interface{}{
 		"token":     token,
 		"key":       key,
@@ -733,7 +791,7 @@ func (siyuan *SiYuan) requestScopeKeyUploadToken(key string, overwrite bool) (ke
 			err = ErrCloudAuthFailed
 			return
 		}
-		err = fmt.Errorf("request repo upload token failed [%d]", resp.StatusCode)
+		err = newStatusErr(resp, "request repo upload token")
 		return
 	}
 
@@ -0,0 +1,155 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/siyuan-note/logging"
+)
+
+// ConfTLS 用于描述 HTTPS 连接的 TLS 配置，用于自建 CA 签发证书或者自签名证书的存储服务。
+type ConfTLS struct {
+	CABundle     string   // PEM 格式的 CA 证书，可以是文件路径或者证书内容，用于在系统 CA 之外校验服务端证书
+	Fingerprints []string // 固定的服务端证书 SHA-256 指纹（十六进制，可以包含冒号），配置后只校验服务端证书是否匹配其中之一，不再校验 CA
+	ClientCert   string   // PEM 格式的客户端证书，可以是文件路径或者证书内容，用于双向 TLS 认证
+	ClientKey    string   // PEM 格式的客户端私钥，可以是文件路径或者私钥内容
+}
+
+func (conf *ConfTLS) isEmpty() bool {
+	return nil == conf || ("" == conf.CABundle && 1 > len(conf.Fingerprints) && "" == conf.ClientCert && "" == conf.ClientKey)
+}
+
+// newTLSConfig 用于根据 conf 创建 TLS 配置，skipVerify 为是否跳过服务端证书校验，跳过时仍然会校验固定的证书指纹。
+func newTLSConfig(conf *ConfTLS, skipVerify bool) (ret *tls.Config, err error) {
+	ret = &tls.Config{InsecureSkipVerify: skipVerify}
+	if nil == conf {
+		return
+	}
+
+	if "" != conf.CABundle {
+		data, readErr := readPEM(conf.CABundle)
+		if nil != readErr {
+			err = fmt.Errorf("read CA bundle failed: %w", readErr)
+			return
+		}
+		pool, poolErr := x509.SystemCertPool()
+		if nil != poolErr {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			err = errors.New("no certificate found in CA bundle")
+			return
+		}
+		ret.RootCAs = pool
+	}
+
+	if "" != conf.ClientCert || "" != conf.ClientKey {
+		certPEM, readErr := readPEM(conf.ClientCert)
+		if nil != readErr {
+			err = fmt.Errorf("read client certificate failed: %w", readErr)
+			return
+		}
+		keyPEM, readErr := readPEM(conf.ClientKey)
+		if nil != readErr {
+			err = fmt.Errorf("read client key failed: %w", readErr)
+			return
+		}
+		cert, pairErr := tls.X509KeyPair(certPEM, keyPEM)
+		if nil != pairErr {
+			err = fmt.Errorf("load client certificate failed: %w", pairErr)
+			return
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+
+	if 0 < len(conf.Fingerprints) {
+		pins := map[string]bool{}
+		for _, fingerprint := range conf.Fingerprints {
+			pin := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+			if decoded, decodeErr := hex.DecodeString(pin); nil != decodeErr || sha256.Size != len(decoded) {
+				err = fmt.Errorf("invalid SHA-256 fingerprint [%s]", fingerprint)
+				return
+			}
+			pins[pin] = true
+		}
+
+		// 固定证书指纹时服务端通常使用自签名证书，所以不校验 CA，只校验服务端证书是否匹配指纹
+		ret.InsecureSkipVerify = true
+		ret.VerifyConnection = func(state tls.ConnectionState) error {
+			if 1 > len(state.PeerCertificates) {
+				return errors.New("no server certificate")
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !pins[hex.EncodeToString(sum[:])] {
+				return fmt.Errorf("server certificate fingerprint [%x] not pinned", sum)
+			}
+			return nil
+		}
+	}
+	return
+}
+
+// readPEM 用于读取 PEM 内容，value 为文件路径或者 PEM 内容。
+func readPEM(value string) (ret []byte, err error) {
+	if strings.Contains(value, "-----BEGIN") {
+		ret = []byte(value)
+		return
+	}
+	ret, err = os.ReadFile(value)
+	return
+}
+
+// newHTTPTransport 基于 base 创建使用 TLS 配置 tlsConf 和代理 proxyConf 的 HTTP 传输，base 不是 *http.Transport 时基于 http.DefaultTransport。
+//
+// 配置有误时返回的传输在每次请求时都返回错误，避免在配置有误时降级为不安全的连接。
+func newHTTPTransport(base http.RoundTripper, tlsConf *ConfTLS, skipVerify bool, proxyConf *ConfProxy) http.RoundTripper {
+	baseTransport, ok := base.(*http.Transport)
+	if !ok {
+		baseTransport = http.DefaultTransport.(*http.Transport)
+	}
+	transport := baseTransport.Clone()
+	if !tlsConf.isEmpty() || !ok {
+		tlsConfig, err := newTLSConfig(tlsConf, skipVerify)
+		if nil != err {
+			logging.LogErrorf("create TLS config failed: %s", err)
+			return errRoundTripper{err: err}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if !proxyConf.isEmpty() {
+		transport.Proxy = proxyConf.proxyFunc()
+	}
+	return transport
+}
+
+// errRoundTripper 描述了总是返回错误 err 的 HTTP 传输。
+type errRoundTripper struct {
+	err error
+}
+
+func (rt errRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, rt.err
+}
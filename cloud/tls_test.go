@@ -0,0 +1,179 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cloud
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+func newTLSTestServer(t *testing.T, handler http.Handler, clientCAs *x509.CertPool) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	if nil != clientCAs {
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func serverCertPEM(server *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+}
+
+// newTestClientCert 生成自签名的客户端证书，返回证书、私钥 PEM 和用于服务端校验的 CA 池。
+func newTestClientCert(t *testing.T) (certPEM, keyPEM string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dejavu"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if nil != err {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return
+}
+
+func TestTLSTransport(t *testing.T) {
+	okHandler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
+	server := newTLSTestServer(t, okHandler, nil)
+	sum := sha256.Sum256(server.Certificate().Raw)
+	fingerprint := strings.ToUpper(fmt.Sprintf("% x", sum[:]))
+	fingerprint = strings.ReplaceAll(fingerprint, " ", ":")
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caPath, []byte(serverCertPEM(server)), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		conf    *ConfTLS
+		skip    bool
+		wantErr bool
+	}{
+		{"system CA", &ConfTLS{}, false, true},
+		{"CA bundle content", &ConfTLS{CABundle: serverCertPEM(server)}, false, false},
+		{"CA bundle path", &ConfTLS{CABundle: caPath}, false, false},
+		{"invalid CA bundle", &ConfTLS{CABundle: "-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----"}, false, true},
+		{"pinned", &ConfTLS{Fingerprints: []string{fingerprint}}, false, false},
+		{"wrong pin", &ConfTLS{Fingerprints: []string{strings.Repeat("00", 32)}}, false, true},
+		{"wrong pin skip verify", &ConfTLS{Fingerprints: []string{strings.Repeat("00", 32)}}, true, true},
+		{"invalid pin", &ConfTLS{Fingerprints: []string{"abc"}}, false, true},
+	}
+	for _, c := range cases {
+		client := &http.Client{Transport: newHTTPTransport(nil, c.conf, c.skip, nil)}
+		resp, err := client.Get(server.URL)
+		if nil == err {
+			resp.Body.Close()
+		}
+		if c.wantErr != (nil != err) {
+			t.Fatalf("case [%s] got err [%v]", c.name, err)
+		}
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	certPEM, keyPEM, pool := newTestClientCert(t)
+	server := newTLSTestServer(t, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}), pool)
+
+	for _, withCert := range []bool{false, true} {
+		conf := &ConfTLS{CABundle: serverCertPEM(server)}
+		if withCert {
+			conf.ClientCert, conf.ClientKey = certPEM, keyPEM
+		}
+		client := &http.Client{Transport: newHTTPTransport(nil, conf, false, nil)}
+		resp, err := client.Get(server.URL)
+		if nil == err {
+			resp.Body.Close()
+		}
+		if withCert != (nil == err) {
+			t.Fatalf("request with client cert [%v] got err [%v]", withCert, err)
+		}
+	}
+}
+
+func TestTLSBackends(t *testing.T) {
+	stub := newS3Stub()
+	s3Server := newTLSTestServer(t, stub, nil)
+	s3 := NewS3(&BaseCloud{Conf: &Conf{S3: &ConfS3{
+		Endpoint:  s3Server.URL,
+		AccessKey: "access",
+		SecretKey: "secret",
+		Region:    "us-east-1",
+		Bucket:    "bucket",
+		PathStyle: true,
+		Timeout:   30,
+		TLS:       &ConfTLS{CABundle: serverCertPEM(s3Server)},
+	}}}, http.DefaultClient)
+	if _, err := s3.UploadBytes("refs/latest", []byte("latest"), true); nil != err {
+		t.Fatal(err)
+	}
+	if nil != http.DefaultClient.Transport {
+		t.Fatal("caller's HTTP client should not be changed")
+	}
+
+	davServer := newTLSTestServer(t, http.NotFoundHandler(), nil)
+	webdav := NewWebDAV(&BaseCloud{Conf: &Conf{WebDAV: &ConfWebDAV{
+		Endpoint: davServer.URL,
+		TLS:      &ConfTLS{CABundle: serverCertPEM(davServer)},
+	}}}, gowebdav.NewClient(davServer.URL, "", ""))
+	if _, err := webdav.Stat(context.Background(), "refs/latest"); !errors.Is(err, ErrCloudObjectNotFound) {
+		t.Fatalf("stat over TLS got [%v]", err)
+	}
+}
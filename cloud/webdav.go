@@ -17,15 +17,18 @@
 package cloud
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"io"
 	"io/fs"
 	"math"
-	"os"
+	"net/http"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/88250/gulu"
 	"github.com/siyuan-note/dejavu/entity"
@@ -38,18 +41,50 @@ type WebDAV struct {
 	*BaseCloud
 	Client *gowebdav.Client
 
-	lock sync.Mutex
+	lock        sync.Mutex
+	conditions  sync.Map                               // 条件上传的请求头，键为对象的完整路径，值为 http.Header
+	interceptor func(method string, req *http.Request) // 调用方设置的拦截器
+	dirs        sync.Map                               // 已经存在的目录，键为目录的 URL 路径（不含末尾的 /）
+	retryAfter  sync.Map                               // 服务端要求稍后重试的响应头 Retry-After，键为请求的 URL 路径
+
+	nextcloud          *nextcloudEndpoint // 服务端为 Nextcloud/ownCloud 时用于分块上传，否则为空
+	chunkClient        *http.Client       // 用于分块上传的 HTTP 客户端
+	chunkRetry         *Retry             // 用于重试上传失败的分块
+	chunkedUnsupported atomic.Bool        // 服务端是否不支持分块上传
 }
 
+// NewWebDAV 创建 WebDAV 存储服务，配置了 ConfWebDAV.TLS 或者 Conf.Proxy 时会按照配置替换 client 的 HTTP 传输，否则保留 client 原有的 HTTP 传输。
+//
+// 服务端点为 Nextcloud/ownCloud 的 remote.php 地址时大对象使用分块上传。缓存已经存在的目录、分块上传以及遵循响应头 Retry-After 重试需要通过 SetTransport 设置 HTTP 传输，
+// 需要使用自定义 HTTP 传输的调用方应该在创建后调用 SetTransport，而不是 client.SetTransport。
+//
+// client 只能设置一个拦截器且无法读取已经设置的拦截器，所以需要拦截请求的调用方应该在创建后调用 SetInterceptor，而不是 client.SetInterceptor。
 func NewWebDAV(baseCloud *BaseCloud, client *gowebdav.Client) (ret *WebDAV) {
 	ret = &WebDAV{
 		BaseCloud: baseCloud,
 		Client:    client,
 		lock:      sync.Mutex{},
 	}
+	if conf := baseCloud.Conf.WebDAV; nil != conf {
+		ret.nextcloud = parseNextcloudEndpoint(conf.Endpoint, conf.Username)
+		if !conf.TLS.isEmpty() || !baseCloud.Conf.Proxy.isEmpty() {
+			ret.SetTransport(newHTTPTransport(nil, conf.TLS, conf.SkipTlsVerify, baseCloud.Conf.Proxy))
+		}
+	}
+	// 客户端不支持为单个请求设置请求头，通过拦截器为条件上传添加 If 请求头
+	client.SetInterceptor(ret.intercept)
 	return
 }
 
+// SetTransport 用于设置 HTTP 传输，设置后会缓存已经存在的目录，服务端为 Nextcloud/ownCloud 时启用分块上传。
+func (webdav *WebDAV) SetTransport(transport http.RoundTripper) {
+	webdav.Client.SetTransport(&webdavDirTransport{base: transport, dirs: &webdav.dirs, retryAfter: &webdav.retryAfter})
+	if nil != webdav.nextcloud {
+		webdav.chunkClient = &http.Client{Transport: transport}
+		webdav.chunkRetry = NewRetry(nil, nil)
+	}
+}
+
 func (webdav *WebDAV) GetRepos() (repos []*Repo, size int64, err error) {
 	repos, err = webdav.listRepos()
 	if nil != err {
@@ -63,69 +98,120 @@ func (webdav *WebDAV) GetRepos() (repos []*Repo, size int64, err error) {
 }
 
 func (webdav *WebDAV) UploadObject(filePath string, overwrite bool) (length int64, err error) {
-	absFilePath := filepath.Join(webdav.Conf.RepoPath, filePath)
-	file, err := os.Open(absFilePath)
-	if nil != err {
+	length, err = putFile(context.Background(), webdav.Put, webdav.Conf.RepoPath, filePath)
+	return
+}
+
+func (webdav *WebDAV) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	if err = webdav.Put(context.Background(), filePath, bytes.NewReader(data), int64(len(data))); nil != err {
 		return
 	}
-	defer file.Close()
+	length = int64(len(data))
+	return
+}
 
-	info, err := file.Stat()
-	if nil != err {
+func (webdav *WebDAV) DownloadObject(filePath string) (data []byte, err error) {
+	data, err = getBytes(context.Background(), webdav.Get, filePath)
+	return
+}
+
+func (webdav *WebDAV) RemoveObject(filePath string) (err error) {
+	err = webdav.Delete(context.Background(), filePath)
+	return
+}
+
+// WebDAV 客户端不支持上下文，以下流式接口在请求前检查上下文，并通过可取消的数据流中断传输。
+
+func (webdav *WebDAV) Put(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	if err = ctx.Err(); nil != err {
 		return
 	}
-	length = info.Size()
 
-	key := path.Join(webdav.Dir, "siyuan", "repo", filePath)
+	key = path.Join(webdav.Dir, "siyuan", "repo", key)
 	folder := path.Dir(key)
 	if err = webdav.mkdirAll(folder); nil != err {
 		return
 	}
 
-	err = webdav.Client.WriteStreamWithLength(key, file, length, 0644)
-	err = webdav.parseErr(err)
+	err = webdav.write(ctx, key, reader, size)
+	if gowebdav.IsErrCode(err, http.StatusConflict) || errors.Is(err, ErrCloudObjectNotFound) {
+		// 缓存的目录可能已经被其他客户端删除，清空目录缓存并重新创建目录后重试
+		webdav.dirs.Clear()
+		if seeker, ok := reader.(io.Seeker); ok {
+			if _, seekErr := seeker.Seek(0, io.SeekStart); nil == seekErr {
+				if err = webdav.mkdirAll(folder); nil != err {
+					return
+				}
+				err = webdav.write(ctx, key, reader, size)
+			}
+		}
+	}
 	if nil != err {
 		logging.LogErrorf("upload object [%s] failed: %s", key, err)
+		return
 	}
+	//logging.LogInfof("uploaded object [%s]", key)
 	return
 }
 
-func (webdav *WebDAV) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
-	length = int64(len(data))
-	key := path.Join(webdav.Dir, "siyuan", "repo", filePath)
-	folder := path.Dir(key)
-	err = webdav.mkdirAll(folder)
-	if nil != err {
+// write 用于上传对象 key，服务端为 Nextcloud/ownCloud 时大对象使用分块上传。
+func (webdav *WebDAV) write(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	throttled := webdav.GetBandwidthLimiter().UploadReader(ctx, reader)
+	defer throttled.Close()
+	if webdav.useChunkedUpload(size) {
+		if err = webdav.putChunked(ctx, key, throttled, size); !errors.Is(err, errChunkedUploadUnsupported) {
+			return
+		}
+	}
+
+	err = webdav.Client.WriteStreamWithLength(key, throttled, size, 0644)
+	err = webdav.parseErr(err)
+	return
+}
+
+func (webdav *WebDAV) Get(ctx context.Context, key string) (reader io.ReadCloser, err error) {
+	if err = ctx.Err(); nil != err {
 		return
 	}
 
-	err = webdav.Client.Write(key, data, 0644)
+	key = path.Join(webdav.Dir, "siyuan", "repo", key)
+	body, err := webdav.Client.ReadStream(key)
 	err = webdav.parseErr(err)
 	if nil != err {
-		logging.LogErrorf("upload object [%s] failed: %s", key, err)
 		return
 	}
-	//logging.LogInfof("uploaded object [%s]", key)
+	reader = webdav.GetBandwidthLimiter().DownloadReader(ctx, body)
+
+	//logging.LogInfof("downloaded object [%s]", key)
 	return
 }
 
-func (webdav *WebDAV) DownloadObject(filePath string) (data []byte, err error) {
-	key := path.Join(webdav.Dir, "siyuan", "repo", filePath)
-	data, err = webdav.Client.Read(key)
+func (webdav *WebDAV) Stat(ctx context.Context, key string) (info *entity.ObjectInfo, err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	fileInfo, err := webdav.Client.Stat(path.Join(webdav.Dir, "siyuan", "repo", key))
 	err = webdav.parseErr(err)
 	if nil != err {
 		return
 	}
-
-	//logging.LogInfof("downloaded object [%s]", key)
+	info = &entity.ObjectInfo{Path: key, Size: fileInfo.Size(), Updated: fileInfo.ModTime()}
 	return
 }
 
-func (webdav *WebDAV) RemoveObject(filePath string) (err error) {
-	key := path.Join(webdav.Dir, "siyuan", "repo", filePath)
+func (webdav *WebDAV) Delete(ctx context.Context, key string) (err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	key = path.Join(webdav.Dir, "siyuan", "repo", key)
 	err = webdav.Client.Remove(key)
 	err = webdav.parseErr(err)
 	if nil != err {
+		if errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+		}
 		return
 	}
 
@@ -259,6 +345,11 @@ func (webdav *WebDAV) GetIndex(id string) (index *entity.Index, err error) {
 	return
 }
 
+func (webdav *WebDAV) GetCapabilities() *Capabilities {
+	// 条件上传依赖服务端返回 ETag，常见的服务端（Apache mod_dav、Nextcloud 等）在上传完成后才替换对象
+	return &Capabilities{ConditionalWrite: true, AtomicRename: true, ConsistentListing: true}
+}
+
 func (webdav *WebDAV) GetConcurrentReqs() (ret int) {
 	ret = webdav.Conf.WebDAV.ConcurrentReqs
 	if 1 > ret {
@@ -271,7 +362,15 @@ func (webdav *WebDAV) GetConcurrentReqs() (ret int) {
 }
 
 func (webdav *WebDAV) ListObjects(pathPrefix string) (ret map[string]*entity.ObjectInfo, err error) {
+	ret, err = webdav.List(context.Background(), pathPrefix)
+	return
+}
+
+func (webdav *WebDAV) List(ctx context.Context, pathPrefix string) (ret map[string]*entity.ObjectInfo, err error) {
 	ret = map[string]*entity.ObjectInfo{}
+	if err = ctx.Err(); nil != err {
+		return
+	}
 
 	endWithSlash := strings.HasSuffix(pathPrefix, "/")
 	pathPrefix = path.Join(webdav.Dir, "siyuan", "repo", pathPrefix)
@@ -281,6 +380,10 @@ func (webdav *WebDAV) ListObjects(pathPrefix string) (ret map[string]*entity.Obj
 
 	infos, err := webdav.Client.ReadDir(pathPrefix)
 	if nil != err {
+		if err = webdav.parseErr(err); errors.Is(err, ErrCloudObjectNotFound) {
+			err = nil
+			return
+		}
 		logging.LogErrorf("list objects [%s] failed: %s", pathPrefix, err)
 		return
 	}
@@ -408,6 +511,96 @@ func (webdav *WebDAV) repoIndex(repoDir, id string) (ret *entity.Index, err erro
 	return
 }
 
+func (webdav *WebDAV) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	key = path.Join(webdav.Dir, "siyuan", "repo", key)
+	fileInfo, err := webdav.Client.Stat(key)
+	err = webdav.parseErr(err)
+	if nil != err {
+		return
+	}
+	if file, ok := fileInfo.(interface{ ETag() string }); ok {
+		etag = file.ETag()
+	}
+	if "" == etag {
+		// 服务端不返回 ETag 时无法条件上传
+		err = ErrUnsupported
+		return
+	}
+
+	// 先获取 ETag 再读取数据，如果期间对象被修改，使用旧的 ETag 条件上传会失败
+	data, err = webdav.Client.Read(key)
+	err = webdav.parseErr(err)
+	return
+}
+
+func (webdav *WebDAV) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+
+	key = path.Join(webdav.Dir, "siyuan", "repo", key)
+	if err = webdav.mkdirAll(path.Dir(key)); nil != err {
+		return
+	}
+
+	header := http.Header{}
+	if "" == etag {
+		header.Set("If-None-Match", "*")
+	} else {
+		if !strings.HasPrefix(etag, "\"") && !strings.HasPrefix(etag, "W/") {
+			etag = "\"" + etag + "\""
+		}
+		header.Set("If-Match", etag)
+		header.Set("If", "(["+etag+"])")
+	}
+	conditionKey := "/" + strings.TrimPrefix(key, "/")
+	webdav.conditions.Store(conditionKey, header)
+	defer webdav.conditions.Delete(conditionKey)
+
+	err = webdav.Client.WriteStreamWithLength(key, bytes.NewReader(data), int64(len(data)), 0644)
+	if gowebdav.IsErrCode(err, http.StatusPreconditionFailed) {
+		err = ErrCloudPreconditionFailed
+		return
+	}
+	if gowebdav.IsErrCode(err, http.StatusNotImplemented) {
+		err = ErrUnsupported
+		return
+	}
+	err = webdav.parseErr(err)
+	if nil != err {
+		logging.LogErrorf("upload object [%s] failed: %s", key, err)
+	}
+	return
+}
+
+// SetInterceptor 用于设置拦截器，拦截器在添加条件上传的请求头之后调用。
+func (webdav *WebDAV) SetInterceptor(interceptor func(method string, req *http.Request)) {
+	webdav.interceptor = interceptor
+}
+
+func (webdav *WebDAV) intercept(method string, req *http.Request) {
+	if nil != webdav.interceptor {
+		defer webdav.interceptor(method, req)
+	}
+	if http.MethodPut != method {
+		return
+	}
+
+	webdav.conditions.Range(func(key, value any) bool {
+		if !strings.HasSuffix(req.URL.Path, key.(string)) {
+			return true
+		}
+		for name, values := range value.(http.Header) {
+			req.Header[name] = values
+		}
+		return false
+	})
+}
+
 func (webdav *WebDAV) parseErr(err error) error {
 	if nil == err {
 		return nil
@@ -421,8 +614,12 @@ func (webdav *WebDAV) parseErr(err error) error {
 				statusErr := e.(gowebdav.StatusError)
 				if 404 == statusErr.Status {
 					return ErrCloudObjectNotFound
-				} else if 503 == statusErr.Status || 502 == statusErr.Status || 500 == statusErr.Status {
-					return ErrCloudServiceUnavailable
+				} else if 503 == statusErr.Status || 502 == statusErr.Status || 500 == statusErr.Status || 504 == statusErr.Status {
+					return webdav.retryAfterErr(err.(*fs.PathError).Path, ErrCloudServiceUnavailable)
+				} else if 429 == statusErr.Status {
+					return webdav.retryAfterErr(err.(*fs.PathError).Path, ErrCloudTooManyRequests)
+				} else if 507 == statusErr.Status {
+					return ErrCloudQuotaExceeded
 				} else if 200 == statusErr.Status {
 					return nil
 				}
@@ -436,52 +633,95 @@ func (webdav *WebDAV) parseErr(err error) error {
 	return err
 }
 
-func (webdav *WebDAV) mkdirAll(folder string) (err error) {
-	cacheKey := "webdav.dir." + folder
-	_, ok := cache.Get(cacheKey)
-	if ok {
-		return
-	}
+// retryAfterErr 用于使用请求 filePath 时服务端返回的响应头 Retry-After 包装错误 err。
+func (webdav *WebDAV) retryAfterErr(filePath string, err error) error {
+	suffix := "/" + strings.TrimPrefix(filePath, "/")
+	var ret error = err
+	webdav.retryAfter.Range(func(key, value any) bool {
+		if !strings.HasSuffix(key.(string), suffix) {
+			return true
+		}
+		webdav.retryAfter.Delete(key)
+		ret = newRetryAfterError(err, http.Header{"Retry-After": []string{value.(string)}})
+		return false
+	})
+	return ret
+}
 
+// mkdirAll 用于创建目录 folder 及其上级目录。
+//
+// 已经存在的目录由 webdavDirTransport 缓存，不会重复请求，客户端上传前创建父目录的请求也同样不会发送到服务端。
+func (webdav *WebDAV) mkdirAll(folder string) (err error) {
 	webdav.lock.Lock()
 	defer webdav.lock.Unlock()
 
-	info, err := webdav.Client.Stat(folder)
+	err = webdav.Client.MkdirAll(folder, 0755)
+	err = webdav.parseErr(err)
 	if nil != err {
-		err = webdav.parseErr(err)
-		if nil == err {
-			cache.Set(cacheKey, true, 1)
-			return
-		}
+		logging.LogErrorf("mkdir [%s] failed: %s", folder, err)
+	}
+	return
+}
 
-		if ErrCloudObjectNotFound != err {
+// webdavDirTransport 描述了缓存已经存在的目录的 HTTP 传输。
+//
+// MKCOL 请求的目录已经缓存时直接返回 405（目录已经存在），不发送到服务端。上传文件时服务端返回 404 或者 409 说明
+// 父目录已经被其他客户端删除，此时清空缓存；删除目录时移除该目录及其下级目录的缓存。
+// WebDAV 客户端返回的错误只包含状态码，所以服务端返回 429 或者 503 时在这里记录响应头 Retry-After，供 WebDAV.parseErr 使用。
+type webdavDirTransport struct {
+	base       http.RoundTripper
+	dirs       *sync.Map
+	retryAfter *sync.Map
+}
+
+func (transport *webdavDirTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	dir := strings.TrimSuffix(req.URL.Path, "/")
+	if "MKCOL" == req.Method {
+		if _, ok := transport.dirs.Load(dir); ok {
+			resp = &http.Response{
+				Status:     "405 " + http.StatusText(http.StatusMethodNotAllowed),
+				StatusCode: http.StatusMethodNotAllowed,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}
 			return
 		}
 	}
-	i := info.(*gowebdav.File)
-	if nil != i && i.IsDir() {
-		cache.Set(cacheKey, true, 1)
+
+	resp, err = transport.base.RoundTrip(req)
+	if nil != err {
 		return
 	}
 
-	paths := strings.Split(folder, "/")
-	sub := "/"
-	for _, e := range paths {
-		if e == "" {
-			continue
+	if nil != transport.retryAfter {
+		if retryAfter := resp.Header.Get("Retry-After"); "" != retryAfter && (http.StatusTooManyRequests == resp.StatusCode || 500 <= resp.StatusCode) {
+			transport.retryAfter.Store(req.URL.Path, retryAfter)
+		} else {
+			transport.retryAfter.Delete(req.URL.Path)
 		}
-		sub += e + "/"
+	}
 
-		if _, ok := cache.Get("webdav.dir." + sub); ok {
-			continue
+	switch req.Method {
+	case "MKCOL":
+		if http.StatusCreated == resp.StatusCode || http.StatusMethodNotAllowed == resp.StatusCode {
+			transport.dirs.Store(dir, true)
 		}
-
-		err = webdav.Client.Mkdir(sub, 0755)
-		err = webdav.parseErr(err)
-		if nil != err {
-			logging.LogErrorf("mkdir [%s] failed: %s", folder, err)
-		} else {
-			cache.Set("webdav.dir."+sub, true, 1)
+	case http.MethodPut:
+		if http.StatusNotFound == resp.StatusCode || http.StatusConflict == resp.StatusCode {
+			transport.dirs.Clear()
+		}
+	case http.MethodDelete:
+		if 200 <= resp.StatusCode && 300 > resp.StatusCode {
+			transport.dirs.Range(func(key, value any) bool {
+				if key.(string) == dir || strings.HasPrefix(key.(string), dir+"/") {
+					transport.dirs.Delete(key)
+				}
+				return true
+			})
 		}
 	}
 	return
@@ -0,0 +1,239 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/logging"
+	"github.com/studio-b12/gowebdav"
+)
+
+const (
+	webdavDefaultChunkedUploadThreshold = 10 * 1024 * 1024
+	webdavDefaultChunkSize              = 10 * 1024 * 1024
+	webdavMinChunkSize                  = 5 * 1024 * 1024        // Nextcloud 分块上传 v2 要求除最后一块外每块不小于 5MB
+	webdavMaxChunkSize                  = 5 * 1024 * 1024 * 1024 // Nextcloud 分块上传 v2 要求每块不大于 5GB
+	webdavMaxChunks                     = 10000                  // Nextcloud 分块上传 v2 要求单个文件最多 10000 块
+)
+
+// errChunkedUploadUnsupported 表示服务端不支持分块上传，此时需要改用普通上传。
+var errChunkedUploadUnsupported = errors.New("chunked upload unsupported")
+
+// nextcloudEndpoint 描述了 Nextcloud/ownCloud 分块上传所需的地址。
+type nextcloudEndpoint struct {
+	uploads *url.URL // 用户的分块上传目录，比如 https://cloud.example.com/remote.php/dav/uploads/alice
+	files   *url.URL // 服务端点对应的文件目录，比如 https://cloud.example.com/remote.php/dav/files/alice/sync
+}
+
+// parseNextcloudEndpoint 用于根据服务端点判断服务端是否为 Nextcloud/ownCloud，不是时返回 nil。
+//
+// 服务端点可以是 remote.php/dav/files/<user>/ 或者旧的 remote.php/webdav/，后者使用用户名 username 作为用户 ID。
+func parseNextcloudEndpoint(endpoint, username string) (ret *nextcloudEndpoint) {
+	u, err := url.Parse(endpoint)
+	if nil != err || "" == u.Host {
+		return
+	}
+
+	i := strings.Index(u.Path, "/remote.php/")
+	if 0 > i {
+		return
+	}
+	prefix, rest := u.Path[:i], strings.Trim(u.Path[i+len("/remote.php/"):], "/")
+	var user, dir string
+	switch {
+	case strings.HasPrefix(rest, "dav/files/"):
+		user, dir, _ = strings.Cut(strings.TrimPrefix(rest, "dav/files/"), "/")
+	case "webdav" == rest || strings.HasPrefix(rest, "webdav/"):
+		user, dir = username, strings.TrimPrefix(strings.TrimPrefix(rest, "webdav"), "/")
+	}
+	if "" == user {
+		return
+	}
+
+	uploads, files := *u, *u
+	uploads.Path, uploads.RawPath = path.Join(prefix, "/remote.php/dav/uploads", user), ""
+	files.Path, files.RawPath = path.Join(prefix, "/remote.php/dav/files", user, dir), ""
+	uploads.RawQuery, files.RawQuery = "", ""
+	ret = &nextcloudEndpoint{uploads: &uploads, files: &files}
+	return
+}
+
+// fileURL 返回相对服务端点的路径 key 对应的文件地址。
+func (endpoint *nextcloudEndpoint) fileURL(key string) string {
+	u := *endpoint.files
+	u.Path = path.Join(u.Path, key)
+	return u.String()
+}
+
+// uploadURL 返回分块上传目录 transferID 下 name 的地址，name 为空时返回分块上传目录的地址。
+func (endpoint *nextcloudEndpoint) uploadURL(transferID, name string) string {
+	u := *endpoint.uploads
+	u.Path = path.Join(u.Path, transferID, name)
+	return u.String()
+}
+
+// useChunkedUpload 用于判断大小为 size 的对象是否使用分块上传。
+func (webdav *WebDAV) useChunkedUpload(size int64) bool {
+	if nil == webdav.nextcloud || nil == webdav.chunkClient || webdav.chunkedUnsupported.Load() {
+		return false
+	}
+
+	threshold := webdav.Conf.WebDAV.ChunkedUploadThreshold
+	if 0 > threshold {
+		return false
+	}
+	if 0 == threshold {
+		threshold = webdavDefaultChunkedUploadThreshold
+	}
+	return threshold <= size
+}
+
+// chunkSize 返回大小为 size 的对象分块上传时的块大小，块数超过上限时增大块。
+func (webdav *WebDAV) chunkSize(size int64) (ret int64) {
+	ret = webdav.Conf.WebDAV.ChunkSize
+	if 1 > ret {
+		ret = webdavDefaultChunkSize
+	}
+	if minSize := (size + webdavMaxChunks - 1) / webdavMaxChunks; minSize > ret {
+		ret = minSize
+	}
+	ret = max(webdavMinChunkSize, min(webdavMaxChunkSize, ret))
+	return
+}
+
+func (webdav *WebDAV) getChunkRetry() *Retry {
+	if nil == webdav.chunkRetry {
+		return NewRetry(nil, nil)
+	}
+	return webdav.chunkRetry
+}
+
+func (webdav *WebDAV) getTimeout() time.Duration {
+	timeout := webdav.Conf.WebDAV.Timeout
+	if 1 > timeout {
+		timeout = 30
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// putChunked 用于通过 Nextcloud 分块上传 v2 协议上传对象 key。
+//
+// 先创建上传目录，然后顺序上传分块，失败的分块单独重试，最后通过一次 MOVE 在服务端合并为目标文件，
+// 单个请求的大小不超过块大小，因此不受服务端 PHP 上传大小限制。上传失败时删除上传目录，避免已上传的分块残留。
+// 服务端不支持分块上传时返回 errChunkedUploadUnsupported，此时还未读取 reader，调用方可以改用普通上传。
+func (webdav *WebDAV) putChunked(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	transferID := "dejavu-" + gulu.Rand.String(16)
+	uploadURL := webdav.nextcloud.uploadURL(transferID, "")
+	header := http.Header{}
+	header.Set("Destination", webdav.nextcloud.fileURL(key))
+	status, err := webdav.chunkRequest(ctx, webdav.getTimeout(), "MKCOL", uploadURL, nil, -1, header)
+	switch status {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		webdav.chunkedUnsupported.Store(true)
+		logging.LogWarnf("chunked upload is not supported by [%s]: %d", webdav.Conf.WebDAV.Endpoint, status)
+		err = errChunkedUploadUnsupported
+	}
+	if nil != err {
+		return
+	}
+
+	defer func() {
+		if nil == err {
+			return
+		}
+
+		// 上传可能因为 ctx 取消而失败，所以使用新的上下文删除上传目录
+		if _, abortErr := webdav.chunkRequest(context.Background(), webdav.getTimeout(), http.MethodDelete, uploadURL, nil, -1, nil); nil != abortErr {
+			logging.LogWarnf("abort chunked upload [%s] failed: %s", key, abortErr)
+		}
+	}()
+
+	header.Set("OC-Total-Length", strconv.FormatInt(size, 10))
+	chunkSize := webdav.chunkSize(size)
+	buf := make([]byte, chunkSize)
+	chunks := 0
+	for offset := int64(0); offset < size; {
+		data := buf[:min(chunkSize, size-offset)]
+		if _, err = io.ReadFull(reader, data); nil != err {
+			return
+		}
+		offset += int64(len(data))
+		chunks++
+
+		chunkURL := webdav.nextcloud.uploadURL(transferID, fmt.Sprintf("%05d", chunks))
+		err = webdav.getChunkRetry().do(ctx, "upload chunk", fmt.Sprintf("%s#%d", key, chunks), func() error {
+			_, putErr := webdav.chunkRequest(ctx, webdav.getTimeout(), http.MethodPut, chunkURL, bytes.NewReader(data), int64(len(data)), header)
+			return putErr
+		})
+		if nil != err {
+			return
+		}
+	}
+
+	// 服务端在 MOVE 时合并分块，耗时和块数相关，所以按照块数延长超时时间
+	header.Set("Overwrite", "T")
+	timeout := webdav.getTimeout() * time.Duration(1+chunks/10)
+	_, err = webdav.chunkRequest(ctx, timeout, "MOVE", webdav.nextcloud.uploadURL(transferID, ".file"), nil, -1, header)
+	return
+}
+
+// chunkRequest 用于发送分块上传请求，返回响应状态码，状态码不是 2xx 时同时返回对应的错误。
+func (webdav *WebDAV) chunkRequest(ctx context.Context, timeout time.Duration, method, u string, body io.Reader, size int64, header http.Header) (status int, err error) {
+	ctx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if nil != err {
+		return
+	}
+	if 0 <= size && nil != body {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.SetBasicAuth(webdav.Conf.WebDAV.Username, webdav.Conf.WebDAV.Password)
+
+	resp, err := webdav.chunkClient.Do(req)
+	if nil != err {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	status = resp.StatusCode
+	switch {
+	case 200 <= status && 300 > status:
+	case http.StatusUnauthorized == status:
+		err = ErrCloudAuthFailed
+	case http.StatusForbidden == status:
+		err = ErrCloudForbidden
+	default:
+		err = webdav.parseErr(gowebdav.NewPathError(method, req.URL.Path, status))
+	}
+	return
+}
@@ -0,0 +1,335 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+	xwebdav "golang.org/x/net/webdav"
+)
+
+const (
+	nextcloudTestFilesPrefix   = "/remote.php/dav/files/dejavu"
+	nextcloudTestUploadsPrefix = "/remote.php/dav/uploads/dejavu"
+)
+
+// nextcloudTestServer 描述了用于测试的 Nextcloud WebDAV 服务，支持分块上传 v2 协议并限制单个 PUT 请求的大小。
+type nextcloudTestServer struct {
+	server     *httptest.Server
+	fs         xwebdav.FileSystem
+	files      http.Handler
+	maxPutSize int64 // 文件目录下单个 PUT 请求的最大字节数，模拟 PHP 上传大小限制
+	chunked    bool  // 是否支持分块上传
+
+	lock       sync.Mutex
+	requests   map[string]int               // 各请求的次数，键为方法和命名空间，比如 "MKCOL files"
+	uploads    map[string]map[string][]byte // 未完成的分块上传，键为上传目录和块名
+	failChunks map[string]int               // 需要失败的块及其失败次数
+}
+
+func newNextcloudTestServer(t *testing.T, chunked bool) (ret *nextcloudTestServer) {
+	fs := xwebdav.NewMemFS()
+	ret = &nextcloudTestServer{
+		fs:         fs,
+		files:      &xwebdav.Handler{Prefix: nextcloudTestFilesPrefix, FileSystem: fs, LockSystem: xwebdav.NewMemLS()},
+		maxPutSize: 6 * 1024 * 1024,
+		chunked:    chunked,
+		requests:   map[string]int{},
+		uploads:    map[string]map[string][]byte{},
+		failChunks: map[string]int{},
+	}
+	ret.server = httptest.NewServer(ret)
+	t.Cleanup(ret.server.Close)
+	return
+}
+
+func (server *nextcloudTestServer) count(key string) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.requests[key]
+}
+
+func (server *nextcloudTestServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if username, password, _ := request.BasicAuth(); "dejavu" != username || "secret" != password {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="Nextcloud"`)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(request.URL.Path, nextcloudTestFilesPrefix+"/"):
+		server.lock.Lock()
+		server.requests[request.Method+" files"]++
+		server.lock.Unlock()
+		if http.MethodPut == request.Method && server.maxPutSize < request.ContentLength {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		server.files.ServeHTTP(writer, request)
+	case strings.HasPrefix(request.URL.Path, nextcloudTestUploadsPrefix+"/") && server.chunked:
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		server.requests[request.Method+" uploads"]++
+		server.serveUpload(writer, request)
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (server *nextcloudTestServer) serveUpload(writer http.ResponseWriter, request *http.Request) {
+	transferID, name, _ := strings.Cut(strings.TrimPrefix(request.URL.Path, nextcloudTestUploadsPrefix+"/"), "/")
+	destination, _ := url.Parse(request.Header.Get("Destination"))
+	if http.MethodDelete != request.Method && (nil == destination || !strings.HasPrefix(destination.Path, nextcloudTestFilesPrefix+"/")) {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	chunks, ok := server.uploads[transferID]
+	switch request.Method {
+	case "MKCOL":
+		server.uploads[transferID] = map[string][]byte{}
+		writer.WriteHeader(http.StatusCreated)
+	case http.MethodPut:
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if 0 < server.failChunks[name] {
+			server.failChunks[name]--
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := io.ReadAll(request.Body)
+		chunks[name] = data
+		writer.WriteHeader(http.StatusCreated)
+	case "MOVE":
+		if !ok || ".file" != name {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var names []string
+		for chunkName := range chunks {
+			names = append(names, chunkName)
+		}
+		sort.Strings(names)
+		buf := &bytes.Buffer{}
+		for _, chunkName := range names {
+			buf.Write(chunks[chunkName])
+		}
+		if strconv.Itoa(buf.Len()) != request.Header.Get("OC-Total-Length") {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		file, err := server.fs.OpenFile(request.Context(), strings.TrimPrefix(destination.Path, nextcloudTestFilesPrefix), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if nil != err {
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		file.Write(buf.Bytes())
+		file.Close()
+		delete(server.uploads, transferID)
+		writer.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(server.uploads, transferID)
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (server *nextcloudTestServer) newWebDAV(t *testing.T, endpoint string) (ret *WebDAV) {
+	conf := &ConfWebDAV{
+		Endpoint:               endpoint,
+		Username:               "dejavu",
+		Password:               "secret",
+		Timeout:                30,
+		ChunkedUploadThreshold: 6 * 1024 * 1024,
+		ChunkSize:              webdavMinChunkSize,
+	}
+	ret = NewWebDAV(&BaseCloud{Conf: &Conf{Dir: "main", RepoPath: t.TempDir(), WebDAV: conf}}, gowebdav.NewClient(endpoint, conf.Username, conf.Password))
+	ret.SetTransport(http.DefaultTransport)
+	if nil != ret.chunkRetry {
+		ret.chunkRetry.sleep = func(context.Context, time.Duration) error { return nil }
+	}
+	return
+}
+
+func TestParseNextcloudEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		username string
+		uploads  string
+		file     string
+	}{
+		{"https://cloud.example.com/remote.php/dav/files/alice/", "", "https://cloud.example.com/remote.php/dav/uploads/alice", "https://cloud.example.com/remote.php/dav/files/alice/siyuan/repo/refs/latest"},
+		{"https://cloud.example.com/nc/remote.php/dav/files/alice/sync", "bob", "https://cloud.example.com/nc/remote.php/dav/uploads/alice", "https://cloud.example.com/nc/remote.php/dav/files/alice/sync/siyuan/repo/refs/latest"},
+		{"https://cloud.example.com/remote.php/webdav/", "alice@example.com", "https://cloud.example.com/remote.php/dav/uploads/alice@example.com", "https://cloud.example.com/remote.php/dav/files/alice@example.com/siyuan/repo/refs/latest"},
+		{"https://cloud.example.com/remote.php/webdav/", "", "", ""},
+		{"https://dav.example.com/dav/", "alice", "", ""},
+	}
+	for _, c := range cases {
+		endpoint := parseNextcloudEndpoint(c.endpoint, c.username)
+		if "" == c.uploads {
+			if nil != endpoint {
+				t.Fatalf("endpoint [%s] detected as Nextcloud", c.endpoint)
+			}
+			continue
+		}
+		if nil == endpoint {
+			t.Fatalf("endpoint [%s] not detected as Nextcloud", c.endpoint)
+		}
+		if got := endpoint.uploadURL("", ""); c.uploads != got {
+			t.Fatalf("endpoint [%s] got uploads [%s]", c.endpoint, got)
+		}
+		if got := endpoint.fileURL("siyuan/repo/refs/latest"); c.file != got {
+			t.Fatalf("endpoint [%s] got file [%s]", c.endpoint, got)
+		}
+	}
+}
+
+func TestWebDAVChunkedUpload(t *testing.T) {
+	server := newNextcloudTestServer(t, true)
+	webdav := server.newWebDAV(t, server.server.URL+nextcloudTestFilesPrefix+"/")
+
+	if _, err := webdav.UploadBytes("refs/latest", []byte("latest"), true); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != server.count("PUT files") || 0 != server.count("MKCOL uploads") {
+		t.Fatalf("small object uploaded by [%d] puts and [%d] chunked uploads", server.count("PUT files"), server.count("MKCOL uploads"))
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*webdavMinChunkSize+1024*1024)/16)
+	server.failChunks["00002"] = 2
+	if _, err := webdav.UploadBytes("objects/ab/large", data, true); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != server.count("PUT files") || 1 != server.count("MKCOL uploads") || 1 != server.count("MOVE uploads") {
+		t.Fatalf("large object uploaded by [%d] puts and [%d] chunked uploads", server.count("PUT files"), server.count("MKCOL uploads"))
+	}
+	if 5 != server.count("PUT uploads") {
+		t.Fatalf("got [%d] chunk puts", server.count("PUT uploads"))
+	}
+	if 0 != len(server.uploads) {
+		t.Fatalf("got [%d] incomplete uploads", len(server.uploads))
+	}
+	if got, err := webdav.DownloadObject("objects/ab/large"); nil != err || !bytes.Equal(data, got) {
+		t.Fatalf("download large object got [%d] bytes, err [%v]", len(got), err)
+	}
+
+	// 分块上传失败时删除上传目录
+	server.failChunks["00001"] = 100
+	if _, err := webdav.UploadBytes("objects/ab/failed", data, true); nil == err {
+		t.Fatal("chunked upload should fail")
+	}
+	if 0 != len(server.uploads) || 1 != server.count("DELETE uploads") {
+		t.Fatalf("got [%d] incomplete uploads after abort", len(server.uploads))
+	}
+}
+
+func TestWebDAVChunkedUploadUnsupported(t *testing.T) {
+	server := newNextcloudTestServer(t, false)
+	server.maxPutSize = 64 * 1024 * 1024
+	webdav := server.newWebDAV(t, server.server.URL+nextcloudTestFilesPrefix+"/")
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 7*1024*1024/16)
+	for _, key := range []string{"objects/ab/large1", "objects/ab/large2"} {
+		if _, err := webdav.UploadBytes(key, data, true); nil != err {
+			t.Fatal(err)
+		}
+		if got, err := webdav.DownloadObject(key); nil != err || !bytes.Equal(data, got) {
+			t.Fatalf("download [%s] got [%d] bytes, err [%v]", key, len(got), err)
+		}
+	}
+	if 2 != server.count("PUT files") || !webdav.chunkedUnsupported.Load() {
+		t.Fatalf("got [%d] puts, chunked upload unsupported [%v]", server.count("PUT files"), webdav.chunkedUnsupported.Load())
+	}
+}
+
+func TestWebDAVDirCache(t *testing.T) {
+	server := newNextcloudTestServer(t, true)
+	webdav := server.newWebDAV(t, server.server.URL+nextcloudTestFilesPrefix+"/")
+
+	upload := func(key string, expectedMkcols int) {
+		if _, err := webdav.UploadBytes(key, []byte(key), true); nil != err {
+			t.Fatal(err)
+		}
+		if got := server.count("MKCOL files"); expectedMkcols != got {
+			t.Fatalf("upload [%s] got [%d] mkcols, expected [%d]", key, got, expectedMkcols)
+		}
+	}
+
+	// 首次上传时直接创建目录失败，然后逐级创建 main/siyuan/repo/objects/ab
+	upload("objects/ab/1", 6)
+	upload("objects/ab/2", 6)
+	upload("objects/cd/1", 7)
+	upload("objects/cd/2", 7)
+
+	// 其他客户端删除目录后缓存失效，重新创建目录并重试上传
+	if err := server.fs.RemoveAll(context.Background(), "/main/siyuan/repo/objects/cd"); nil != err {
+		t.Fatal(err)
+	}
+	upload("objects/cd/3", 8)
+	if got, err := webdav.DownloadObject("objects/cd/3"); nil != err || "objects/cd/3" != string(got) {
+		t.Fatalf("download after recreating dir got [%s], err [%v]", got, err)
+	}
+}
+
+// countingTransport 记录经过的请求数。
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (transport *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWebDAVKeepTransport(t *testing.T) {
+	server := newNextcloudTestServer(t, true)
+	endpoint := server.server.URL + nextcloudTestFilesPrefix + "/"
+	client := gowebdav.NewClient(endpoint, "dejavu", "secret")
+	transport := &countingTransport{}
+	client.SetTransport(transport)
+
+	// 没有配置 TLS 和代理时保留调用方设置的 HTTP 传输，不缓存目录也不使用分块上传
+	webdav := NewWebDAV(&BaseCloud{Conf: &Conf{Dir: "main", WebDAV: &ConfWebDAV{Endpoint: endpoint, Username: "dejavu", Password: "secret"}}}, client)
+	var intercepted atomic.Int32
+	webdav.SetInterceptor(func(method string, req *http.Request) { intercepted.Add(1) })
+	if _, err := webdav.UploadBytes("objects/ab/1", []byte("data"), true); nil != err {
+		t.Fatal(err)
+	}
+	if 0 == transport.requests.Load() || 0 == intercepted.Load() {
+		t.Fatal("caller's transport or interceptor not used")
+	}
+	if webdav.useChunkedUpload(webdavDefaultChunkedUploadThreshold) {
+		t.Fatal("unexpected chunked upload")
+	}
+}
@@ -98,4 +98,7 @@ type CheckReport struct {
 	CheckCount     int      `json:"checkCount"`
 	FixCount       int      `json:"fixCount"`
 	MissingObjects []string `json:"missingObjects"`
+
+	RepairedObjects  []string `json:"repairedObjects"`  // 使用本地奇偶校验数据修复的对象
+	CorruptedObjects []string `json:"corruptedObjects"` // 损坏且无法修复的对象
 }
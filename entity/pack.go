@@ -0,0 +1,35 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package entity
+
+// Pack 描述了包文件的索引。
+//
+// 包文件由多个数据对象（分块或文件）压缩加密后的数据依次拼接而成，用于减少云端对象数量和 API 请求次数。
+// 包索引记录了每个对象在包文件中的位置，压缩加密后和包文件一起存放。
+//
+// 存放路径：repo/packs/{id} 和 repo/packs/{id}.idx。
+type Pack struct {
+	ID      string        `json:"id"`      // Hash
+	Objects []*PackObject `json:"objects"` // 包内对象
+}
+
+// PackObject 描述了包文件中的一个数据对象。
+type PackObject struct {
+	ID     string `json:"id"`     // 对象 ID
+	Offset int64  `json:"offset"` // 在包文件中的偏移
+	Length int64  `json:"length"` // 压缩加密后的数据长度
+}
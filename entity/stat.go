@@ -16,13 +16,18 @@
 
 package entity
 
+import "time"
+
 type ObjectInfo struct {
-	Path string
-	Size int64
+	Path    string
+	Size    int64
+	Updated time.Time // 最近修改时间，由存储服务记录，存储服务不提供时为零值，目前只有 Stat 返回
 }
 
 type PurgeStat struct {
 	Objects int
 	Indexes int
 	Size    int64
+	Uploads int // 中止的未完成分片上传数
+	Locked  int // 因对象锁定而保留的对象数
 }
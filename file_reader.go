@@ -0,0 +1,65 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"io"
+	"os"
+
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+// fileReader 描述了文件数据流，文件分块在读取时才逐个解码，不会将整个文件加载到内存中。
+type fileReader struct {
+	store  *Store
+	chunks []string // 尚未读取的分块 ID
+	buf    []byte   // 当前分块中尚未读取的数据
+	closed bool
+}
+
+func (repo *Repo) newFileReader(file *entity.File) *fileReader {
+	return &fileReader{store: repo.store, chunks: file.Chunks}
+}
+
+func (reader *fileReader) Read(p []byte) (n int, err error) {
+	for 1 > len(reader.buf) {
+		if reader.closed {
+			return 0, os.ErrClosed
+		}
+		if 1 > len(reader.chunks) {
+			return 0, io.EOF
+		}
+
+		chunk, getErr := reader.store.GetChunk(reader.chunks[0])
+		if nil != getErr {
+			return 0, getErr
+		}
+		reader.chunks = reader.chunks[1:]
+		reader.buf = chunk.Data
+	}
+
+	n = copy(p, reader.buf)
+	reader.buf = reader.buf[n:]
+	return
+}
+
+func (reader *fileReader) Close() error {
+	reader.closed = true
+	reader.chunks = nil
+	reader.buf = nil
+	return nil
+}
@@ -0,0 +1,68 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+	"testing/iotest"
+
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+)
+
+func TestFileReader(t *testing.T) {
+	store, err := NewStore(t.TempDir(), []byte("0123456789abcdef0123456789abcdef"))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var expected []byte
+	file := &entity.File{}
+	for i := 0; i < 3; i++ {
+		data := bytes.Repeat([]byte("chunk "+strconv.Itoa(i)), 1024)
+		chunk := &entity.Chunk{ID: util.Hash(data), Data: data}
+		if err = store.PutChunk(chunk); nil != err {
+			t.Fatal(err)
+		}
+		file.Chunks = append(file.Chunks, chunk.ID)
+		expected = append(expected, data...)
+	}
+	file.Size = int64(len(expected))
+
+	repo := &Repo{store: store}
+	if err = iotest.TestReader(repo.newFileReader(file), expected); nil != err {
+		t.Fatal(err)
+	}
+
+	reader := repo.newFileReader(file)
+	if err = reader.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = reader.Read(make([]byte, 8)); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("read closed reader should fail, got [%v]", err)
+	}
+
+	file.Chunks = append(file.Chunks, util.RandHash())
+	if _, err = io.ReadAll(repo.newFileReader(file)); nil == err {
+		t.Fatal("read missing chunk should fail")
+	}
+}
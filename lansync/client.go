@@ -207,7 +207,9 @@ func (manager *Manager) downloadPeerChunk(current *peer, id string) (data []byte
 		}
 		return nil, fmt.Errorf("LAN chunk request failed with status %d", response.StatusCode)
 	}
-	return io.ReadAll(io.LimitReader(response.Body, maxChunkSize))
+	body := manager.limiter.DownloadReader(manager.ctx, response.Body)
+	defer body.Close()
+	return io.ReadAll(io.LimitReader(body, maxChunkSize))
 }
 
 func (manager *Manager) postPeerJSON(current *peer, path string, requestBody, responseBody interface{}) (err error) {
@@ -30,6 +30,7 @@ import (
 
 	"github.com/hashicorp/mdns"
 	"github.com/siyuan-note/dejavu"
+	"github.com/siyuan-note/dejavu/cloud"
 	"github.com/siyuan-note/logging"
 )
 
@@ -50,6 +51,7 @@ type Config struct {
 	MaxConcurrentReqs int
 	NativeDiscovery   bool
 	OnCommitHint      func(latestID string)
+	Bandwidth         *cloud.ConfBandwidth // 局域网传输带宽限制，为空时不限制
 }
 
 type DiscoveryInfo struct {
@@ -83,6 +85,8 @@ type Manager struct {
 	sessionMu sync.Mutex
 	sessions  map[string]*serverSession
 
+	limiter *cloud.BandwidthLimiter
+
 	stopOnce sync.Once
 }
 
@@ -146,6 +150,7 @@ func Start(config Config) (ret *Manager, err error) {
 		peers:        map[string]*peer{},
 		routes:       map[string][]*peer{},
 		sessions:     map[string]*serverSession{},
+		limiter:      cloud.NewBandwidthLimiter(config.Bandwidth),
 	}
 	ret.scopeID = calculateScopeID(ret.discoveryKey, config.Scope)
 	if err = ret.startServer(); nil != err {
@@ -228,6 +233,11 @@ func (manager *Manager) Name() string {
 	return "LAN peer"
 }
 
+// GetBandwidthLimiter 返回局域网传输的带宽限速器，向其他设备提供分块和从其他设备下载分块时都会经过该限速器。
+func (manager *Manager) GetBandwidthLimiter() *cloud.BandwidthLimiter {
+	return manager.limiter
+}
+
 func (manager *Manager) GetConcurrentReqs() int {
 	return manager.config.MaxConcurrentReqs
 }
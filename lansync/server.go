@@ -260,7 +260,9 @@ func (manager *Manager) handleDownloadChunk(writer http.ResponseWriter, request
 	writer.Header().Set("Cache-Control", "private, immutable")
 	writer.Header().Set("ETag", `"`+id+`"`)
 	writer.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
-	_, _ = io.Copy(writer, file)
+	body := manager.limiter.UploadReader(request.Context(), file)
+	defer body.Close()
+	_, _ = io.Copy(writer, body)
 }
 
 func (manager *Manager) handleCommitHint(writer http.ResponseWriter, request *http.Request) {
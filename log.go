@@ -17,6 +17,7 @@
 package dejavu
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"sort"
@@ -53,6 +54,17 @@ func (log *Log) String() string {
 }
 
 func (repo *Repo) GetCloudRepoLogs(page int) (ret []*Log, pageCount, totalCount int, err error) {
+	if err = repo.lockRepo(false); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	runlockCloud, err := repo.tryRLockCloud(context.Background())
+	if nil != err {
+		return
+	}
+	defer runlockCloud()
+
 	cloudIndexes, pageCount, totalCount, err := repo.cloud.GetIndexes(page)
 	if nil != err {
 		return
@@ -69,7 +81,18 @@ func (repo *Repo) GetCloudRepoLogs(page int) (ret []*Log, pageCount, totalCount
 	return
 }
 
-func (repo *Repo) GetCloudRepoTagLogs(context map[string]interface{}) (ret []*Log, err error) {
+func (repo *Repo) GetCloudRepoTagLogs(ctx context.Context) (ret []*Log, err error) {
+	if err = repo.lockRepo(false); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	runlockCloud, err := repo.tryRLockCloud(ctx)
+	if nil != err {
+		return
+	}
+	defer runlockCloud()
+
 	cloudTags, err := repo.cloud.GetTags()
 	if nil != err {
 		return
@@ -77,7 +100,7 @@ func (repo *Repo) GetCloudRepoTagLogs(context map[string]interface{}) (ret []*Lo
 	for _, tag := range cloudTags {
 		index, _ := repo.store.GetIndex(tag.ID)
 		if nil == index {
-			_, index, err = repo.downloadCloudIndex(tag.ID, context)
+			_, index, err = repo.downloadCloudIndex(ctx, tag.ID)
 			if nil != err {
 				return
 			}
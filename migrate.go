@@ -0,0 +1,303 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/logging"
+)
+
+// MigrateStat 描述了迁移云端仓库的统计信息。
+type MigrateStat struct {
+	Objects int   // 源仓库中的数据对象数，包括对象、索引、包文件和校验索引
+	Copied  int   // 本次复制的数据对象数
+	Skipped int   // 目标仓库中已经存在而跳过的数据对象数，中断后重新迁移时会跳过已经复制的对象
+	Refs    int   // 复制的引用数，包括 latest 和所有标记
+	Bytes   int64 // 本次复制的字节数
+}
+
+// MigrateCloudRepo 将云端仓库 src 迁移到云端仓库 dst，比如从 WebDAV 迁移到 S3。
+//
+// 数据按原样复制，不需要解密，各存储服务的对象路径差异由 cloud.ListRepoKeys 和流式对象接口处理。
+// 迁移开始时先读取源仓库的引用，复制完所有数据对象后再写入 indexes-v2.json、标记和 latest，
+// 所以迁移中断时目标仓库不会引用缺失的数据，重新迁移时会跳过目标仓库中已经存在且大小一致的对象。
+// 迁移完成后会校验目标仓库中的所有对象，目标仓库可以直接用于同步。
+func MigrateCloudRepo(ctx context.Context, src, dst cloud.Cloud) (stat *MigrateStat, err error) {
+	stat = &MigrateStat{}
+
+	// 先获取引用快照，迁移期间源仓库的引用更新不影响本次迁移
+	refs, err := migrateRefs(ctx, src)
+	if nil != err {
+		return
+	}
+
+	srcKeys, err := cloud.ListRepoKeys(ctx, src)
+	if nil != err {
+		logging.LogErrorf("list source cloud repo failed: %s", err)
+		return
+	}
+	dstKeys, err := cloud.ListRepoKeys(ctx, dst)
+	if nil != err {
+		logging.LogErrorf("list destination cloud repo failed: %s", err)
+		return
+	}
+
+	var keys []string
+	for key, size := range srcKeys {
+		if migrateMutableKey(key) {
+			continue
+		}
+		stat.Objects++
+		if dstSize, ok := dstKeys[key]; ok && dstSize == size {
+			stat.Skipped++
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	logging.LogInfof("migrating cloud repo [objects=%d, skipped=%d]", stat.Objects, stat.Skipped)
+
+	copied, bytes, err := migrateObjects(ctx, src, dst, keys)
+	stat.Copied, stat.Bytes = copied, bytes
+	if nil != err {
+		return
+	}
+
+	// 引用最后写入，latest 放在最后
+	refKeys := make([]string, 0, len(refs))
+	for key := range refs {
+		refKeys = append(refKeys, key)
+	}
+	sort.Strings(refKeys)
+	sort.SliceStable(refKeys, func(i, j int) bool {
+		return migrateRefOrder(refKeys[i]) < migrateRefOrder(refKeys[j])
+	})
+	for _, key := range refKeys {
+		data := refs[key]
+		if strings.HasPrefix(key, "refs/") {
+			indexKey := path.Join("indexes", strings.TrimSpace(string(data)))
+			if _, ok := srcKeys[indexKey]; !ok {
+				err = fmt.Errorf("ref [%s] points to missing index [%s]", key, indexKey)
+				logging.LogErrorf("migrate cloud repo failed: %s", err)
+				return
+			}
+		}
+		if err = migrateObject(ctx, dst, key, data); nil != err {
+			logging.LogErrorf("migrate ref [%s] failed: %s", key, err)
+			return
+		}
+		if strings.HasPrefix(key, "refs/") {
+			stat.Refs++
+		}
+		stat.Bytes += int64(len(data))
+	}
+
+	if err = verifyMigratedRepo(ctx, dst, srcKeys, refs); nil != err {
+		logging.LogErrorf("verify migrated cloud repo failed: %s", err)
+		return
+	}
+	logging.LogInfof("migrated cloud repo [objects=%d, copied=%d, skipped=%d, refs=%d, bytes=%d]", stat.Objects, stat.Copied, stat.Skipped, stat.Refs, stat.Bytes)
+	return
+}
+
+// migrateMutableKey 判断对象 key 是否为内容会变化的对象，这些对象在复制完数据对象后按迁移开始时的快照写入。
+func migrateMutableKey(key string) bool {
+	return strings.HasPrefix(key, "refs/") || "indexes-v2.json" == key
+}
+
+func migrateRefOrder(key string) int {
+	switch {
+	case "refs/latest" == key:
+		return 2
+	case strings.HasPrefix(key, "refs/"):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// migrateRefs 用于获取源仓库 src 中的引用和 indexes-v2.json。
+func migrateRefs(ctx context.Context, src cloud.Cloud) (ret map[string][]byte, err error) {
+	ret = map[string][]byte{}
+	latest, err := getCloudBytes(ctx, src, "refs/latest")
+	if nil != err {
+		logging.LogErrorf("get source cloud latest failed: %s", err)
+		return
+	}
+	ret["refs/latest"] = latest
+
+	tags, err := src.List(ctx, "refs/tags/")
+	if nil != err {
+		logging.LogErrorf("list source cloud tags failed: %s", err)
+		return
+	}
+	for tag := range tags {
+		key := path.Join("refs", "tags", path.Base(tag))
+		if ret[key], err = getCloudBytes(ctx, src, key); nil != err {
+			logging.LogErrorf("get source cloud tag [%s] failed: %s", key, err)
+			return
+		}
+	}
+
+	data, err := getCloudBytes(ctx, src, "indexes-v2.json")
+	if nil != err {
+		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			logging.LogErrorf("get source cloud indexes-v2.json failed: %s", err)
+			return
+		}
+		err = nil
+		return
+	}
+	ret["indexes-v2.json"] = data
+	return
+}
+
+// migrateObjects 用于并发复制数据对象 keys。
+func migrateObjects(ctx context.Context, src, dst cloud.Cloud, keys []string) (copied int, copiedBytes int64, err error) {
+	if 1 > len(keys) {
+		return
+	}
+
+	waitGroup := &sync.WaitGroup{}
+	var copyErr error
+	copyErrLock := sync.Mutex{}
+	copiedCount, bytesAtomic := atomic.Int32{}, atomic.Int64{}
+	poolSize := min(src.GetConcurrentReqs(), dst.GetConcurrentReqs(), len(keys))
+	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		copyErrLock.Lock()
+		if nil == copyErr {
+			copyErr = ctx.Err()
+		}
+		if nil != copyErr {
+			copyErrLock.Unlock()
+			return // 快速失败
+		}
+		copyErrLock.Unlock()
+
+		key := arg.(string)
+		data, getErr := getCloudBytes(ctx, src, key)
+		if nil == getErr {
+			getErr = migrateObject(ctx, dst, key, data)
+		}
+		if nil != getErr {
+			logging.LogErrorf("migrate object [%s] failed: %s", key, getErr)
+			copyErrLock.Lock()
+			if nil == copyErr {
+				copyErr = getErr
+			}
+			copyErrLock.Unlock()
+			return
+		}
+		copiedCount.Add(1)
+		bytesAtomic.Add(int64(len(data)))
+	})
+	if nil != err {
+		return
+	}
+
+	for _, key := range keys {
+		waitGroup.Add(1)
+		if err = p.Invoke(key); nil != err {
+			waitGroup.Done()
+			logging.LogErrorf("invoke failed: %s", err)
+			break
+		}
+	}
+	waitGroup.Wait()
+	p.Release()
+	copied, copiedBytes = int(copiedCount.Load()), bytesAtomic.Load()
+	if nil != err {
+		return
+	}
+	copyErrLock.Lock()
+	err = copyErr
+	copyErrLock.Unlock()
+	return
+}
+
+// migrateObject 用于将 data 写入目标仓库 dst 的对象 key 并校验写入的大小。
+func migrateObject(ctx context.Context, dst cloud.Cloud, key string, data []byte) (err error) {
+	if _, err = dst.UploadBytes(key, data, true); nil != err {
+		return
+	}
+
+	info, err := dst.Stat(ctx, key)
+	if nil != err {
+		if errors.Is(err, cloud.ErrUnsupported) {
+			err = nil
+		}
+		return
+	}
+	if int64(len(data)) != info.Size {
+		err = fmt.Errorf("object [%s] size mismatch [expected=%d, actual=%d]", key, len(data), info.Size)
+	}
+	return
+}
+
+// verifyMigratedRepo 用于校验目标仓库 dst 中包含源仓库的所有数据对象且大小一致，并且引用的内容一致。
+func verifyMigratedRepo(ctx context.Context, dst cloud.Cloud, srcKeys map[string]int64, refs map[string][]byte) (err error) {
+	dstKeys, err := cloud.ListRepoKeys(ctx, dst)
+	if nil != err {
+		return
+	}
+	for key, size := range srcKeys {
+		if migrateMutableKey(key) {
+			continue
+		}
+		dstSize, ok := dstKeys[key]
+		if !ok {
+			return fmt.Errorf("object [%s] not found in destination", key)
+		}
+		if dstSize != size {
+			return fmt.Errorf("object [%s] size mismatch [expected=%d, actual=%d]", key, size, dstSize)
+		}
+	}
+
+	for key, data := range refs {
+		dstData, getErr := getCloudBytes(ctx, dst, key)
+		if nil != getErr {
+			return fmt.Errorf("get [%s] from destination failed: %w", key, getErr)
+		}
+		if string(data) != string(dstData) {
+			return fmt.Errorf("[%s] mismatch in destination", key)
+		}
+	}
+	return
+}
+
+// getCloudBytes 下载云端仓库 c 中对象 key 的原始数据。
+func getCloudBytes(ctx context.Context, c cloud.Cloud, key string) (data []byte, err error) {
+	reader, err := c.Get(ctx, key)
+	if nil != err {
+		return
+	}
+	defer reader.Close()
+	data, err = io.ReadAll(reader)
+	return
+}
@@ -0,0 +1,118 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/siyuan-note/dejavu/cloud"
+)
+
+// interruptedMigrateCloud 在上传 failAfter 个对象后返回错误，用于模拟迁移中断。
+type interruptedMigrateCloud struct {
+	*cloud.Local
+	failAfter int32
+	uploads   atomic.Int32
+}
+
+func (c *interruptedMigrateCloud) UploadBytes(filePath string, data []byte, overwrite bool) (int64, error) {
+	if c.uploads.Add(1) > c.failAfter {
+		return 0, cloud.ErrCloudServiceUnavailable
+	}
+	return c.Local.UploadBytes(filePath, data, overwrite)
+}
+
+func TestMigrateCloudRepo(t *testing.T) {
+	tempDir := t.TempDir()
+	srcPath := filepath.Join(tempDir, "src")
+	repo := newPackTestRepo(t, tempDir, "source", srcPath)
+	repo.cloud.GetConf().PackObjects = false
+	for i, content := range []string{"first note", "second note", "third note"} {
+		writeTestDataFile(t, repo, "note"+string(rune('a'+i))+".sy", content)
+	}
+	index, err := repo.Index(context.Background(), "migrate", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = repo.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if err = repo.AddTag(index.ID, "v1"); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, _, err = repo.UploadTagIndex(context.Background(), "v1", index.ID); nil != err {
+		t.Fatal(err)
+	}
+
+	dstPath := filepath.Join(tempDir, "dst")
+	newDst := func() *cloud.Local {
+		return cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+			Dir:           "migrated",
+			RepoPath:      filepath.Join(tempDir, "migrate-temp"),
+			AvailableSize: 1024 * 1024 * 1024,
+			Local:         &cloud.ConfLocal{Endpoint: dstPath},
+		}})
+	}
+
+	interrupted := &interruptedMigrateCloud{Local: newDst(), failAfter: 3}
+	if _, err = MigrateCloudRepo(context.Background(), repo.cloud, interrupted); !errors.Is(err, cloud.ErrCloudServiceUnavailable) {
+		t.Fatalf("unexpected error [%v]", err)
+	}
+	if _, statErr := os.Stat(filepath.Join(dstPath, "migrated", "refs", "latest")); !os.IsNotExist(statErr) {
+		t.Fatalf("interrupted migration should not write refs [%v]", statErr)
+	}
+
+	stat, err := MigrateCloudRepo(context.Background(), repo.cloud, newDst())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 3 > stat.Skipped || stat.Objects != stat.Skipped+stat.Copied || 2 != stat.Refs {
+		t.Fatalf("unexpected migrate stat %+v", stat)
+	}
+
+	stat, err = MigrateCloudRepo(context.Background(), repo.cloud, newDst())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != stat.Copied || stat.Objects != stat.Skipped {
+		t.Fatalf("second migration should skip everything %+v", stat)
+	}
+
+	// 目标仓库可以直接用于同步
+	target := newPackTestRepo(t, tempDir, "target", dstPath)
+	target.cloud.GetConf().Dir = "migrated"
+	writeTestDataFile(t, target, "local.sy", "local")
+	if _, err = target.Index(context.Background(), "target", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = target.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(target.DataPath, "noteb.sy"))
+	if nil != err || "second note" != string(data) {
+		t.Fatalf("migrated data not synced [%s, %v]", data, err)
+	}
+	tags, err := target.cloud.GetTags()
+	if nil != err || 1 != len(tags) || "v1" != tags[0].Name {
+		t.Fatalf("tag not migrated %v [%v]", tags, err)
+	}
+}
@@ -0,0 +1,575 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/88250/gulu"
+	"github.com/panjf2000/ants/v2"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// 包文件将多个小对象聚合在一起上传，以减少云端对象数量和 API 请求次数。
+//
+// 包文件数据直接拼接对象压缩加密后的数据，包索引使用和数据对象相同的方式压缩加密，所以包文件不会影响端到端加密。
+// 云端存放路径为 packs/{id} 和 packs/{id}.idx，先上传包文件再上传包索引，有包索引的包文件一定是完整的。
+// 本地在 repo/packs/ 下缓存云端的包索引，本地包文件存放在 repo/packs/local/ 下，见 pack_local.go。
+
+const (
+	packObjectMaxSize = 512 * 1024      // 压缩加密后小于该大小的对象才会聚合到包文件中
+	packMaxSize       = 8 * 1024 * 1024 // 包文件大小上限
+	packSparseRatio   = 0.5             // 包内有效数据占比低于该值时清理会重写包文件
+	packIndexExt      = ".idx"
+)
+
+var ErrInvalidPack = errors.New("invalid pack")
+
+// assemblePack 将 ids 对应的对象压缩加密后的数据依次拼接为包文件数据。
+func assemblePack(ids []string, read func(id string) ([]byte, error)) (pack *entity.Pack, data []byte, err error) {
+	pack = &entity.Pack{}
+	for _, id := range ids {
+		objData, readErr := read(id)
+		if nil != readErr {
+			err = readErr
+			return
+		}
+
+		pack.Objects = append(pack.Objects, &entity.PackObject{ID: id, Offset: int64(len(data)), Length: int64(len(objData))})
+		data = append(data, objData...)
+	}
+	pack.ID = util.Hash(data)
+	return
+}
+
+// unpack 从包文件数据中拆出各个对象压缩加密后的数据。
+func unpack(pack *entity.Pack, data []byte) (ret map[string][]byte, err error) {
+	if pack.ID != util.Hash(data) {
+		err = ErrInvalidPack
+		return
+	}
+
+	ret = map[string][]byte{}
+	for _, obj := range pack.Objects {
+		if 0 > obj.Offset || 0 > obj.Length || int64(len(data)) < obj.Offset+obj.Length {
+			err = ErrInvalidPack
+			return
+		}
+		ret[obj.ID] = data[obj.Offset : obj.Offset+obj.Length]
+	}
+	return
+}
+
+// buildPack 将 ids 对应的本地对象聚合为包文件数据。
+func (store *Store) buildPack(ids []string) (pack *entity.Pack, data []byte, err error) {
+	return assemblePack(ids, store.readEncoded)
+}
+
+func (store *Store) encodePackIndex(pack *entity.Pack) (ret []byte, err error) {
+	data, err := gulu.JSON.MarshalJSON(pack)
+	if nil != err {
+		return
+	}
+	ret, err = store.encodeData(data)
+	return
+}
+
+func (store *Store) decodePackIndex(data []byte) (ret *entity.Pack, err error) {
+	if data, err = store.decodeData(data); nil != err {
+		return
+	}
+
+	ret = &entity.Pack{}
+	if err = gulu.JSON.UnmarshalJSON(data, ret); nil != err {
+		ret = nil
+	}
+	return
+}
+
+func (store *Store) packIndexPath(id string) string {
+	return filepath.Join(store.Path, "packs", id+packIndexExt)
+}
+
+// cachePackIndex 在本地缓存云端包索引。
+func (store *Store) cachePackIndex(id string, data []byte) (err error) {
+	file := store.packIndexPath(id)
+	if err = os.MkdirAll(filepath.Dir(file), 0755); nil != err {
+		return
+	}
+	err = gulu.File.WriteFileSafer(file, data, 0644)
+	return
+}
+
+func (store *Store) getCachedPackIndex(id string) (ret *entity.Pack, err error) {
+	data, err := os.ReadFile(store.packIndexPath(id))
+	if nil != err {
+		return
+	}
+	ret, err = store.decodePackIndex(data)
+	return
+}
+
+// removeStalePackIndexes 删除云端已经不存在的包索引缓存。
+func (store *Store) removeStalePackIndexes(cloudPackIDs map[string]bool) {
+	entries, err := os.ReadDir(filepath.Join(store.Path, "packs"))
+	if nil != err {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() { // 本地包文件目录
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), packIndexExt)
+		if cloudPackIDs[id] {
+			continue
+		}
+		if removeErr := os.RemoveAll(store.packIndexPath(id)); nil != removeErr {
+			logging.LogWarnf("remove pack index [%s] failed: %s", id, removeErr)
+		}
+	}
+}
+
+// usePacks 判断上传时是否将小对象聚合为包文件。
+//
+// 思源云端服务需要按松散对象校验云端数据完整性，所以不使用包文件。
+func (repo *Repo) usePacks() bool {
+	return repo.cloud.GetConf().PackObjects && !repo.isCloudSiYuan()
+}
+
+// splitPackObjects 将待上传的对象分为聚合到包文件中上传的小对象和单独上传的松散对象。
+func (repo *Repo) splitPackObjects(ids []string) (packIDs, looseIDs []string) {
+	if !repo.usePacks() {
+		looseIDs = ids
+		return
+	}
+
+	for _, id := range ids {
+		info, statErr := repo.store.Stat(id)
+		if nil != statErr || packObjectMaxSize < info.Size() {
+			looseIDs = append(looseIDs, id)
+			continue
+		}
+		packIDs = append(packIDs, id)
+	}
+	return
+}
+
+// groupPackObjects 将对象按包文件大小上限分组。
+func (store *Store) groupPackObjects(ids []string) (ret [][]string) {
+	sort.Strings(ids)
+	var group []string
+	var size int64
+	for _, id := range ids {
+		info, statErr := store.Stat(id)
+		if nil == statErr {
+			size += info.Size()
+		}
+		group = append(group, id)
+		if packMaxSize <= size {
+			ret = append(ret, group)
+			group = nil
+			size = 0
+		}
+	}
+	if 0 < len(group) {
+		ret = append(ret, group)
+	}
+	return
+}
+
+// uploadPacks 将 ids 对应的本地对象聚合为包文件后上传。
+func (repo *Repo) uploadPacks(ids []string, journal *uploadJournal) (uploadBytes int64, uploadPuts int, err error) {
+	if 1 > len(ids) {
+		return
+	}
+
+	groups := repo.store.groupPackObjects(ids)
+	waitGroup := &sync.WaitGroup{}
+	var uploadErr error
+	uploadErrLock := sync.Mutex{}
+	uploadBytesAtomic := atomic.Int64{}
+	uploadPutsAtomic := atomic.Int32{}
+	poolSize := repo.cloud.GetConcurrentReqs()
+	if poolSize > len(groups) {
+		poolSize = len(groups)
+	}
+	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		uploadErrLock.Lock()
+		if nil != uploadErr {
+			uploadErrLock.Unlock()
+			return // 快速失败
+		}
+		uploadErrLock.Unlock()
+
+		group := arg.([]string)
+		length, upErr := repo.uploadPack(group)
+		if nil != upErr {
+			uploadErrLock.Lock()
+			if nil == uploadErr {
+				uploadErr = upErr
+			}
+			uploadErrLock.Unlock()
+			return
+		}
+		journal.add(group...)
+		uploadBytesAtomic.Add(length)
+		uploadPutsAtomic.Add(2)
+	})
+	if nil != err {
+		return
+	}
+
+	for _, group := range groups {
+		waitGroup.Add(1)
+		if err = p.Invoke(group); nil != err {
+			waitGroup.Done()
+			logging.LogErrorf("invoke failed: %s", err)
+			break
+		}
+	}
+	waitGroup.Wait()
+	p.Release()
+	uploadBytes = uploadBytesAtomic.Load()
+	uploadPuts = int(uploadPutsAtomic.Load())
+	if nil != err {
+		return
+	}
+	uploadErrLock.Lock()
+	err = uploadErr
+	uploadErrLock.Unlock()
+	return
+}
+
+func (repo *Repo) uploadPack(ids []string) (uploadBytes int64, err error) {
+	pack, data, err := repo.store.buildPack(ids)
+	if nil != err {
+		logging.LogErrorf("build pack failed: %s", err)
+		return
+	}
+	idxData, err := repo.store.encodePackIndex(pack)
+	if nil != err {
+		logging.LogErrorf("encode pack index [%s] failed: %s", pack.ID, err)
+		return
+	}
+
+	uploadBytes, err = repo.putCloudPack(pack.ID, data, idxData)
+	if nil != err {
+		return
+	}
+
+	if cacheErr := repo.store.cachePackIndex(pack.ID, idxData); nil != cacheErr {
+		logging.LogWarnf("cache pack index [%s] failed: %s", pack.ID, cacheErr)
+	}
+	repo.addCachedCloudPack(pack)
+	logging.LogInfof("uploaded pack [%s, objects=%d]", pack.ID, len(pack.Objects))
+	return
+}
+
+func (repo *Repo) putCloudPack(id string, data, idxData []byte) (uploadBytes int64, err error) {
+	length, err := repo.cloud.UploadBytes(path.Join("packs", id), data, false)
+	if nil != err {
+		logging.LogErrorf("upload pack [%s] failed: %s", id, err)
+		return
+	}
+	uploadBytes += length
+
+	// 包索引需要在包文件上传成功后再上传
+	length, err = repo.cloud.UploadBytes(path.Join("packs", id+packIndexExt), idxData, false)
+	if nil != err {
+		logging.LogErrorf("upload pack index [%s] failed: %s", id, err)
+		return
+	}
+	uploadBytes += length
+	return
+}
+
+// cloudPacksCache 缓存一次同步中列出的云端包索引，避免每次上传或者下载对象时都列出云端包文件。
+type cloudPacksCache struct {
+	lock  sync.Mutex
+	packs map[string]*entity.Pack // 为 nil 时表示尚未列出
+}
+
+// cacheCloudPacks 开始缓存云端包索引，调用方需要持有云端锁，返回的函数用于结束缓存。
+func (repo *Repo) cacheCloudPacks() (endCache func()) {
+	repo.cloudPacksCache.Store(&cloudPacksCache{})
+	return func() { repo.cloudPacksCache.Store(nil) }
+}
+
+// addCachedCloudPack 将刚上传的包文件加入缓存。
+func (repo *Repo) addCachedCloudPack(pack *entity.Pack) {
+	cache := repo.cloudPacksCache.Load()
+	if nil == cache {
+		return
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if nil != cache.packs {
+		cache.packs[pack.ID] = pack
+	}
+}
+
+// cloudPacks 返回云端所有包文件的索引，同步期间只列出一次云端包文件。
+func (repo *Repo) cloudPacks() (ret map[string]*entity.Pack, apiGet int, downloadBytes int64, err error) {
+	cache := repo.cloudPacksCache.Load()
+	if nil == cache {
+		return repo.listCloudPacks()
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if nil == cache.packs {
+		var packs map[string]*entity.Pack
+		if packs, apiGet, downloadBytes, err = repo.listCloudPacks(); nil != err {
+			return
+		}
+		cache.packs = packs
+	}
+
+	ret = make(map[string]*entity.Pack, len(cache.packs))
+	for id, pack := range cache.packs {
+		ret[id] = pack
+	}
+	return
+}
+
+// listCloudPacks 列出云端所有包文件的索引，本地没有缓存的包索引会从云端下载。
+func (repo *Repo) listCloudPacks() (ret map[string]*entity.Pack, apiGet int, downloadBytes int64, err error) {
+	ret = map[string]*entity.Pack{}
+	if repo.isCloudSiYuan() {
+		return
+	}
+
+	objInfos, err := repo.cloud.ListObjects("packs/")
+	if nil != err {
+		logging.LogErrorf("list cloud packs failed: %s", err)
+		return
+	}
+	apiGet++
+
+	cloudPackIDs := map[string]bool{}
+	for name := range objInfos {
+		if !strings.HasSuffix(name, packIndexExt) {
+			continue
+		}
+
+		id := strings.TrimSuffix(name, packIndexExt)
+		cloudPackIDs[id] = true
+		pack, getErr := repo.store.getCachedPackIndex(id)
+		if nil == getErr {
+			ret[id] = pack
+			continue
+		}
+
+		data, downloadErr := repo.cloud.DownloadObject(path.Join("packs", name))
+		if nil != downloadErr {
+			err = downloadErr
+			logging.LogErrorf("download cloud pack index [%s] failed: %s", id, err)
+			return
+		}
+		apiGet++
+		downloadBytes += int64(len(data))
+
+		if pack, err = repo.store.decodePackIndex(data); nil != err {
+			logging.LogErrorf("decode cloud pack index [%s] failed: %s", id, err)
+			return
+		}
+		ret[id] = pack
+		if cacheErr := repo.store.cachePackIndex(id, data); nil != cacheErr {
+			logging.LogWarnf("cache pack index [%s] failed: %s", id, cacheErr)
+		}
+	}
+	repo.store.removeStalePackIndexes(cloudPackIDs)
+	return
+}
+
+// excludeCloudPacked 排除 ids 中已经位于云端包文件内的对象。
+func (repo *Repo) excludeCloudPacked(ids []string) (ret []string, apiGet int, err error) {
+	ret = ids
+	if 1 > len(ids) {
+		return
+	}
+
+	packs, apiGet, _, err := repo.cloudPacks()
+	if nil != err || 1 > len(packs) {
+		return
+	}
+
+	packed := map[string]bool{}
+	for _, pack := range packs {
+		for _, obj := range pack.Objects {
+			packed[obj.ID] = true
+		}
+	}
+
+	ret = nil
+	for _, id := range ids {
+		if !packed[id] {
+			ret = append(ret, id)
+		}
+	}
+	return
+}
+
+// downloadCloudPacked 下载 ids 中位于云端包文件内的对象，解密解压后交给 put 入库，返回不在包文件中的对象 ID。
+func (repo *Repo) downloadCloudPacked(ids []string, stat *chunkDownloadStat, put func(id string, data []byte) error) (rest []string, err error) {
+	rest = ids
+	if 1 > len(ids) {
+		return
+	}
+
+	packs, apiGet, downloadBytes, err := repo.cloudPacks()
+	if nil != err {
+		return
+	}
+	stat.PackGets += apiGet
+	stat.CloudBytes += downloadBytes
+	if 1 > len(packs) {
+		return
+	}
+
+	objPacks := map[string]string{}
+	for _, pack := range packs {
+		for _, obj := range pack.Objects {
+			objPacks[obj.ID] = pack.ID
+		}
+	}
+
+	rest = nil
+	packObjs := map[string][]string{}
+	for _, id := range ids {
+		packID := objPacks[id]
+		if "" == packID {
+			rest = append(rest, id)
+			continue
+		}
+		packObjs[packID] = append(packObjs[packID], id)
+	}
+
+	for packID, objIDs := range packObjs {
+		data, downloadErr := repo.cloud.DownloadObject(path.Join("packs", packID))
+		if nil != downloadErr {
+			err = downloadErr
+			logging.LogErrorf("download cloud pack [%s] failed: %s", packID, err)
+			return
+		}
+		stat.PackGets++
+		stat.CloudBytes += int64(len(data))
+
+		objects, unpackErr := unpack(packs[packID], data)
+		if nil != unpackErr {
+			err = unpackErr
+			logging.LogErrorf("unpack cloud pack [%s] failed: %s", packID, err)
+			return
+		}
+
+		for _, objID := range objIDs {
+			objData, decodeErr := repo.store.decodeData(objects[objID])
+			if nil != decodeErr {
+				err = decodeErr
+				logging.LogErrorf("decode packed object [%s] in pack [%s] failed: %s", objID, packID, err)
+				return
+			}
+			if err = put(objID, objData); nil != err {
+				return
+			}
+			stat.PackCount++
+		}
+	}
+	return
+}
+
+// purgeCloudPacks 清理云端包文件：删除不包含被引用对象的包，重写被引用数据占比过低的稀疏包。
+func (repo *Repo) purgeCloudPacks(packs map[string]*entity.Pack, referencedObjIDs map[string]bool, stat *entity.PurgeStat) (err error) {
+	for packID, pack := range packs {
+		var liveIDs []string
+		var liveSize, totalSize int64
+		for _, obj := range pack.Objects {
+			totalSize += obj.Length
+			if referencedObjIDs[obj.ID] {
+				liveIDs = append(liveIDs, obj.ID)
+				liveSize += obj.Length
+			}
+		}
+
+		if 0 < len(liveIDs) && float64(liveSize) >= float64(totalSize)*packSparseRatio {
+			continue
+		}
+
+		if 0 < len(liveIDs) {
+			data, downloadErr := repo.cloud.DownloadObject(path.Join("packs", packID))
+			if nil != downloadErr {
+				err = downloadErr
+				logging.LogErrorf("download cloud pack [%s] failed: %s", packID, err)
+				return
+			}
+
+			objects, unpackErr := unpack(pack, data)
+			if nil != unpackErr {
+				err = unpackErr
+				logging.LogErrorf("unpack cloud pack [%s] failed: %s", packID, err)
+				return
+			}
+
+			newPack, newData, _ := assemblePack(liveIDs, func(id string) ([]byte, error) { return objects[id], nil })
+			idxData, encodeErr := repo.store.encodePackIndex(newPack)
+			if nil != encodeErr {
+				err = encodeErr
+				return
+			}
+			if _, err = repo.putCloudPack(newPack.ID, newData, idxData); nil != err {
+				return
+			}
+			logging.LogInfof("rewrote sparse pack [%s] to [%s], objects [%d -> %d]", packID, newPack.ID, len(pack.Objects), len(newPack.Objects))
+		}
+
+		// 先删除包索引再删除包文件，避免其他设备读到没有包文件的包索引
+		locked, removeErr := repo.removeCloudObjects([]string{path.Join("packs", packID+packIndexExt)})
+		if nil != removeErr {
+			err = removeErr
+			return
+		}
+		if 0 < len(locked) {
+			// 包索引被锁定时保留包文件
+			stat.Locked++
+			continue
+		}
+		if locked, err = repo.removeCloudObjects([]string{path.Join("packs", packID)}); nil != err {
+			return
+		}
+		if 0 < len(locked) {
+			stat.Locked++
+			continue
+		}
+
+		stat.Objects += len(pack.Objects) - len(liveIDs)
+		stat.Size += totalSize - liveSize
+	}
+	return
+}
@@ -0,0 +1,382 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// 启用 Store.PackObjects 后，新写入的小对象会在写入索引时聚合为本地包文件，以减少本地仓库中的文件数量。
+//
+// 本地包文件和云端包文件的格式相同，存放在 repo/packs/local/{id} 和 repo/packs/local/{id}.idx，
+// 先写入包文件再写入包索引，包索引写入成功后删除松散对象。
+// 读取对象时优先读取松散对象，不存在时再从本地包文件中读取，所以没有聚合过的旧仓库不受影响。
+
+// localPackedObject 描述了对象在本地包文件中的位置。
+type localPackedObject struct {
+	pack string // 本地包文件 ID
+	obj  *entity.PackObject
+}
+
+// packedObjectInfo 描述了本地包文件中的对象，用于 Store.Stat。
+type packedObjectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (info *packedObjectInfo) Name() string       { return info.name }
+func (info *packedObjectInfo) Size() int64        { return info.size }
+func (info *packedObjectInfo) Mode() os.FileMode  { return 0644 }
+func (info *packedObjectInfo) ModTime() time.Time { return info.modTime }
+func (info *packedObjectInfo) IsDir() bool        { return false }
+func (info *packedObjectInfo) Sys() interface{}   { return nil }
+
+func (store *Store) localPacksDir() string {
+	return filepath.Join(store.Path, "packs", "local")
+}
+
+// loadLocalPacks 加载本地包索引，调用方需要持有 packLock。
+func (store *Store) loadLocalPacks() {
+	if nil != store.localPacks {
+		return
+	}
+
+	store.localPacks = map[string]*entity.Pack{}
+	store.packedObjects = map[string]*localPackedObject{}
+	dir := store.localPacksDir()
+	entries, err := os.ReadDir(dir)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			logging.LogWarnf("read local packs dir [%s] failed: %s", dir, err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, packIndexExt) {
+			continue
+		}
+
+		data, readErr := os.ReadFile(filepath.Join(dir, name))
+		if nil != readErr {
+			logging.LogWarnf("read local pack index [%s] failed: %s", name, readErr)
+			continue
+		}
+		pack, decodeErr := store.decodePackIndex(data)
+		if nil != decodeErr {
+			logging.LogWarnf("decode local pack index [%s] failed: %s", name, decodeErr)
+			continue
+		}
+		store.addLocalPack(pack)
+	}
+}
+
+func (store *Store) addLocalPack(pack *entity.Pack) {
+	store.localPacks[pack.ID] = pack
+	for _, obj := range pack.Objects {
+		store.packedObjects[obj.ID] = &localPackedObject{pack: pack.ID, obj: obj}
+	}
+}
+
+func (store *Store) removeLocalPack(id string) {
+	pack := store.localPacks[id]
+	if nil == pack {
+		return
+	}
+
+	delete(store.localPacks, id)
+	for _, obj := range pack.Objects {
+		if packed := store.packedObjects[obj.ID]; nil != packed && id == packed.pack {
+			delete(store.packedObjects, obj.ID)
+		}
+	}
+}
+
+// localPacked 返回对象 id 在本地包文件中的位置，对象不在本地包文件中时返回 nil。
+func (store *Store) localPacked(id string) *localPackedObject {
+	store.packLock.Lock()
+	defer store.packLock.Unlock()
+
+	store.loadLocalPacks()
+	return store.packedObjects[id]
+}
+
+// readEncoded 读取对象 id 压缩加密后的数据，优先读取松散对象，不存在时从本地包文件中读取。
+func (store *Store) readEncoded(id string) (ret []byte, err error) {
+	_, file := store.AbsPath(id)
+	if ret, err = os.ReadFile(file); nil == err || !os.IsNotExist(err) {
+		return
+	}
+
+	packed := store.localPacked(id)
+	if nil == packed {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(store.localPacksDir(), packed.pack))
+	if nil != err {
+		return
+	}
+	defer f.Close()
+
+	ret = make([]byte, packed.obj.Length)
+	if _, err = f.ReadAt(ret, packed.obj.Offset); nil != err {
+		ret = nil
+	}
+	return
+}
+
+// exists 判断对象 id 是否已经位于本地仓库中（松散对象或者本地包文件）。
+func (store *Store) exists(id string) bool {
+	_, file := store.AbsPath(id)
+	return gulu.File.IsExist(file) || nil != store.localPacked(id)
+}
+
+// markUnpacked 记录新写入的松散对象，写入索引时聚合为本地包文件。
+func (store *Store) markUnpacked(id string) {
+	if !store.PackObjects {
+		return
+	}
+
+	store.packLock.Lock()
+	store.unpackedIDs[id] = true
+	store.packLock.Unlock()
+}
+
+// packObjects 将新写入的小对象聚合为本地包文件，在写入索引时调用，此时索引引用的对象均已写入。
+func (store *Store) packObjects() (err error) {
+	store.packLock.Lock()
+	var ids []string
+	for id := range store.unpackedIDs {
+		ids = append(ids, id)
+	}
+	store.unpackedIDs = map[string]bool{}
+	store.packLock.Unlock()
+
+	if !store.PackObjects || 1 > len(ids) {
+		return
+	}
+
+	var packIDs []string
+	for _, id := range ids {
+		_, file := store.AbsPath(id)
+		info, statErr := os.Stat(file)
+		if nil != statErr || packObjectMaxSize < info.Size() {
+			continue
+		}
+		packIDs = append(packIDs, id)
+	}
+
+	for _, group := range store.groupPackObjects(packIDs) {
+		if 2 > len(group) {
+			continue // 单个对象不需要聚合
+		}
+		if err = store.putLocalPack(group); nil != err {
+			return
+		}
+	}
+	return
+}
+
+// putLocalPack 将松散对象 ids 聚合为本地包文件，写入成功后删除松散对象。
+func (store *Store) putLocalPack(ids []string) (err error) {
+	pack, data, err := store.buildPack(ids)
+	if nil != err {
+		logging.LogErrorf("build local pack failed: %s", err)
+		return
+	}
+	idxData, err := store.encodePackIndex(pack)
+	if nil != err {
+		logging.LogErrorf("encode local pack index [%s] failed: %s", pack.ID, err)
+		return
+	}
+	if err = store.writeLocalPack(pack, data, idxData); nil != err {
+		return
+	}
+
+	for _, id := range ids {
+		if removeErr := store.Remove(id); nil != removeErr {
+			logging.LogWarnf("remove packed object [%s] failed: %s", id, removeErr)
+		}
+	}
+	logging.LogInfof("packed local objects into pack [%s, objects=%d]", pack.ID, len(pack.Objects))
+	return
+}
+
+func (store *Store) writeLocalPack(pack *entity.Pack, data, idxData []byte) (err error) {
+	dir := store.localPacksDir()
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		logging.LogErrorf("create local packs dir [%s] failed: %s", dir, err)
+		return
+	}
+
+	// 包索引需要在包文件写入成功后再写入
+	if err = gulu.File.WriteFileSafer(filepath.Join(dir, pack.ID), data, 0644); nil != err {
+		logging.LogErrorf("write local pack [%s] failed: %s", pack.ID, err)
+		return
+	}
+	if err = gulu.File.WriteFileSafer(filepath.Join(dir, pack.ID+packIndexExt), idxData, 0644); nil != err {
+		logging.LogErrorf("write local pack index [%s] failed: %s", pack.ID, err)
+		return
+	}
+
+	store.packLock.Lock()
+	store.loadLocalPacks()
+	store.addLocalPack(pack)
+	store.packLock.Unlock()
+	store.markParityDirty(localPackParityKey(pack.ID))
+	return
+}
+
+// removeLocalPackFiles 删除本地包文件 id，先删除包索引再删除包文件。
+func (store *Store) removeLocalPackFiles(id string) (err error) {
+	store.packLock.Lock()
+	store.loadLocalPacks()
+	store.removeLocalPack(id)
+	store.packLock.Unlock()
+	store.dropParity(localPackParityKey(id))
+
+	dir := store.localPacksDir()
+	if err = os.RemoveAll(filepath.Join(dir, id+packIndexExt)); nil != err {
+		return
+	}
+	err = os.RemoveAll(filepath.Join(dir, id))
+	return
+}
+
+// purgeLocalPacks 清理本地包文件：删除不包含被引用对象的包，重写被引用数据占比过低的稀疏包。
+func (store *Store) purgeLocalPacks(ctx context.Context, referencedObjIDs map[string]bool, stat *entity.PurgeStat) (err error) {
+	store.packLock.Lock()
+	store.loadLocalPacks()
+	var packs []*entity.Pack
+	for _, pack := range store.localPacks {
+		packs = append(packs, pack)
+	}
+	store.packLock.Unlock()
+
+	for _, pack := range packs {
+		if isCancelled(ctx) {
+			logging.LogWarnf("purging data repo [%s] cancelled while purging local packs", store.Path)
+			return
+		}
+
+		var liveIDs []string
+		var liveSize, totalSize int64
+		for _, obj := range pack.Objects {
+			totalSize += obj.Length
+			if referencedObjIDs[obj.ID] {
+				liveIDs = append(liveIDs, obj.ID)
+				liveSize += obj.Length
+			}
+		}
+
+		if 0 < len(liveIDs) && float64(liveSize) >= float64(totalSize)*packSparseRatio {
+			continue
+		}
+
+		if 0 < len(liveIDs) {
+			data, readErr := os.ReadFile(filepath.Join(store.localPacksDir(), pack.ID))
+			if nil != readErr {
+				err = readErr
+				logging.LogErrorf("read local pack [%s] failed: %s", pack.ID, err)
+				return
+			}
+
+			objects, unpackErr := unpack(pack, data)
+			if nil != unpackErr {
+				err = unpackErr
+				logging.LogErrorf("unpack local pack [%s] failed: %s", pack.ID, err)
+				return
+			}
+
+			newPack, newData, _ := assemblePack(liveIDs, func(id string) ([]byte, error) { return objects[id], nil })
+			idxData, encodeErr := store.encodePackIndex(newPack)
+			if nil != encodeErr {
+				err = encodeErr
+				return
+			}
+			if err = store.writeLocalPack(newPack, newData, idxData); nil != err {
+				return
+			}
+			logging.LogInfof("rewrote sparse local pack [%s] to [%s], objects [%d -> %d]", pack.ID, newPack.ID, len(pack.Objects), len(newPack.Objects))
+		}
+
+		if err = store.removeLocalPackFiles(pack.ID); nil != err {
+			logging.LogErrorf("remove local pack [%s] failed: %s", pack.ID, err)
+			return
+		}
+		for _, obj := range pack.Objects {
+			if !referencedObjIDs[obj.ID] {
+				fileCache.Del(obj.ID)
+			}
+		}
+		stat.Objects += len(pack.Objects) - len(liveIDs)
+		stat.Size += totalSize - liveSize
+	}
+	return
+}
+
+// checkLocalPacks 校验本地包文件的完整性并尝试使用奇偶校验数据修复，无法修复的包文件中的对象记入 report.CorruptedObjects。
+func (store *Store) checkLocalPacks(ctx context.Context, report *entity.CheckReport) {
+	store.packLock.Lock()
+	store.loadLocalPacks()
+	var packs []*entity.Pack
+	for _, pack := range store.localPacks {
+		packs = append(packs, pack)
+	}
+	store.packLock.Unlock()
+	sort.Slice(packs, func(i, j int) bool { return packs[i].ID < packs[j].ID })
+
+	for _, pack := range packs {
+		if isCancelled(ctx) {
+			return
+		}
+
+		report.CheckCount += len(pack.Objects)
+		data, err := os.ReadFile(filepath.Join(store.localPacksDir(), pack.ID))
+		if nil == err && pack.ID == util.Hash(data) {
+			continue
+		}
+
+		key := localPackParityKey(pack.ID)
+		repaired, repairErr := store.repairObject(key)
+		if gulu.Str.Contains(key, repaired) {
+			for _, obj := range pack.Objects {
+				report.RepairedObjects = append(report.RepairedObjects, obj.ID)
+				fileCache.Del(obj.ID)
+			}
+			continue
+		}
+
+		logging.LogWarnf("local pack [%s] is corrupted: %v, repair failed: %v", pack.ID, err, repairErr)
+		for _, obj := range pack.Objects {
+			report.CorruptedObjects = append(report.CorruptedObjects, obj.ID)
+		}
+	}
+}
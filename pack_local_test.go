@@ -0,0 +1,175 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+func TestLocalPacks(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repoA := newPackTestRepo(t, tempDir, "a", cloudPath)
+	repoA.cloud.GetConf().PackObjects = false // 云端使用松散对象，上传时从本地包文件中读取
+	repoA.SetPackObjects(true)
+
+	for i := 0; i < 8; i++ {
+		writeTestDataFile(t, repoA, "doc"+strconv.Itoa(i)+".txt", "content "+strconv.Itoa(i))
+	}
+	ctx := context.Background()
+	first, err := repoA.Index(ctx, "first", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	loose := 0
+	filepath.Walk(filepath.Join(repoA.Path, "objects"), func(path string, info os.FileInfo, err error) error {
+		if nil == err && !info.IsDir() {
+			loose++
+		}
+		return nil
+	})
+	if 0 != loose {
+		t.Fatalf("small objects should be packed, found [%d] loose objects", loose)
+	}
+	for _, fileID := range first.Files {
+		file, getErr := repoA.store.GetFile(fileID)
+		if nil != getErr {
+			t.Fatal(getErr)
+		}
+		if _, getErr = repoA.store.GetChunk(file.Chunks[0]); nil != getErr {
+			t.Fatal(getErr)
+		}
+		if stat, statErr := repoA.store.Stat(fileID); nil != statErr || 1 > stat.Size() {
+			t.Fatalf("stat packed object got [%v]", statErr)
+		}
+	}
+
+	if _, _, err = repoA.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+	repoB := newPackTestRepo(t, tempDir, "b", cloudPath)
+	writeTestDataFile(t, repoB, "b.txt", "b")
+	if _, err = repoB.Index(ctx, "b", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = repoB.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		data, readErr := os.ReadFile(filepath.Join(repoB.DataPath, "doc"+strconv.Itoa(i)+".txt"))
+		if nil != readErr || "content "+strconv.Itoa(i) != string(data) {
+			t.Fatalf("synced data [%s], err [%v]", data, readErr)
+		}
+	}
+
+	// 清理时重写稀疏的本地包文件
+	for i := 1; i < 8; i++ {
+		if err = os.Remove(filepath.Join(repoA.DataPath, "doc"+strconv.Itoa(i)+".txt")); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if err = os.RemoveAll(filepath.Join(repoA.Path, "refs")); nil != err {
+		t.Fatal(err)
+	}
+	second, err := repoA.Index(ctx, "second", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	stat, err := repoA.Purge(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 14 != stat.Objects {
+		t.Fatalf("unexpected purged objects [%d]", stat.Objects)
+	}
+	for _, fileID := range second.Files {
+		if _, err = repoA.store.GetFile(fileID); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	// 重新加载本地包索引后仍然可以读取
+	repoA.store.localPacks = nil
+	data, err := repoA.store.GetChunk(mustGetFile(t, repoA, second.Files[0]).Chunks[0])
+	if nil != err || !strings.HasPrefix(string(data.Data), "content") {
+		t.Fatalf("read packed chunk got [%s], err [%v]", data.Data, err)
+	}
+}
+
+type listCountingCloud struct {
+	*cloud.Local
+	packLists atomic.Int32
+}
+
+func (c *listCountingCloud) ListObjects(pathPrefix string) (ret map[string]*entity.ObjectInfo, err error) {
+	if "packs/" == pathPrefix {
+		c.packLists.Add(1)
+	}
+	return c.Local.ListObjects(pathPrefix)
+}
+
+func TestCloudPacksListedOncePerSync(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repoA := newPackTestRepo(t, tempDir, "a", cloudPath)
+	for i := 0; i < 8; i++ {
+		writeTestDataFile(t, repoA, "doc"+strconv.Itoa(i)+".txt", "content "+strconv.Itoa(i))
+	}
+	ctx := context.Background()
+	if _, err := repoA.Index(ctx, "a", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repoA.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+
+	repoB := newPackTestRepo(t, tempDir, "b", cloudPath)
+	counting := &listCountingCloud{Local: repoB.cloud.(*cloud.Local)}
+	repoB.cloud = counting
+	writeTestDataFile(t, repoB, "b.txt", "b")
+	if _, err := repoB.Index(ctx, "b", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repoB.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != counting.packLists.Load() {
+		t.Fatalf("cloud packs listed [%d] times in one sync", counting.packLists.Load())
+	}
+	if nil != repoB.cloudPacksCache.Load() {
+		t.Fatal("cloud packs cache should be released after sync")
+	}
+}
+
+func mustGetFile(t *testing.T, repo *Repo, id string) *entity.File {
+	t.Helper()
+	file, err := repo.store.GetFile(id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return file
+}
@@ -0,0 +1,201 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/siyuan-note/dejavu/cloud"
+)
+
+func TestSyncWithPacks(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repoA := newPackTestRepo(t, tempDir, "a", cloudPath)
+	repoB := newPackTestRepo(t, tempDir, "b", cloudPath)
+
+	for i := 0; i < 8; i++ {
+		writeTestDataFile(t, repoA, "doc"+strconv.Itoa(i)+".txt", "content "+strconv.Itoa(i))
+	}
+	if _, err := repoA.Index(context.Background(), "a", false); nil != err {
+		t.Fatal(err)
+	}
+	_, trafficStat, err := repoA.Sync(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 8 != trafficStat.UploadChunkCount || 16 <= trafficStat.APIPut {
+		t.Fatalf("unexpected upload traffic [chunks=%d, puts=%d]", trafficStat.UploadChunkCount, trafficStat.APIPut)
+	}
+
+	cloudRepoPath := filepath.Join(cloudPath, "main")
+	if entries, _ := os.ReadDir(filepath.Join(cloudRepoPath, "objects")); 0 != len(entries) {
+		t.Fatalf("small objects should be uploaded in packs, found [%d] loose object dirs", len(entries))
+	}
+	packs, err := os.ReadDir(filepath.Join(cloudRepoPath, "packs"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 4 != len(packs) { // 分块和文件各一个包文件及其包索引
+		t.Fatalf("unexpected cloud pack files [%d]", len(packs))
+	}
+
+	writeTestDataFile(t, repoB, "b.txt", "b")
+	if _, err = repoB.Index(context.Background(), "b", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = repoB.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		data, readErr := os.ReadFile(filepath.Join(repoB.DataPath, "doc"+strconv.Itoa(i)+".txt"))
+		if nil != readErr {
+			t.Fatal(readErr)
+		}
+		if "content "+strconv.Itoa(i) != string(data) {
+			t.Fatalf("unexpected synced data [%s]", data)
+		}
+	}
+}
+
+func TestPurgeCloudRewritesSparsePacks(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repo := newPackTestRepo(t, tempDir, "a", cloudPath)
+
+	for i := 0; i < 8; i++ {
+		writeTestDataFile(t, repo, "doc"+strconv.Itoa(i)+".txt", "content "+strconv.Itoa(i))
+	}
+	if _, err := repo.Index(context.Background(), "first", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < 8; i++ {
+		if err := os.Remove(filepath.Join(repo.DataPath, "doc"+strconv.Itoa(i)+".txt")); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.Index(context.Background(), "second", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+
+	stat, err := repo.PurgeCloud(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 14 != stat.Objects {
+		t.Fatalf("unexpected purged objects [%d]", stat.Objects)
+	}
+
+	packs, _, _, err := repo.cloudPacks()
+	if nil != err {
+		t.Fatal(err)
+	}
+	objects := 0
+	for _, pack := range packs {
+		objects += len(pack.Objects)
+	}
+	if 2 != objects {
+		t.Fatalf("unexpected packed objects after purge [%d]", objects)
+	}
+}
+
+func TestPurgeCloudSkipsLockedObjects(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	memory := cloud.NewMemory(&cloud.BaseCloud{Conf: repo.cloud.GetConf()}, nil)
+	repo.cloud = memory
+
+	for i := 0; i < 8; i++ {
+		writeTestDataFile(t, repo, "doc"+strconv.Itoa(i)+".txt", "content "+strconv.Itoa(i))
+	}
+	if _, err := repo.Index(context.Background(), "first", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	for i := 1; i < 8; i++ {
+		if err := os.Remove(filepath.Join(repo.DataPath, "doc"+strconv.Itoa(i)+".txt")); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.Index(context.Background(), "second", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+
+	memory.AddFault(&cloud.MemoryFault{Method: "Delete", Key: "indexes/", Error: "locked"},
+		&cloud.MemoryFault{Method: "Delete", Key: "packs/", Error: "locked"})
+	stat, err := repo.PurgeCloud(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != stat.Indexes || 0 != stat.Objects || 0 != stat.Size || 2 > stat.Locked {
+		t.Fatalf("unexpected purge stat %+v", stat)
+	}
+
+	indexes, err := memory.ListObjects("indexes/")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(indexes) {
+		t.Fatalf("locked indexes removed, remains [%d]", len(indexes))
+	}
+}
+
+func newPackTestRepo(t *testing.T, tempDir, name, cloudPath string) (repo *Repo) {
+	t.Helper()
+	dataPath := filepath.Join(tempDir, name, "data")
+	repoPath := filepath.Join(tempDir, name, "repo")
+	if err := os.MkdirAll(dataPath, 0755); nil != err {
+		t.Fatal(err)
+	}
+
+	localCloud := cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:           "main",
+		RepoPath:      repoPath,
+		AvailableSize: 1024 * 1024 * 1024,
+		PackObjects:   true,
+		Local:         &cloud.ConfLocal{Endpoint: cloudPath},
+	}})
+	repo, err := NewRepo(dataPath, repoPath, filepath.Join(tempDir, name, "history"), filepath.Join(tempDir, name, "temp"),
+		"device-"+name, "Device", "linux", []byte("0123456789abcdef0123456789abcdef"), nil, localCloud)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return
+}
+
+func writeTestDataFile(t *testing.T, repo *Repo, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(repo.DataPath, name), []byte(content), 0644); nil != err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,569 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/klauspost/reedsolomon"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// 本地数据对象的奇偶校验数据按校验组生成，存放在 repo/parity/{id}，组内对象列表另存在 repo/parity/{id}.idx，用于定位对象所在的校验组。
+//
+// 写入索引时将新写入的数据对象（松散对象或者本地包文件）按对象 ID 排序后拼接，每 parityGroupMaxSize 字节左右划分为一个校验组，
+// 每个校验组切分为 parityDataShards 个数据分片，并使用 Reed-Solomon 编码生成 Store.ParityShards 个校验分片。
+// 校验组中还保存了所有分片的哈希，修复时据此定位损坏的分片。
+// 对象被删除时只删除其所在的校验组，组内其他对象在下次写入索引时重新生成校验组，不会重新读取未变动的对象。
+//
+// 校验分片基于加密后的对象数据计算，不会影响端到端加密的安全性。
+
+const (
+	parityDataShards   = 16               // 每个校验组的数据分片数
+	parityGroupMaxSize = 16 * 1024 * 1024 // 每个校验组覆盖的对象数据量上限
+	parityIndexExt     = ".idx"
+)
+
+var ErrParityUnrecoverable = errors.New("too many corrupted shards to recover")
+
+type parityGroup struct {
+	DataShards   int             `msgpack:"dataShards"`
+	ParityShards int             `msgpack:"parityShards"`
+	Objects      []*parityObject `msgpack:"objects"`   // 组内对象，按顺序拼接后切分为数据分片
+	ShardSize    int             `msgpack:"shardSize"` // 分片大小
+	Hashes       []string        `msgpack:"hashes"`    // 所有分片的哈希，数据分片在前，校验分片在后
+	Parity       [][]byte        `msgpack:"parity"`    // 校验分片
+}
+
+type parityObject struct {
+	Key  string `msgpack:"key"` // 松散对象为对象 ID，本地包文件为 packs/local/{id}
+	Size int64  `msgpack:"size"`
+}
+
+// localPackParityKey 返回本地包文件 id 在校验组中的键。
+func localPackParityKey(id string) string {
+	return path.Join("packs", "local", id)
+}
+
+func (store *Store) parityObjectPath(key string) string {
+	if strings.HasPrefix(key, "packs/") {
+		return filepath.Join(store.Path, filepath.FromSlash(key))
+	}
+	_, file := store.AbsPath(key)
+	return file
+}
+
+func (store *Store) parityDir() string {
+	return filepath.Join(store.Path, "parity")
+}
+
+// markParityDirty 记录新写入的对象，写入索引时为其生成奇偶校验数据。
+func (store *Store) markParityDirty(key string) {
+	store.parityLock.Lock()
+	store.parityDirty[key] = true
+	store.parityLock.Unlock()
+}
+
+// loadParityGroups 加载对象所在的校验组，调用方需要持有 parityLock。
+func (store *Store) loadParityGroups() {
+	if nil != store.parityGroups {
+		return
+	}
+
+	store.parityGroups = map[string]string{}
+	entries, err := os.ReadDir(store.parityDir())
+	if nil != err {
+		if !os.IsNotExist(err) {
+			logging.LogWarnf("read parity dir failed: %s", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), parityIndexExt) {
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), parityIndexExt)
+		keys, readErr := store.getParityGroupKeys(id)
+		if nil != readErr {
+			logging.LogWarnf("read parity group [%s] index failed: %s", id, readErr)
+			continue
+		}
+		for _, key := range keys {
+			store.parityGroups[key] = id
+		}
+	}
+}
+
+func (store *Store) getParityGroupKeys(id string) (ret []string, err error) {
+	data, err := os.ReadFile(filepath.Join(store.parityDir(), id+parityIndexExt))
+	if nil != err {
+		return
+	}
+	err = msgpack.Unmarshal(data, &ret)
+	return
+}
+
+func (store *Store) getParityGroup(id string) (ret *parityGroup, err error) {
+	data, err := os.ReadFile(filepath.Join(store.parityDir(), id))
+	if nil != err {
+		return
+	}
+
+	ret = &parityGroup{}
+	if err = msgpack.Unmarshal(data, ret); nil != err {
+		ret = nil
+	}
+	return
+}
+
+// updateParity 为新写入的对象生成奇偶校验数据，已经生成过奇偶校验数据的对象不会被重新读取。
+func (store *Store) updateParity() (err error) {
+	store.parityLock.Lock()
+	defer store.parityLock.Unlock()
+
+	if 1 > store.ParityShards {
+		store.parityDirty = map[string]bool{}
+		return
+	}
+
+	var keys []string
+	for key := range store.parityDirty {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var objects []*parityObject
+	for _, key := range keys {
+		info, statErr := os.Stat(store.parityObjectPath(key))
+		if nil != statErr { // 已经被删除的对象不需要生成奇偶校验数据
+			delete(store.parityDirty, key)
+			continue
+		}
+		objects = append(objects, &parityObject{Key: key, Size: info.Size()})
+	}
+	if 1 > len(objects) {
+		return
+	}
+
+	enc, err := reedsolomon.New(parityDataShards, store.ParityShards)
+	if nil != err {
+		return
+	}
+
+	var groupObjects []*parityObject
+	var groupSize int64
+	for i, obj := range objects {
+		groupObjects = append(groupObjects, obj)
+		groupSize += obj.Size
+		if parityGroupMaxSize > groupSize && i < len(objects)-1 {
+			continue
+		}
+
+		if err = store.putParityGroup(enc, groupObjects); nil != err {
+			logging.LogErrorf("put parity group failed: %s", err)
+			return
+		}
+		for _, groupObj := range groupObjects {
+			delete(store.parityDirty, groupObj.Key)
+		}
+		groupObjects = nil
+		groupSize = 0
+	}
+	return
+}
+
+// putParityGroup 为 objects 生成一个校验组，先写入校验组再写入组内对象列表。
+func (store *Store) putParityGroup(enc reedsolomon.Encoder, objects []*parityObject) (err error) {
+	group, err := store.encodeParityGroup(enc, objects)
+	if nil != err {
+		return
+	}
+	data, err := msgpack.Marshal(group)
+	if nil != err {
+		return
+	}
+	var keys []string
+	for _, obj := range group.Objects {
+		keys = append(keys, obj.Key)
+	}
+	idxData, err := msgpack.Marshal(keys)
+	if nil != err {
+		return
+	}
+
+	id := util.Hash(data)
+	dir := store.parityDir()
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		return
+	}
+	if err = gulu.File.WriteFileSafer(filepath.Join(dir, id), data, 0644); nil != err {
+		return
+	}
+	if err = gulu.File.WriteFileSafer(filepath.Join(dir, id+parityIndexExt), idxData, 0644); nil != err {
+		return
+	}
+
+	store.loadParityGroups()
+	for _, key := range keys {
+		store.parityGroups[key] = id
+	}
+	return
+}
+
+func (store *Store) encodeParityGroup(enc reedsolomon.Encoder, objects []*parityObject) (ret *parityGroup, err error) {
+	var buf []byte
+	for _, obj := range objects {
+		data, readErr := os.ReadFile(store.parityObjectPath(obj.Key))
+		if nil != readErr {
+			err = readErr
+			return
+		}
+		obj.Size = int64(len(data)) // 以实际读取到的数据为准
+		buf = append(buf, data...)
+	}
+
+	shardSize := (len(buf) + parityDataShards - 1) / parityDataShards
+	if 1 > shardSize {
+		shardSize = 1
+	}
+	buf = append(buf, make([]byte, shardSize*parityDataShards-len(buf))...)
+	shards := splitParityShards(buf, shardSize, store.ParityShards)
+	if err = enc.Encode(shards); nil != err {
+		return
+	}
+
+	ret = &parityGroup{DataShards: parityDataShards, ParityShards: store.ParityShards, Objects: objects, ShardSize: shardSize}
+	for i, shard := range shards {
+		ret.Hashes = append(ret.Hashes, util.Hash(shard))
+		if parityDataShards <= i {
+			ret.Parity = append(ret.Parity, shard)
+		}
+	}
+	return
+}
+
+func splitParityShards(data []byte, shardSize, parityShards int) (ret [][]byte) {
+	for i := 0; i < parityDataShards; i++ {
+		ret = append(ret, data[i*shardSize:(i+1)*shardSize])
+	}
+	for i := 0; i < parityShards; i++ {
+		ret = append(ret, make([]byte, shardSize))
+	}
+	return
+}
+
+// dropParity 删除对象 keys 所在的校验组，组内其他仍然存在的对象在下次写入索引时重新生成校验组。
+func (store *Store) dropParity(keys ...string) {
+	store.parityLock.Lock()
+	defer store.parityLock.Unlock()
+
+	store.loadParityGroups()
+	groupIDs := map[string]bool{}
+	for _, key := range keys {
+		if id := store.parityGroups[key]; "" != id {
+			groupIDs[id] = true
+		}
+		delete(store.parityGroups, key)
+		delete(store.parityDirty, key)
+	}
+	for id := range groupIDs {
+		store.removeParityGroup(id)
+	}
+}
+
+// removeParityGroup 删除校验组 id，组内其他仍然存在的对象标记为需要重新生成奇偶校验数据，调用方需要持有 parityLock。
+func (store *Store) removeParityGroup(id string) {
+	members, err := store.getParityGroupKeys(id)
+	if nil != err && !os.IsNotExist(err) {
+		logging.LogWarnf("read parity group [%s] index failed: %s", id, err)
+	}
+	for _, member := range members {
+		if id != store.parityGroups[member] {
+			continue
+		}
+
+		delete(store.parityGroups, member)
+		if gulu.File.IsExist(store.parityObjectPath(member)) {
+			store.parityDirty[member] = true
+		}
+	}
+
+	dir := store.parityDir()
+	if err = os.RemoveAll(filepath.Join(dir, id+parityIndexExt)); nil != err {
+		logging.LogWarnf("remove parity group [%s] index failed: %s", id, err)
+		return
+	}
+	if err = os.RemoveAll(filepath.Join(dir, id)); nil != err {
+		logging.LogWarnf("remove parity group [%s] failed: %s", id, err)
+	}
+}
+
+// repairObject 使用奇偶校验数据修复对象 key 所在校验组中损坏的对象，返回被修复的对象。
+func (store *Store) repairObject(key string) (ret []string, err error) {
+	store.parityLock.Lock()
+	defer store.parityLock.Unlock()
+
+	store.loadParityGroups()
+	id := store.parityGroups[key]
+	if "" == id {
+		err = os.ErrNotExist
+		return
+	}
+
+	group, err := store.getParityGroup(id)
+	if nil != err {
+		return
+	}
+	return store.repairParityGroup(group)
+}
+
+func (store *Store) repairParityGroup(group *parityGroup) (ret []string, err error) {
+	if 1 > group.ShardSize || len(group.Hashes) != group.DataShards+group.ParityShards || len(group.Parity) != group.ParityShards {
+		err = errors.New("invalid parity group")
+		return
+	}
+
+	buf := make([]byte, group.ShardSize*group.DataShards)
+	offset := int64(0)
+	for _, obj := range group.Objects {
+		data, readErr := os.ReadFile(store.parityObjectPath(obj.Key))
+		if nil == readErr && int64(len(data)) == obj.Size {
+			copy(buf[offset:], data)
+		} // 读取失败或者大小不符的对象保持零值，其所在分片会因哈希不匹配被视为损坏
+		offset += obj.Size
+	}
+
+	shards := make([][]byte, group.DataShards+group.ParityShards)
+	for i := 0; i < group.DataShards; i++ {
+		shards[i] = buf[i*group.ShardSize : (i+1)*group.ShardSize]
+	}
+	for i := 0; i < group.ParityShards; i++ {
+		shards[group.DataShards+i] = group.Parity[i]
+	}
+
+	corrupted := 0
+	for i, shard := range shards {
+		if util.Hash(shard) != group.Hashes[i] {
+			shards[i] = nil
+			corrupted++
+		}
+	}
+	if 0 == corrupted {
+		return
+	}
+	if group.ParityShards < corrupted {
+		err = ErrParityUnrecoverable
+		return
+	}
+
+	enc, err := reedsolomon.New(group.DataShards, group.ParityShards)
+	if nil != err {
+		return
+	}
+	if err = enc.ReconstructData(shards); nil != err {
+		return
+	}
+
+	repaired := bytes.Join(shards[:group.DataShards], nil)
+	offset = 0
+	for _, obj := range group.Objects {
+		want := repaired[offset : offset+obj.Size]
+		offset += obj.Size
+
+		absPath := store.parityObjectPath(obj.Key)
+		data, readErr := os.ReadFile(absPath)
+		if os.IsNotExist(readErr) { // 已经被清理的对象不需要恢复
+			continue
+		}
+		if nil == readErr && bytes.Equal(data, want) {
+			continue
+		}
+
+		if err = gulu.File.WriteFileSafer(absPath, want, 0644); nil != err {
+			return
+		}
+		fileCache.Del(obj.Key)
+		ret = append(ret, obj.Key)
+		logging.LogInfof("repaired object [%s] with parity", obj.Key)
+	}
+	return
+}
+
+// Check 校验本地仓库中的所有数据对象，使用奇偶校验数据修复损坏的对象，并为缺少奇偶校验数据的对象生成奇偶校验数据。
+func (store *Store) Check(ctx context.Context) (ret *entity.CheckReport, err error) {
+	ret = &entity.CheckReport{CheckTime: time.Now().UnixMilli()}
+	store.checkLocalPacks(ctx, ret)
+
+	objectsDir := filepath.Join(store.Path, "objects")
+	if gulu.File.IsDir(objectsDir) {
+		var entries []os.DirEntry
+		entries, err = os.ReadDir(objectsDir)
+		if nil != err {
+			logging.LogErrorf("read objects dir [%s] failed: %s", objectsDir, err)
+			return
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() || 2 != len(entry.Name()) {
+				continue
+			}
+
+			if isCancelled(ctx) {
+				logging.LogWarnf("checking data repo [%s] cancelled", store.Path)
+				return
+			}
+
+			prefix := entry.Name()
+			objs, readErr := os.ReadDir(filepath.Join(objectsDir, prefix))
+			if nil != readErr {
+				err = readErr
+				logging.LogErrorf("read objects dir [%s] failed: %s", prefix, err)
+				return
+			}
+
+			repaired := map[string]bool{}
+			for _, obj := range objs {
+				id := prefix + obj.Name()
+				ret.CheckCount++
+				if repaired[id] {
+					continue
+				}
+
+				_, file := store.AbsPath(id)
+				data, readErr := os.ReadFile(file)
+				if nil == readErr {
+					if _, readErr = store.decodeData(data); nil == readErr {
+						continue
+					}
+				}
+
+				repairedIDs, repairErr := store.repairObject(id)
+				for _, repairedID := range repairedIDs {
+					repaired[repairedID] = true
+				}
+				if !repaired[id] {
+					logging.LogWarnf("repair object [%s] failed: %v", id, repairErr)
+					ret.CorruptedObjects = append(ret.CorruptedObjects, id)
+				}
+			}
+			for id := range repaired {
+				ret.RepairedObjects = append(ret.RepairedObjects, id)
+			}
+		}
+	}
+
+	if 0 < store.ParityShards {
+		if err = store.refreshParity(); nil != err {
+			logging.LogErrorf("refresh parity failed: %s", err)
+			return
+		}
+	}
+
+	sort.Strings(ret.RepairedObjects)
+	ret.FixCount = len(ret.RepairedObjects)
+	logging.LogInfof("checked data repo [%s], [%d] objects, [%d] repaired, [%d] corrupted", store.Path, ret.CheckCount, ret.FixCount, len(ret.CorruptedObjects))
+	return
+}
+
+// refreshParity 删除过期的校验组（冗余级别变化或者组内对象缺失），并为缺少奇偶校验数据的对象生成奇偶校验数据。
+func (store *Store) refreshParity() (err error) {
+	store.parityLock.Lock()
+	store.loadParityGroups()
+	entries, err := os.ReadDir(store.parityDir())
+	if nil != err && !os.IsNotExist(err) {
+		store.parityLock.Unlock()
+		return
+	}
+	err = nil
+
+	groupIDs := map[string]bool{}
+	for _, id := range store.parityGroups {
+		groupIDs[id] = true
+	}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), parityIndexExt)
+		if !groupIDs[id] { // 没有对象列表的校验组
+			if removeErr := os.RemoveAll(filepath.Join(store.parityDir(), entry.Name())); nil != removeErr {
+				logging.LogWarnf("remove orphan parity [%s] failed: %s", entry.Name(), removeErr)
+			}
+		}
+	}
+	for id := range groupIDs {
+		group, getErr := store.getParityGroup(id)
+		if nil == getErr && store.ParityShards == group.ParityShards {
+			complete := true
+			for _, obj := range group.Objects {
+				if !gulu.File.IsExist(store.parityObjectPath(obj.Key)) {
+					complete = false
+					break
+				}
+			}
+			if complete {
+				continue
+			}
+		}
+		store.removeParityGroup(id)
+	}
+
+	for _, key := range store.parityObjectKeys() {
+		if "" == store.parityGroups[key] {
+			store.parityDirty[key] = true
+		}
+	}
+	store.parityLock.Unlock()
+
+	err = store.updateParity()
+	return
+}
+
+// parityObjectKeys 返回本地仓库中所有需要奇偶校验数据的对象，包括松散对象和本地包文件。
+func (store *Store) parityObjectKeys() (ret []string) {
+	objectsDir := filepath.Join(store.Path, "objects")
+	prefixes, _ := os.ReadDir(objectsDir)
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() || 2 != len(prefix.Name()) {
+			continue
+		}
+
+		objs, _ := os.ReadDir(filepath.Join(objectsDir, prefix.Name()))
+		for _, obj := range objs {
+			ret = append(ret, prefix.Name()+obj.Name())
+		}
+	}
+
+	packs, _ := os.ReadDir(store.localPacksDir())
+	for _, pack := range packs {
+		if !pack.IsDir() && !strings.HasSuffix(pack.Name(), packIndexExt) {
+			ret = append(ret, localPackParityKey(pack.Name()))
+		}
+	}
+	return
+}
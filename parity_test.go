@@ -0,0 +1,229 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+)
+
+func TestParityRepairCorruptedChunk(t *testing.T) {
+	store, chunks := newParityTestStore(t, 2)
+
+	corruptObject(t, store, chunks[1].ID)
+	chunk, err := store.GetChunk(chunks[1].ID)
+	if nil != err {
+		t.Fatalf("get corrupted chunk failed: %s", err)
+	}
+	if !bytes.Equal(chunks[1].Data, chunk.Data) {
+		t.Fatalf("repaired chunk data not match")
+	}
+
+	corruptObject(t, store, chunks[2].ID)
+	report, err := store.Check(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(chunks) != report.CheckCount || 1 != report.FixCount || 0 != len(report.CorruptedObjects) {
+		t.Fatalf("unexpected check report [%+v]", report)
+	}
+	if chunks[2].ID != report.RepairedObjects[0] {
+		t.Fatalf("unexpected repaired objects [%v]", report.RepairedObjects)
+	}
+}
+
+func TestParityReportsUnrecoverableChunks(t *testing.T) {
+	store, chunks := newParityTestStore(t, 1)
+
+	for _, chunk := range chunks {
+		corruptObject(t, store, chunk.ID)
+	}
+	report, err := store.Check(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != report.FixCount || len(chunks) != len(report.CorruptedObjects) {
+		t.Fatalf("unexpected check report [%+v]", report)
+	}
+}
+
+func TestParityIncremental(t *testing.T) {
+	store, chunks := newParityTestStore(t, 2)
+	firstGroup := parityGroupOf(store, chunks[0].ID)
+	firstInfo, err := os.Stat(filepath.Join(store.parityDir(), firstGroup))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("parity incremental"), 512)
+	chunk := &entity.Chunk{ID: "ab" + util.Hash(data)[2:], Data: data}
+	if err = store.PutChunk(chunk); nil != err {
+		t.Fatal(err)
+	}
+	if err = store.PutIndex(&entity.Index{ID: util.RandHash()}); nil != err {
+		t.Fatal(err)
+	}
+	newGroup := parityGroupOf(store, chunk.ID)
+	if "" == newGroup || firstGroup == newGroup {
+		t.Fatalf("new chunk should be covered by a new parity group, got [%s]", newGroup)
+	}
+	info, err := os.Stat(filepath.Join(store.parityDir(), firstGroup))
+	if nil != err {
+		t.Fatalf("existing parity group removed: %s", err)
+	}
+	if !info.ModTime().Equal(firstInfo.ModTime()) || firstGroup != parityGroupOf(store, chunks[1].ID) {
+		t.Fatalf("existing parity group should not be rebuilt")
+	}
+
+	// 删除对象后其所在的校验组被删除，组内其他对象在下次写入索引时重新生成校验组
+	if err = store.Remove(chunks[0].ID); nil != err {
+		t.Fatal(err)
+	}
+	if gulu.File.IsExist(filepath.Join(store.parityDir(), firstGroup)) {
+		t.Fatalf("parity group of removed chunk should be dropped")
+	}
+	if err = store.PutIndex(&entity.Index{ID: util.RandHash()}); nil != err {
+		t.Fatal(err)
+	}
+	for _, c := range chunks[1:] {
+		if group := parityGroupOf(store, c.ID); "" == group || firstGroup == group {
+			t.Fatalf("chunk [%s] should be covered by a rebuilt parity group, got [%s]", c.ID, group)
+		}
+	}
+	if newGroup != parityGroupOf(store, chunk.ID) {
+		t.Fatalf("unrelated parity group should not be rebuilt")
+	}
+
+	corruptObject(t, store, chunks[2].ID)
+	got, err := store.GetChunk(chunks[2].ID)
+	if nil != err {
+		t.Fatalf("get corrupted chunk failed: %s", err)
+	}
+	if !bytes.Equal(chunks[2].Data, got.Data) {
+		t.Fatalf("repaired chunk data not match")
+	}
+}
+
+func TestParityRepairLocalPack(t *testing.T) {
+	store, err := NewStore(t.TempDir(), []byte("0123456789abcdef0123456789abcdef"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	store.ParityShards = 2
+	store.PackObjects = true
+
+	var chunks []*entity.Chunk
+	for i := 0; i < 4; i++ {
+		data := []byte("parity pack " + strconv.Itoa(i))
+		chunk := &entity.Chunk{ID: util.Hash(data), Data: data}
+		if err = store.PutChunk(chunk); nil != err {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err = store.PutIndex(&entity.Index{ID: util.RandHash()}); nil != err {
+		t.Fatal(err)
+	}
+
+	packed := store.localPacked(chunks[0].ID)
+	if nil == packed {
+		t.Fatalf("chunk should be packed")
+	}
+	if "" == parityGroupOf(store, localPackParityKey(packed.pack)) {
+		t.Fatalf("parity group of local pack not found")
+	}
+
+	packFile := filepath.Join(store.localPacksDir(), packed.pack)
+	data, err := os.ReadFile(packFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err = os.WriteFile(packFile, data, 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	report, err := store.Check(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != len(report.CorruptedObjects) || len(store.localPacks[packed.pack].Objects) != report.FixCount {
+		t.Fatalf("unexpected check report [%+v]", report)
+	}
+	for _, chunk := range chunks {
+		got, getErr := store.GetChunk(chunk.ID)
+		if nil != getErr || !bytes.Equal(chunk.Data, got.Data) {
+			t.Fatalf("get chunk [%s] failed: %v", chunk.ID, getErr)
+		}
+	}
+}
+
+func newParityTestStore(t *testing.T, parityShards int) (store *Store, chunks []*entity.Chunk) {
+	t.Helper()
+	store, err := NewStore(t.TempDir(), []byte("0123456789abcdef0123456789abcdef"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	store.ParityShards = parityShards
+
+	for i := 0; i < 4; i++ {
+		data := bytes.Repeat([]byte("parity "+strconv.Itoa(i)), 512)
+		chunk := &entity.Chunk{ID: "ab" + util.Hash(data)[2:], Data: data}
+		if err = store.PutChunk(chunk); nil != err {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err = store.PutIndex(&entity.Index{ID: util.RandHash()}); nil != err {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if "" == parityGroupOf(store, chunk.ID) {
+			t.Fatalf("parity group of chunk [%s] not found", chunk.ID)
+		}
+	}
+	return
+}
+
+func parityGroupOf(store *Store, key string) string {
+	store.parityLock.Lock()
+	defer store.parityLock.Unlock()
+
+	store.loadParityGroups()
+	return store.parityGroups[key]
+}
+
+func corruptObject(t *testing.T, store *Store, id string) {
+	t.Helper()
+	_, file := store.AbsPath(id)
+	data, err := os.ReadFile(file)
+	if nil != err {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err = os.WriteFile(file, data, 0644); nil != err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,114 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+
+	"github.com/siyuan-note/eventbus"
+)
+
+// ProgressReporter 描述了仓库操作的进度报告，event 为事件名称，取值同 eventbus 中的仓库事件，如 eventbus.EvtIndexUpsertFile。
+//
+// 通过 WithProgressReporter 将报告器绑定到传给仓库方法的上下文中，没有绑定时进度事件通过 eventbus 发布。
+type ProgressReporter interface {
+	// Stage 用于报告进入某个阶段，如云端加锁、清理云端时列出对象。
+	Stage(event string)
+
+	// Item 用于报告正在处理的对象 item，如数据文件夹路径、索引 ID 或者引用路径。
+	Item(event, item string)
+
+	// Total 用于报告待处理对象总数 total。
+	Total(event string, total int)
+
+	// Progress 用于报告处理进度，count 为当前序号，total 为总数。
+	Progress(event string, count, total int)
+}
+
+// EventBusReporter 描述了通过 eventbus 发布进度事件的报告器，Context 为发布事件时传递的调用上下文。
+type EventBusReporter struct {
+	Context map[string]interface{}
+}
+
+// NewEventBusReporter 创建一个通过 eventbus 发布进度事件的报告器，context 为发布事件时传递的调用上下文。
+func NewEventBusReporter(context map[string]interface{}) *EventBusReporter {
+	if nil == context {
+		context = map[string]interface{}{}
+	}
+	return &EventBusReporter{Context: context}
+}
+
+func (reporter *EventBusReporter) Stage(event string) {
+	eventbus.Publish(event, reporter.Context)
+}
+
+func (reporter *EventBusReporter) Item(event, item string) {
+	eventbus.Publish(event, reporter.Context, item)
+}
+
+func (reporter *EventBusReporter) Total(event string, total int) {
+	eventbus.Publish(event, reporter.Context, total)
+}
+
+func (reporter *EventBusReporter) Progress(event string, count, total int) {
+	eventbus.Publish(event, reporter.Context, count, total)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) Stage(string)              {}
+func (nopReporter) Item(string, string)       {}
+func (nopReporter) Total(string, int)         {}
+func (nopReporter) Progress(string, int, int) {}
+
+type progressReporterKey struct{}
+
+// WithProgressReporter 返回绑定了进度报告器 reporter 的上下文。
+func WithProgressReporter(ctx context.Context, reporter ProgressReporter) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, reporter)
+}
+
+// EventBusContext 返回通过 eventbus 发布进度事件的上下文，eventContext 为发布事件时传递的调用上下文。
+func EventBusContext(ctx context.Context, eventContext map[string]interface{}) context.Context {
+	return WithProgressReporter(ctx, NewEventBusReporter(eventContext))
+}
+
+// progressReporter 返回上下文 ctx 中绑定的进度报告器。
+func progressReporter(ctx context.Context) ProgressReporter {
+	if reporter, ok := ctx.Value(progressReporterKey{}).(ProgressReporter); ok && nil != reporter {
+		return reporter
+	}
+	return defaultReporter
+}
+
+var defaultReporter = NewEventBusReporter(nil)
+
+// defaultProgress 返回 ctx，没有绑定进度报告器时绑定通过 eventbus 发布进度事件的报告器，pushMsg 为该方法默认的消息推送方式，如 eventbus.CtxPushMsgToStatusBar。
+func defaultProgress(ctx context.Context, pushMsg int) context.Context {
+	if reporter, ok := ctx.Value(progressReporterKey{}).(ProgressReporter); ok && nil != reporter {
+		return ctx
+	}
+	return EventBusContext(ctx, map[string]interface{}{eventbus.CtxPushMsg: pushMsg})
+}
+
+// quietProgress 返回不向用户展示进度的上下文，用于加锁、解锁等内部辅助操作。
+func quietProgress(ctx context.Context) context.Context {
+	if _, ok := progressReporter(ctx).(*EventBusReporter); ok {
+		return EventBusContext(ctx, map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone})
+	}
+	return WithProgressReporter(ctx, nopReporter{})
+}
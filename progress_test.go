@@ -0,0 +1,125 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/siyuan-note/eventbus"
+)
+
+type testProgressReporter struct {
+	lock   sync.Mutex
+	events map[string]int
+}
+
+func (reporter *testProgressReporter) record(event string) {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	reporter.events[event]++
+}
+
+func (reporter *testProgressReporter) Stage(event string)              { reporter.record(event) }
+func (reporter *testProgressReporter) Item(event, item string)         { reporter.record(event) }
+func (reporter *testProgressReporter) Total(event string, total int)   { reporter.record(event) }
+func (reporter *testProgressReporter) Progress(event string, _, _ int) { reporter.record(event) }
+
+func TestProgressReporter(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	for i := 0; i < 3; i++ {
+		writeTestDataFile(t, repo, "doc"+strconv.Itoa(i)+".txt", "content "+strconv.Itoa(i))
+	}
+
+	reporter := &testProgressReporter{events: map[string]int{}}
+	ctx := WithProgressReporter(context.Background(), reporter)
+	if _, err := repo.Index(ctx, "progress", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+
+	if 3 != reporter.events[eventbus.EvtIndexWalkData] || 3 != reporter.events[eventbus.EvtIndexUpsertFile] {
+		t.Fatalf("unexpected index events [%v]", reporter.events)
+	}
+	if 1 != reporter.events[eventbus.EvtCloudLock] || 1 != reporter.events[eventbus.EvtCloudBeforeUploadIndex] {
+		t.Fatalf("unexpected sync events [%v]", reporter.events)
+	}
+}
+
+func TestCanceledContext(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	writeTestDataFile(t, repo, "doc.txt", "content")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := repo.Index(ctx, "canceled", false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("index with canceled context should fail, got [%v]", err)
+	}
+	if latest, _ := repo.Latest(); nil != latest && "canceled" == latest.Memo {
+		t.Fatal("canceled index should not update latest")
+	}
+
+	index, err := repo.Index(context.Background(), "first", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	writeTestDataFile(t, repo, "doc.txt", "changed")
+	if _, _, err = repo.Checkout(ctx, index.ID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("checkout with canceled context should fail, got [%v]", err)
+	}
+	if _, _, err = repo.Sync(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("sync with canceled context should fail, got [%v]", err)
+	}
+}
+
+func TestDefaultProgress(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	writeTestDataFile(t, repo, "doc.txt", "content")
+	if _, err := repo.Index(context.Background(), "first", false); nil != err {
+		t.Fatal(err)
+	}
+
+	// 没有绑定进度报告器时清理云端的进度和之前一样推送到状态栏和进度条
+	var pushMsg atomic.Value
+	eventbus.Subscribe(eventbus.EvtCloudPurgeListObjects, func(context map[string]interface{}) {
+		pushMsg.Store(context[eventbus.CtxPushMsg])
+	})
+	if _, err := repo.PurgeCloud(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if eventbus.CtxPushMsgToStatusBarAndProgress != pushMsg.Load() {
+		t.Fatalf("unexpected push msg [%v]", pushMsg.Load())
+	}
+
+	reporter := &testProgressReporter{events: map[string]int{}}
+	if _, err := repo.PurgeCloud(WithProgressReporter(context.Background(), reporter)); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != reporter.events[eventbus.EvtCloudPurgeListObjects] {
+		t.Fatalf("unexpected purge events [%v]", reporter.events)
+	}
+}
@@ -0,0 +1,237 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// ErrCloudVersionNotFound 描述了云端对象不存在符合条件的历史版本的错误。
+var ErrCloudVersionNotFound = errors.New("cloud version not found")
+
+// CloudRefVersion 描述了云端引用的一个历史版本。
+type CloudRefVersion struct {
+	VersionID string        // 版本 ID
+	Updated   time.Time     // 版本写入时间
+	Latest    bool          // 是否为当前版本
+	IndexID   string        // 该版本指向的索引 ID
+	Index     *entity.Index // 该版本指向的索引，索引已经被清理时为空
+}
+
+// GetCloudRefVersions 列出云端引用 ref（比如 latest、tags/v1）的历史版本，按写入时间从新到旧排列。
+//
+// 需要存储服务支持版本控制，比如启用了版本控制的 S3 存储空间，否则返回 cloud.ErrUnsupported。
+func (repo *Repo) GetCloudRefVersions(ctx context.Context, ref string) (ret []*CloudRefVersion, err error) {
+	versioned, key, err := repo.versionedCloudRef(ref)
+	if nil != err {
+		return
+	}
+
+	versions, err := versioned.ListObjectVersions(ctx, key)
+	if nil != err {
+		logging.LogErrorf("list cloud [%s] versions failed: %s", key, err)
+		return
+	}
+
+	ret = []*CloudRefVersion{}
+	indexes := map[string]*entity.Index{}
+	for _, version := range versions {
+		if version.DeleteMarker {
+			continue
+		}
+
+		data, getErr := versioned.GetObjectVersion(ctx, key, version.VersionID)
+		if nil != getErr {
+			logging.LogWarnf("get cloud [%s] version [%s] failed: %s", key, version.VersionID, getErr)
+			continue
+		}
+
+		refVersion := &CloudRefVersion{VersionID: version.VersionID, Updated: version.Updated, Latest: version.Latest, IndexID: strings.TrimSpace(string(data))}
+		if index, ok := indexes[refVersion.IndexID]; ok {
+			refVersion.Index = index
+		} else if 40 == len(refVersion.IndexID) {
+			_, index, downloadErr := repo.downloadCloudIndex(ctx, refVersion.IndexID)
+			if nil != downloadErr {
+				logging.LogWarnf("download cloud index [%s] of [%s] version [%s] failed: %s", refVersion.IndexID, key, version.VersionID, downloadErr)
+				index = nil
+			}
+			indexes[refVersion.IndexID] = index
+			refVersion.Index = index
+		}
+		ret = append(ret, refVersion)
+	}
+	return
+}
+
+// RestoreCloudRefVersion 下载云端引用 ref 的历史版本 versionID 指向的索引及其数据到本地仓库，返回的索引可以用于检出。
+func (repo *Repo) RestoreCloudRefVersion(ctx context.Context, ref, versionID string) (index *entity.Index, err error) {
+	versioned, key, err := repo.versionedCloudRef(ref)
+	if nil != err {
+		return
+	}
+
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	runlockCloud, err := repo.tryRLockCloud(ctx)
+	if nil != err {
+		return
+	}
+	defer runlockCloud()
+
+	data, err := versioned.GetObjectVersion(ctx, key, versionID)
+	if nil != err {
+		logging.LogErrorf("get cloud [%s] version [%s] failed: %s", key, versionID, err)
+		return
+	}
+
+	index, err = repo.restoreCloudIndex(ctx, strings.TrimSpace(string(data)))
+	return
+}
+
+// RollbackCloud 将云端仓库回滚到时间点 at，即将 refs/latest 和 indexes-v2.json 恢复为 at 时的版本。
+//
+// 回滚前会先下载 at 时的最新索引及其全部数据到本地仓库，确认云端数据完整，返回的索引可以用于检出。
+// 回滚只改写引用，不删除数据，at 之后上传的索引和对象在下次清理云端时才会被删除。
+func (repo *Repo) RollbackCloud(ctx context.Context, at time.Time) (index *entity.Index, err error) {
+	versioned, key, err := repo.versionedCloudRef("latest")
+	if nil != err {
+		return
+	}
+
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	lockCtx := quietProgress(ctx)
+	if err = repo.tryLockCloud(lockCtx, "rollback"); nil != err {
+		return
+	}
+	defer repo.unlockCloud(lockCtx)
+
+	latestVersion, err := cloudVersionAt(ctx, versioned, key, at)
+	if nil != err {
+		return
+	}
+	data, err := versioned.GetObjectVersion(ctx, key, latestVersion.VersionID)
+	if nil != err {
+		logging.LogErrorf("get cloud [%s] version [%s] failed: %s", key, latestVersion.VersionID, err)
+		return
+	}
+	latestID := strings.TrimSpace(string(data))
+	if index, err = repo.restoreCloudIndex(ctx, latestID); nil != err {
+		return
+	}
+
+	var indexesV2 []byte
+	indexesV2Version, versionErr := cloudVersionAt(ctx, versioned, "indexes-v2.json", at)
+	if nil == versionErr {
+		if indexesV2, err = versioned.GetObjectVersion(ctx, "indexes-v2.json", indexesV2Version.VersionID); nil != err {
+			logging.LogErrorf("get cloud [indexes-v2.json] version [%s] failed: %s", indexesV2Version.VersionID, err)
+			return
+		}
+	} else if !errors.Is(versionErr, ErrCloudVersionNotFound) {
+		err = versionErr
+		return
+	}
+
+	if err = repo.checkCloudLease(ctx); nil != err {
+		return
+	}
+	if nil != indexesV2 {
+		if _, err = repo.cloud.UploadBytes("indexes-v2.json", indexesV2, true); nil != err {
+			logging.LogErrorf("rollback cloud [indexes-v2.json] failed: %s", err)
+			return
+		}
+	}
+	if _, err = repo.cloud.UploadBytes(key, []byte(latestID), true); nil != err {
+		logging.LogErrorf("rollback cloud [%s] failed: %s", key, err)
+		return
+	}
+	if repo.isCloudS3() || repo.isCloudSiYuan() {
+		// refs/latest-seqNum-id 中较新的索引会优先于 refs/latest 使用，所以也需要更新
+		if err = repo.updateCloudSeqNumLatest(latestID); nil != err {
+			return
+		}
+	}
+	logging.LogInfof("rolled back cloud to [%s], latest [%s]", at.Format(time.RFC3339), index.String())
+	return
+}
+
+// restoreCloudIndex 用于下载云端索引 id 及其数据到本地仓库。
+func (repo *Repo) restoreCloudIndex(ctx context.Context, id string) (index *entity.Index, err error) {
+	if 40 != len(id) {
+		err = fmt.Errorf("%w: invalid index ID [%s]", ErrNotFoundIndex, id)
+		return
+	}
+
+	if _, _, _, err = repo.downloadIndex(ctx, id); nil != err {
+		logging.LogErrorf("restore cloud index [%s] failed: %s", id, err)
+		return
+	}
+	index, err = repo.store.GetIndex(id)
+	return
+}
+
+// versionedCloudRef 返回支持版本控制的存储服务和云端引用 ref 的对象路径。
+func (repo *Repo) versionedCloudRef(ref string) (versioned cloud.Versioned, key string, err error) {
+	versioned, ok := cloud.Unwrap(repo.cloud).(cloud.Versioned)
+	if !ok {
+		err = cloud.ErrUnsupported
+		return
+	}
+
+	key = path.Join("refs", ref)
+	if "refs/latest" != key && "refs/tags" != path.Dir(key) {
+		err = fmt.Errorf("invalid ref [%s]", ref)
+	}
+	return
+}
+
+// cloudVersionAt 返回对象 key 在时间点 at 时的版本，当时对象不存在时返回 ErrCloudVersionNotFound。
+func cloudVersionAt(ctx context.Context, versioned cloud.Versioned, key string, at time.Time) (ret *cloud.ObjectVersion, err error) {
+	versions, err := versioned.ListObjectVersions(ctx, key)
+	if nil != err {
+		logging.LogErrorf("list cloud [%s] versions failed: %s", key, err)
+		return
+	}
+
+	for _, version := range versions {
+		if version.Updated.After(at) {
+			continue
+		}
+		if version.DeleteMarker {
+			break
+		}
+		ret = version
+		return
+	}
+	err = fmt.Errorf("%w: [%s] at [%s]", ErrCloudVersionNotFound, key, at.Format(time.RFC3339))
+	return
+}
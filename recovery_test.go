@@ -0,0 +1,169 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+)
+
+// versionedTestCloud 为存储服务记录每次上传的版本，用于模拟启用了版本控制的 S3 存储空间。
+type versionedTestCloud struct {
+	cloud.Cloud
+
+	lock     sync.Mutex
+	versions map[string][]*versionedTestObject
+}
+
+type versionedTestObject struct {
+	version *cloud.ObjectVersion
+	data    []byte
+}
+
+func (versioned *versionedTestCloud) record(key string, data []byte) {
+	versioned.lock.Lock()
+	defer versioned.lock.Unlock()
+	version := &cloud.ObjectVersion{VersionID: strconv.Itoa(len(versioned.versions[key])), Updated: time.Now(), Size: int64(len(data))}
+	versioned.versions[key] = append(versioned.versions[key], &versionedTestObject{version: version, data: bytes.Clone(data)})
+}
+
+func (versioned *versionedTestCloud) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	if length, err = versioned.Cloud.UploadObject(filePath, overwrite); nil != err {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(versioned.GetConf().RepoPath, filePath))
+	if nil != err {
+		return
+	}
+	versioned.record(filePath, data)
+	return
+}
+
+func (versioned *versionedTestCloud) UploadBytes(filePath string, data []byte, overwrite bool) (length int64, err error) {
+	if length, err = versioned.Cloud.UploadBytes(filePath, data, overwrite); nil != err {
+		return
+	}
+	versioned.record(filePath, data)
+	return
+}
+
+func (versioned *versionedTestCloud) ListObjectVersions(ctx context.Context, key string) (ret []*cloud.ObjectVersion, err error) {
+	versioned.lock.Lock()
+	defer versioned.lock.Unlock()
+	objects := versioned.versions[key]
+	for i, obj := range objects {
+		version := *obj.version
+		version.Latest = i == len(objects)-1
+		ret = append(ret, &version)
+	}
+	slices.Reverse(ret)
+	return
+}
+
+func (versioned *versionedTestCloud) GetObjectVersion(ctx context.Context, key, versionID string) (data []byte, err error) {
+	versioned.lock.Lock()
+	defer versioned.lock.Unlock()
+	for _, obj := range versioned.versions[key] {
+		if versionID == obj.version.VersionID {
+			return bytes.Clone(obj.data), nil
+		}
+	}
+	return nil, cloud.ErrCloudObjectNotFound
+}
+
+func TestRollbackCloud(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	if _, err := repo.RollbackCloud(context.Background(), time.Now()); !errors.Is(err, cloud.ErrUnsupported) {
+		t.Fatalf("rollback unversioned cloud got [%v]", err)
+	}
+
+	versioned := &versionedTestCloud{Cloud: repo.cloud, versions: map[string][]*versionedTestObject{}}
+	repo.cloud = versioned
+	beforeFirst := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	writeTestDataFile(t, repo, "doc.txt", "good")
+	first, err := repo.Index(context.Background(), "first", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = repo.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	afterFirst := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	writeTestDataFile(t, repo, "bad.txt", "bad")
+	if _, err = repo.Index(context.Background(), "second", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = repo.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+
+	versions, err := repo.GetCloudRefVersions(context.Background(), "latest")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(versions) || !versions[0].Latest || "second" != versions[0].Index.Memo || first.ID != versions[1].IndexID {
+		t.Fatalf("unexpected cloud latest versions %+v", versions)
+	}
+	if _, err = repo.GetCloudRefVersions(context.Background(), "../lock-sync"); nil == err {
+		t.Fatal("invalid ref should fail")
+	}
+
+	restored, err := repo.RestoreCloudRefVersion(context.Background(), "latest", versions[1].VersionID)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if first.ID != restored.ID {
+		t.Fatalf("restored index [%s], want [%s]", restored.ID, first.ID)
+	}
+
+	if _, err = repo.RollbackCloud(context.Background(), beforeFirst); !errors.Is(err, ErrCloudVersionNotFound) {
+		t.Fatalf("rollback before first sync got [%v]", err)
+	}
+	if _, err = repo.RollbackCloud(context.Background(), afterFirst); nil != err {
+		t.Fatal(err)
+	}
+	cloudLatest, err := repo.GetCloudLatest(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if first.ID != cloudLatest.ID {
+		t.Fatalf("cloud latest [%s] after rollback, want [%s]", cloudLatest.ID, first.ID)
+	}
+	indexesV2, err := versioned.DownloadObject("indexes-v2.json")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(versioned.versions["indexes-v2.json"][0].data, indexesV2) {
+		t.Fatal("indexes-v2.json not rolled back")
+	}
+}
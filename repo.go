@@ -17,6 +17,7 @@
 package dejavu
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -35,6 +36,7 @@ import (
 	"github.com/88250/gulu"
 	"github.com/88250/lute/ast"
 	"github.com/88250/lute/html"
+	"github.com/gofrs/flock"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/panjf2000/ants/v2"
 	"github.com/restic/chunker"
@@ -63,6 +65,19 @@ type Repo struct {
 	cloud    cloud.Cloud // 云端存储服务
 
 	chunkSource ChunkSource // 同步时可选的只读分块来源
+
+	lock                    sync.Mutex                      // 仓库锁，Checkout、Index 和 Sync 等不能同时执行
+	downloadCloudLatestLock sync.Mutex                      // 下载云端最新索引锁
+	endRefreshLock          chan struct{}                   // 用于结束云端锁刷新，锁定云端后创建，解锁时关闭
+	refreshLockWait         sync.WaitGroup                  // 用于等待云端锁刷新结束
+	cloudLease              atomic.Pointer[cloudLease]      // 当前持有的云端锁，存储服务不支持条件写入时为 nil
+	holderID                string                          // 当前实例的随机标识，写入云端锁以区分同一设备上不同进程持有的锁
+	cloudReaders            sync.Map                        // 当前进程持有的云端共享锁，键为共享锁的对象路径
+	lockAPIGet, lockAPIPut  atomic.Int64                    // 加锁时检查共享锁的请求数，通过 trafficMeter 计入 TrafficStat
+	cloudPacksCache         atomic.Pointer[cloudPacksCache] // 同步期间缓存的云端包索引，不在同步中时为 nil
+	fileLock                *flock.Flock                    // 仓库文件夹上的跨进程文件锁，Checkout、Index 和 Sync 等获取排他锁，只读操作获取共享锁
+
+	uploadedCloudMissingObjects bool // 是否已经补传过云端缺失的对象
 }
 
 // SetChunkSource 设置同步时可选的只读分块来源。
@@ -70,6 +85,33 @@ func (repo *Repo) SetChunkSource(source ChunkSource) {
 	repo.chunkSource = source
 }
 
+// SetParityShards 设置本地数据对象的冗余级别，即每 16 个数据分片生成的 Reed-Solomon 校验分片数，0 表示不生成奇偶校验数据。
+func (repo *Repo) SetParityShards(parityShards int) {
+	if 0 > parityShards {
+		parityShards = 0
+	}
+	if parityDataShards < parityShards {
+		parityShards = parityDataShards
+	}
+	repo.store.ParityShards = parityShards
+}
+
+// SetPackObjects 设置是否将新写入的小对象聚合为本地包文件，已经聚合的包文件在关闭后仍然可以读取。
+func (repo *Repo) SetPackObjects(packObjects bool) {
+	repo.store.PackObjects = packObjects
+}
+
+// CheckObjects 校验本地仓库中的所有数据对象，使用奇偶校验数据修复损坏的对象，并重新生成过期的奇偶校验数据。
+func (repo *Repo) CheckObjects(ctx context.Context) (ret *entity.CheckReport, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	ret, err = repo.store.Check(ctx)
+	return
+}
+
 // NewRepo 创建一个新的仓库。
 func NewRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, deviceOS string, aesKey []byte, ignoreLines []string, cloud cloud.Cloud) (ret *Repo, err error) {
 	if nil != cloud {
@@ -85,6 +127,7 @@ func NewRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, de
 		DeviceOS:    deviceOS,
 		cloud:       cloud,
 		chunkPol:    chunker.Pol(0x3DA3358B4DC173), // 固定分块多项式值
+		holderID:    util.RandHash(),
 	}
 	if !strings.HasSuffix(ret.DataPath, string(os.PathSeparator)) {
 		ret.DataPath += string(os.PathSeparator)
@@ -109,8 +152,6 @@ var (
 	ErrIndexFileChanged = errors.New("file changed")
 )
 
-var lock = sync.Mutex{} // 仓库锁，Checkout、Index 和 Sync 等不能同时执行
-
 func (repo *Repo) CountIndexes() (ret int, err error) {
 	dir := filepath.Join(repo.Path, "indexes")
 	files, err := os.ReadDir(dir)
@@ -134,41 +175,54 @@ func (repo *Repo) CountIndexes() (ret int, err error) {
 
 // Reset 重置仓库，清空所有数据。
 func (repo *Repo) Reset() (err error) {
-	lock.Lock()
-	defer lock.Unlock()
-
-	if err = os.RemoveAll(repo.Path); nil != err {
+	if err = repo.lockRepo(true); nil != err {
 		return
 	}
-	if err = os.MkdirAll(repo.Path, 0755); nil != err {
+	defer repo.unlockRepo()
+
+	entries, err := os.ReadDir(repo.Path)
+	if nil != err {
 		return
 	}
+	for _, entry := range entries {
+		if name := entry.Name(); repoLockName == name || repoLockHolderName == name {
+			// 保留仓库锁文件，避免其他进程在新建的锁文件上加锁
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(repo.Path, entry.Name())); nil != err {
+			return
+		}
+	}
 	return
 }
 
 // Purge 清理所有未引用数据，retentionIndexIDs 为保留的索引 ID 列表，如果不传入的话则清理所有未引用数据。
 func (repo *Repo) Purge(ctx context.Context, retentionIndexIDs ...string) (ret *entity.PurgeStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 	return repo.store.Purge(ctx, retentionIndexIDs...)
 }
 
-// PurgeCloud 清理云端所有未引用数据。
+// PurgeCloud 清理云端所有未引用数据，ctx 中没有绑定进度报告器时进度推送到状态栏和进度条。
 // Support manual purge of unreferenced data snapshots in the S3/WebDAV cloud storage https://github.com/siyuan-note/siyuan/issues/10081
-func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (repo *Repo) PurgeCloud(ctx context.Context) (ret *entity.PurgeStat, err error) {
+	ctx = defaultProgress(ctx, eventbus.CtxPushMsgToStatusBarAndProgress)
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 
-	lockCtx := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
-	err = repo.tryLockCloud("purge", lockCtx)
+	lockCtx := quietProgress(ctx)
+	err = repo.tryLockCloud(lockCtx, "purge")
 	if nil != err {
 		return
 	}
 	defer repo.unlockCloud(lockCtx)
 
 	logging.LogInfof("purging cloud...")
-	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBarAndProgress}
-	eventbus.Publish(eventbus.EvtCloudPurgeListObjects, context)
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeListObjects)
 	objInfos, listErr := repo.cloud.ListObjects("objects/")
 	if nil != listErr {
 		logging.LogErrorf("list objects failed: %s", listErr)
@@ -186,7 +240,13 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		objIDs[objID] = true
 	}
 
-	eventbus.Publish(eventbus.EvtCloudPurgeListIndexes, context)
+	packs, _, _, listErr := repo.cloudPacks()
+	if nil != listErr {
+		err = listErr
+		return
+	}
+
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeListIndexes)
 	indexIDs, listErr := repo.cloud.ListObjects("indexes/")
 	if nil != listErr {
 		logging.LogErrorf("list indexes failed: %s", listErr)
@@ -194,12 +254,12 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		return
 	}
 
-	if 1 > len(indexIDs) || 1 > len(objIDs) {
+	if 1 > len(indexIDs) || (1 > len(objIDs) && 1 > len(packs)) {
 		logging.LogInfof("skip purge cloud")
 		return
 	}
 
-	eventbus.Publish(eventbus.EvtCloudPurgeListRefs, context)
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeListRefs)
 	refs, listErr := repo.cloud.ListObjects("refs/")
 	if nil != listErr {
 		logging.LogErrorf("list refs failed: %s", listErr)
@@ -227,7 +287,7 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		}
 	}
 
-	eventbus.Publish(eventbus.EvtCloudPurgeDownloadIndexes, context)
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeDownloadIndexes)
 	referencedFileIDs := map[string]bool{}
 	referencedObjIDs := map[string]bool{}
 	for refID := range refIndexIDs {
@@ -255,8 +315,8 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		filesIDs = append(filesIDs, fileID)
 	}
 
-	eventbus.Publish(eventbus.EvtCloudPurgeDownloadFiles, context)
-	_, dFiles, downloadErr := repo.downloadCloudFilesPut(filesIDs, map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone})
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeDownloadFiles)
+	_, dFiles, downloadErr := repo.downloadCloudFilesPut(quietProgress(ctx), filesIDs)
 	if nil != downloadErr {
 		err = downloadErr
 		logging.LogErrorf("download cloud files failed: %s", err)
@@ -304,12 +364,13 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		checkIndexPath := path.Join("check", "indexes", checkIndexID)
 		unreferencedCheckIndexPaths = append(unreferencedCheckIndexPaths, checkIndexPath)
 	}
-	eventbus.Publish(eventbus.EvtCloudPurgeRemoveIndexes, context)
-	err = repo.removeCloudObjects(unreferencedCheckIndexPaths)
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeRemoveIndexes)
+	locked, err := repo.removeCloudObjects(unreferencedCheckIndexPaths)
 	if nil != err {
 		logging.LogErrorf("remove unreferenced check indexes failed: %s", err)
 		return
 	}
+	ret.Locked += len(locked)
 
 	// 删除索引
 	var unreferencedIndexPaths []string
@@ -318,15 +379,17 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		unreferencedIndexPaths = append(unreferencedIndexPaths, indexPath)
 	}
 
-	eventbus.Publish(eventbus.EvtCloudPurgeRemoveIndexes, context)
-	err = repo.removeCloudObjects(unreferencedIndexPaths)
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeRemoveIndexes)
+	locked, err = repo.removeCloudObjects(unreferencedIndexPaths)
 	if nil != err {
 		logging.LogErrorf("remove unreferenced indexes failed: %s", err)
 		return
 	}
+	ret.Indexes -= len(locked)
+	ret.Locked += len(locked)
 
 	// 清理索引列表
-	eventbus.Publish(eventbus.EvtCloudPurgeRemoveIndexesV2, context)
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeRemoveIndexesV2)
 	err = repo.purgeIndexesV2(refIndexIDs)
 	if nil != err {
 		logging.LogErrorf("purge indexes-v2.json failed: %s", err)
@@ -339,14 +402,39 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		objPath := path.Join("objects", unreferencedPath)
 		unreferencedObjPaths = append(unreferencedObjPaths, objPath)
 	}
-	eventbus.Publish(eventbus.EvtCloudPurgeRemoveObjects, context)
-	err = repo.removeCloudObjects(unreferencedObjPaths)
+	progressReporter(ctx).Stage(eventbus.EvtCloudPurgeRemoveObjects)
+	locked, err = repo.removeCloudObjects(unreferencedObjPaths)
 	if nil != err {
 		logging.LogErrorf("remove unreferenced objects failed: %s", err)
 		return
 	}
+	for _, lockedPath := range locked {
+		if objInfo := objInfos[strings.TrimPrefix(lockedPath, "objects/")]; nil != objInfo {
+			ret.Size -= objInfo.Size
+		}
+		ret.Objects--
+	}
+	ret.Locked += len(locked)
+
+	// 清理包文件
+	err = repo.purgeCloudPacks(packs, referencedObjIDs, ret)
+	if nil != err {
+		logging.LogErrorf("purge packs failed: %s", err)
+		return
+	}
 
-	logging.LogInfof("purged cloud, [%d] indexes, [%d] objects, [%d] bytes", ret.Indexes, ret.Objects, ret.Size)
+	// 中止未完成的分片上传
+	// 清理时持有云端锁，其他设备不会在上传，保留一小时是为了避开锁过期后仍在上传的设备
+	if s3, ok := cloud.Unwrap(repo.cloud).(*cloud.S3); ok {
+		uploads, abortErr := s3.AbortIncompleteUploads(ctx, time.Hour)
+		if nil != abortErr {
+			// 部分 S3 兼容服务不支持列出分片上传，不影响清理结果
+			logging.LogWarnf("abort incomplete multipart uploads failed: %s", abortErr)
+		}
+		ret.Uploads = uploads
+	}
+
+	logging.LogInfof("purged cloud, [%d] indexes, [%d] objects, [%d] bytes, [%d] uploads, [%d] locked", ret.Indexes, ret.Objects, ret.Size, ret.Uploads, ret.Locked)
 	return
 }
 
@@ -396,25 +484,31 @@ func (repo *Repo) purgeIndexesV2(refIndexIDs map[string]bool) (err error) {
 
 // GetIndex 从仓库根据 id 获取索引。
 func (repo *Repo) GetIndex(id string) (index *entity.Index, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.lockRepo(false); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 	return repo.store.GetIndex(id)
 }
 
 // PutIndex 将索引 index 写入仓库。
 func (repo *Repo) PutIndex(index *entity.Index) (err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 	return repo.store.PutIndex(index)
 }
 
 var workspaceDataDirs = []string{"assets", "emojis", "snippets", "storage", "templates", "widgets", "plugins", "public", "snippets"}
 var removeEmptyDirExcludes = append(workspaceDataDirs, ".git")
 
-// Checkout 将仓库中的数据迁出到 repo 数据文件夹下。context 参数用于发布事件时传递调用上下文。
-func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts, removes []*entity.File, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+// Checkout 将仓库中的数据迁出到 repo 数据文件夹下。ctx 用于取消操作和报告进度，参考 WithProgressReporter。
+func (repo *Repo) Checkout(ctx context.Context, id string) (upserts, removes []*entity.File, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 
 	index, err := repo.store.GetIndex(id)
 	if nil != err {
@@ -426,8 +520,11 @@ func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts,
 	}
 	var files []*entity.File
 	ignoreMatcher := repo.ignoreMatcher()
-	eventbus.Publish(eventbus.EvtCheckoutBeforeWalkData, context, repo.DataPath)
+	progressReporter(ctx).Item(eventbus.EvtCheckoutBeforeWalkData, repo.DataPath)
 	err = filelock.Walk(repo.DataPath, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); nil != ctxErr {
+			return ctxErr
+		}
 		if nil != err {
 			logging.LogErrorf("walk data failed: %s", err)
 			return err
@@ -448,7 +545,7 @@ func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts,
 		}
 
 		files = append(files, entity.NewFile(p, info.Size(), info.ModTime().UnixMilli()))
-		eventbus.Publish(eventbus.EvtCheckoutWalkData, context, p)
+		progressReporter(ctx).Item(eventbus.EvtCheckoutWalkData, p)
 		return nil
 	})
 	if nil != err {
@@ -467,29 +564,34 @@ func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts,
 		return
 	}
 
-	err = repo.checkoutFiles(upserts, context)
+	err = repo.checkoutFiles(ctx, upserts)
 	if nil != err {
 		return
 	}
 
 	total := len(removes)
-	eventbus.Publish(eventbus.EvtCheckoutRemoveFiles, context, total)
+	progressReporter(ctx).Total(eventbus.EvtCheckoutRemoveFiles, total)
 	for i, f := range removes {
+		if err = ctx.Err(); nil != err {
+			return
+		}
 		absPath := repo.absPath(f.Path)
 		if err = filelock.Remove(absPath); nil != err {
 			return
 		}
-		eventbus.Publish(eventbus.EvtCheckoutRemoveFile, context, i+1, total)
+		progressReporter(ctx).Progress(eventbus.EvtCheckoutRemoveFile, i+1, total)
 	}
 	return
 }
 
-// Index 将 repo 数据文件夹中的文件索引到仓库中。context 参数用于发布事件时传递调用上下文。
-func (repo *Repo) Index(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+// Index 将 repo 数据文件夹中的文件索引到仓库中。ctx 用于取消操作和报告进度，参考 WithProgressReporter。
+func (repo *Repo) Index(ctx context.Context, memo string, checkChunks bool) (ret *entity.Index, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 
-	ret, err = repo.index(memo, checkChunks, context)
+	ret, err = repo.index(ctx, memo, checkChunks)
 	return
 }
 
@@ -524,6 +626,12 @@ func (repo *Repo) OpenFile(file *entity.File) (ret []byte, err error) {
 	return
 }
 
+// OpenFileReader 打开文件 file 的数据流，文件分块在读取时才逐个解码，适合读取大文件。调用方负责关闭返回的数据流。
+func (repo *Repo) OpenFileReader(file *entity.File) (ret io.ReadCloser, err error) {
+	ret = repo.newFileReader(file)
+	return
+}
+
 func (repo *Repo) SearchFile(keyword string, page int, pageSize int) (ret []*entity.File, fileIndexIDs map[string]string, totalCount, pageCount int, err error) {
 	keyword = strings.ToLower(keyword)
 	return repo.searchFile(page, pageSize, func(file *entity.File) (matched bool, matchErr error) {
@@ -584,7 +692,9 @@ func (repo *Repo) searchFile(page int, pageSize int, matcher func(file *entity.F
 	idSet := map[string]bool{}
 	fileIndexIDsMap := map[string]string{}
 	var collectErr error
-	lock.Lock()
+	if err = repo.lockRepo(false); nil != err {
+		return
+	}
 	{
 		_, _, collectErr = repo.getIndexesIter(1, math.MaxInt, func(index *entity.Index) error {
 			for _, fileID := range index.Files {
@@ -597,7 +707,7 @@ func (repo *Repo) searchFile(page int, pageSize int, matcher func(file *entity.F
 			return nil
 		})
 	}
-	lock.Unlock()
+	repo.unlockRepo()
 	if nil != collectErr {
 		err = collectErr
 		return
@@ -698,8 +808,10 @@ func (repo *Repo) searchFile(page int, pageSize int, matcher func(file *entity.F
 }
 
 func (repo *Repo) GetIndexesIter(page, pageSize int, handler func(index *entity.Index) error) (totalCount, pageCount int, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.lockRepo(false); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 	return repo.getIndexesIter(page, pageSize, handler)
 }
 
@@ -778,8 +890,10 @@ func (repo *Repo) getIndexesIter(page, pageSize int, handler func(index *entity.
 }
 
 func (repo *Repo) GetIndexes(page, pageSize int) (ret []*entity.Index, totalCount, pageCount int, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if err = repo.lockRepo(false); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 
 	dir := filepath.Join(repo.Path, "indexes")
 	entries, err := os.ReadDir(dir)
@@ -834,9 +948,11 @@ func (repo *Repo) GetIndexes(page, pageSize int) (ret []*entity.Index, totalCoun
 	return
 }
 
-func (repo *Repo) removeCloudObjects(objects []string) (err error) {
+// removeCloudObjects 用于删除云端对象，被锁定（比如 S3 对象锁定）的对象会跳过并通过 locked 返回。
+func (repo *Repo) removeCloudObjects(objects []string) (locked []string, err error) {
 	waitGroup := &sync.WaitGroup{}
 	var removeErr error
+	lockedLock := sync.Mutex{}
 	poolSize := repo.cloud.GetConcurrentReqs()
 	if poolSize > len(objects) {
 		poolSize = len(objects)
@@ -850,6 +966,13 @@ func (repo *Repo) removeCloudObjects(objects []string) (err error) {
 
 		fileID := arg.(string)
 		rmErr := repo.cloud.RemoveObject(fileID)
+		if errors.Is(rmErr, cloud.ErrCloudObjectLocked) {
+			logging.LogWarnf("skip removing locked object [%s]: %s", fileID, rmErr)
+			lockedLock.Lock()
+			locked = append(locked, fileID)
+			lockedLock.Unlock()
+			return
+		}
 		if nil != rmErr {
 			removeErr = rmErr
 			return
@@ -879,9 +1002,9 @@ func (repo *Repo) removeCloudObjects(objects []string) (err error) {
 	return
 }
 
-func (repo *Repo) index(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
+func (repo *Repo) index(ctx context.Context, memo string, checkChunks bool) (ret *entity.Index, err error) {
 	for i := 0; i < 7; i++ {
-		ret, err = repo.index0(memo, checkChunks, context)
+		ret, err = repo.index0(ctx, memo, checkChunks)
 		if nil == err {
 			return
 		}
@@ -897,12 +1020,15 @@ func (repo *Repo) index(memo string, checkChunks bool, context map[string]interf
 	return
 }
 
-func (repo *Repo) index0(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
+func (repo *Repo) index0(ctx context.Context, memo string, checkChunks bool) (ret *entity.Index, err error) {
 	var files []*entity.File
 	ignoreMatcher := repo.ignoreMatcher()
-	eventbus.Publish(eventbus.EvtIndexBeforeWalkData, context, repo.DataPath)
+	progressReporter(ctx).Item(eventbus.EvtIndexBeforeWalkData, repo.DataPath)
 	start := time.Now()
 	err = filelock.Walk(repo.DataPath, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); nil != ctxErr {
+			return ctxErr
+		}
 		if nil != err {
 			if isNoSuchFileOrDirErr(err) {
 				// An error `Failed to create data snapshot` is occasionally reported during automatic data sync https://github.com/siyuan-note/siyuan/issues/8998
@@ -928,7 +1054,7 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 		}
 
 		files = append(files, entity.NewFile(p, info.Size(), info.ModTime().UnixMilli()))
-		eventbus.Publish(eventbus.EvtIndexWalkData, context, p)
+		progressReporter(ctx).Item(eventbus.EvtIndexWalkData, p)
 		return nil
 	})
 	if nil != err {
@@ -979,14 +1105,14 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 			start = time.Now()
 			count := atomic.Int32{}
 			total := len(files)
-			eventbus.Publish(eventbus.EvtIndexBeforeGetLatestFiles, context, total)
+			progressReporter(ctx).Total(eventbus.EvtIndexBeforeGetLatestFiles, total)
 			lock := &sync.Mutex{}
 			waitGroup := &sync.WaitGroup{}
 			p, _ := ants.NewPoolWithFunc(4, func(arg interface{}) {
 				defer waitGroup.Done()
 
 				count.Add(1)
-				eventbus.Publish(eventbus.EvtIndexGetLatestFile, context, int(count.Load()), total)
+				progressReporter(ctx).Progress(eventbus.EvtIndexGetLatestFile, int(count.Load()), total)
 
 				fileID := arg.(string)
 				file, getErr := repo.store.GetFile(fileID)
@@ -1082,14 +1208,17 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 	total := len(upserts)
 	var workerErrs []error
 	workerErrLock := sync.Mutex{}
-	eventbus.Publish(eventbus.EvtIndexUpsertFiles, context, total)
+	progressReporter(ctx).Total(eventbus.EvtIndexUpsertFiles, total)
 	waitGroup := &sync.WaitGroup{}
 	p, _ := ants.NewPoolWithFunc(4, func(arg interface{}) {
 		defer waitGroup.Done()
+		if nil != ctx.Err() {
+			return // 取消后不再处理
+		}
 
 		count.Add(1)
 		file := arg.(*entity.File)
-		putErr := repo.putFileChunks(file, context, int(count.Load()), total)
+		putErr := repo.putFileChunks(ctx, file, int(count.Load()), total)
 		if nil != putErr {
 			workerErrLock.Lock()
 			workerErrs = append(workerErrs, putErr)
@@ -1129,6 +1258,9 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 		logging.LogErrorf("put file chunks failed: %s", err)
 		return
 	}
+	if err = ctx.Err(); nil != err {
+		return
+	}
 
 	for _, file := range files {
 		ret.Files = append(ret.Files, file.ID)
@@ -1207,7 +1339,7 @@ func (repo *Repo) relPath(absPath string) string {
 	return "/" + filepath.ToSlash(strings.TrimPrefix(absPath, repo.DataPath))
 }
 
-func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{}, count, total int) (err error) {
+func (repo *Repo) putFileChunks(ctx context.Context, file *entity.File, count, total int) (err error) {
 	absPath := repo.absPath(file.Path)
 
 	if chunker.MinSize > file.Size {
@@ -1241,7 +1373,7 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 			return
 		}
 
-		eventbus.Publish(eventbus.EvtIndexUpsertFile, context, count, total)
+		progressReporter(ctx).Progress(eventbus.EvtIndexUpsertFile, count, total)
 		err = repo.store.PutFile(file)
 		if nil != err {
 			return
@@ -1303,7 +1435,7 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 		return
 	}
 
-	eventbus.Publish(eventbus.EvtIndexUpsertFile, context, count, total)
+	progressReporter(ctx).Progress(eventbus.EvtIndexUpsertFile, count, total)
 	err = repo.store.PutFile(file)
 	return
 }
@@ -1321,35 +1453,38 @@ func (repo *Repo) getFiles(fileIDs []string) (ret []*entity.File, err error) {
 }
 
 func (repo *Repo) openFile(file *entity.File) (ret []byte, err error) {
-	for _, c := range file.Chunks {
-		var chunk *entity.Chunk
-		chunk, err = repo.store.GetChunk(c)
-		if nil != err {
-			return
-		}
-		ret = append(ret, chunk.Data...)
+	reader := repo.newFileReader(file)
+	defer reader.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, file.Size))
+	if _, err = buf.ReadFrom(reader); nil != err {
+		return
 	}
+	ret = buf.Bytes()
 	return
 }
 
-func (repo *Repo) removeFiles(files []*entity.File, context map[string]interface{}) (err error) {
+func (repo *Repo) removeFiles(ctx context.Context, files []*entity.File) (err error) {
 	total := len(files)
 	if 1 > total {
 		return
 	}
 
-	eventbus.Publish(eventbus.EvtCheckoutRemoveFiles, context, total)
+	progressReporter(ctx).Total(eventbus.EvtCheckoutRemoveFiles, total)
 	for i, file := range files {
+		if err = ctx.Err(); nil != err {
+			return
+		}
 		absPath := repo.absPath(file.Path)
 		if err = filelock.Remove(absPath); nil != err {
 			return
 		}
-		eventbus.Publish(eventbus.EvtCheckoutRemoveFile, context, i+1, total)
+		progressReporter(ctx).Progress(eventbus.EvtCheckoutRemoveFile, i+1, total)
 	}
 	return
 }
 
-func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interface{}) (err error) {
+func (repo *Repo) checkoutFiles(ctx context.Context, files []*entity.File) (err error) {
 	if 1 > len(files) {
 		return
 	}
@@ -1422,10 +1557,13 @@ func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interfa
 
 	files = all
 	count, total := 0, len(files)
-	eventbus.Publish(eventbus.EvtCheckoutUpsertFiles, context, total)
+	progressReporter(ctx).Total(eventbus.EvtCheckoutUpsertFiles, total)
 	for _, file := range files {
+		if err = ctx.Err(); nil != err {
+			return
+		}
 		count++
-		err = repo.checkoutFile(file, repo.DataPath, count, total, context)
+		err = repo.checkoutFile(ctx, file, repo.DataPath, count, total)
 		if nil != err {
 			return
 		}
@@ -1435,7 +1573,7 @@ func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interfa
 	return
 }
 
-func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, total int, context map[string]interface{}) (err error) {
+func (repo *Repo) checkoutFile(ctx context.Context, file *entity.File, checkoutDir string, count, total int) (err error) {
 	absPath := filepath.Join(checkoutDir, file.Path)
 	dir, name := filepath.Split(absPath)
 	if err = os.MkdirAll(dir, 0755); nil != err {
@@ -1448,17 +1586,13 @@ func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, tot
 		return
 	}
 
-	for _, c := range file.Chunks {
-		var chunk *entity.Chunk
-		chunk, err = repo.store.GetChunk(c)
-		if nil != err {
-			return
-		}
-
-		if _, err = f.Write(chunk.Data); nil != err {
-			logging.LogErrorf("write file [%s] failed: %s", absPath, err)
-			return
-		}
+	reader := repo.newFileReader(file)
+	defer reader.Close()
+	if _, err = io.Copy(f, reader); nil != err {
+		logging.LogErrorf("write file [%s] failed: %s", absPath, err)
+		f.Close()
+		os.Remove(tmp)
+		return
 	}
 
 	if err = f.Sync(); nil != err {
@@ -1495,7 +1629,7 @@ func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, tot
 		logging.LogErrorf("change [%s] time [file.Updated=%d, updated=%v] failed: %s", absPath, file.Updated, updated, err)
 		return
 	}
-	eventbus.Publish(eventbus.EvtCheckoutUpsertFile, context, count, total)
+	progressReporter(ctx).Progress(eventbus.EvtCheckoutUpsertFile, count, total)
 	return
 }
 
@@ -1511,7 +1645,7 @@ func (repo *Repo) isCloudS3() bool {
 		return false
 	}
 
-	switch repo.cloud.(type) {
+	switch cloud.Unwrap(repo.cloud).(type) {
 	case *cloud.S3:
 		return true
 	default:
@@ -1524,7 +1658,7 @@ func (repo *Repo) isCloudWebDAV() bool {
 		return false
 	}
 
-	switch repo.cloud.(type) {
+	switch cloud.Unwrap(repo.cloud).(type) {
 	case *cloud.WebDAV:
 		return true
 	default:
@@ -1537,7 +1671,7 @@ func (repo *Repo) isCloudSiYuan() bool {
 		return false
 	}
 
-	switch repo.cloud.(type) {
+	switch cloud.Unwrap(repo.cloud).(type) {
 	case *cloud.SiYuan:
 		return true
 	default:
@@ -0,0 +1,178 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/gofrs/flock"
+	"github.com/siyuan-note/logging"
+)
+
+// ErrRepoBusy 表示仓库正在被其他进程使用，可以使用 errors.As 获取 *RepoBusyError 以了解锁持有者。
+var ErrRepoBusy = errors.New("repo is busy")
+
+const (
+	repoLockName       = "lock"      // 仓库文件夹上的操作系统文件锁
+	repoLockHolderName = "lock.json" // 排他锁持有者信息，正常解锁时删除
+)
+
+// RepoLockHolder 描述了仓库排他锁的持有者。
+type RepoLockHolder struct {
+	PID        int    `json:"pid"`        // 进程 ID
+	Hostname   string `json:"hostname"`   // 主机名
+	DeviceID   string `json:"deviceID"`   // 设备 ID
+	DeviceName string `json:"deviceName"` // 设备名称
+	Time       int64  `json:"time"`       // 加锁时间
+}
+
+func (holder *RepoLockHolder) String() string {
+	return fmt.Sprintf("process [%d] of device [%s/%s] on host [%s] since [%s]",
+		holder.PID, holder.DeviceName, holder.DeviceID, holder.Hostname, time.UnixMilli(holder.Time).Format("2006-01-02 15:04:05"))
+}
+
+// RepoBusyError 描述了仓库被其他进程锁定时的错误。
+type RepoBusyError struct {
+	Path   string          // 仓库路径
+	Holder *RepoLockHolder // 排他锁持有者，其他进程仅持有共享锁时为 nil
+}
+
+func (e *RepoBusyError) Error() string {
+	if nil == e.Holder {
+		return fmt.Sprintf("repo [%s] is busy", e.Path)
+	}
+	return fmt.Sprintf("repo [%s] is busy, locked by %s", e.Path, e.Holder)
+}
+
+func (e *RepoBusyError) Is(target error) bool {
+	return ErrRepoBusy == target
+}
+
+// lockRepo 锁定仓库，先获取进程内的仓库锁，再获取仓库文件夹上的跨进程文件锁。
+// exclusive 为 true 时获取排他锁，用于修改仓库的操作；否则获取共享锁，用于只读操作。仓库被其他进程锁定时返回 *RepoBusyError。
+func (repo *Repo) lockRepo(exclusive bool) (err error) {
+	repo.lock.Lock()
+	if err = repo.lockRepoFile(exclusive); nil != err {
+		repo.lock.Unlock()
+	}
+	return
+}
+
+// unlockRepo 解锁仓库。
+func (repo *Repo) unlockRepo() {
+	repo.unlockRepoFile()
+	repo.lock.Unlock()
+}
+
+func (repo *Repo) lockRepoFile(exclusive bool) (err error) {
+	if err = os.MkdirAll(repo.Path, 0755); nil != err {
+		logging.LogErrorf("create repo dir failed: %s", err)
+		return
+	}
+
+	if nil == repo.fileLock {
+		repo.fileLock = flock.New(filepath.Join(repo.Path, repoLockName))
+	}
+
+	var locked bool
+	if exclusive {
+		locked, err = repo.fileLock.TryLock()
+	} else {
+		locked, err = repo.fileLock.TryRLock()
+	}
+	if nil != err {
+		// 部分文件系统（比如某些网络存储）不支持文件锁，此时退化为仅使用进程内的仓库锁
+		logging.LogWarnf("lock repo [%s] failed, fallback to in-process lock: %s", repo.Path, err)
+		err = nil
+		return
+	}
+	if !locked {
+		err = &RepoBusyError{Path: repo.Path, Holder: repo.readRepoLockHolder()}
+		logging.LogWarnf("%s", err)
+		return
+	}
+
+	// 获得文件锁后如果仍然存在持有者信息，说明之前的持有者没有正常解锁（比如进程崩溃），文件锁已经由操作系统释放
+	holderPath := filepath.Join(repo.Path, repoLockHolderName)
+	if holder := repo.readRepoLockHolder(); nil != holder {
+		logging.LogWarnf("found stale repo lock held by %s", holder)
+		if err = os.Remove(holderPath); nil != err && !os.IsNotExist(err) {
+			logging.LogErrorf("remove stale repo lock [%s] failed: %s", holderPath, err)
+		}
+		err = nil
+	}
+	if !exclusive {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	holder := &RepoLockHolder{
+		PID:        os.Getpid(),
+		Hostname:   hostname,
+		DeviceID:   repo.DeviceID,
+		DeviceName: repo.DeviceName,
+		Time:       time.Now().UnixMilli(),
+	}
+	data, err := gulu.JSON.MarshalJSON(holder)
+	if nil != err {
+		logging.LogErrorf("marshal repo lock holder failed: %s", err)
+		repo.unlockRepoFile()
+		return
+	}
+	if err = gulu.File.WriteFileSafer(holderPath, data, 0644); nil != err {
+		logging.LogErrorf("write repo lock holder [%s] failed: %s", holderPath, err)
+		repo.unlockRepoFile()
+		return
+	}
+	return
+}
+
+func (repo *Repo) unlockRepoFile() {
+	if nil == repo.fileLock || (!repo.fileLock.Locked() && !repo.fileLock.RLocked()) {
+		return
+	}
+
+	if repo.fileLock.Locked() {
+		holderPath := filepath.Join(repo.Path, repoLockHolderName)
+		if err := os.Remove(holderPath); nil != err && !os.IsNotExist(err) {
+			logging.LogErrorf("remove repo lock holder [%s] failed: %s", holderPath, err)
+		}
+	}
+	if err := repo.fileLock.Unlock(); nil != err {
+		logging.LogErrorf("unlock repo [%s] failed: %s", repo.Path, err)
+	}
+}
+
+func (repo *Repo) readRepoLockHolder() (ret *RepoLockHolder) {
+	holderPath := filepath.Join(repo.Path, repoLockHolderName)
+	data, err := os.ReadFile(holderPath)
+	if nil != err {
+		return
+	}
+
+	ret = &RepoLockHolder{}
+	if err = gulu.JSON.UnmarshalJSON(data, ret); nil != err {
+		logging.LogWarnf("unmarshal repo lock holder [%s] failed: %s", holderPath, err)
+		ret = nil
+	}
+	return
+}
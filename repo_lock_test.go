@@ -0,0 +1,102 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/gofrs/flock"
+)
+
+func TestRepoFileLock(t *testing.T) {
+	clearTestdata(t)
+	subscribeEvents(t)
+
+	repo, _ := initIndex(t)
+	holderPath := filepath.Join(repo.Path, repoLockHolderName)
+	writeHolder := func(pid int) {
+		data, err := gulu.JSON.MarshalJSON(&RepoLockHolder{PID: pid, Hostname: "other-host", DeviceID: "other-device", Time: time.Now().UnixMilli()})
+		if nil != err {
+			t.Fatalf("marshal holder failed: %s", err)
+		}
+		if err = os.WriteFile(holderPath, data, 0644); nil != err {
+			t.Fatalf("write holder failed: %s", err)
+		}
+	}
+
+	// 模拟其他进程持有排他锁
+	other := flock.New(filepath.Join(repo.Path, repoLockName))
+	if locked, err := other.TryLock(); !locked || nil != err {
+		t.Fatalf("lock repo failed: %v, %v", locked, err)
+	}
+	writeHolder(12345)
+
+	_, err := repo.Index(context.Background(), "busy", false)
+	var busyErr *RepoBusyError
+	if !errors.Is(err, ErrRepoBusy) || !errors.As(err, &busyErr) {
+		t.Fatalf("index should fail with busy error: %v", err)
+	}
+	if nil == busyErr.Holder || 12345 != busyErr.Holder.PID || "other-device" != busyErr.Holder.DeviceID {
+		t.Fatalf("unexpected lock holder: %#v", busyErr.Holder)
+	}
+	if _, _, _, err = repo.GetIndexLogs(1, 10); !errors.Is(err, ErrRepoBusy) {
+		t.Fatalf("get index logs should fail with busy error: %v", err)
+	}
+
+	// 其他进程持有共享锁时只读操作可以并发执行
+	if err = other.Unlock(); nil != err {
+		t.Fatalf("unlock failed: %s", err)
+	}
+	if locked, lockErr := other.TryRLock(); !locked || nil != lockErr {
+		t.Fatalf("rlock repo failed: %v, %v", locked, lockErr)
+	}
+	if _, _, _, err = repo.GetIndexLogs(1, 10); nil != err {
+		t.Fatalf("get index logs failed: %s", err)
+	}
+	if _, _, _, _, err = repo.SearchFile("foo", 1, 10); nil != err {
+		t.Fatalf("search file failed: %s", err)
+	}
+	if gulu.File.IsExist(holderPath) {
+		t.Fatalf("stale lock holder should be removed")
+	}
+	_, err = repo.Purge(context.Background())
+	if !errors.As(err, &busyErr) || nil != busyErr.Holder {
+		t.Fatalf("purge should fail with busy error without holder: %v", err)
+	}
+
+	// 之前的持有者异常退出后残留的锁信息不影响加锁
+	if err = other.Unlock(); nil != err {
+		t.Fatalf("unlock failed: %s", err)
+	}
+	writeHolder(23456)
+	if _, err = repo.Purge(context.Background()); nil != err {
+		t.Fatalf("purge failed: %s", err)
+	}
+	if gulu.File.IsExist(holderPath) {
+		t.Fatalf("lock holder should be removed after unlock")
+	}
+	if locked, lockErr := other.TryLock(); !locked || nil != lockErr {
+		t.Fatalf("repo should be unlocked: %v, %v", locked, lockErr)
+	}
+	other.Unlock()
+}
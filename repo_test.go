@@ -65,7 +65,7 @@ func TestIndexEmpty(t *testing.T) {
 		t.Fatalf("new repo failed: %s", err)
 		return
 	}
-	_, err = repo.Index("Index 1", true, map[string]interface{}{})
+	_, err = repo.Index(context.Background(), "Index 1", true)
 	if !errors.Is(err, ErrEmptyIndex) {
 		t.Fatalf("should be empty index")
 		return
@@ -91,7 +91,7 @@ func TestIndexCheckout(t *testing.T) {
 	subscribeEvents(t)
 
 	repo, index := initIndex(t)
-	index2, err := repo.Index("Index 2", true, map[string]interface{}{})
+	index2, err := repo.Index(context.Background(), "Index 2", true)
 	if nil != err {
 		t.Fatalf("index failed: %s", err)
 		return
@@ -107,7 +107,7 @@ func TestIndexCheckout(t *testing.T) {
 		t.Fatalf("new repo failed: %s", err)
 		return
 	}
-	_, _, err = repo.Checkout(index.ID, map[string]interface{}{})
+	_, _, err = repo.Checkout(context.Background(), index.ID)
 	if nil != err {
 		t.Fatalf("checkout failed: %s", err)
 		return
@@ -248,7 +248,7 @@ func initIndex(t *testing.T) (repo *Repo, index *entity.Index) {
 		t.Fatalf("new repo failed: %s", err)
 		return
 	}
-	index, err = repo.Index("Index 1", true, map[string]interface{}{})
+	index, err = repo.Index(context.Background(), "Index 1", true)
 	if nil != err {
 		t.Fatalf("index failed: %s", err)
 		return
@@ -0,0 +1,376 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package rest 实现了 REST 协议的云端存储服务端，客户端为 cloud.REST。
+//
+// 服务端可以直接托管 cloud.Local 布局的目录，团队可以在局域网或者 VPS 上通过单个程序搭建共享的同步服务，不需要 S3 或者 WebDAV。
+package rest
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// Conf 描述了服务端配置，至少需要配置 HTTP Basic 认证或者 Bearer 令牌中的一种。
+type Conf struct {
+	Dir      string // 存放仓库的目录，目录结构和 cloud.Local 的服务端点一致
+	Username string // HTTP Basic 认证用户名
+	Password string // HTTP Basic 认证密码
+	Token    string // Bearer 令牌
+}
+
+// maxConditionalPutSize 为条件上传的最大数据长度，条件上传只用于锁等小对象。
+const maxConditionalPutSize = 16 * 1024 * 1024
+
+// Server 描述了 REST 协议服务端，协议约定见 cloud.REST。
+type Server struct {
+	conf    *Conf
+	handler http.Handler
+}
+
+func NewServer(conf *Conf) (ret *Server, err error) {
+	if "" == conf.Dir {
+		err = errors.New("repos dir is required")
+		return
+	}
+	if "" == conf.Token && ("" == conf.Username || "" == conf.Password) {
+		err = errors.New("basic auth or token is required")
+		return
+	}
+	if err = os.MkdirAll(conf.Dir, 0755); nil != err {
+		return
+	}
+
+	ret = &Server{conf: conf}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", ret.handleListRepos)
+	mux.HandleFunc("POST /{repo}/{$}", ret.handleCreateRepo)
+	mux.HandleFunc("DELETE /{repo}/{$}", ret.handleRemoveRepo)
+	mux.HandleFunc("GET /{repo}/{key...}", ret.handleGet)
+	mux.HandleFunc("HEAD /{repo}/{key...}", ret.handleStat)
+	mux.HandleFunc("PUT /{repo}/{key...}", ret.handlePut)
+	mux.HandleFunc("DELETE /{repo}/{key...}", ret.handleDelete)
+	ret.handler = ret.authorize(mux)
+	return
+}
+
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	server.handler.ServeHTTP(writer, request)
+}
+
+// ListenAndServe 用于在 addr 上启动服务，certFile 和 keyFile 不为空时启用 TLS。
+func (server *Server) ListenAndServe(ctx context.Context, addr, certFile, keyFile string) (err error) {
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    16 * 1024,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	logging.LogInfof("REST server is listening on [%s]", addr)
+	if "" != certFile && "" != keyFile {
+		err = httpServer.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return
+}
+
+func (server *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		authorized := false
+		if value := request.Header.Get("Authorization"); "" != server.conf.Token && strings.HasPrefix(value, "Bearer ") {
+			token := strings.TrimSpace(strings.TrimPrefix(value, "Bearer "))
+			authorized = 1 == subtle.ConstantTimeCompare([]byte(token), []byte(server.conf.Token))
+		} else if username, password, ok := request.BasicAuth(); ok && "" != server.conf.Username {
+			usernameOK := 1 == subtle.ConstantTimeCompare([]byte(username), []byte(server.conf.Username))
+			passwordOK := 1 == subtle.ConstantTimeCompare([]byte(password), []byte(server.conf.Password))
+			authorized = usernameOK && passwordOK
+		}
+		if !authorized {
+			if "" != server.conf.Username {
+				writer.Header().Set("WWW-Authenticate", `Basic realm="dejavu"`)
+			}
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func (server *Server) handleListRepos(writer http.ResponseWriter, request *http.Request) {
+	local := server.newLocal("")
+	repos, _, err := local.GetRepos()
+	if nil != err {
+		server.writeErr(writer, err)
+		return
+	}
+	if nil == repos {
+		repos = []*cloud.Repo{}
+	}
+	server.writeJSON(writer, &cloud.RESTRepos{Repos: repos, AvailableSize: local.GetAvailableSize()})
+}
+
+func (server *Server) handleCreateRepo(writer http.ResponseWriter, request *http.Request) {
+	repo := request.PathValue("repo")
+	if !cloud.IsValidCloudDirName(repo) {
+		http.Error(writer, "invalid repo name", http.StatusBadRequest)
+		return
+	}
+	if err := server.newLocal(repo).CreateRepo(repo); nil != err {
+		server.writeErr(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusCreated)
+}
+
+func (server *Server) handleRemoveRepo(writer http.ResponseWriter, request *http.Request) {
+	repo := request.PathValue("repo")
+	if !cloud.IsValidCloudDirName(repo) {
+		http.Error(writer, "invalid repo name", http.StatusBadRequest)
+		return
+	}
+	if err := server.newLocal(repo).RemoveRepo(repo); nil != err {
+		server.writeErr(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleGet(writer http.ResponseWriter, request *http.Request) {
+	local, key, ok := server.parseKey(writer, request)
+	if !ok {
+		return
+	}
+	if "" == key || strings.HasSuffix(request.URL.Path, "/") {
+		server.handleList(writer, request, local, key)
+		return
+	}
+
+	info, ok := server.statFile(writer, local, key)
+	if !ok {
+		return
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+
+	if "" != request.URL.Query().Get("etag") {
+		data, etag, err := local.GetWithETag(request.Context(), key)
+		if nil != err {
+			server.writeErr(writer, err)
+			return
+		}
+		writer.Header().Set("ETag", "\""+etag+"\"")
+		writer.Write(data)
+		return
+	}
+
+	reader, err := local.Get(request.Context(), key)
+	if nil != err {
+		server.writeErr(writer, err)
+		return
+	}
+	defer reader.Close()
+	writer.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	io.Copy(writer, reader)
+}
+
+func (server *Server) handleList(writer http.ResponseWriter, request *http.Request, local *cloud.Local, prefix string) {
+	objects, err := local.List(request.Context(), prefix)
+	if nil != err {
+		server.writeErr(writer, err)
+		return
+	}
+
+	// 只返回对象，不返回子目录（objects/ 下的两级目录已经展开）
+	repoDir := filepath.Join(server.conf.Dir, local.Dir)
+	ret := map[string]*entity.ObjectInfo{}
+	for p, info := range objects {
+		if strings.HasSuffix(p, ".cas") {
+			continue
+		}
+		if fileInfo, statErr := os.Stat(filepath.Join(repoDir, filepath.FromSlash(prefix), filepath.FromSlash(p))); nil != statErr || fileInfo.IsDir() {
+			continue
+		}
+		ret[p] = info
+	}
+	server.writeJSON(writer, ret)
+}
+
+func (server *Server) handleStat(writer http.ResponseWriter, request *http.Request) {
+	local, key, ok := server.parseKey(writer, request)
+	if !ok {
+		return
+	}
+
+	info, ok := server.statFile(writer, local, key)
+	if !ok {
+		return
+	}
+	writer.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	writer.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (server *Server) handlePut(writer http.ResponseWriter, request *http.Request) {
+	local, key, ok := server.parseKey(writer, request)
+	if !ok {
+		return
+	}
+	if "" == key || strings.HasSuffix(request.URL.Path, "/") || strings.HasSuffix(key, ".cas") {
+		http.Error(writer, "invalid object key", http.StatusBadRequest)
+		return
+	}
+
+	ifMatch := strings.Trim(request.Header.Get("If-Match"), "\"")
+	ifNoneMatch := request.Header.Get("If-None-Match")
+	if "" != ifMatch || "*" == ifNoneMatch {
+		data, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxConditionalPutSize))
+		if nil != err {
+			http.Error(writer, "read body failed", http.StatusBadRequest)
+			return
+		}
+		if err = local.PutIfMatch(request.Context(), key, data, ifMatch); nil != err {
+			server.writeErr(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := local.Put(request.Context(), key, request.Body, request.ContentLength); nil != err {
+		server.writeErr(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleDelete(writer http.ResponseWriter, request *http.Request) {
+	local, key, ok := server.parseKey(writer, request)
+	if !ok {
+		return
+	}
+	if "" == key {
+		http.Error(writer, "invalid object key", http.StatusBadRequest)
+		return
+	}
+
+	if err := local.Delete(request.Context(), key); nil != err {
+		server.writeErr(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// parseKey 用于解析请求路径中的仓库和对象路径，拒绝越过仓库目录的路径。
+func (server *Server) parseKey(writer http.ResponseWriter, request *http.Request) (local *cloud.Local, key string, ok bool) {
+	repo := request.PathValue("repo")
+	if !cloud.IsValidCloudDirName(repo) {
+		http.Error(writer, "invalid repo name", http.StatusBadRequest)
+		return
+	}
+
+	key = strings.Trim(request.PathValue("key"), "/")
+	if strings.Contains(key, "\\") || strings.Contains(key, "\x00") {
+		http.Error(writer, "invalid object key", http.StatusBadRequest)
+		return
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if "." == segment || ".." == segment || ("" == segment && "" != key) {
+			http.Error(writer, "invalid object key", http.StatusBadRequest)
+			return
+		}
+	}
+	if "" != key {
+		key = path.Clean(key)
+	}
+
+	local, ok = server.newLocal(repo), true
+	return
+}
+
+// statFile 用于获取对象文件信息，对象不存在或者是目录时响应 404。
+func (server *Server) statFile(writer http.ResponseWriter, local *cloud.Local, key string) (info os.FileInfo, ok bool) {
+	info, err := os.Stat(filepath.Join(server.conf.Dir, local.Dir, filepath.FromSlash(key)))
+	if nil != err || info.IsDir() {
+		if nil != err && !os.IsNotExist(err) {
+			server.writeErr(writer, err)
+			return
+		}
+		http.Error(writer, "not found", http.StatusNotFound)
+		return
+	}
+	ok = true
+	return
+}
+
+func (server *Server) newLocal(repo string) *cloud.Local {
+	return cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+		Dir:   repo,
+		Local: &cloud.ConfLocal{Endpoint: server.conf.Dir},
+	}})
+}
+
+func (server *Server) writeErr(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, cloud.ErrCloudObjectNotFound), os.IsNotExist(err):
+		http.Error(writer, "not found", http.StatusNotFound)
+	case errors.Is(err, cloud.ErrCloudPreconditionFailed):
+		http.Error(writer, "precondition failed", http.StatusPreconditionFailed)
+	case errors.Is(err, syscall.ENOSPC):
+		http.Error(writer, "insufficient storage", http.StatusInsufficientStorage)
+	case errors.Is(err, context.Canceled):
+		// 客户端已经断开
+	default:
+		logging.LogErrorf("handle REST request failed: %s", err)
+		http.Error(writer, "internal error", http.StatusInternalServerError)
+	}
+}
+
+func (server *Server) writeJSON(writer http.ResponseWriter, v interface{}) {
+	data, err := gulu.JSON.MarshalJSON(v)
+	if nil != err {
+		server.writeErr(writer, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(data)
+}
@@ -0,0 +1,292 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/siyuan-note/dejavu/cloud"
+)
+
+func newTestServer(t *testing.T, conf *Conf) (dir string, endpoint string) {
+	t.Helper()
+	dir = t.TempDir()
+	conf.Dir = dir
+	server, err := NewServer(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	endpoint = httpServer.URL
+	return
+}
+
+func newTestClient(endpoint string, conf *cloud.ConfREST) *cloud.REST {
+	conf.Endpoint = endpoint
+	return cloud.NewREST(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "main", REST: conf}}, nil)
+}
+
+func TestServerObjects(t *testing.T) {
+	dir, endpoint := newTestServer(t, &Conf{Token: "secret"})
+	client := newTestClient(endpoint, &cloud.ConfREST{Token: "secret"})
+
+	if err := client.CreateRepo("main"); nil != err {
+		t.Fatal(err)
+	}
+	repos, _, err := client.GetRepos()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(repos) || "main" != repos[0].Name {
+		t.Fatalf("unexpected repos [%+v]", repos)
+	}
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("stream"), 64*1024)
+	if err = client.Put(ctx, "objects/ab/cdef", bytes.NewReader(data), int64(len(data))); nil != err {
+		t.Fatal(err)
+	}
+	if err = client.Put(ctx, "packs/empty", bytes.NewReader(nil), 0); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = client.UploadBytes("refs/latest", []byte("index-id"), true); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = client.UploadBytes("refs/tags/v1", []byte("tag-id"), true); nil != err {
+		t.Fatal(err)
+	}
+
+	info, err := client.Stat(ctx, "objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != info.Size {
+		t.Fatalf("unexpected object size [%d]", info.Size)
+	}
+	if info, err = client.Stat(ctx, "packs/empty"); nil != err || 0 != info.Size {
+		t.Fatalf("unexpected empty object [%+v, %v]", info, err)
+	}
+	got, err := client.DownloadObject("objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("downloaded data mismatch")
+	}
+
+	objects, err := client.List(ctx, "objects/")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := objects["ab/cdef"]; !ok || 1 != len(objects) {
+		t.Fatalf("unexpected objects [%v]", objects)
+	}
+	refs, err := client.List(ctx, "refs")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := refs["latest"]; !ok || 1 != len(refs) {
+		t.Fatalf("unexpected refs [%v]", refs)
+	}
+	tags, err := client.GetTags()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(tags) || "v1" != tags[0].Name || "tag-id" != tags[0].ID || "" == tags[0].Updated {
+		t.Fatalf("unexpected tags [%+v]", tags)
+	}
+
+	// 服务端目录和 Local 的仓库布局一致
+	local := cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{Dir: "main", Local: &cloud.ConfLocal{Endpoint: dir}}})
+	localData, err := local.DownloadObject("objects/ab/cdef")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, localData) {
+		t.Fatal("local data mismatch")
+	}
+
+	chunks, err := client.GetChunks([]string{"abcdef", "0123456789"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(chunks) || "0123456789" != chunks[0] {
+		t.Fatalf("unexpected missing chunks [%v]", chunks)
+	}
+
+	if err = client.Delete(ctx, "objects/ab/cdef"); nil != err {
+		t.Fatal(err)
+	}
+	if err = client.Delete(ctx, "objects/ab/cdef"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = client.Get(ctx, "objects/ab/cdef"); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("expected object not found, got [%v]", err)
+	}
+	if _, err = client.Get(ctx, "refs/tags"); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("expected directory not found, got [%v]", err)
+	}
+
+	if err = client.RemoveRepo("main"); nil != err {
+		t.Fatal(err)
+	}
+	if repos, _, err = client.GetRepos(); nil != err || 0 != len(repos) {
+		t.Fatalf("unexpected repos after remove [%+v, %v]", repos, err)
+	}
+}
+
+func TestServerPutIfMatch(t *testing.T) {
+	_, endpoint := newTestServer(t, &Conf{Username: "dejavu", Password: "secret"})
+	client := newTestClient(endpoint, &cloud.ConfREST{Username: "dejavu", Password: "secret"})
+
+	ctx := context.Background()
+	if err := client.PutIfMatch(ctx, "lock-sync", []byte("first"), ""); nil != err {
+		t.Fatal(err)
+	}
+	if err := client.PutIfMatch(ctx, "lock-sync", []byte("second"), ""); !errors.Is(err, cloud.ErrCloudPreconditionFailed) {
+		t.Fatalf("expected precondition failed, got [%v]", err)
+	}
+	data, etag, err := client.GetWithETag(ctx, "lock-sync")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "first" != string(data) || "" == etag {
+		t.Fatalf("unexpected data [%s] etag [%s]", data, etag)
+	}
+
+	var waitGroup sync.WaitGroup
+	var lock sync.Mutex
+	succeeded := 0
+	for i := 0; i < 8; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			if putErr := client.PutIfMatch(ctx, "lock-sync", []byte("next"+strconv.Itoa(i)), etag); nil == putErr {
+				lock.Lock()
+				succeeded++
+				lock.Unlock()
+			} else if !errors.Is(putErr, cloud.ErrCloudPreconditionFailed) {
+				t.Error(putErr)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+	if 1 != succeeded {
+		t.Fatalf("expected exactly one conditional put to succeed, got [%d]", succeeded)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	dir, endpoint := newTestServer(t, &Conf{Username: "dejavu", Password: "secret", Token: "token"})
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, conf := range []*cloud.ConfREST{
+		{Username: "dejavu", Password: "wrong"},
+		{Token: "wrong"},
+		{},
+	} {
+		if _, err := newTestClient(endpoint, conf).Stat(ctx, "refs/latest"); !errors.Is(err, cloud.ErrCloudAuthFailed) {
+			t.Fatalf("expected auth failed for [%+v], got [%v]", conf, err)
+		}
+	}
+	for _, conf := range []*cloud.ConfREST{
+		{Username: "dejavu", Password: "secret"},
+		{Token: "token"},
+	} {
+		if _, err := newTestClient(endpoint, conf).Stat(ctx, "refs/latest"); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			t.Fatalf("expected object not found for [%+v], got [%v]", conf, err)
+		}
+	}
+
+	for _, p := range []string{"/main/refs/%2E%2E/%2E%2E/secret", "/main/refs/..%5Csecret", "/%2E%2E/latest"} {
+		req, err := http.NewRequest(http.MethodGet, endpoint+p, nil)
+		if nil != err {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// 越过仓库目录的路径不能读到仓库目录之外的文件
+		if http.StatusOK == resp.StatusCode {
+			t.Fatalf("unexpected status [%d] for [%s]", resp.StatusCode, p)
+		}
+	}
+
+	if _, err := NewServer(&Conf{Dir: filepath.Join(t.TempDir(), "repos")}); nil == err {
+		t.Fatal("expected server without auth to be rejected")
+	}
+}
+
+func TestServerGetChunksError(t *testing.T) {
+	server, err := NewServer(&Conf{Dir: t.TempDir(), Token: "secret"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	// 模拟查询 ab 开头的对象时服务端出错
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if http.MethodHead == r.Method && strings.Contains(r.URL.Path, "/objects/ab/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+	client := newTestClient(httpServer.URL, &cloud.ConfREST{Token: "secret"})
+
+	chunks, err := client.GetChunks([]string{"0123456789", "abcdef"})
+	if nil == err {
+		t.Fatalf("expected error, got missing chunks [%v]", chunks)
+	}
+
+	sourcePath := filepath.Join(t.TempDir(), "refs", "latest")
+	client.Conf.RepoPath = filepath.Dir(filepath.Dir(sourcePath))
+	if err = os.MkdirAll(filepath.Dir(sourcePath), 0755); nil != err {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(sourcePath, []byte("first"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = client.UploadObject("refs/latest", false); nil != err {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(sourcePath, []byte("second"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	if length, err := client.UploadObject("refs/latest", false); nil != err || 0 != length {
+		t.Fatalf("unexpected non-overwrite upload [%d, %v]", length, err)
+	}
+	if data, err := client.DownloadObject("refs/latest"); nil != err || "first" != string(data) {
+		t.Fatalf("unexpected data [%s, %v]", data, err)
+	}
+}
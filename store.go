@@ -18,10 +18,17 @@ package dejavu
 
 import (
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/88250/gulu"
@@ -39,12 +46,25 @@ type Store struct {
 	Path   string // 存储库文件夹的绝对路径，如：F:\\SiYuan\\repo\\
 	AesKey []byte
 
+	ParityShards int // 每个奇偶校验组的校验分片数（数据分片数为 16），0 表示不生成奇偶校验数据
+
+	parityLock   sync.Mutex
+	parityDirty  map[string]bool   // 新写入、需要生成奇偶校验数据的对象
+	parityGroups map[string]string // 对象 -> 所在的校验组 ID，首次使用时加载
+
+	PackObjects bool // 是否将新写入的小对象聚合为本地包文件
+
+	packLock      sync.Mutex
+	localPacks    map[string]*entity.Pack       // 本地包文件 ID -> 包索引，首次使用时加载
+	packedObjects map[string]*localPackedObject // 对象 ID -> 在本地包文件中的位置
+	unpackedIDs   map[string]bool               // 新写入的尚未聚合的对象
+
 	compressEncoder *zstd.Encoder
 	compressDecoder *zstd.Decoder
 }
 
 func NewStore(path string, aesKey []byte) (ret *Store, err error) {
-	ret = &Store{Path: path, AesKey: aesKey}
+	ret = &Store{Path: path, AesKey: aesKey, parityDirty: map[string]bool{}, unpackedIDs: map[string]bool{}}
 
 	ret.compressEncoder, err = zstd.NewWriter(nil,
 		zstd.WithEncoderLevel(zstd.SpeedDefault),
@@ -274,6 +294,15 @@ func (store *Store) Purge(ctx context.Context, retentionIndexIDs ...string) (ret
 		}
 	}
 
+	// 清理本地包文件中未引用的数据对象
+	if err = store.purgeLocalPacks(ctx, referencedObjIDs, ret); nil != err {
+		return
+	}
+
+	if err = store.updateParity(); nil != err {
+		return
+	}
+
 	fileCache.Clear()
 	indexCache.Clear()
 
@@ -347,6 +376,14 @@ func (store *Store) PutIndex(index *entity.Index) (err error) {
 	}
 
 	indexCache.Set(index.ID, index, int64(len(data)))
+
+	// 索引写入时该索引引用的数据对象均已写入，此时聚合新写入的小对象并刷新奇偶校验数据
+	if packErr := store.packObjects(); nil != packErr {
+		logging.LogWarnf("pack objects failed: %s", packErr)
+	}
+	if parityErr := store.updateParity(); nil != parityErr {
+		logging.LogWarnf("update parity failed: %s", parityErr)
+	}
 	return
 }
 
@@ -383,7 +420,7 @@ func (store *Store) PutFile(file *entity.File) (err error) {
 		return errors.New("invalid id")
 	}
 	dir, f := store.AbsPath(file.ID)
-	if gulu.File.IsExist(f) {
+	if store.exists(file.ID) {
 		return
 	}
 	if err = os.MkdirAll(dir, 0755); nil != err {
@@ -402,6 +439,8 @@ func (store *Store) PutFile(file *entity.File) (err error) {
 	if nil != err {
 		return errors.New("put file failed: " + err.Error())
 	}
+	store.markParityDirty(file.ID)
+	store.markUnpacked(file.ID)
 
 	fileCache.Set(file.ID, file, int64(len(data)))
 	return
@@ -414,14 +453,10 @@ func (store *Store) GetFile(id string) (ret *entity.File, err error) {
 		return
 	}
 
-	_, file := store.AbsPath(id)
-	data, err := os.ReadFile(file)
+	data, err := store.readObject(id)
 	if nil != err {
 		return
 	}
-	if data, err = store.decodeData(data); nil != err {
-		return
-	}
 	ret = &entity.File{}
 	err = gulu.JSON.UnmarshalJSON(data, ret)
 	if nil != err {
@@ -438,7 +473,7 @@ func (store *Store) PutChunk(chunk *entity.Chunk) (err error) {
 		return errors.New("invalid id")
 	}
 	dir, file := store.AbsPath(chunk.ID)
-	if gulu.File.IsExist(file) {
+	if store.exists(chunk.ID) {
 		return
 	}
 
@@ -455,31 +490,193 @@ func (store *Store) PutChunk(chunk *entity.Chunk) (err error) {
 	if nil != err {
 		return errors.New("put chunk failed: " + err.Error())
 	}
+	store.markParityDirty(chunk.ID)
+	store.markUnpacked(chunk.ID)
 	return
 }
 
-func (store *Store) GetChunk(id string) (ret *entity.Chunk, err error) {
-	_, file := store.AbsPath(id)
-	data, err := os.ReadFile(file)
+// putEncodedChunk 流式校验压缩加密后的分块数据 reader 后直接写入仓库，返回分块原始数据长度 length。
+//
+// 数据一边写入临时文件一边解密、解压并计算分块哈希，不需要在内存中保存整个分块，也不需要重新压缩加密。
+// AES-GCM 的密文部分就是 AES-CTR 密文，流式解密时无法校验末尾的认证标签，完整性由分块哈希保证：
+// 分块 ID 即原始数据的哈希，被篡改的密文无法解密出哈希相同的数据。写入仓库的仍然是带认证标签的原始数据，本地读取时会完整校验。
+func (store *Store) putEncodedChunk(id string, reader io.Reader) (length int64, err error) {
+	dir, file := store.AbsPath(id)
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		err = errors.New("put chunk failed: " + err.Error())
+		return
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(file)+".*.tmp")
 	if nil != err {
+		err = errors.New("put chunk failed: " + err.Error())
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	tee := io.TeeReader(reader, tmp)
+	nonce := make([]byte, gcmNonceSize)
+	if _, err = io.ReadFull(tee, nonce); nil != err {
+		err = fmt.Errorf("%w: chunk [%s] is too short", ErrRepoFatal, id)
+		return
+	}
+	block, err := aes.NewCipher(store.AesKey)
+	if nil != err {
+		return
+	}
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, nonce)
+	counter[aes.BlockSize-1] = 2 // GCM 使用 96 位随机数时，密文从计数器 2 开始
+	ciphertext := &gcmCiphertextReader{reader: tee}
+
+	decoder := streamDecoderPool.Get().(*zstd.Decoder)
+	defer streamDecoderPool.Put(decoder)
+	if err = decoder.Reset(cipher.StreamReader{S: cipher.NewCTR(block, counter), R: ciphertext}); nil != err {
+		return
+	}
+	hasher := sha1.New()
+	if length, err = io.Copy(hasher, decoder); nil != err {
+		return
+	}
+	if id != hex.EncodeToString(hasher.Sum(nil)) {
+		err = fmt.Errorf("%w: chunk [%s] hash mismatch", ErrRepoFatal, id)
+		return
+	}
+
+	// 读完剩余数据，确保临时文件中是完整的压缩加密数据
+	if _, err = io.Copy(io.Discard, ciphertext); nil != err {
+		return
+	}
+	if gcmTagSize != len(ciphertext.buf) {
+		err = fmt.Errorf("%w: chunk [%s] is too short", ErrRepoFatal, id)
+		return
+	}
+	if err = tmp.Close(); nil != err {
+		return
+	}
+
+	if store.exists(id) {
+		return
+	}
+	if err = os.Rename(tmp.Name(), file); nil != err {
+		err = errors.New("put chunk failed: " + err.Error())
 		return
 	}
-	if data, err = store.decodeData(data); nil != err {
+	store.markParityDirty(id)
+	store.markUnpacked(id)
+	return
+}
+
+const (
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+// gcmCiphertextReader 从 AES-GCM 加密数据中读取密文，保留末尾的认证标签不返回。
+type gcmCiphertextReader struct {
+	reader  io.Reader
+	buf     []byte // 已经读取但是尚未返回的数据，末尾 gcmTagSize 字节可能是认证标签
+	scratch []byte
+	err     error
+}
+
+func (reader *gcmCiphertextReader) Read(p []byte) (n int, err error) {
+	if nil == reader.scratch {
+		reader.scratch = make([]byte, 32*1024)
+	}
+	for len(reader.buf) < gcmTagSize+len(p) && nil == reader.err {
+		var m int
+		m, reader.err = reader.reader.Read(reader.scratch)
+		reader.buf = append(reader.buf, reader.scratch[:m]...)
+	}
+
+	if avail := len(reader.buf) - gcmTagSize; 0 < avail {
+		n = copy(p, reader.buf[:avail])
+		reader.buf = reader.buf[n:]
+		return
+	}
+	err = reader.err
+	return
+}
+
+var streamDecoderPool = sync.Pool{
+	New: func() interface{} {
+		decoder, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(16*1024*1024*1024))
+		return decoder
+	},
+}
+
+func (store *Store) GetChunk(id string) (ret *entity.Chunk, err error) {
+	data, err := store.readObject(id)
+	if nil != err {
 		return
 	}
 	ret = &entity.Chunk{ID: id, Data: data}
 	return
 }
 
+// readObject 读取并解码数据对象，解码失败时尝试使用奇偶校验数据修复。
+func (store *Store) readObject(id string) (ret []byte, err error) {
+	data, err := store.readEncoded(id)
+	if nil != err {
+		return
+	}
+	if ret, err = store.decodeData(data); nil == err {
+		return
+	}
+
+	// 本地包文件中的对象需要修复所在的包文件
+	key := id
+	if _, file := store.AbsPath(id); !gulu.File.IsExist(file) {
+		packed := store.localPacked(id)
+		if nil == packed {
+			return
+		}
+		key = localPackParityKey(packed.pack)
+	}
+
+	repaired, repairErr := store.repairObject(key)
+	if !gulu.Str.Contains(key, repaired) {
+		if nil != repairErr && !os.IsNotExist(repairErr) {
+			logging.LogWarnf("repair object [%s] failed: %s", id, repairErr)
+		}
+		return
+	}
+
+	if data, err = store.readEncoded(id); nil != err {
+		return
+	}
+	ret, err = store.decodeData(data)
+	return
+}
+
 func (store *Store) Remove(id string) (err error) {
 	_, file := store.AbsPath(id)
-	err = os.RemoveAll(file)
+	if err = os.RemoveAll(file); nil != err {
+		return
+	}
+	store.dropParity(id)
 	return
 }
 
+// Stat 返回对象 id 的文件信息，对象位于本地包文件中时返回包内对象的大小。
 func (store *Store) Stat(id string) (stat os.FileInfo, err error) {
 	_, file := store.AbsPath(id)
-	stat, err = os.Stat(file)
+	if stat, err = os.Stat(file); nil == err || !os.IsNotExist(err) {
+		return
+	}
+
+	packed := store.localPacked(id)
+	if nil == packed {
+		return
+	}
+	packInfo, statErr := os.Stat(filepath.Join(store.localPacksDir(), packed.pack))
+	if nil != statErr {
+		return
+	}
+	stat, err = &packedObjectInfo{name: id[2:], size: packed.obj.Length, modTime: packInfo.ModTime()}, nil
 	return
 }
 
@@ -18,7 +18,11 @@ package dejavu
 
 import (
 	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/iotest"
 
 	"github.com/siyuan-note/dejavu/entity"
 	"github.com/siyuan-note/dejavu/util"
@@ -70,3 +74,56 @@ func TestPutGet(t *testing.T) {
 		return
 	}
 }
+
+func TestPutEncodedChunk(t *testing.T) {
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatal(err)
+	}
+	store, err := NewStore(t.TempDir(), aesKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("Hello!"), 64*1024)
+	id := util.Hash(data)
+	encoded, err := store.encodeData(data)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// 篡改、截断的数据不能入库
+	tampered := append([]byte{}, encoded...)
+	tampered[len(tampered)/2] ^= 0xFF
+	for _, bad := range [][]byte{tampered, encoded[:len(encoded)-1], encoded[:8]} {
+		if _, err = store.putEncodedChunk(id, bytes.NewReader(bad)); nil == err {
+			t.Fatal("put invalid encoded chunk should fail")
+		}
+		if store.exists(id) {
+			t.Fatal("invalid encoded chunk should not be stored")
+		}
+	}
+
+	if _, err = store.putEncodedChunk(util.Hash([]byte("other")), bytes.NewReader(encoded)); !errors.Is(err, ErrRepoFatal) {
+		t.Fatalf("put chunk with mismatched ID got [%v]", err)
+	}
+
+	length, err := store.putEncodedChunk(id, iotest.OneByteReader(bytes.NewReader(encoded)))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != length {
+		t.Fatalf("chunk length [%d], want [%d]", length, len(data))
+	}
+	_, file := store.AbsPath(id)
+	if stored, readErr := os.ReadFile(file); nil != readErr || !bytes.Equal(encoded, stored) {
+		t.Fatalf("stored chunk differs from downloaded data, err [%v]", readErr)
+	}
+	chunk, err := store.GetChunk(id)
+	if nil != err || !bytes.Equal(data, chunk.Data) {
+		t.Fatalf("get stored chunk failed: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(file)); 1 != len(entries) {
+		t.Fatalf("temp files left in objects dir [%d]", len(entries))
+	}
+}
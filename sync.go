@@ -17,8 +17,10 @@
 package dejavu
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -111,9 +113,11 @@ type DownloadTrafficStat struct {
 	DownloadFileCount      int
 	DownloadChunkCount     int
 	DownloadBytes          int64
+	DownloadRate           int64 // 云端实际下载速率，单位：字节/秒
 	PeerDownloadFileCount  int
 	PeerDownloadChunkCount int
 	PeerDownloadBytes      int64
+	PeerDownloadRate       int64 // 局域网实际下载速率，单位：字节/秒
 	PeerFallbackCount      int
 }
 
@@ -121,11 +125,13 @@ type UploadTrafficStat struct {
 	UploadFileCount  int
 	UploadChunkCount int
 	UploadBytes      int64
+	UploadRate       int64 // 云端实际上传速率，单位：字节/秒
 }
 
 type APITrafficStat struct {
-	APIGet int
-	APIPut int
+	APIGet   int
+	APIPut   int
+	APIRetry int // 失败后重试的请求数
 }
 
 type TrafficStat struct {
@@ -136,39 +142,127 @@ type TrafficStat struct {
 	m *sync.Mutex
 }
 
-func (repo *Repo) GetSyncCloudFiles(cloudLatest *entity.Index, context map[string]interface{}) (fetchedFiles []*entity.File, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+// trafficMeter 用于根据云端和局域网带宽限速器的统计计算一次操作期间的实际传输速率，以及云端请求的重试次数和加锁时检查共享锁的请求数。
+type trafficMeter struct {
+	cloud, peer         *cloud.BandwidthLimiter
+	cloudStat, peerStat *cloud.BandwidthStat
+	retry               interface{ RetryCount() int64 }
+	retryCount          int64
+	repo                *Repo
+	lockGet, lockPut    int64
+}
+
+func (repo *Repo) newTrafficMeter() (ret *trafficMeter) {
+	ret = &trafficMeter{cloud: repo.cloud.GetBandwidthLimiter(), repo: repo, lockGet: repo.lockAPIGet.Load(), lockPut: repo.lockAPIPut.Load()}
+	if source, ok := repo.chunkSource.(interface {
+		GetBandwidthLimiter() *cloud.BandwidthLimiter
+	}); ok {
+		ret.peer = source.GetBandwidthLimiter()
+	}
+	ret.cloudStat, ret.peerStat = ret.cloud.Stat(), ret.peer.Stat()
+	if retry, ok := repo.cloud.(interface{ RetryCount() int64 }); ok {
+		ret.retry, ret.retryCount = retry, retry.RetryCount()
+	}
+	return
+}
+
+func (meter *trafficMeter) setDownloadRates(stat *DownloadTrafficStat) {
+	if nil == stat {
+		return
+	}
+	stat.DownloadRate = meter.cloud.Stat().DownloadRate(meter.cloudStat)
+	stat.PeerDownloadRate = meter.peer.Stat().DownloadRate(meter.peerStat)
+}
+
+func (meter *trafficMeter) setRates(stat *TrafficStat) {
+	if nil == stat {
+		return
+	}
+	meter.setDownloadRates(&stat.DownloadTrafficStat)
+	stat.UploadRate = meter.cloud.Stat().UploadRate(meter.cloudStat)
+	if nil != meter.retry {
+		stat.APIRetry = int(meter.retry.RetryCount() - meter.retryCount)
+	}
+	stat.APIGet += int(meter.repo.lockAPIGet.Load() - meter.lockGet)
+	stat.APIPut += int(meter.repo.lockAPIPut.Load() - meter.lockPut)
+}
+
+func (repo *Repo) GetSyncCloudFiles(ctx context.Context, cloudLatest *entity.Index) (fetchedFiles []*entity.File, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	runlockCloud, err := repo.tryRLockCloud(ctx)
+	if nil != err {
+		return
+	}
+	defer runlockCloud()
 
-	fetchedFiles, _, err = repo.getSyncCloudFiles(cloudLatest, context)
+	fetchedFiles, _, err = repo.getSyncCloudFiles(ctx, cloudLatest)
 	return
 }
 
-func (repo *Repo) GetSyncCloudFilesWithTraffic(cloudLatest *entity.Index, context map[string]interface{}) (fetchedFiles []*entity.File, trafficStat *DownloadTrafficStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (repo *Repo) GetSyncCloudFilesWithTraffic(ctx context.Context, cloudLatest *entity.Index) (fetchedFiles []*entity.File, trafficStat *DownloadTrafficStat, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	runlockCloud, err := repo.tryRLockCloud(ctx)
+	if nil != err {
+		return
+	}
+	defer runlockCloud()
 
-	fetchedFiles, trafficStat, err = repo.getSyncCloudFiles(cloudLatest, context)
+	meter := repo.newTrafficMeter()
+	defer func() { meter.setDownloadRates(trafficStat) }()
+	fetchedFiles, trafficStat, err = repo.getSyncCloudFiles(ctx, cloudLatest)
 	return
 }
 
-func (repo *Repo) GetCloudLatest(context map[string]interface{}) (cloudLatest *entity.Index, err error) {
-	_, cloudLatest, err = repo.downloadCloudLatest(context)
+func (repo *Repo) GetCloudLatest(ctx context.Context) (cloudLatest *entity.Index, err error) {
+	_, cloudLatest, err = repo.downloadCloudLatest(ctx)
 	return
 }
 
 // GetCloudLatestFast 获取云端最新索引，云端引用与本地最新索引一致时复用本地索引。
-func (repo *Repo) GetCloudLatestFast(context map[string]interface{}) (cloudLatest *entity.Index, err error) {
-	_, cloudLatest, err = repo.downloadCloudLatestFast(context)
+func (repo *Repo) GetCloudLatestFast(ctx context.Context) (cloudLatest *entity.Index, err error) {
+	_, cloudLatest, err = repo.downloadCloudLatestFast(ctx)
 	return
 }
 
-func (repo *Repo) Sync(context map[string]interface{}) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+type skipCloudPreflightKey struct{}
+
+// WithSkipCloudPreflight 返回同步时跳过云端预检的上下文，云端最新索引与本地一致时也会锁定云端并完成同步。
+func WithSkipCloudPreflight(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipCloudPreflightKey{}, true)
+}
+
+func skipCloudPreflight(ctx context.Context) bool {
+	if skip, ok := ctx.Value(skipCloudPreflightKey{}).(bool); ok {
+		return skip
+	}
+
+	// 兼容通过 eventbus 调用上下文传入的选项
+	if reporter, ok := progressReporter(ctx).(*EventBusReporter); ok {
+		skip, _ := reporter.Context["skipCloudPreflight"].(bool)
+		return skip
+	}
+	return false
+}
+
+// Sync 同步本地仓库和云端仓库，ctx 用于取消同步和报告进度。
+func (repo *Repo) Sync(ctx context.Context) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
 
-	skipCloudPreflight, _ := context["skipCloudPreflight"].(bool)
-	if !skipCloudPreflight {
+	meter := repo.newTrafficMeter()
+	defer func() { meter.setRates(trafficStat) }()
+
+	if !skipCloudPreflight(ctx) {
 		mergeResult = &MergeResult{Time: time.Now()}
 		trafficStat = &TrafficStat{m: &sync.Mutex{}}
 		latest, latestErr := repo.Latest()
@@ -177,7 +271,7 @@ func (repo *Repo) Sync(context map[string]interface{}) (mergeResult *MergeResult
 			err = latestErr
 			return
 		}
-		length, cloudLatest, latestErr := repo.downloadCloudLatest(context)
+		length, cloudLatest, latestErr := repo.downloadCloudLatest(ctx)
 		if nil != latestErr {
 			if !errors.Is(latestErr, cloud.ErrCloudObjectNotFound) {
 				logging.LogErrorf("download cloud latest failed: %s", latestErr)
@@ -195,13 +289,14 @@ func (repo *Repo) Sync(context map[string]interface{}) (mergeResult *MergeResult
 	}
 
 	// 锁定云端，防止其他设备并发上传数据
-	err = repo.tryLockCloud(repo.DeviceID, context)
+	err = repo.tryLockCloud(ctx, repo.DeviceID)
 	if nil != err {
 		return
 	}
-	defer repo.unlockCloud(context)
+	defer repo.unlockCloud(ctx)
+	defer repo.cacheCloudPacks()()
 
-	mergeResult, trafficStat, err = repo.sync(context)
+	mergeResult, trafficStat, err = repo.sync(ctx)
 	if e, ok := err.(*os.PathError); ok && isNoSuchFileOrDirErr(err) {
 		p := e.Path
 		if !strings.Contains(p, "objects") {
@@ -215,7 +310,7 @@ func (repo *Repo) Sync(context map[string]interface{}) (mergeResult *MergeResult
 	return
 }
 
-func (repo *Repo) sync(context map[string]interface{}) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
+func (repo *Repo) sync(ctx context.Context) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
 	mergeResult = &MergeResult{Time: time.Now()}
 	trafficStat = &TrafficStat{m: &sync.Mutex{}}
 
@@ -227,7 +322,7 @@ func (repo *Repo) sync(context map[string]interface{}) (mergeResult *MergeResult
 	}
 
 	// 从云端获取最新索引
-	length, cloudLatest, err := repo.downloadCloudLatest(context)
+	length, cloudLatest, err := repo.downloadCloudLatest(ctx)
 	if nil != err {
 		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
 			logging.LogErrorf("download cloud latest failed: %s", err)
@@ -257,20 +352,20 @@ func (repo *Repo) sync(context map[string]interface{}) (mergeResult *MergeResult
 	}
 
 	// 下载缺失文件并入库
-	downloadStat, _, err := repo.downloadCloudFilesPut(fetchFileIDs, context)
+	downloadStat, _, err := repo.downloadCloudFilesPut(ctx, fetchFileIDs)
 	if nil != err {
 		logging.LogErrorf("download cloud files put failed: %s", err)
 		return
 	}
 	trafficStat.DownloadBytes += downloadStat.CloudBytes
 	trafficStat.DownloadFileCount += len(fetchFileIDs)
-	trafficStat.APIGet += len(fetchFileIDs) - downloadStat.PeerCount
+	trafficStat.APIGet += downloadStat.cloudGets(len(fetchFileIDs))
 	trafficStat.PeerDownloadBytes += downloadStat.PeerBytes
 	trafficStat.PeerDownloadFileCount += downloadStat.PeerCount
 	trafficStat.PeerFallbackCount += downloadStat.PeerFallbackCount
 
 	// 执行数据同步
-	err = repo.sync0(context, cloudLatest, latest, mergeResult, trafficStat)
+	err = repo.sync0(ctx, cloudLatest, latest, mergeResult, trafficStat)
 	return
 }
 
@@ -280,7 +375,7 @@ func (repo *Repo) sync(context map[string]interface{}) (mergeResult *MergeResult
 // latest 本地最新索引
 // mergeResult 待返回的同步合并结果
 // trafficStat 待返回的流量统计
-func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Index, latest *entity.Index, mergeResult *MergeResult,
+func (repo *Repo) sync0(ctx context.Context, cloudLatest *entity.Index, latest *entity.Index, mergeResult *MergeResult,
 	trafficStat *TrafficStat) (err error) {
 	// 组装还原云端最新文件列表
 	cloudLatestFiles, err := repo.getFiles(cloudLatest.Files)
@@ -308,7 +403,7 @@ func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Inde
 			return
 		}
 
-		downloadStat, downloadErr := repo.downloadCloudChunksPut(fetchChunkIDs, context)
+		downloadStat, downloadErr := repo.downloadCloudChunksPut(ctx, fetchChunkIDs)
 		if nil != downloadErr {
 			logging.LogErrorf("download cloud chunks put failed: %s", downloadErr)
 			errsLock.Lock()
@@ -319,7 +414,7 @@ func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Inde
 		trafficStat.m.Lock()
 		trafficStat.DownloadBytes += downloadStat.CloudBytes
 		trafficStat.DownloadChunkCount += len(fetchChunkIDs)
-		trafficStat.APIGet += len(fetchChunkIDs) - downloadStat.PeerCount
+		trafficStat.APIGet += downloadStat.cloudGets(len(fetchChunkIDs))
 		trafficStat.PeerDownloadBytes += downloadStat.PeerBytes
 		trafficStat.PeerDownloadChunkCount += downloadStat.PeerCount
 		trafficStat.PeerFallbackCount += downloadStat.PeerFallbackCount
@@ -330,7 +425,7 @@ func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Inde
 	go func() { // 上传差异数据
 		defer waitGroup.Done()
 
-		uploadErr := repo.uploadCloud(context, latest, cloudLatest, cloudChunkIDs, trafficStat)
+		uploadErr := repo.uploadCloud(ctx, latest, cloudLatest, cloudChunkIDs, trafficStat)
 		if nil != uploadErr {
 			logging.LogErrorf("upload cloud failed: %s", uploadErr)
 			errsLock.Lock()
@@ -404,7 +499,7 @@ func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Inde
 
 		decision := decideSyncFile(versions)
 		if ConflictTypeLocalUpsertCloudUpsert == decision.ConflictType &&
-			repo.ignoreLocalUpsert(versions.Local, versions.Base, nowStr, context) {
+			repo.ignoreLocalUpsert(ctx, versions.Local, versions.Base, nowStr) {
 			// 本地仅变更了折叠属性，使用云端内容进行合并
 			decision = syncFileDecision{Winner: syncFileWinnerCloud, HistoryFile: versions.Local}
 		}
@@ -463,7 +558,7 @@ func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Inde
 	var ignoreLines []string
 	if nil != cloudUpsertIgnore {
 		coDir := filepath.Join(repo.TempPath, "repo", "sync", "ignore")
-		if err = repo.checkoutFile(cloudUpsertIgnore, coDir, 1, 1, context); nil != err {
+		if err = repo.checkoutFile(ctx, cloudUpsertIgnore, coDir, 1, 1); nil != err {
 			logging.LogErrorf("checkout ignore file failed: %s", err)
 			return
 		}
@@ -501,7 +596,7 @@ func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Inde
 				return
 			}
 
-			err = repo.checkoutFile(checkoutTmp, temp, i+1, len(historyFiles), context)
+			err = repo.checkoutFile(ctx, checkoutTmp, temp, i+1, len(historyFiles))
 			if nil != err {
 				logging.LogErrorf("checkout file failed: %s", err)
 				return
@@ -519,14 +614,14 @@ func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Inde
 	}
 
 	// 数据变更后还原文件
-	err = repo.restoreFiles(mergeResult, context)
+	err = repo.restoreFiles(ctx, mergeResult)
 	if nil != err {
 		logging.LogErrorf("restore files failed: %s", err)
 		return
 	}
 
 	// 处理合并
-	err = repo.mergeSync(mergeResult, localChanged, true, latest, cloudLatest, cloudChunkIDs, trafficStat, context)
+	err = repo.mergeSync(ctx, mergeResult, localChanged, true, latest, cloudLatest, cloudChunkIDs, trafficStat)
 	if nil != err {
 		logging.LogErrorf("merge sync failed: %s", err)
 		return
@@ -545,7 +640,7 @@ func (repo *Repo) sync0(context map[string]interface{}, cloudLatest *entity.Inde
 	return
 }
 
-func (repo *Repo) ignoreLocalUpsert(localUpsert, latestSyncFile *entity.File, now string, context map[string]interface{}) bool {
+func (repo *Repo) ignoreLocalUpsert(ctx context.Context, localUpsert, latestSyncFile *entity.File, now string) bool {
 	if !strings.HasSuffix(localUpsert.Path, ".sy") {
 		return false // 非 .sy 文件目前不做内容对比，直接认为本地 upsert 是最新的
 	}
@@ -558,11 +653,11 @@ func (repo *Repo) ignoreLocalUpsert(localUpsert, latestSyncFile *entity.File, no
 
 	luteEngine := lute.New()
 	temp := filepath.Join(repo.TempPath, "repo", "sync", "resolves", now)
-	localTree, err := repo.checkoutTree(localUpsert, temp, luteEngine, context)
+	localTree, err := repo.checkoutTree(ctx, localUpsert, temp, luteEngine)
 	if nil != err {
 		return false
 	}
-	localLastSyncTree, err := repo.checkoutTree(latestSyncFile, temp, luteEngine, context)
+	localLastSyncTree, err := repo.checkoutTree(ctx, latestSyncFile, temp, luteEngine)
 	if nil != err {
 		return false
 	}
@@ -632,13 +727,13 @@ func onlyChangeFoldIAL(n1, n2 *ast.Node) bool {
 	return true
 }
 
-func (repo *Repo) checkoutTree(file *entity.File, checkoutDir string, luteEngine *lute.Lute, context map[string]interface{}) (ret *parse.Tree, err error) {
+func (repo *Repo) checkoutTree(ctx context.Context, file *entity.File, checkoutDir string, luteEngine *lute.Lute) (ret *parse.Tree, err error) {
 	checkoutTmp, err := repo.store.GetFile(file.ID)
 	if nil != err {
 		logging.LogErrorf("get file failed: %s", err)
 		return
 	}
-	if err = repo.checkoutFile(checkoutTmp, checkoutDir, 1, 1, context); nil != err {
+	if err = repo.checkoutFile(ctx, checkoutTmp, checkoutDir, 1, 1); nil != err {
 		logging.LogErrorf("checkout file failed: %s", err)
 		return
 	}
@@ -656,13 +751,13 @@ func (repo *Repo) checkoutTree(file *entity.File, checkoutDir string, luteEngine
 	return
 }
 
-func (repo *Repo) restoreFiles(mergeResult *MergeResult, context map[string]interface{}) (err error) {
-	err = repo.checkoutFiles(mergeResult.Upserts, context)
+func (repo *Repo) restoreFiles(ctx context.Context, mergeResult *MergeResult) (err error) {
+	err = repo.checkoutFiles(ctx, mergeResult.Upserts)
 	if nil != err {
 		logging.LogErrorf("checkout files failed: %s", err)
 		return
 	}
-	err = repo.removeFiles(mergeResult.Removes, context)
+	err = repo.removeFiles(ctx, mergeResult.Removes)
 	if nil != err {
 		logging.LogErrorf("remove files failed: %s", err)
 		return
@@ -670,12 +765,12 @@ func (repo *Repo) restoreFiles(mergeResult *MergeResult, context map[string]inte
 	return
 }
 
-func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncCloud bool, latest, cloudLatest *entity.Index, cloudChunkIDs []string, trafficStat *TrafficStat, context map[string]interface{}) (err error) {
+func (repo *Repo) mergeSync(ctx context.Context, mergeResult *MergeResult, localChanged, needSyncCloud bool, latest, cloudLatest *entity.Index, cloudChunkIDs []string, trafficStat *TrafficStat) (err error) {
 	if mergeResult.DataChanged() {
 		if localChanged { // 如果云端和本地都改变了，则需要创建合并索引并再次同步
 			logging.LogInfof("creating merge index [%s]", latest.ID)
 			mergeStart := time.Now()
-			mergedLatest, mergeIndexErr := repo.index("[Sync] Cloud sync merge", false, context)
+			mergedLatest, mergeIndexErr := repo.index(ctx, "[Sync] Cloud sync merge", false)
 			if nil != mergeIndexErr {
 				logging.LogErrorf("merge index failed: %s", mergeIndexErr)
 				err = mergeIndexErr
@@ -707,7 +802,7 @@ func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncClou
 			logging.LogInfof("created merge index [%s]", latest.ID)
 
 			if needSyncCloud {
-				err = repo.uploadCloud(context, latest, cloudLatest, cloudChunkIDs, trafficStat)
+				err = repo.uploadCloud(ctx, latest, cloudLatest, cloudChunkIDs, trafficStat)
 				if nil != err {
 					logging.LogErrorf("upload cloud failed: %s", err)
 					return
@@ -719,7 +814,7 @@ func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncClou
 	}
 
 	if (localChanged && needSyncCloud) || "" == cloudLatest.ID {
-		err = repo.updateCloudIndexes(latest, trafficStat, context)
+		err = repo.updateCloudIndexes(ctx, latest, trafficStat)
 		if nil != err {
 			logging.LogErrorf("update cloud indexes failed: %s", err)
 			return
@@ -745,7 +840,7 @@ func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncClou
 	return
 }
 
-func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficStat, context map[string]interface{}) (err error) {
+func (repo *Repo) updateCloudIndexes(ctx context.Context, latest *entity.Index, trafficStat *TrafficStat) (err error) {
 	// 生成校验索引
 	files, getErr := repo.getFiles(latest.Files)
 	if nil != getErr {
@@ -780,7 +875,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 		// 上传索引和更新 refs/latest 两个操作需要保证顺序，否则可能会导致云端索引 和 refs/latest 不一致 https://github.com/siyuan-note/siyuan/issues/10111
 
 		// 上传索引
-		length, uploadErr := repo.uploadIndex(latest, context)
+		length, uploadErr := repo.uploadIndex(ctx, latest)
 		if nil != uploadErr {
 			logging.LogErrorf("upload latest index failed: %s", uploadErr)
 			errLock.Lock()
@@ -795,7 +890,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 		trafficStat.m.Unlock()
 
 		// 更新 refs/latest
-		length, uploadErr = repo.updateCloudRef("refs/latest", context)
+		length, uploadErr = repo.updateCloudRef(ctx, "refs/latest")
 		if nil != uploadErr {
 			logging.LogErrorf("update cloud [refs/latest] failed: %s", uploadErr)
 			errLock.Lock()
@@ -803,6 +898,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 			errLock.Unlock()
 			return
 		}
+		repo.removeUploadJournals()
 		trafficStat.m.Lock()
 		trafficStat.UploadFileCount++
 		trafficStat.UploadBytes += length
@@ -820,27 +916,11 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 		go func() {
 			defer waitGroup.Done()
 
-			_, maxSeqNum, seqNumLatests := repo.getSeqNumLatest()
-			seqNum := maxSeqNum + 1
-			_, uploadErr := repo.cloud.UploadBytes("refs/latest-"+strconv.Itoa(seqNum)+"-"+latest.ID, []byte(latest.ID), true)
-			if nil != uploadErr {
-				logging.LogErrorf("update cloud [refs/latest-%d] failed: %s", seqNum, uploadErr)
+			if uploadErr := repo.updateCloudSeqNumLatest(latest.ID); nil != uploadErr {
 				errLock.Lock()
 				errs = append(errs, uploadErr)
 				errLock.Unlock()
-				return
 			}
-
-			// 删除旧的 refs/latest-*
-			go func() {
-				for _, seqNumLatest := range seqNumLatests {
-					deleteErr := repo.cloud.RemoveObject(seqNumLatest)
-					if nil != deleteErr {
-						logging.LogWarnf("delete cloud [%s] failed: %s", seqNumLatest, deleteErr)
-						continue
-					}
-				}
-			}()
 		}()
 	}
 
@@ -849,7 +929,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 	go func() {
 		defer waitGroup.Done()
 
-		downloadBytes, uploadBytes, uploadErr := repo.updateCloudIndexesV2(latest, context)
+		downloadBytes, uploadBytes, uploadErr := repo.updateCloudIndexesV2(ctx, latest)
 		if nil != uploadErr {
 			logging.LogErrorf("update cloud indexes failed: %s", uploadErr)
 			errLock.Lock()
@@ -873,7 +953,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 	go func() {
 		defer waitGroup.Done()
 
-		uploadErr := repo.updateCloudCheckIndex(checkIndex, context)
+		uploadErr := repo.updateCloudCheckIndex(ctx, checkIndex)
 		if nil != uploadErr {
 			logging.LogErrorf("update cloud check index failed: %s", uploadErr)
 			errLock.Lock()
@@ -888,7 +968,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 	go func() {
 		defer waitGroup.Done()
 
-		repo.uploadCloudMissingObjects(trafficStat, context)
+		repo.uploadCloudMissingObjects(ctx, trafficStat)
 	}()
 
 	waitGroup.Wait()
@@ -899,7 +979,7 @@ func (repo *Repo) updateCloudIndexes(latest *entity.Index, trafficStat *TrafficS
 	return
 }
 
-func (repo *Repo) getSyncCloudFiles(cloudLatest *entity.Index, context map[string]interface{}) (fetchedFiles []*entity.File, trafficStat *DownloadTrafficStat, err error) {
+func (repo *Repo) getSyncCloudFiles(ctx context.Context, cloudLatest *entity.Index) (fetchedFiles []*entity.File, trafficStat *DownloadTrafficStat, err error) {
 	trafficStat = &DownloadTrafficStat{}
 	latest, err := repo.Latest()
 	if nil != err {
@@ -926,7 +1006,7 @@ func (repo *Repo) getSyncCloudFiles(cloudLatest *entity.Index, context map[strin
 	}
 
 	// 下载缺失文件并入库
-	downloadStat, fetchedFiles, err := repo.downloadCloudFilesPut(fetchFileIDs, context)
+	downloadStat, fetchedFiles, err := repo.downloadCloudFilesPut(ctx, fetchFileIDs)
 	if nil != err {
 		logging.LogErrorf("download cloud files put failed: %s", err)
 		return
@@ -940,12 +1020,12 @@ func (repo *Repo) getSyncCloudFiles(cloudLatest *entity.Index, context map[strin
 	// 统计流量
 	go repo.cloud.AddTraffic(&cloud.Traffic{
 		DownloadBytes: trafficStat.DownloadBytes,
-		APIGet:        len(fetchFileIDs) - downloadStat.PeerCount,
+		APIGet:        downloadStat.cloudGets(len(fetchFileIDs)),
 	})
 	return
 }
 
-func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]interface{}) (stat *chunkDownloadStat, err error) {
+func (repo *Repo) downloadCloudChunksPut(ctx context.Context, chunkIDs []string) (stat *chunkDownloadStat, err error) {
 	stat = &chunkDownloadStat{}
 	if 1 > len(chunkIDs) {
 		return
@@ -960,6 +1040,40 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 		}
 	}
 
+	// 先从云端包文件中获取不能从分块来源获取的分块
+	var cloudChunkIDs []string
+	for _, chunkID := range chunkIDs {
+		if !peerChunks[chunkID] {
+			cloudChunkIDs = append(cloudChunkIDs, chunkID)
+		}
+	}
+	unpackedChunkIDs, err := repo.downloadCloudPacked(cloudChunkIDs, stat, func(id string, data []byte) error {
+		if util.Hash(data) != id {
+			logging.LogErrorf("cloud packed chunk [%s] hash mismatch", id)
+			return ErrRepoFatal
+		}
+		return repo.store.PutChunk(&entity.Chunk{ID: id, Data: data})
+	})
+	if nil != err {
+		return
+	}
+	if len(unpackedChunkIDs) < len(cloudChunkIDs) {
+		unpacked := map[string]bool{}
+		for _, chunkID := range unpackedChunkIDs {
+			unpacked[chunkID] = true
+		}
+		var restChunkIDs []string
+		for _, chunkID := range chunkIDs {
+			if peerChunks[chunkID] || unpacked[chunkID] {
+				restChunkIDs = append(restChunkIDs, chunkID)
+			}
+		}
+		chunkIDs = restChunkIDs
+		if 1 > len(chunkIDs) {
+			return
+		}
+	}
+
 	waitGroup := &sync.WaitGroup{}
 	var downloadErr error
 	downloadErrLock := sync.Mutex{}
@@ -989,6 +1103,9 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
 		downloadErrLock.Lock()
+		if nil == downloadErr {
+			downloadErr = ctx.Err() // 取消后不再传输
+		}
 		if nil != downloadErr {
 			downloadErrLock.Unlock()
 			return // 快速失败
@@ -1014,8 +1131,9 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 			}
 		}
 		if nil == chunk {
+			// 云端下载的分块数据校验后直接入库
 			cloudSemaphore <- struct{}{}
-			length, chunk, dccErr = repo.downloadCloudChunk(chunkID, int(count.Load()), total, context)
+			length, dccErr = repo.downloadCloudChunk(ctx, chunkID, int(count.Load()), total)
 			<-cloudSemaphore
 			if nil == dccErr {
 				cloudBytes.Add(length)
@@ -1029,6 +1147,9 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 			downloadErrLock.Unlock()
 			return
 		}
+		if nil == chunk {
+			return
+		}
 		if pcErr := repo.store.PutChunk(chunk); nil != pcErr {
 			downloadErrLock.Lock()
 			if nil == downloadErr {
@@ -1043,7 +1164,7 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 	}
 	defer p.Release()
 
-	eventbus.Publish(eventbus.EvtCloudBeforeDownloadChunks, context, total)
+	progressReporter(ctx).Total(eventbus.EvtCloudBeforeDownloadChunks, total)
 	for _, chunkID := range chunkIDs {
 		waitGroup.Add(1)
 		if err = p.Invoke(chunkID); nil != err {
@@ -1069,7 +1190,7 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 	return
 }
 
-func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]interface{}) (stat *chunkDownloadStat, ret []*entity.File, err error) {
+func (repo *Repo) downloadCloudFilesPut(ctx context.Context, fileIDs []string) (stat *chunkDownloadStat, ret []*entity.File, err error) {
 	stat = &chunkDownloadStat{}
 	if 1 > len(fileIDs) {
 		return
@@ -1086,6 +1207,45 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 	}
 
 	retLock := &sync.Mutex{}
+
+	// 先从云端包文件中获取不能从对象来源获取的文件
+	var cloudFileIDs []string
+	for _, fileID := range fileIDs {
+		if !peerFiles[fileID] {
+			cloudFileIDs = append(cloudFileIDs, fileID)
+		}
+	}
+	unpackedFileIDs, err := repo.downloadCloudPacked(cloudFileIDs, stat, func(id string, data []byte) (putErr error) {
+		file := &entity.File{}
+		if putErr = gulu.JSON.UnmarshalJSON(data, file); nil != putErr {
+			return
+		}
+		if putErr = repo.store.PutFile(file); nil != putErr {
+			return
+		}
+		ret = append(ret, file)
+		return
+	})
+	if nil != err {
+		return
+	}
+	if len(unpackedFileIDs) < len(cloudFileIDs) {
+		unpacked := map[string]bool{}
+		for _, fileID := range unpackedFileIDs {
+			unpacked[fileID] = true
+		}
+		var restFileIDs []string
+		for _, fileID := range fileIDs {
+			if peerFiles[fileID] || unpacked[fileID] {
+				restFileIDs = append(restFileIDs, fileID)
+			}
+		}
+		fileIDs = restFileIDs
+		if 1 > len(fileIDs) {
+			return
+		}
+	}
+
 	waitGroup := &sync.WaitGroup{}
 	var downloadErr error
 	downloadErrLock := sync.Mutex{}
@@ -1115,6 +1275,9 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
 		downloadErrLock.Lock()
+		if nil == downloadErr {
+			downloadErr = ctx.Err() // 取消后不再传输
+		}
 		if nil != downloadErr {
 			downloadErrLock.Unlock()
 			return // 快速失败
@@ -1141,7 +1304,7 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 		}
 		if nil == file {
 			cloudSemaphore <- struct{}{}
-			length, file, dcfErr = repo.downloadCloudFile(fileID, int(count.Load()), total, context)
+			length, file, dcfErr = repo.downloadCloudFile(ctx, fileID, int(count.Load()), total)
 			<-cloudSemaphore
 			if nil == dcfErr {
 				cloudBytes.Add(length)
@@ -1172,7 +1335,7 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 		return
 	}
 
-	eventbus.Publish(eventbus.EvtCloudBeforeDownloadFiles, context, total)
+	progressReporter(ctx).Total(eventbus.EvtCloudBeforeDownloadFiles, total)
 	for _, fileID := range fileIDs {
 		waitGroup.Add(1)
 		if err = p.Invoke(fileID); nil != err {
@@ -1199,8 +1362,12 @@ func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]int
 	return
 }
 
-func (repo *Repo) updateCloudRef(ref string, context map[string]interface{}) (uploadBytes int64, err error) {
-	eventbus.Publish(eventbus.EvtCloudBeforeUploadRef, context, ref)
+func (repo *Repo) updateCloudRef(ctx context.Context, ref string) (uploadBytes int64, err error) {
+	progressReporter(ctx).Item(eventbus.EvtCloudBeforeUploadRef, ref)
+	if err = repo.checkCloudLease(ctx); nil != err {
+		return
+	}
+
 	absFilePath := filepath.Join(repo.cloud.GetConf().RepoPath, ref)
 	data, err := os.ReadFile(absFilePath)
 	if nil != err {
@@ -1217,19 +1384,17 @@ func (repo *Repo) updateCloudRef(ref string, context map[string]interface{}) (up
 	return
 }
 
-var uploadedCloudMissingObjects = false
-
-func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context map[string]interface{}) {
-	if uploadedCloudMissingObjects {
+func (repo *Repo) uploadCloudMissingObjects(ctx context.Context, trafficStat *TrafficStat) {
+	if repo.uploadedCloudMissingObjects {
 		return
 	}
-	uploadedCloudMissingObjects = true
+	repo.uploadedCloudMissingObjects = true
 
-	if _, ok := repo.cloud.(*cloud.SiYuan); !ok {
+	if _, ok := cloud.Unwrap(repo.cloud).(*cloud.SiYuan); !ok {
 		return
 	}
 
-	defer eventbus.Publish(eventbus.EvtCloudAfterFixObjects, context)
+	defer progressReporter(ctx).Stage(eventbus.EvtCloudAfterFixObjects)
 
 	checkReportKey := "check/indexes-report"
 	data, err := repo.cloud.DownloadObject(checkReportKey)
@@ -1269,8 +1434,7 @@ func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context ma
 		logging.LogInfof("cloud missing object [%s]", missingObject)
 		stillMissingObjects[missingObject] = true
 
-		absFilePath := filepath.Join(repo.Path, "objects", missingObject)
-		info, statErr := os.Stat(absFilePath)
+		info, statErr := repo.store.Stat(strings.ReplaceAll(missingObject, "/", ""))
 		if nil != statErr {
 			// 本地没有该文件，忽略
 			logging.LogWarnf("cloud missing object [%s] not found: %s", missingObject, statErr)
@@ -1297,15 +1461,15 @@ func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context ma
 	lock := sync.Mutex{}
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
-		if nil != uploadErr {
+		if nil != uploadErr || nil != ctx.Err() {
 			return // 快速失败
 		}
 
 		objectPath := arg.(string)
 		filePath := "objects/" + objectPath
 		count.Add(1)
-		eventbus.Publish(eventbus.EvtCloudBeforeFixObjects, context, int(count.Load()), total)
-		_, uoErr := repo.cloud.UploadObject(filePath, false)
+		progressReporter(ctx).Progress(eventbus.EvtCloudBeforeFixObjects, int(count.Load()), total)
+		_, uoErr := repo.uploadObject(strings.ReplaceAll(objectPath, "/", ""))
 		if nil != uoErr {
 			uploadErr = uoErr
 			err = uploadErr
@@ -1376,13 +1540,13 @@ func (repo *Repo) uploadCloudMissingObjects(trafficStat *TrafficStat, context ma
 	return
 }
 
-func (repo *Repo) updateCloudCheckIndex(checkIndex *entity.CheckIndex, context map[string]interface{}) (err error) {
-	if _, ok := repo.cloud.(*cloud.SiYuan); !ok {
+func (repo *Repo) updateCloudCheckIndex(ctx context.Context, checkIndex *entity.CheckIndex) (err error) {
+	if _, ok := cloud.Unwrap(repo.cloud).(*cloud.SiYuan); !ok {
 		// S3/WebDAV 不上传校验索引 S3/WebDAV data sync no longer uploads check index https://github.com/siyuan-note/siyuan/issues/10180
 		return
 	}
 
-	eventbus.Publish(eventbus.EvtCloudBeforeUploadCheckIndex, context)
+	progressReporter(ctx).Stage(eventbus.EvtCloudBeforeUploadCheckIndex)
 
 	data, marshalErr := gulu.JSON.MarshalIndentJSON(checkIndex, "", "\t")
 	if nil != marshalErr {
@@ -1410,8 +1574,8 @@ func (repo *Repo) updateCloudCheckIndex(checkIndex *entity.CheckIndex, context m
 	return
 }
 
-func (repo *Repo) updateCloudIndexesV2(latest *entity.Index, context map[string]interface{}) (downloadBytes, uploadBytes int64, err error) {
-	eventbus.Publish(eventbus.EvtCloudBeforeUploadIndexes, context)
+func (repo *Repo) updateCloudIndexesV2(ctx context.Context, latest *entity.Index) (downloadBytes, uploadBytes int64, err error) {
+	progressReporter(ctx).Stage(eventbus.EvtCloudBeforeUploadIndexes)
 
 	data, err := repo.cloud.DownloadObject("indexes-v2.json")
 	if nil != err {
@@ -1480,8 +1644,8 @@ func (repo *Repo) updateCloudIndexesV2(latest *entity.Index, context map[string]
 	return
 }
 
-func (repo *Repo) uploadIndex(index *entity.Index, context map[string]interface{}) (uploadBytes int64, err error) {
-	eventbus.Publish(eventbus.EvtCloudBeforeUploadIndex, context, index.ID)
+func (repo *Repo) uploadIndex(ctx context.Context, index *entity.Index) (uploadBytes int64, err error) {
+	progressReporter(ctx).Item(eventbus.EvtCloudBeforeUploadIndex, index.ID)
 	length, err := repo.cloud.UploadObject(path.Join("indexes", index.ID), false)
 	if nil != err {
 		return
@@ -1491,24 +1655,37 @@ func (repo *Repo) uploadIndex(index *entity.Index, context map[string]interface{
 	return
 }
 
-func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]interface{}) (uploadBytes int64, err error) {
+func (repo *Repo) uploadFiles(ctx context.Context, upsertFiles []*entity.File, journal *uploadJournal) (uploadBytes int64, uploadPuts int, err error) {
 	if 1 > len(upsertFiles) {
 		return
 	}
 
+	var upsertFileIDs []string
+	for _, upsertFile := range upsertFiles {
+		upsertFileIDs = append(upsertFileIDs, upsertFile.ID)
+	}
+	packFileIDs, upsertFileIDs := repo.splitPackObjects(upsertFileIDs)
+	uploadBytes, uploadPuts, err = repo.uploadPacks(packFileIDs, journal)
+	if nil != err || 1 > len(upsertFileIDs) {
+		return
+	}
+
 	waitGroup := &sync.WaitGroup{}
 	var uploadErr error
 	uploadErrLock := sync.Mutex{}
 	uploadBytesAtomic := atomic.Int64{}
 	poolSize := repo.cloud.GetConcurrentReqs()
-	if poolSize > len(upsertFiles) {
-		poolSize = len(upsertFiles)
+	if poolSize > len(upsertFileIDs) {
+		poolSize = len(upsertFileIDs)
 	}
 	count, uploadedCount := atomic.Int32{}, atomic.Int32{}
-	total := len(upsertFiles)
+	total := len(upsertFileIDs)
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
 		uploadErrLock.Lock()
+		if nil == uploadErr {
+			uploadErr = ctx.Err() // 取消后不再传输
+		}
 		if nil != uploadErr {
 			uploadErrLock.Unlock()
 			return // 快速失败
@@ -1516,10 +1693,9 @@ func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]int
 		uploadErrLock.Unlock()
 
 		upsertFileID := arg.(string)
-		filePath := path.Join("objects", upsertFileID[:2], upsertFileID[2:])
 		count.Add(1)
-		eventbus.Publish(eventbus.EvtCloudBeforeUploadFile, context, int(count.Load()), total)
-		length, uoErr := repo.cloud.UploadObject(filePath, false)
+		progressReporter(ctx).Progress(eventbus.EvtCloudBeforeUploadFile, int(count.Load()), total)
+		length, uoErr := repo.uploadObject(upsertFileID)
 		if nil != uoErr {
 			uploadErrLock.Lock()
 			if nil == uploadErr {
@@ -1528,18 +1704,19 @@ func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]int
 			uploadErrLock.Unlock()
 			return
 		}
+		journal.add(upsertFileID)
 		uploadBytesAtomic.Add(length)
 		uploadedCount.Add(1)
-		//logging.LogInfof("uploaded file [%s, %d/%d]", filePath, int(uploadedCount.Load()), total)
+		//logging.LogInfof("uploaded file [%s, %d/%d]", upsertFileID, int(uploadedCount.Load()), total)
 	})
 	if nil != err {
 		return
 	}
 
-	eventbus.Publish(eventbus.EvtCloudBeforeUploadFiles, context, total)
-	for _, upsertFile := range upsertFiles {
+	progressReporter(ctx).Total(eventbus.EvtCloudBeforeUploadFiles, total)
+	for _, upsertFileID := range upsertFileIDs {
 		waitGroup.Add(1)
-		if err = p.Invoke(upsertFile.ID); nil != err {
+		if err = p.Invoke(upsertFileID); nil != err {
 			waitGroup.Done()
 			logging.LogErrorf("invoke failed: %s", err)
 			break
@@ -1547,7 +1724,8 @@ func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]int
 	}
 	waitGroup.Wait()
 	p.Release()
-	uploadBytes = uploadBytesAtomic.Load()
+	uploadBytes += uploadBytesAtomic.Load()
+	uploadPuts += int(uploadedCount.Load())
 	if nil != err {
 		return
 	}
@@ -1557,11 +1735,17 @@ func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]int
 	return
 }
 
-func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]interface{}) (uploadBytes int64, err error) {
+func (repo *Repo) uploadChunks(ctx context.Context, upsertChunkIDs []string, journal *uploadJournal) (uploadBytes int64, uploadPuts int, err error) {
 	if 1 > len(upsertChunkIDs) {
 		return
 	}
 
+	packChunkIDs, upsertChunkIDs := repo.splitPackObjects(upsertChunkIDs)
+	uploadBytes, uploadPuts, err = repo.uploadPacks(packChunkIDs, journal)
+	if nil != err || 1 > len(upsertChunkIDs) {
+		return
+	}
+
 	waitGroup := &sync.WaitGroup{}
 	var uploadErr error
 	uploadErrLock := sync.Mutex{}
@@ -1575,6 +1759,9 @@ func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]inter
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
 		defer waitGroup.Done()
 		uploadErrLock.Lock()
+		if nil == uploadErr {
+			uploadErr = ctx.Err() // 取消后不再传输
+		}
 		if nil != uploadErr {
 			uploadErrLock.Unlock()
 			return // 快速失败
@@ -1582,10 +1769,9 @@ func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]inter
 		uploadErrLock.Unlock()
 
 		upsertChunkID := arg.(string)
-		filePath := path.Join("objects", upsertChunkID[:2], upsertChunkID[2:])
 		count.Add(1)
-		eventbus.Publish(eventbus.EvtCloudBeforeUploadChunk, context, int(count.Load()), total)
-		length, uoErr := repo.cloud.UploadObject(filePath, false)
+		progressReporter(ctx).Progress(eventbus.EvtCloudBeforeUploadChunk, int(count.Load()), total)
+		length, uoErr := repo.uploadObject(upsertChunkID)
 		if nil != uoErr {
 			uploadErrLock.Lock()
 			if nil == uploadErr {
@@ -1594,15 +1780,16 @@ func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]inter
 			uploadErrLock.Unlock()
 			return
 		}
+		journal.add(upsertChunkID)
 		uploadBytesAtomic.Add(length)
 		uploadedCount.Add(1)
-		//logging.LogInfof("uploaded chunk [%s, %d/%d]", filePath, int(uploadedCount.Load()), total)
+		//logging.LogInfof("uploaded chunk [%s, %d/%d]", upsertChunkID, int(uploadedCount.Load()), total)
 	})
 	if nil != err {
 		return
 	}
 
-	eventbus.Publish(eventbus.EvtCloudBeforeUploadChunks, context, total)
+	progressReporter(ctx).Total(eventbus.EvtCloudBeforeUploadChunks, total)
 	for _, upsertChunkID := range upsertChunkIDs {
 		waitGroup.Add(1)
 		if err = p.Invoke(upsertChunkID); nil != err {
@@ -1613,7 +1800,8 @@ func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]inter
 	}
 	waitGroup.Wait()
 	p.Release()
-	uploadBytes = uploadBytesAtomic.Load()
+	uploadBytes += uploadBytesAtomic.Load()
+	uploadPuts += int(uploadedCount.Load())
 	if nil != err {
 		return
 	}
@@ -1623,6 +1811,20 @@ func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]inter
 	return
 }
 
+// uploadObject 上传本地数据对象 id，位于本地包文件中的对象没有松散文件，读取后上传。
+func (repo *Repo) uploadObject(id string) (length int64, err error) {
+	filePath := path.Join("objects", id[:2], id[2:])
+	if _, file := repo.store.AbsPath(id); gulu.File.IsExist(file) {
+		return repo.cloud.UploadObject(filePath, false)
+	}
+
+	data, err := repo.store.readEncoded(id)
+	if nil != err {
+		return
+	}
+	return repo.cloud.UploadBytes(filePath, data, false)
+}
+
 func (repo *Repo) localNotFoundChunks(chunkIDs []string) (ret []string, err error) {
 	for _, chunkID := range chunkIDs {
 		if _, getChunkErr := repo.store.Stat(chunkID); nil != getChunkErr {
@@ -1725,7 +1927,7 @@ func (repo *Repo) UpdateLatestSync(index *entity.Index) (err error) {
 	return
 }
 
-func (repo *Repo) uploadCloud(context map[string]interface{},
+func (repo *Repo) uploadCloud(ctx context.Context,
 	latest, cloudLatest *entity.Index, cloudChunkIDs []string, trafficStat *TrafficStat) (err error) {
 	// 计算待上传云端的本地变更文件
 	upsertFiles, err := repo.localUpsertFiles(latest, cloudLatest)
@@ -1745,8 +1947,31 @@ func (repo *Repo) uploadCloud(context map[string]interface{},
 		return
 	}
 
+	// 跳过之前中断的同步已经上传成功的对象
+	journal := repo.openUploadJournal(latest, cloudLatest)
+	defer journal.close()
+	journaledIDs := append([]string{}, upsertChunkIDs...)
+	for _, upsertFile := range upsertFiles {
+		journaledIDs = append(journaledIDs, upsertFile.ID)
+	}
+	gets, err := journal.confirm(repo, journaledIDs)
+	if nil != err {
+		return
+	}
+	trafficStat.m.Lock()
+	trafficStat.APIGet += gets
+	trafficStat.m.Unlock()
+	upsertChunkIDs = journal.exclude(upsertChunkIDs)
+	var pendingFiles []*entity.File
+	for _, upsertFile := range upsertFiles {
+		if !journal.has(upsertFile.ID) {
+			pendingFiles = append(pendingFiles, upsertFile)
+		}
+	}
+	upsertFiles = pendingFiles
+
 	// 上传分块
-	length, err := repo.uploadChunks(upsertChunkIDs, context)
+	length, puts, err := repo.uploadChunks(ctx, upsertChunkIDs, journal)
 	if nil != err {
 		logging.LogErrorf("upload chunks failed: %s", err)
 		return
@@ -1754,11 +1979,11 @@ func (repo *Repo) uploadCloud(context map[string]interface{},
 	trafficStat.m.Lock()
 	trafficStat.UploadChunkCount += len(upsertChunkIDs)
 	trafficStat.UploadBytes += length
-	trafficStat.APIPut += len(upsertChunkIDs)
+	trafficStat.APIPut += puts
 	trafficStat.m.Unlock()
 
 	// 上传文件
-	length, err = repo.uploadFiles(upsertFiles, context)
+	length, puts, err = repo.uploadFiles(ctx, upsertFiles, journal)
 	if nil != err {
 		logging.LogErrorf("upload files failed: %s", err)
 		return
@@ -1766,7 +1991,7 @@ func (repo *Repo) uploadCloud(context map[string]interface{},
 	trafficStat.m.Lock()
 	trafficStat.UploadFileCount += len(upsertFiles)
 	trafficStat.UploadBytes += length
-	trafficStat.APIPut += len(upsertFiles)
+	trafficStat.APIPut += puts
 	trafficStat.m.Unlock()
 	return
 }
@@ -1802,22 +2027,21 @@ func (repo *Repo) latestSync() (ret *entity.Index) {
 	return
 }
 
-func (repo *Repo) downloadCloudChunk(id string, count, total int, context map[string]interface{}) (length int64, ret *entity.Chunk, err error) {
-	eventbus.Publish(eventbus.EvtCloudBeforeDownloadChunk, context, count, total)
+// downloadCloudChunk 流式下载云端分块，校验后将压缩加密的分块数据直接写入本地仓库。
+func (repo *Repo) downloadCloudChunk(ctx context.Context, id string, count, total int) (length int64, err error) {
+	progressReporter(ctx).Progress(eventbus.EvtCloudBeforeDownloadChunk, count, total)
 
 	key := path.Join("objects", id[:2], id[2:])
-	data, err := repo.downloadCloudObject(key)
+	reader, err := repo.cloud.Get(ctx, key)
 	if nil != err {
 		logging.LogErrorf("download cloud chunk [%s] failed: %s", id, err)
 		return
 	}
-	length = int64(len(data))
-	if util.Hash(data) != id {
-		err = ErrRepoFatal
-		logging.LogErrorf("cloud chunk [%s] hash mismatch", id)
+	defer reader.Close()
+	if length, err = repo.store.putEncodedChunk(id, reader); nil != err {
+		logging.LogErrorf("put cloud chunk [%s] failed: %s", id, err)
 		return
 	}
-	ret = &entity.Chunk{ID: id, Data: data}
 	return
 }
 
@@ -1885,11 +2109,14 @@ func (repo *Repo) downloadSourceObject(id string, validate func(data []byte) err
 	return
 }
 
-func (repo *Repo) downloadCloudFile(id string, count, total int, context map[string]interface{}) (length int64, ret *entity.File, err error) {
-	eventbus.Publish(eventbus.EvtCloudBeforeDownloadFile, context, count, total)
+func (repo *Repo) downloadCloudFile(ctx context.Context, id string, count, total int) (length int64, ret *entity.File, err error) {
+	progressReporter(ctx).Progress(eventbus.EvtCloudBeforeDownloadFile, count, total)
 
 	key := path.Join("objects", id[:2], id[2:])
-	data, err := repo.downloadCloudObject(key)
+	data, err := repo.getCloudObject(ctx, key)
+	if nil == err {
+		data, err = repo.decodeDownloadedData(key, data)
+	}
 	if nil != err {
 		logging.LogErrorf("download cloud file [%s] failed: %s", id, err)
 		return
@@ -1900,6 +2127,17 @@ func (repo *Repo) downloadCloudFile(id string, count, total int, context map[str
 	return
 }
 
+// getCloudObject 下载云端对象的原始数据，下载过程中可以通过 ctx 取消。
+func (repo *Repo) getCloudObject(ctx context.Context, key string) (ret []byte, err error) {
+	reader, err := repo.cloud.Get(ctx, key)
+	if nil != err {
+		return
+	}
+	defer reader.Close()
+	ret, err = io.ReadAll(reader)
+	return
+}
+
 func (repo *Repo) downloadCloudObject(filePath string) (ret []byte, err error) {
 	data, err := repo.cloud.DownloadObject(filePath)
 	if nil != err {
@@ -1932,8 +2170,8 @@ func (repo *Repo) decodeDownloadedData(key string, data []byte) (ret []byte, err
 	return
 }
 
-func (repo *Repo) downloadCloudIndex(id string, context map[string]interface{}) (downloadBytes int64, index *entity.Index, err error) {
-	eventbus.Publish(eventbus.EvtCloudBeforeDownloadIndex, context, id)
+func (repo *Repo) downloadCloudIndex(ctx context.Context, id string) (downloadBytes int64, index *entity.Index, err error) {
+	progressReporter(ctx).Item(eventbus.EvtCloudBeforeDownloadIndex, id)
 	index = &entity.Index{}
 
 	key := path.Join("indexes", id)
@@ -1955,19 +2193,17 @@ func (repo *Repo) downloadCloudIndex(id string, context map[string]interface{})
 	return
 }
 
-var downloadCloudLatestLock = sync.Mutex{}
-
-func (repo *Repo) downloadCloudLatest(context map[string]interface{}) (downloadBytes int64, index *entity.Index, err error) {
-	return repo.downloadCloudLatest0(context, false)
+func (repo *Repo) downloadCloudLatest(ctx context.Context) (downloadBytes int64, index *entity.Index, err error) {
+	return repo.downloadCloudLatest0(ctx, false)
 }
 
-func (repo *Repo) downloadCloudLatestFast(context map[string]interface{}) (downloadBytes int64, index *entity.Index, err error) {
-	return repo.downloadCloudLatest0(context, true)
+func (repo *Repo) downloadCloudLatestFast(ctx context.Context) (downloadBytes int64, index *entity.Index, err error) {
+	return repo.downloadCloudLatest0(ctx, true)
 }
 
-func (repo *Repo) downloadCloudLatest0(context map[string]interface{}, reuseLocalIndex bool) (downloadBytes int64, index *entity.Index, err error) {
-	downloadCloudLatestLock.Lock()
-	defer downloadCloudLatestLock.Unlock()
+func (repo *Repo) downloadCloudLatest0(ctx context.Context, reuseLocalIndex bool) (downloadBytes int64, index *entity.Index, err error) {
+	repo.downloadCloudLatestLock.Lock()
+	defer repo.downloadCloudLatestLock.Unlock()
 
 	start := time.Now()
 	index = &entity.Index{}
@@ -1991,7 +2227,7 @@ func (repo *Repo) downloadCloudLatest0(context map[string]interface{}, reuseLoca
 	}
 
 	key := path.Join("refs", "latest")
-	eventbus.Publish(eventbus.EvtCloudBeforeDownloadRef, context, "refs/latest")
+	progressReporter(ctx).Item(eventbus.EvtCloudBeforeDownloadRef, "refs/latest")
 	data, err := repo.downloadCloudObject(key)
 	if nil != err {
 		if errors.Is(err, cloud.ErrCloudObjectNotFound) {
@@ -2014,7 +2250,7 @@ func (repo *Repo) downloadCloudLatest0(context map[string]interface{}, reuseLoca
 	if isS3OrSiYuan && nil == seqNumLatestIDCh {
 		startGetSeqNumLatest()
 	}
-	downloadBytes, index, err = repo.downloadCloudIndexOrReuseLocal(latestID, localLatest, context)
+	downloadBytes, index, err = repo.downloadCloudIndexOrReuseLocal(ctx, latestID, localLatest)
 
 	var seqNumLatestID string
 	if isS3OrSiYuan {
@@ -2024,7 +2260,7 @@ func (repo *Repo) downloadCloudLatest0(context map[string]interface{}, reuseLoca
 	if isS3OrSiYuan && ("" != seqNumLatestID && "" != index.ID && latestID != seqNumLatestID) {
 		logging.LogWarnf("cloud latest [%s] not match seq num latest [%s]", latestID, seqNumLatestID)
 		// 以时间较新的为准
-		length, seqNumLatest, downloadErr := repo.downloadCloudIndexOrReuseLocal(seqNumLatestID, localLatest, context)
+		length, seqNumLatest, downloadErr := repo.downloadCloudIndexOrReuseLocal(ctx, seqNumLatestID, localLatest)
 		downloadBytes += length
 		if nil != downloadErr {
 			logging.LogWarnf("download seq num latest [%s] failed: %s", seqNumLatestID, downloadErr)
@@ -2048,12 +2284,34 @@ func (repo *Repo) downloadCloudLatest0(context map[string]interface{}, reuseLoca
 	return
 }
 
-func (repo *Repo) downloadCloudIndexOrReuseLocal(id string, localLatest *entity.Index, context map[string]interface{}) (downloadBytes int64, index *entity.Index, err error) {
+func (repo *Repo) downloadCloudIndexOrReuseLocal(ctx context.Context, id string, localLatest *entity.Index) (downloadBytes int64, index *entity.Index, err error) {
 	if nil != localLatest && id == localLatest.ID {
 		index = localLatest
 		return
 	}
-	return repo.downloadCloudIndex(id, context)
+	return repo.downloadCloudIndex(ctx, id)
+}
+
+// updateCloudSeqNumLatest 用于上传 refs/latest-seqNum-id 并异步删除旧的 refs/latest-*。
+func (repo *Repo) updateCloudSeqNumLatest(id string) (err error) {
+	_, maxSeqNum, seqNumLatests := repo.getSeqNumLatest()
+	seqNum := maxSeqNum + 1
+	if _, err = repo.cloud.UploadBytes("refs/latest-"+strconv.Itoa(seqNum)+"-"+id, []byte(id), true); nil != err {
+		logging.LogErrorf("update cloud [refs/latest-%d] failed: %s", seqNum, err)
+		return
+	}
+
+	// 删除旧的 refs/latest-*
+	go func() {
+		for _, seqNumLatest := range seqNumLatests {
+			deleteErr := repo.cloud.RemoveObject(seqNumLatest)
+			if nil != deleteErr {
+				logging.LogWarnf("delete cloud [%s] failed: %s", seqNumLatest, deleteErr)
+				continue
+			}
+		}
+	}()
+	return
 }
 
 func (repo *Repo) getSeqNumLatest() (id string, maxSeqNum int, seqNumLatests []string) {
@@ -2104,8 +2362,21 @@ func (repo *Repo) getHistoryDirNow(now, suffix string) (ret string, err error) {
 	return
 }
 
-func (repo *Repo) CheckoutFilesFromCloud(files []*entity.File, context map[string]interface{}) (stat *DownloadTrafficStat, err error) {
+func (repo *Repo) CheckoutFilesFromCloud(ctx context.Context, files []*entity.File) (stat *DownloadTrafficStat, err error) {
 	stat = &DownloadTrafficStat{}
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	runlockCloud, err := repo.tryRLockCloud(ctx)
+	if nil != err {
+		return
+	}
+	defer runlockCloud()
+
+	meter := repo.newTrafficMeter()
+	defer func() { meter.setDownloadRates(stat) }()
 
 	chunkIDs := repo.getChunks(files)
 	chunkIDs, err = repo.localNotFoundChunks(chunkIDs)
@@ -2113,7 +2384,7 @@ func (repo *Repo) CheckoutFilesFromCloud(files []*entity.File, context map[strin
 		return
 	}
 
-	downloadStat, downloadErr := repo.downloadCloudChunksPut(chunkIDs, context)
+	downloadStat, downloadErr := repo.downloadCloudChunksPut(ctx, chunkIDs)
 	err = downloadErr
 	if nil != err {
 		return
@@ -2124,34 +2395,34 @@ func (repo *Repo) CheckoutFilesFromCloud(files []*entity.File, context map[strin
 	stat.PeerDownloadChunkCount += downloadStat.PeerCount
 	stat.PeerFallbackCount += downloadStat.PeerFallbackCount
 
-	err = repo.checkoutFiles(files, context)
+	err = repo.checkoutFiles(ctx, files)
 	return
 }
 
 func (repo *Repo) RemoveCloudRepo(name string) (err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
-	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBar}
-	err = repo.tryLockCloud("remove", context)
+	ctx := EventBusContext(context.Background(), map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBar})
+	err = repo.tryLockCloud(ctx, "remove")
 	if nil != err {
 		return
 	}
-	defer repo.unlockCloud(context)
+	defer repo.unlockCloud(ctx)
 
 	return repo.cloud.RemoveRepo(name)
 }
 
 func (repo *Repo) CreateCloudRepo(name string) (err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
 
-	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBar}
-	err = repo.tryLockCloud("create", context)
+	ctx := EventBusContext(context.Background(), map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBar})
+	err = repo.tryLockCloud(ctx, "create")
 	if nil != err {
 		return
 	}
-	defer repo.unlockCloud(context)
+	defer repo.unlockCloud(ctx)
 
 	return repo.cloud.CreateRepo(name)
 }
@@ -17,32 +17,151 @@
 package dejavu
 
 import (
+	"context"
 	"errors"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/88250/gulu"
 	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
 	"github.com/siyuan-note/eventbus"
 	"github.com/siyuan-note/logging"
 )
 
 var (
-	ErrLockCloudFailed = errors.New("lock cloud repo failed")
-	ErrCloudLocked     = errors.New("cloud repo is locked")
+	ErrLockCloudFailed  = errors.New("lock cloud repo failed")
+	ErrCloudLocked      = errors.New("cloud repo is locked")
+	ErrCloudLockLost    = errors.New("cloud repo lock lost")    // 云端锁已过期并被其他设备获取，此时不能再更新云端引用
+	ErrCloudLockChanged = errors.New("cloud repo lock changed") // 强制解锁时云端锁已经不是用户确认时的锁
 )
 
 const (
-	lockSyncKey = "lock-sync"
+	lockSyncKey         = "lock-sync"
+	cloudLockExpiration = 65 * time.Second // 云端锁的过期时间，持有者每 30 秒刷新一次
 )
 
-func (repo *Repo) unlockCloud(context map[string]interface{}) {
-	endRefreshLock <- true
+// cloudLease 描述了云端锁 lock-sync 的内容，deviceID 和 time 字段兼容旧版本。
+type cloudLease struct {
+	DeviceID   string `json:"deviceID"`
+	DeviceName string `json:"deviceName"`
+	DeviceOS   string `json:"deviceOS"`
+	Time       int64  `json:"time"`             // 加锁或者刷新的时间，解锁后为 0
+	Token      int64  `json:"token"`            // 防护令牌（fencing token），每次获取锁时递增
+	Holder     string `json:"holder,omitempty"` // 持有者实例的随机标识，用于区分同一设备上的不同进程
+
+	AesKeyVerifyVal string `json:"aesKeyVerifyVal,omitempty"` // 持有者密钥的校验值，同 entity.Index.AesKeyVerifyVal，用于强制解锁时校验密钥
+}
+
+func (lease *cloudLease) expired() bool {
+	return time.Now().After(time.UnixMilli(lease.Time).Add(cloudLockExpiration))
+}
+
+// heldBy 判断锁是否仍然是 held 获取时的锁。
+func (lease *cloudLease) heldBy(held *cloudLease) bool {
+	return nil != lease && 0 != lease.Time && lease.DeviceID == held.DeviceID && lease.Holder == held.Holder && lease.Token == held.Token
+}
+
+// reclaimable 判断设备 deviceID 上的实例 holder 持有的锁是否可以由当前实例直接获取：锁是当前实例持有的，或者是当前设备上已经退出的进程残留的。
+//
+// 同一设备上的其他进程持有云端锁时必然持有仓库文件锁，所以只有当前实例持有仓库排他文件锁时才能确定残留锁的持有者已经退出。
+// 文件系统不支持文件锁时无法确定，只能等待锁过期。
+func (repo *Repo) reclaimable(deviceID, holder, currentDeviceID string) bool {
+	if holder == repo.holderID {
+		return true
+	}
+	return deviceID == currentDeviceID && nil != repo.fileLock && repo.fileLock.Locked()
+}
+
+// CloudLockInfo 描述了云端锁的持有者信息。
+type CloudLockInfo struct {
+	DeviceID   string // 设备 ID
+	DeviceName string // 设备名称
+	DeviceOS   string // 操作系统
+	Time       int64  // 加锁或者最近一次刷新的时间
+	Token      int64  // 防护令牌，存储服务不支持条件写入时为 0
+	Expired    bool   // 是否已经过期，过期的锁可以被其他设备直接获取
+}
+
+// GetCloudLockInfo 获取云端锁的持有者信息，云端没有被锁定时返回 nil。
+func (repo *Repo) GetCloudLockInfo() (ret *CloudLockInfo, err error) {
+	lease, _, err := repo.readCloudLease(context.Background())
+	if nil != err || nil == lease || 0 == lease.Time {
+		return
+	}
+
+	ret = &CloudLockInfo{
+		DeviceID:   lease.DeviceID,
+		DeviceName: lease.DeviceName,
+		DeviceOS:   lease.DeviceOS,
+		Time:       lease.Time,
+		Token:      lease.Token,
+		Expired:    lease.expired(),
+	}
+	return
+}
+
+// ForceUnlockCloud 强制释放云端锁，用于持有锁的设备在同步过程中崩溃等情况，界面上应该在用户确认后再调用。
+// lockInfo 为用户确认时 GetCloudLockInfo 的返回值，如果此后云端锁已经变更则返回 ErrCloudLockChanged。
+// 只有本地密钥能够解密云端锁或者云端最新索引中校验值的设备才能强制解锁，否则（包括没有可以校验的数据时）返回 cloud.ErrDecryptFailed。
+// 本地仓库正在同步等操作时不等待，直接返回 ErrRepoBusy。
+func (repo *Repo) ForceUnlockCloud(lockInfo *CloudLockInfo) (err error) {
+	if !repo.lock.TryLock() {
+		err = ErrRepoBusy
+		return
+	}
+	defer repo.lock.Unlock()
+
+	ctx := context.Background()
+	lease, etag, err := repo.readCloudLease(ctx)
+	if nil != err {
+		return
+	}
+	if nil == lease || 0 == lease.Time {
+		return
+	}
+	if err = repo.verifyCloudAESKey(ctx, lease); nil != err {
+		logging.LogErrorf("verify cloud repo before force unlock failed: %s", err)
+		return
+	}
+	if nil == lockInfo || lease.DeviceID != lockInfo.DeviceID || lease.Time != lockInfo.Time || lease.Token != lockInfo.Token {
+		err = ErrCloudLockChanged
+		return
+	}
+
+	if "" == etag {
+		// 存储服务不支持条件写入，直接删除锁
+		err = repo.cloud.RemoveObject(lockSyncKey)
+	} else {
+		// 递增防护令牌，原持有者的刷新和引用更新都会失败
+		released := &cloudLease{DeviceID: lease.DeviceID, DeviceName: lease.DeviceName, DeviceOS: lease.DeviceOS, Token: lease.Token + 1, AesKeyVerifyVal: repo.aesKeyVerifyVal()}
+		if err = repo.putCloudLease(ctx, released, etag); errors.Is(err, ErrCloudLocked) {
+			err = ErrCloudLockChanged
+		}
+	}
+	if nil != err {
+		logging.LogErrorf("force unlock cloud repo failed: %s", err)
+		return
+	}
+	logging.LogWarnf("force unlocked cloud repo locked by device [%s/%s] at [%s]", lease.DeviceName, lease.DeviceID, time.UnixMilli(lease.Time).Format("2006-01-02 15:04:05"))
+	return
+}
+
+func (repo *Repo) unlockCloud(ctx context.Context) {
+	repo.stopRefreshLock()
+	if lease := repo.cloudLease.Swap(nil); nil != lease {
+		repo.releaseCloudLease(ctx, lease)
+		return
+	}
+
 	var err error
 	for i := 0; i < 3; i++ {
-		eventbus.Publish(eventbus.EvtCloudUnlock, context)
+		progressReporter(ctx).Stage(eventbus.EvtCloudUnlock)
 		err = repo.cloud.RemoveObject(lockSyncKey)
 		if nil == err {
 			return
@@ -57,22 +176,42 @@ func (repo *Repo) unlockCloud(context map[string]interface{}) {
 	return
 }
 
-var endRefreshLock = make(chan bool)
+// stopRefreshLock 结束当前仓库的云端锁刷新，并等待正在进行的刷新完成，避免解锁后锁又被刷新写回。
+func (repo *Repo) stopRefreshLock() {
+	if nil == repo.endRefreshLock {
+		return
+	}
 
-func (repo *Repo) tryLockCloud(currentDeviceID string, context map[string]interface{}) (err error) {
+	close(repo.endRefreshLock)
+	repo.endRefreshLock = nil
+	repo.refreshLockWait.Wait()
+}
+
+func (repo *Repo) tryLockCloud(ctx context.Context, currentDeviceID string) (err error) {
 	for i := 0; i < 3; i++ {
-		err = repo.lockCloud(currentDeviceID, context)
+		if err = ctx.Err(); nil != err {
+			return
+		}
+
+		err = repo.lockCloud(ctx, currentDeviceID)
 		if nil != err {
 			if errors.Is(err, ErrCloudLocked) {
 				logging.LogInfof("cloud repo is locked, retry after 5s")
-				time.Sleep(5 * time.Second)
+				select {
+				case <-ctx.Done():
+				case <-time.After(5 * time.Second):
+				}
 				continue
 			}
 			return
 		}
 
 		// 锁定成功，定时刷新锁
+		endRefreshLock := make(chan struct{})
+		repo.endRefreshLock = endRefreshLock
+		repo.refreshLockWait.Add(1)
 		go func() {
+			defer repo.refreshLockWait.Done()
 			ticker := time.NewTicker(30 * time.Second)
 			defer ticker.Stop()
 			for {
@@ -80,7 +219,7 @@ func (repo *Repo) tryLockCloud(currentDeviceID string, context map[string]interf
 				case <-endRefreshLock:
 					return
 				case <-ticker.C:
-					if refershErr := repo.lockCloud0(currentDeviceID); nil != refershErr {
+					if refershErr := repo.refreshCloudLock(currentDeviceID); nil != refershErr {
 						logging.LogErrorf("refresh cloud repo lock failed: %s", refershErr)
 					}
 				}
@@ -92,9 +231,27 @@ func (repo *Repo) tryLockCloud(currentDeviceID string, context map[string]interf
 	return
 }
 
-// lockCloud 锁定云端仓库，不要单独调用，应该调用 tryLockCloud，否则解锁时 endRefreshLock 会阻塞。
-func (repo *Repo) lockCloud(currentDeviceID string, context map[string]interface{}) (err error) {
-	eventbus.Publish(eventbus.EvtCloudLock, context)
+// lockCloud 锁定云端仓库，不要单独调用，应该调用 tryLockCloud，否则不会定时刷新锁。
+// 获取排他锁后新的共享锁无法再获取，然后等待其他设备已经持有的共享锁释放。
+func (repo *Repo) lockCloud(ctx context.Context, currentDeviceID string) (err error) {
+	progressReporter(ctx).Stage(eventbus.EvtCloudLock)
+	if err = repo.lockCloudExclusive(ctx, currentDeviceID); nil != err {
+		return
+	}
+
+	if err = repo.waitCloudReaders(ctx); nil != err {
+		repo.unlockCloud(ctx)
+	}
+	return
+}
+
+func (repo *Repo) lockCloudExclusive(ctx context.Context, currentDeviceID string) (err error) {
+	err = repo.lockCloudLease(ctx, currentDeviceID)
+	if !errors.Is(err, cloud.ErrUnsupported) {
+		return
+	}
+
+	// 存储服务不支持条件写入，回退为先检查再覆盖写入
 	data, err := repo.cloud.DownloadObject(lockSyncKey)
 	if errors.Is(err, cloud.ErrCloudObjectNotFound) {
 		err = repo.lockCloud0(currentDeviceID)
@@ -119,11 +276,12 @@ func (repo *Repo) lockCloud(currentDeviceID string, context map[string]interface
 	}
 
 	deviceID := content["deviceID"].(string)
+	holder, _ := content["holder"].(string)
 	t := int64(content["time"].(float64))
 	now := time.Now()
 	lockTime := time.UnixMilli(t)
-	if now.After(lockTime.Add(65*time.Second)) || deviceID == currentDeviceID {
-		// 云端锁超时过期或者就是当前设备锁的，那么当前设备可以继续直接锁
+	if now.After(lockTime.Add(cloudLockExpiration)) || repo.reclaimable(deviceID, holder, currentDeviceID) {
+		// 云端锁超时过期、就是当前实例锁的或者是当前设备上已经退出的进程残留的，那么可以继续直接锁
 		err = repo.lockCloud0(currentDeviceID)
 		return
 	}
@@ -143,8 +301,11 @@ func (repo *Repo) lockCloud0(currentDeviceID string) (err error) {
 
 	lockSyncPath := filepath.Join(repo.Path, lockSyncKey)
 	content := map[string]interface{}{
-		"deviceID": currentDeviceID,
-		"time":     time.Now().UnixMilli(),
+		"deviceID":   currentDeviceID,
+		"deviceName": repo.DeviceName,
+		"deviceOS":   repo.DeviceOS,
+		"time":       time.Now().UnixMilli(),
+		"holder":     repo.holderID,
 	}
 	data, err := gulu.JSON.MarshalJSON(content)
 	if nil != err {
@@ -177,6 +338,431 @@ func (repo *Repo) lockCloud0(currentDeviceID string) (err error) {
 	return
 }
 
+const (
+	cloudReadLockDir        = "lock-read"      // 云端共享锁所在的目录，每个共享锁为一个对象
+	cloudReadersWaitTimeout = 30 * time.Second // 获取排他锁后等待共享锁释放的最长时间
+)
+
+// tryRLockCloud 获取云端共享锁，用于只读操作。多个共享锁可以同时持有，仅与 tryLockCloud 获取的排他锁互斥。
+// 共享锁会定时刷新，返回的函数用于释放共享锁。
+func (repo *Repo) tryRLockCloud(ctx context.Context) (unlock func(), err error) {
+	for i := 0; i < 3; i++ {
+		if err = ctx.Err(); nil != err {
+			return
+		}
+
+		unlock, err = repo.rlockCloud(ctx)
+		if errors.Is(err, ErrCloudLocked) {
+			logging.LogInfof("cloud repo is locked, retry after 5s")
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		return
+	}
+	return
+}
+
+func (repo *Repo) rlockCloud(ctx context.Context) (unlock func(), err error) {
+	if err = repo.checkCloudWriter(ctx); nil != err {
+		return
+	}
+
+	key := path.Join(cloudReadLockDir, repo.DeviceID+"-"+util.RandHash()[:16])
+	repo.cloudReaders.Store(key, true)
+	if err = repo.putCloudReader(key); nil != err {
+		repo.cloudReaders.Delete(key)
+		return
+	}
+
+	// 写入共享锁后再检查一次排他锁，和 waitCloudReaders 配合保证排他锁和共享锁不会同时持有
+	if err = repo.checkCloudWriter(ctx); nil != err {
+		repo.removeCloudReader(key)
+		return
+	}
+
+	endRefresh := make(chan struct{})
+	refreshWait := sync.WaitGroup{}
+	refreshWait.Add(1)
+	go func() {
+		defer refreshWait.Done()
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-endRefresh:
+				return
+			case <-ticker.C:
+				if refreshErr := repo.putCloudReader(key); nil != refreshErr {
+					logging.LogErrorf("refresh cloud repo read lock failed: %s", refreshErr)
+				}
+			}
+		}
+	}()
+
+	unlock = func() {
+		close(endRefresh)
+		refreshWait.Wait()
+		repo.removeCloudReader(key)
+	}
+	return
+}
+
+// checkCloudWriter 检查云端是否被其他实例的排他锁锁定，锁定时返回 ErrCloudLocked。当前设备上已经退出的进程残留的排他锁不影响获取共享锁。
+func (repo *Repo) checkCloudWriter(ctx context.Context) (err error) {
+	lease, _, err := repo.readCloudLease(ctx)
+	if nil != err {
+		return
+	}
+	if nil == lease || 0 == lease.Time || lease.expired() {
+		return
+	}
+	if repo.holderID == lease.Holder {
+		return
+	}
+	if repo.reclaimable(lease.DeviceID, lease.Holder, repo.DeviceID) {
+		logging.LogWarnf("ignore stale cloud repo lock of current device at [%s]", time.UnixMilli(lease.Time).Format("2006-01-02 15:04:05"))
+		return
+	}
+
+	logging.LogWarnf("cloud repo is locked by device [%s] at [%s]", lease.DeviceID, time.UnixMilli(lease.Time).Format("2006-01-02 15:04:05"))
+	err = ErrCloudLocked
+	return
+}
+
+func (repo *Repo) putCloudReader(key string) (err error) {
+	data, err := gulu.JSON.MarshalJSON(repo.newCloudLease(repo.DeviceID, 0))
+	if nil != err {
+		logging.LogErrorf("marshal read lock failed: %s", err)
+		return
+	}
+
+	if _, err = repo.cloud.UploadBytes(key, data, true); nil != err {
+		logging.LogErrorf("upload read lock [%s] failed: %s", key, err)
+		if ok, retErr := parseErr(err); ok {
+			err = retErr
+		}
+		return
+	}
+	return
+}
+
+func (repo *Repo) removeCloudReader(key string) {
+	repo.cloudReaders.Delete(key)
+	if err := repo.cloud.RemoveObject(key); nil != err {
+		logging.LogErrorf("remove read lock [%s] failed: %s", key, err)
+	}
+}
+
+// waitCloudReaders 等待其他操作持有的云端共享锁释放，超时返回 ErrCloudLocked。过期的共享锁视为持有者异常退出后残留的，会被清理。
+func (repo *Repo) waitCloudReaders(ctx context.Context) (err error) {
+	deadline := time.Now().Add(cloudReadersWaitTimeout)
+	for {
+		readers, countErr := repo.countCloudReaders()
+		if nil != countErr {
+			// 无法确定是否还有共享锁时不能继续写入，释放排他锁后由 tryLockCloud 重试
+			logging.LogWarnf("count cloud repo readers failed: %s", countErr)
+			err = ErrCloudLocked
+			return
+		}
+		if 1 > readers {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			logging.LogWarnf("cloud repo is still read by [%d] readers", readers)
+			err = ErrCloudLocked
+			return
+		}
+
+		logging.LogInfof("waiting for [%d] cloud repo readers", readers)
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// countCloudReaders 返回其他操作持有的云端共享锁数量，列出或者下载共享锁失败（比如网络暂时不可用）时返回错误。
+//
+// 过期的共享锁以及当前设备上已经退出的进程残留的共享锁会被清理。
+func (repo *Repo) countCloudReaders() (ret int, err error) {
+	repo.lockAPIGet.Add(1)
+	objInfos, err := repo.cloud.ListObjects(cloudReadLockDir + "/")
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) || errors.Is(err, cloud.ErrUnsupported) {
+			err = nil
+			return
+		}
+		logging.LogWarnf("list cloud repo read locks failed: %s", err)
+		return
+	}
+
+	for name := range objInfos {
+		key := path.Join(cloudReadLockDir, name)
+		if _, ok := repo.cloudReaders.Load(key); ok {
+			ret++
+			continue
+		}
+
+		repo.lockAPIGet.Add(1)
+		data, downloadErr := repo.cloud.DownloadObject(key)
+		if nil != downloadErr {
+			if errors.Is(downloadErr, cloud.ErrCloudObjectNotFound) { // 已经释放
+				continue
+			}
+			logging.LogWarnf("download read lock [%s] failed: %s", key, downloadErr)
+			err = downloadErr
+			return
+		}
+
+		lease := &cloudLease{}
+		if unmarshalErr := gulu.JSON.UnmarshalJSON(data, lease); nil != unmarshalErr || lease.expired() || repo.reclaimable(lease.DeviceID, lease.Holder, repo.DeviceID) {
+			logging.LogWarnf("remove stale read lock [%s]", key)
+			repo.lockAPIPut.Add(1)
+			repo.removeCloudReader(key)
+			continue
+		}
+		ret++
+	}
+	return
+}
+
+// lockCloudLease 基于条件写入获取云端锁：读取锁及其 ETag，锁过期或者可以直接获取（见 reclaimable）时递增防护令牌，并以读到的 ETag 为条件写入新的锁。
+// 多个设备同时写入时只有一个设备能够成功，其他设备返回 ErrCloudLocked。存储服务不支持条件写入时返回 cloud.ErrUnsupported。
+func (repo *Repo) lockCloudLease(ctx context.Context, currentDeviceID string) (err error) {
+	current, etag, err := repo.getCloudLease(ctx)
+	if nil != err {
+		return
+	}
+
+	token := int64(1)
+	if nil != current {
+		if !current.expired() && !repo.reclaimable(current.DeviceID, current.Holder, currentDeviceID) {
+			logging.LogWarnf("cloud repo is locked by device [%s] at [%s], will retry after 5s", current.DeviceID, time.UnixMilli(current.Time).Format("2006-01-02 15:04:05"))
+			err = ErrCloudLocked
+			return
+		}
+		token = current.Token + 1
+	}
+
+	lease := repo.newCloudLease(currentDeviceID, token)
+	if err = repo.putCloudLease(ctx, lease, etag); nil != err {
+		return
+	}
+
+	// 部分存储服务会忽略条件请求头，写入后再读取一次确认锁确实属于当前设备
+	current, _, err = repo.getCloudLease(ctx)
+	if nil != err {
+		return
+	}
+	if !current.heldBy(lease) {
+		logging.LogWarnf("cloud repo lock was overwritten by other device")
+		err = ErrCloudLocked
+		return
+	}
+
+	repo.cloudLease.Store(lease)
+	logging.LogInfof("locked cloud repo [device=%s, token=%d]", lease.DeviceID, lease.Token)
+	return
+}
+
+// refreshCloudLock 刷新云端锁的时间，不支持条件写入的存储服务直接覆盖写入。
+func (repo *Repo) refreshCloudLock(currentDeviceID string) (err error) {
+	lease := repo.cloudLease.Load()
+	if nil == lease {
+		err = repo.lockCloud0(currentDeviceID)
+		return
+	}
+
+	ctx := context.Background()
+	current, etag, err := repo.getCloudLease(ctx)
+	if nil != err {
+		return
+	}
+	if !current.heldBy(lease) {
+		err = ErrCloudLockLost
+		return
+	}
+
+	refreshed := repo.newCloudLease(lease.DeviceID, lease.Token)
+	if err = repo.putCloudLease(ctx, refreshed, etag); nil != err {
+		if errors.Is(err, ErrCloudLocked) {
+			err = ErrCloudLockLost
+		}
+		return
+	}
+	repo.cloudLease.CompareAndSwap(lease, refreshed)
+	return
+}
+
+// releaseCloudLease 释放云端锁。锁对象会被保留并将时间置为 0，以便下一次加锁时继续递增防护令牌。
+func (repo *Repo) releaseCloudLease(ctx context.Context, lease *cloudLease) {
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	for i := 0; i < 3; i++ {
+		progressReporter(ctx).Stage(eventbus.EvtCloudUnlock)
+		var current *cloudLease
+		var etag string
+		current, etag, err = repo.getCloudLease(ctx)
+		if nil != err {
+			continue
+		}
+		if !current.heldBy(lease) {
+			logging.LogWarnf("cloud repo lock [device=%s, token=%d] has been taken by other device", lease.DeviceID, lease.Token)
+			return
+		}
+
+		released := &cloudLease{DeviceID: lease.DeviceID, DeviceName: lease.DeviceName, DeviceOS: lease.DeviceOS, Token: lease.Token, AesKeyVerifyVal: lease.AesKeyVerifyVal}
+		if err = repo.putCloudLease(ctx, released, etag); nil == err {
+			return
+		}
+	}
+
+	if errors.Is(err, cloud.ErrCloudAuthFailed) {
+		return
+	}
+
+	logging.LogErrorf("unlock cloud repo failed: %s", err)
+}
+
+// checkCloudLease 检查当前设备是否仍然持有获取时的云端锁，用于更新云端引用前的防护令牌检查。
+// 锁过期后被其他设备获取时返回 ErrCloudLockLost，避免覆盖其他设备已经更新的引用。没有持有条件写入获取的锁时不检查。
+func (repo *Repo) checkCloudLease(ctx context.Context) (err error) {
+	lease := repo.cloudLease.Load()
+	if nil == lease {
+		return
+	}
+
+	current, _, err := repo.getCloudLease(ctx)
+	if nil != err {
+		return
+	}
+	if !current.heldBy(lease) {
+		logging.LogErrorf("cloud repo lock [device=%s, token=%d] has been lost", lease.DeviceID, lease.Token)
+		err = ErrCloudLockLost
+		return
+	}
+	return
+}
+
+func (repo *Repo) newCloudLease(deviceID string, token int64) *cloudLease {
+	return &cloudLease{DeviceID: deviceID, DeviceName: repo.DeviceName, DeviceOS: repo.DeviceOS, Time: time.Now().UnixMilli(), Token: token, Holder: repo.holderID, AesKeyVerifyVal: repo.aesKeyVerifyVal()}
+}
+
+// aesKeyVerifyVal 返回本地密钥的校验值。
+func (repo *Repo) aesKeyVerifyVal() string {
+	index := &entity.Index{}
+	index.InitAESKeyVerifyVal(repo.store.AesKey)
+	return index.AesKeyVerifyVal
+}
+
+// verifyCloudAESKey 用于校验本地密钥和云端锁持有者的密钥一致，优先使用云端锁中的校验值，旧版本的锁没有校验值时使用云端最新索引中的校验值。
+//
+// 云端锁和云端最新索引都没有校验值（比如云端还没有数据）时无法校验，返回 cloud.ErrDecryptFailed。
+func (repo *Repo) verifyCloudAESKey(ctx context.Context, lease *cloudLease) (err error) {
+	verifyVal := lease.AesKeyVerifyVal
+	if "" == verifyVal {
+		var latest *entity.Index
+		if _, latest, err = repo.downloadCloudLatest(ctx); nil != err {
+			return
+		}
+		if nil != latest {
+			verifyVal = latest.AesKeyVerifyVal
+		}
+	}
+	if "" == verifyVal {
+		logging.LogErrorf("no AES key verify value found in cloud repo")
+		err = cloud.ErrDecryptFailed
+		return
+	}
+
+	if !(&entity.Index{AesKeyVerifyVal: verifyVal}).VerifyAESKey(repo.store.AesKey) {
+		err = cloud.ErrDecryptFailed
+	}
+	return
+}
+
+// readCloudLease 读取云端锁，存储服务不支持条件写入时 etag 为空。
+func (repo *Repo) readCloudLease(ctx context.Context) (lease *cloudLease, etag string, err error) {
+	lease, etag, err = repo.getCloudLease(ctx)
+	if !errors.Is(err, cloud.ErrUnsupported) {
+		return
+	}
+
+	data, err := repo.cloud.DownloadObject(lockSyncKey)
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			err = nil
+		}
+		return
+	}
+	lease = &cloudLease{}
+	if err = gulu.JSON.UnmarshalJSON(data, lease); nil != err {
+		logging.LogErrorf("unmarshal lock sync failed: %s", err)
+		err = nil
+		lease = nil
+	}
+	return
+}
+
+// getCloudLease 获取云端锁及其 ETag，锁不存在或者无法解析时 lease 为 nil。
+func (repo *Repo) getCloudLease(ctx context.Context) (lease *cloudLease, etag string, err error) {
+	data, etag, err := repo.cloud.GetWithETag(ctx, lockSyncKey)
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) {
+			err = nil
+			etag = ""
+			return
+		}
+		if ok, retErr := parseErr(err); ok {
+			err = retErr
+		}
+		return
+	}
+
+	lease = &cloudLease{}
+	if err = gulu.JSON.UnmarshalJSON(data, lease); nil != err {
+		// 无法解析的锁仍然以其 ETag 为条件覆盖写入
+		logging.LogErrorf("unmarshal lock sync failed: %s", err)
+		err = nil
+		lease = nil
+	}
+	return
+}
+
+func (repo *Repo) putCloudLease(ctx context.Context, lease *cloudLease, etag string) (err error) {
+	data, err := gulu.JSON.MarshalJSON(lease)
+	if nil != err {
+		logging.LogErrorf("marshal lock sync failed: %s", err)
+		err = ErrLockCloudFailed
+		return
+	}
+
+	err = repo.cloud.PutIfMatch(ctx, lockSyncKey, data, etag)
+	if nil != err {
+		if errors.Is(err, cloud.ErrCloudPreconditionFailed) {
+			logging.LogWarnf("cloud repo lock was changed by other device")
+			err = ErrCloudLocked
+			return
+		}
+		if errors.Is(err, cloud.ErrUnsupported) {
+			return
+		}
+
+		logging.LogErrorf("upload lock sync failed: %s", err)
+		if ok, retErr := parseErr(err); ok {
+			err = retErr
+		}
+		return
+	}
+	return
+}
+
 func parseErr(err error) (bool, error) {
 	if nil == err {
 		return true, nil
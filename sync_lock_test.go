@@ -0,0 +1,484 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+func TestReposLockIndependently(t *testing.T) {
+	tempDir := t.TempDir()
+	repoA := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud-a"))
+	repoB := newPackTestRepo(t, tempDir, "b", filepath.Join(tempDir, "cloud-b"))
+	writeTestDataFile(t, repoA, "a.txt", "a")
+	writeTestDataFile(t, repoB, "b.txt", "b")
+
+	repoA.lock.Lock()
+	done := make(chan error, 1)
+	go func() {
+		if _, err := repoB.Index(context.Background(), "b", false); nil != err {
+			done <- err
+			return
+		}
+		_, _, err := repoB.Sync(context.Background())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("repo b is blocked by the lock of repo a")
+	}
+	repoA.lock.Unlock()
+}
+
+func TestConcurrentReposSync(t *testing.T) {
+	tempDir := t.TempDir()
+	repos := []*Repo{
+		newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud-a")),
+		newPackTestRepo(t, tempDir, "b", filepath.Join(tempDir, "cloud-b")),
+	}
+
+	errs := make([]error, len(repos))
+	waitGroup := sync.WaitGroup{}
+	for i, repo := range repos {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for round := 0; round < 3; round++ {
+				writeTestDataFile(t, repo, "doc"+strconv.Itoa(round)+".txt", "round "+strconv.Itoa(round))
+				if _, errs[i] = repo.Index(context.Background(), "round", false); nil != errs[i] {
+					return
+				}
+				if _, _, errs[i] = repo.Sync(WithSkipCloudPreflight(context.Background())); nil != errs[i] {
+					return
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	for i, repo := range repos {
+		if nil != errs[i] {
+			t.Fatal(errs[i])
+		}
+		if nil != repo.endRefreshLock {
+			t.Fatalf("repo [%s] lock refresher is still running", repo.DeviceID)
+		}
+		data, err := os.ReadFile(filepath.Join(tempDir, "cloud-"+string(rune('a'+i)), "main", lockSyncKey))
+		if nil != err {
+			t.Fatal(err)
+		}
+		lease := &cloudLease{}
+		if err = gulu.JSON.UnmarshalJSON(data, lease); nil != err {
+			t.Fatal(err)
+		}
+		if 0 != lease.Time || nil != repo.cloudLease.Load() {
+			t.Fatalf("repo [%s] cloud lock is not released: %s", repo.DeviceID, data)
+		}
+	}
+}
+
+func TestCloudLeaseFencing(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repoA := newPackTestRepo(t, tempDir, "a", cloudPath)
+	repoB := newPackTestRepo(t, tempDir, "b", cloudPath)
+	ctx := context.Background()
+
+	if err := repoA.lockCloud(ctx, repoA.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	if lease := repoA.cloudLease.Load(); nil == lease || 1 != lease.Token {
+		t.Fatalf("unexpected lease: %#v", lease)
+	}
+	if err := repoB.lockCloud(ctx, repoB.DeviceID); !errors.Is(err, ErrCloudLocked) {
+		t.Fatalf("lock should fail with locked error: %v", err)
+	}
+
+	// 模拟设备 A 的锁过期后被设备 B 获取
+	lease, etag, err := repoA.getCloudLease(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	lease.Time = time.Now().Add(-2 * cloudLockExpiration).UnixMilli()
+	if err = repoA.putCloudLease(ctx, lease, etag); nil != err {
+		t.Fatal(err)
+	}
+	if err = repoB.lockCloud(ctx, repoB.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	if lease = repoB.cloudLease.Load(); 2 != lease.Token {
+		t.Fatalf("fencing token should increase: %#v", lease)
+	}
+
+	if err = repoA.checkCloudLease(ctx); !errors.Is(err, ErrCloudLockLost) {
+		t.Fatalf("check lease should fail with lock lost error: %v", err)
+	}
+	if _, err = repoA.updateCloudRef(ctx, "refs/latest"); !errors.Is(err, ErrCloudLockLost) {
+		t.Fatalf("update ref should fail with lock lost error: %v", err)
+	}
+	if err = repoA.refreshCloudLock(repoA.DeviceID); !errors.Is(err, ErrCloudLockLost) {
+		t.Fatalf("refresh lease should fail with lock lost error: %v", err)
+	}
+
+	// 设备 A 解锁不会释放设备 B 持有的锁
+	repoA.unlockCloud(ctx)
+	if err = repoB.checkCloudLease(ctx); nil != err {
+		t.Fatal(err)
+	}
+	if err = repoB.refreshCloudLock(repoB.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	repoB.unlockCloud(ctx)
+
+	if err = repoA.lockCloud(ctx, repoA.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	if lease = repoA.cloudLease.Load(); 3 != lease.Token {
+		t.Fatalf("fencing token should increase after release: %#v", lease)
+	}
+	repoA.unlockCloud(ctx)
+}
+
+type unconditionalLocalCloud struct {
+	*cloud.Local
+}
+
+func (c *unconditionalLocalCloud) GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error) {
+	err = cloud.ErrUnsupported
+	return
+}
+
+func TestCloudLockFallback(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	repo.cloud = &unconditionalLocalCloud{Local: repo.cloud.(*cloud.Local)}
+	ctx := context.Background()
+
+	if err := repo.tryLockCloud(ctx, repo.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	if nil != repo.cloudLease.Load() {
+		t.Fatalf("lease should not be used without conditional writes")
+	}
+	if err := repo.checkCloudLease(ctx); nil != err {
+		t.Fatal(err)
+	}
+	repo.unlockCloud(ctx)
+	if _, err := repo.cloud.DownloadObject(lockSyncKey); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("cloud lock should be removed: %v", err)
+	}
+}
+
+func TestForceUnlockCloud(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repoA := newPackTestRepo(t, tempDir, "a", cloudPath)
+	repoB := newPackTestRepo(t, tempDir, "b", cloudPath)
+	ctx := context.Background()
+	writeTestDataFile(t, repoA, "a.txt", "a")
+	if _, err := repoA.Index(ctx, "a", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repoA.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+
+	info, err := repoB.GetCloudLockInfo()
+	if nil != err || nil != info {
+		t.Fatalf("cloud repo should not be locked: %#v, %v", info, err)
+	}
+
+	// 模拟设备 A 在同步过程中崩溃，没有释放云端锁
+	if err = repoA.lockCloud(ctx, repoA.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	info, err = repoB.GetCloudLockInfo()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if nil == info || "device-a" != info.DeviceID || "Device" != info.DeviceName || "linux" != info.DeviceOS || 0 == info.Time || info.Expired {
+		t.Fatalf("unexpected cloud lock info: %#v", info)
+	}
+
+	// 密钥不匹配的设备不能强制解锁
+	repoC := newPackTestRepo(t, tempDir, "c", cloudPath)
+	repoC.store.AesKey = []byte("fedcba9876543210fedcba9876543210")
+	if err = repoC.ForceUnlockCloud(info); !errors.Is(err, cloud.ErrDecryptFailed) {
+		t.Fatalf("force unlock should fail with decrypt error: %v", err)
+	}
+
+	stale := *info
+	stale.Token--
+	if err = repoB.ForceUnlockCloud(&stale); !errors.Is(err, ErrCloudLockChanged) {
+		t.Fatalf("force unlock should fail with lock changed error: %v", err)
+	}
+	if err = repoB.ForceUnlockCloud(info); nil != err {
+		t.Fatal(err)
+	}
+	if info, err = repoB.GetCloudLockInfo(); nil != err || nil != info {
+		t.Fatalf("cloud repo should be unlocked: %#v, %v", info, err)
+	}
+
+	// 原持有者的刷新不会把锁写回
+	if err = repoA.refreshCloudLock(repoA.DeviceID); !errors.Is(err, ErrCloudLockLost) {
+		t.Fatalf("refresh lease should fail with lock lost error: %v", err)
+	}
+	repoA.unlockCloud(ctx)
+
+	if err = repoB.lockCloud(ctx, repoB.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	repoB.unlockCloud(ctx)
+}
+
+func TestForceUnlockCloudVerify(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repoA := newPackTestRepo(t, tempDir, "a", cloudPath)
+	repoB := newPackTestRepo(t, tempDir, "b", cloudPath)
+	ctx := context.Background()
+	if err := repoA.cloud.CreateRepo("main"); nil != err {
+		t.Fatal(err)
+	}
+
+	// 云端还没有数据，旧版本的锁没有校验值，无法校验密钥时不能强制解锁
+	data, err := gulu.JSON.MarshalJSON(&cloudLease{DeviceID: "device-old", Time: time.Now().UnixMilli(), Token: 1})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = repoA.cloud.UploadBytes(lockSyncKey, data, true); nil != err {
+		t.Fatal(err)
+	}
+	info, err := repoB.GetCloudLockInfo()
+	if nil != err || nil == info {
+		t.Fatalf("cloud repo should be locked: %#v, %v", info, err)
+	}
+	if err = repoB.ForceUnlockCloud(info); !errors.Is(err, cloud.ErrDecryptFailed) {
+		t.Fatalf("force unlock without verify value should fail with decrypt error: %v", err)
+	}
+
+	// 锁中有校验值时可以在云端没有数据的情况下校验密钥
+	if err = repoA.cloud.RemoveObject(lockSyncKey); nil != err {
+		t.Fatal(err)
+	}
+	if err = repoA.lockCloud(ctx, repoA.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	if info, err = repoB.GetCloudLockInfo(); nil != err || nil == info {
+		t.Fatalf("cloud repo should be locked: %#v, %v", info, err)
+	}
+
+	// 本地仓库正在同步时不等待
+	repoB.lock.Lock()
+	err = repoB.ForceUnlockCloud(info)
+	repoB.lock.Unlock()
+	if !errors.Is(err, ErrRepoBusy) {
+		t.Fatalf("force unlock should fail with repo busy error: %v", err)
+	}
+
+	if err = repoB.ForceUnlockCloud(info); nil != err {
+		t.Fatal(err)
+	}
+	repoA.unlockCloud(ctx)
+}
+
+func TestCloudReadWriteLocks(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repoA := newPackTestRepo(t, tempDir, "a", cloudPath)
+	repoB := newPackTestRepo(t, tempDir, "b", cloudPath)
+	repoC := newPackTestRepo(t, tempDir, "c", cloudPath)
+	ctx := context.Background()
+
+	// 共享锁之间不互斥
+	runlockA, err := repoA.rlockCloud(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	runlockB, err := repoB.rlockCloud(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if readers, countErr := repoC.countCloudReaders(); nil != countErr || 2 != readers {
+		t.Fatalf("unexpected readers [%d]: %v", readers, countErr)
+	}
+
+	// 排他锁等待共享锁释放，取消后释放已经获取的排他锁
+	timeoutCtx, cancel := context.WithTimeout(ctx, 1500*time.Millisecond)
+	err = repoC.lockCloud(timeoutCtx, repoC.DeviceID)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lock should wait for readers: %v", err)
+	}
+	if info, infoErr := repoC.GetCloudLockInfo(); nil != infoErr || nil != info {
+		t.Fatalf("cloud repo should be unlocked: %#v, %v", info, infoErr)
+	}
+
+	runlockA()
+	runlockB()
+	if err = repoC.lockCloud(ctx, repoC.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = repoA.rlockCloud(ctx); !errors.Is(err, ErrCloudLocked) {
+		t.Fatalf("read lock should fail with locked error: %v", err)
+	}
+	if readers, countErr := repoC.countCloudReaders(); nil != countErr || 0 != readers {
+		t.Fatalf("unexpected readers [%d]: %v", readers, countErr)
+	}
+	repoC.unlockCloud(ctx)
+
+	// 持有者异常退出后残留的过期共享锁会被清理
+	stale := repoA.newCloudLease(repoA.DeviceID, 0)
+	stale.Time = time.Now().Add(-2 * cloudLockExpiration).UnixMilli()
+	data, err := gulu.JSON.MarshalJSON(stale)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = repoA.cloud.UploadBytes(cloudReadLockDir+"/stale", data, true); nil != err {
+		t.Fatal(err)
+	}
+	if err = repoC.lockCloud(ctx, repoC.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	repoC.unlockCloud(ctx)
+	if _, err = repoC.cloud.DownloadObject(cloudReadLockDir + "/stale"); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("stale read lock should be removed: %v", err)
+	}
+}
+
+// listFailCloud 模拟列出对象时暂时失败的存储服务。
+type listFailCloud struct {
+	cloud.Cloud
+}
+
+func (c *listFailCloud) ListObjects(pathPrefix string) (map[string]*entity.ObjectInfo, error) {
+	return nil, cloud.ErrCloudServiceUnavailable
+}
+
+func TestCloudLocksOwnDevice(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	ctx := context.Background()
+
+	// 同一设备上的两个进程（比如桌面端和命令行）使用同一个仓库
+	desktop := newPackTestRepo(t, tempDir, "a", cloudPath)
+	cli := newPackTestRepo(t, tempDir, "a", cloudPath)
+
+	// 其他进程持有排他锁时不能获取共享锁
+	if err := desktop.lockRepo(true); nil != err {
+		t.Fatal(err)
+	}
+	if err := desktop.lockCloud(ctx, desktop.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	if err := cli.lockRepo(false); !errors.Is(err, ErrRepoBusy) {
+		t.Fatalf("lock repo should fail with repo busy error: %v", err)
+	}
+	if _, err := cli.rlockCloud(ctx); !errors.Is(err, ErrCloudLocked) {
+		t.Fatalf("read lock should fail with locked error: %v", err)
+	}
+	desktop.unlockCloud(ctx)
+	desktop.unlockRepo()
+
+	// 其他进程持有的共享锁不会被当作残留的锁清理
+	if err := cli.lockRepo(false); nil != err {
+		t.Fatal(err)
+	}
+	runlock, err := cli.rlockCloud(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 1500*time.Millisecond)
+	err = desktop.lockCloud(timeoutCtx, desktop.DeviceID)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lock should wait for read lock of other process: %v", err)
+	}
+	if readers, countErr := desktop.countCloudReaders(); nil != countErr || 1 != readers {
+		t.Fatalf("read lock of other process should be kept [%d]: %v", readers, countErr)
+	}
+	runlock()
+	cli.unlockRepo()
+
+	// 模拟命令行进程在持有排他锁和共享锁时崩溃，操作系统释放了仓库文件锁
+	if err = cli.lockCloud(ctx, cli.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	cli.stopRefreshLock()
+	data, err := gulu.JSON.MarshalJSON(cli.newCloudLease(cli.DeviceID, 0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = cli.cloud.UploadBytes(cloudReadLockDir+"/"+cli.DeviceID+"-crashed", data, true); nil != err {
+		t.Fatal(err)
+	}
+
+	// 没有持有仓库排他文件锁时无法确定持有者已经退出
+	if _, err = desktop.rlockCloud(ctx); !errors.Is(err, ErrCloudLocked) {
+		t.Fatalf("read lock should fail with locked error: %v", err)
+	}
+
+	// 持有仓库排他文件锁后不会被已经退出的进程残留的锁阻塞
+	if err = desktop.lockRepo(true); nil != err {
+		t.Fatal(err)
+	}
+	defer desktop.unlockRepo()
+	runlock, err = desktop.rlockCloud(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	runlock()
+	gets := desktop.lockAPIGet.Load()
+	start := time.Now()
+	if err = desktop.lockCloud(ctx, desktop.DeviceID); nil != err {
+		t.Fatal(err)
+	}
+	desktop.unlockCloud(ctx)
+	if time.Since(start) > cloudReadersWaitTimeout/2 {
+		t.Fatal("lock waited for stale read lock of current device")
+	}
+	if _, err = desktop.cloud.DownloadObject(cloudReadLockDir + "/" + cli.DeviceID + "-crashed"); !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("stale read lock should be removed: %v", err)
+	}
+	if 2 > desktop.lockAPIGet.Load()-gets {
+		t.Fatalf("read lock requests not counted [%d]", desktop.lockAPIGet.Load()-gets)
+	}
+
+	// 列出共享锁失败时无法确定是否还有共享锁，不能获取排他锁
+	desktop.cloud = &listFailCloud{Cloud: desktop.cloud}
+	if err = desktop.lockCloud(ctx, desktop.DeviceID); !errors.Is(err, ErrCloudLocked) {
+		t.Fatalf("lock should fail with locked error: %v", err)
+	}
+	if info, infoErr := desktop.GetCloudLockInfo(); nil != infoErr || nil != info {
+		t.Fatalf("cloud repo should be unlocked: %#v, %v", info, infoErr)
+	}
+}
@@ -17,6 +17,7 @@
 package dejavu
 
 import (
+	"context"
 	"errors"
 	"path/filepath"
 	"sync"
@@ -28,16 +29,23 @@ import (
 	"github.com/siyuan-note/logging"
 )
 
-func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (repo *Repo) SyncDownload(ctx context.Context) (mergeResult *MergeResult, trafficStat *TrafficStat, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	// 加锁时检查共享锁的请求也计入流量统计
+	meter := repo.newTrafficMeter()
+	defer func() { meter.setRates(trafficStat) }()
 
 	// 锁定云端，防止其他设备并发上传数据
-	err = repo.tryLockCloud(repo.DeviceID, context)
+	err = repo.tryLockCloud(ctx, repo.DeviceID)
 	if nil != err {
 		return
 	}
-	defer repo.unlockCloud(context)
+	defer repo.unlockCloud(ctx)
+	defer repo.cacheCloudPacks()()
 
 	mergeResult = &MergeResult{Time: time.Now()}
 	trafficStat = &TrafficStat{m: &sync.Mutex{}}
@@ -50,7 +58,7 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	}
 
 	// 从云端获取最新索引
-	length, cloudLatest, err := repo.downloadCloudLatest(context)
+	length, cloudLatest, err := repo.downloadCloudLatest(ctx)
 	if nil != err {
 		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
 			logging.LogErrorf("download cloud latest failed: %s", err)
@@ -74,14 +82,14 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	}
 
 	// 下载缺失文件并入库
-	fileDownloadStat, _, err := repo.downloadCloudFilesPut(fetchFileIDs, context)
+	fileDownloadStat, _, err := repo.downloadCloudFilesPut(ctx, fetchFileIDs)
 	if nil != err {
 		logging.LogErrorf("download cloud files put failed: %s", err)
 		return
 	}
 	trafficStat.DownloadFileCount += len(fetchFileIDs)
 	trafficStat.DownloadBytes += fileDownloadStat.CloudBytes
-	trafficStat.APIGet += len(fetchFileIDs) - fileDownloadStat.PeerCount
+	trafficStat.APIGet += fileDownloadStat.cloudGets(len(fetchFileIDs))
 	trafficStat.PeerDownloadBytes += fileDownloadStat.PeerBytes
 	trafficStat.PeerDownloadFileCount += fileDownloadStat.PeerCount
 	trafficStat.PeerFallbackCount += fileDownloadStat.PeerFallbackCount
@@ -104,7 +112,7 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	}
 
 	// 下载缺失分块并入库
-	downloadStat, downloadErr := repo.downloadCloudChunksPut(fetchChunkIDs, context)
+	downloadStat, downloadErr := repo.downloadCloudChunksPut(ctx, fetchChunkIDs)
 	err = downloadErr
 	if nil != err {
 		logging.LogErrorf("download chunks put failed: %s", err)
@@ -112,7 +120,7 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	}
 	trafficStat.DownloadBytes += downloadStat.CloudBytes
 	trafficStat.DownloadChunkCount += len(fetchChunkIDs)
-	trafficStat.APIGet += len(fetchChunkIDs) - downloadStat.PeerCount
+	trafficStat.APIGet += downloadStat.cloudGets(len(fetchChunkIDs))
 	trafficStat.PeerDownloadBytes += downloadStat.PeerBytes
 	trafficStat.PeerDownloadChunkCount += downloadStat.PeerCount
 	trafficStat.PeerFallbackCount += downloadStat.PeerFallbackCount
@@ -170,7 +178,7 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 				return
 			}
 
-			err = repo.checkoutFile(checkoutTmp, temp, i+1, len(mergeResult.Conflicts), context)
+			err = repo.checkoutFile(ctx, checkoutTmp, temp, i+1, len(mergeResult.Conflicts))
 			if nil != err {
 				logging.LogErrorf("checkout file failed: %s", err)
 				return
@@ -188,14 +196,14 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	}
 
 	// 数据变更后还原文件
-	err = repo.restoreFiles(mergeResult, context)
+	err = repo.restoreFiles(ctx, mergeResult)
 	if nil != err {
 		logging.LogErrorf("restore files failed: %s", err)
 		return
 	}
 
 	// 处理合并
-	err = repo.mergeSync(mergeResult, localChanged, false, latest, cloudLatest, cloudChunkIDs, trafficStat, context)
+	err = repo.mergeSync(ctx, mergeResult, localChanged, false, latest, cloudLatest, cloudChunkIDs, trafficStat)
 	if nil != err {
 		logging.LogErrorf("merge sync failed: %s", err)
 		return
@@ -212,16 +220,23 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	return
 }
 
-func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *TrafficStat, err error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (repo *Repo) SyncUpload(ctx context.Context) (trafficStat *TrafficStat, err error) {
+	if err = repo.lockRepo(true); nil != err {
+		return
+	}
+	defer repo.unlockRepo()
+
+	// 加锁时检查共享锁的请求也计入流量统计
+	meter := repo.newTrafficMeter()
+	defer func() { meter.setRates(trafficStat) }()
 
 	// 锁定云端，防止其他设备并发上传数据
-	err = repo.tryLockCloud(repo.DeviceID, context)
+	err = repo.tryLockCloud(ctx, repo.DeviceID)
 	if nil != err {
 		return
 	}
-	defer repo.unlockCloud(context)
+	defer repo.unlockCloud(ctx)
+	defer repo.cacheCloudPacks()()
 
 	trafficStat = &TrafficStat{m: &sync.Mutex{}}
 
@@ -232,7 +247,7 @@ func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *Traff
 	}
 
 	// 从云端获取最新索引
-	length, cloudLatest, err := repo.downloadCloudLatest(context)
+	length, cloudLatest, err := repo.downloadCloudLatest(ctx)
 	if nil != err {
 		if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
 			logging.LogErrorf("download cloud latest failed: %s", err)
@@ -279,27 +294,27 @@ func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *Traff
 	//}
 
 	// 上传分块
-	length, err = repo.uploadChunks(uploadChunkIDs, context)
+	length, puts, err := repo.uploadChunks(ctx, uploadChunkIDs, nil)
 	if nil != err {
 		logging.LogErrorf("upload chunks failed: %s", err)
 		return
 	}
 	trafficStat.UploadChunkCount += len(uploadChunkIDs)
 	trafficStat.UploadBytes += length
-	trafficStat.APIPut += trafficStat.UploadChunkCount
+	trafficStat.APIPut += puts
 
 	// 上传文件
-	length, err = repo.uploadFiles(uploadFiles, context)
+	length, puts, err = repo.uploadFiles(ctx, uploadFiles, nil)
 	if nil != err {
 		logging.LogErrorf("upload files failed: %s", err)
 		return
 	}
-	trafficStat.UploadChunkCount += len(uploadFiles)
+	trafficStat.UploadFileCount += len(uploadFiles)
 	trafficStat.UploadBytes += length
-	trafficStat.APIPut += trafficStat.UploadChunkCount
+	trafficStat.APIPut += puts
 
 	// 更新云端索引信息
-	err = repo.updateCloudIndexes(latest, trafficStat, context)
+	err = repo.updateCloudIndexes(ctx, latest, trafficStat)
 	if nil != err {
 		logging.LogErrorf("update cloud indexes failed: %s", err)
 		return
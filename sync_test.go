@@ -17,7 +17,9 @@
 package dejavu
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -29,6 +31,7 @@ import (
 	"time"
 
 	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/rest"
 )
 
 type countingLocalCloud struct {
@@ -44,6 +47,13 @@ func (c *countingLocalCloud) UploadObject(filePath string, overwrite bool) (leng
 	return c.Local.UploadObject(filePath, overwrite)
 }
 
+func (c *countingLocalCloud) PutIfMatch(ctx context.Context, key string, data []byte, etag string) (err error) {
+	if "lock-sync" == key {
+		c.lockUploads.Add(1)
+	}
+	return c.Local.PutIfMatch(ctx, key, data, etag)
+}
+
 func (c *countingLocalCloud) DownloadObject(filePath string) (data []byte, err error) {
 	if strings.HasPrefix(filePath, "indexes/") {
 		c.indexDownloads.Add(1)
@@ -101,25 +111,26 @@ func TestSyncCloudLockFastPath(t *testing.T) {
 	if nil != err {
 		t.Fatal(err)
 	}
-	if _, err = repo.Index("Initial index", false, map[string]interface{}{}); nil != err {
+	if _, err = repo.Index(context.Background(), "Initial index", false); nil != err {
 		t.Fatal(err)
 	}
-	if _, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+	if _, _, err = repo.Sync(context.Background()); nil != err {
 		t.Fatal(err)
 	}
 
 	localCloud.lockUploads.Store(0)
-	if _, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+	if _, _, err = repo.Sync(context.Background()); nil != err {
 		t.Fatal(err)
 	}
 	if 0 != localCloud.lockUploads.Load() {
 		t.Fatalf("unchanged sync uploaded cloud lock [%d] times", localCloud.lockUploads.Load())
 	}
 
-	if _, _, err = repo.Sync(map[string]interface{}{"skipCloudPreflight": true}); nil != err {
+	if _, _, err = repo.Sync(WithSkipCloudPreflight(context.Background())); nil != err {
 		t.Fatal(err)
 	}
-	if 1 != localCloud.lockUploads.Load() {
+	// 加锁和解锁各写入一次
+	if 2 != localCloud.lockUploads.Load() {
 		t.Fatalf("prepared sync uploaded cloud lock [%d] times", localCloud.lockUploads.Load())
 	}
 }
@@ -150,15 +161,15 @@ func TestGetCloudLatestFastPath(t *testing.T) {
 	if nil != err {
 		t.Fatal(err)
 	}
-	if _, err = repo.Index("Initial index", false, map[string]interface{}{}); nil != err {
+	if _, err = repo.Index(context.Background(), "Initial index", false); nil != err {
 		t.Fatal(err)
 	}
-	if _, _, err = repo.Sync(map[string]interface{}{}); nil != err {
+	if _, _, err = repo.Sync(context.Background()); nil != err {
 		t.Fatal(err)
 	}
 
 	localCloud.indexDownloads.Store(0)
-	cloudLatest, err := repo.GetCloudLatestFast(map[string]interface{}{})
+	cloudLatest, err := repo.GetCloudLatestFast(context.Background())
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -173,7 +184,7 @@ func TestGetCloudLatestFastPath(t *testing.T) {
 		t.Fatalf("unchanged fast path downloaded cloud index [%d] times", localCloud.indexDownloads.Load())
 	}
 
-	if _, err = repo.GetCloudLatest(map[string]interface{}{}); nil != err {
+	if _, err = repo.GetCloudLatest(context.Background()); nil != err {
 		t.Fatal(err)
 	}
 	if 1 != localCloud.indexDownloads.Load() {
@@ -183,11 +194,11 @@ func TestGetCloudLatestFastPath(t *testing.T) {
 	if err = os.WriteFile(filepath.Join(dataPath, "changed.txt"), []byte("changed"), 0644); nil != err {
 		t.Fatal(err)
 	}
-	if _, err = repo.Index("Changed index", false, map[string]interface{}{}); nil != err {
+	if _, err = repo.Index(context.Background(), "Changed index", false); nil != err {
 		t.Fatal(err)
 	}
 	localCloud.indexDownloads.Store(0)
-	if _, err = repo.GetCloudLatestFast(map[string]interface{}{}); nil != err {
+	if _, err = repo.GetCloudLatestFast(context.Background()); nil != err {
 		t.Fatal(err)
 	}
 	if 1 != localCloud.indexDownloads.Load() {
@@ -254,13 +265,13 @@ func TestGetCloudLatestFastPathReadsSiYuanRefsConcurrently(t *testing.T) {
 	if nil != err {
 		t.Fatal(err)
 	}
-	localLatest, err := repo.Index("Initial index", false, map[string]interface{}{})
+	localLatest, err := repo.Index(context.Background(), "Initial index", false)
 	if nil != err {
 		t.Fatal(err)
 	}
 	latestID = localLatest.ID
 
-	cloudLatest, err := repo.GetCloudLatestFast(map[string]interface{}{})
+	cloudLatest, err := repo.GetCloudLatestFast(context.Background())
 	if nil != err {
 		t.Fatal(err)
 	}
@@ -328,13 +339,13 @@ func TestGetCloudLatestFastPathDoesNotWaitForSequenceRefsOnInvalidLatest(t *test
 	if nil != err {
 		t.Fatal(err)
 	}
-	if _, err = repo.Index("Initial index", false, map[string]interface{}{}); nil != err {
+	if _, err = repo.Index(context.Background(), "Initial index", false); nil != err {
 		t.Fatal(err)
 	}
 
 	result := make(chan error, 1)
 	go func() {
-		_, latestErr := repo.GetCloudLatestFast(map[string]interface{}{})
+		_, latestErr := repo.GetCloudLatestFast(context.Background())
 		result <- latestErr
 	}()
 	select {
@@ -353,3 +364,189 @@ func TestGetCloudLatestFastPathDoesNotWaitForSequenceRefsOnInvalidLatest(t *test
 		t.Fatal("sequence refs request did not finish")
 	}
 }
+
+func TestSyncBandwidthRates(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	const rate = 512 * 1024
+	bandwidth := &cloud.ConfBandwidth{UploadRate: rate, DownloadRate: rate}
+
+	uploader := newPackTestRepo(t, tempDir, "uploader", cloudPath)
+	uploader.cloud.GetConf().Bandwidth = bandwidth
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	writeTestDataFile(t, uploader, "large.bin", string(content))
+	if _, err := uploader.Index(context.Background(), "large", false); nil != err {
+		t.Fatal(err)
+	}
+	_, trafficStat, err := uploader.Sync(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 > trafficStat.UploadRate || rate*6/5 < trafficStat.UploadRate {
+		t.Fatalf("unexpected upload rate [%d] for [%d] bytes", trafficStat.UploadRate, trafficStat.UploadBytes)
+	}
+
+	downloader := newPackTestRepo(t, tempDir, "downloader", cloudPath)
+	downloader.cloud.GetConf().Bandwidth = bandwidth
+	writeTestDataFile(t, downloader, "small.txt", "small")
+	if _, err = downloader.Index(context.Background(), "small", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, trafficStat, err = downloader.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if 1 > trafficStat.DownloadRate || rate*6/5 < trafficStat.DownloadRate {
+		t.Fatalf("unexpected download rate [%d] for [%d] bytes", trafficStat.DownloadRate, trafficStat.DownloadBytes)
+	}
+	if 0 != trafficStat.PeerDownloadRate {
+		t.Fatalf("unexpected peer download rate [%d] without chunk source", trafficStat.PeerDownloadRate)
+	}
+}
+
+// flakyLocalCloud 在第一次上传时返回临时错误。
+type flakyLocalCloud struct {
+	*cloud.Local
+	failed atomic.Bool
+}
+
+func (c *flakyLocalCloud) UploadObject(filePath string, overwrite bool) (int64, error) {
+	if c.failed.CompareAndSwap(false, true) {
+		return 0, cloud.ErrCloudServiceUnavailable
+	}
+	return c.Local.UploadObject(filePath, overwrite)
+}
+
+func (c *flakyLocalCloud) UploadBytes(filePath string, data []byte, overwrite bool) (int64, error) {
+	if c.failed.CompareAndSwap(false, true) {
+		return 0, cloud.ErrCloudServiceUnavailable
+	}
+	return c.Local.UploadBytes(filePath, data, overwrite)
+}
+
+func TestSyncRetryCount(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "retry", filepath.Join(tempDir, "cloud"))
+	flaky := &flakyLocalCloud{Local: repo.cloud.(*cloud.Local)}
+	repo.cloud = cloud.NewRetry(flaky, &cloud.ConfRetry{BaseDelay: time.Millisecond})
+
+	writeTestDataFile(t, repo, "doc.txt", "content")
+	if _, err := repo.Index(context.Background(), "retry", false); nil != err {
+		t.Fatal(err)
+	}
+	_, trafficStat, err := repo.Sync(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !flaky.failed.Load() || 1 != trafficStat.APIRetry {
+		t.Fatalf("unexpected retry count [%d]", trafficStat.APIRetry)
+	}
+}
+
+// newMirrorTestRepo 创建以 primaryPath 为主存储、secondaryPath 为副存储的测试仓库。
+func newMirrorTestRepo(t *testing.T, tempDir, name, primaryPath, secondaryPath string) (repo *Repo, mirror *cloud.Mirror) {
+	t.Helper()
+	repo = newPackTestRepo(t, tempDir, name, primaryPath)
+	primary := repo.cloud.(*cloud.Local)
+	conf := *primary.GetConf()
+	conf.Local = &cloud.ConfLocal{Endpoint: secondaryPath}
+	mirror = cloud.NewMirror(primary, cloud.NewLocal(&cloud.BaseCloud{Conf: &conf}))
+	repo.cloud = mirror
+	return
+}
+
+func TestSyncMirrorSurvivesPrimaryLoss(t *testing.T) {
+	tempDir := t.TempDir()
+	primaryPath, secondaryPath := filepath.Join(tempDir, "primary"), filepath.Join(tempDir, "secondary")
+	uploader, _ := newMirrorTestRepo(t, tempDir, "uploader", primaryPath, secondaryPath)
+	writeTestDataFile(t, uploader, "note.sy", "note content")
+	if _, err := uploader.Index(context.Background(), "note", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := uploader.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(primaryPath); nil != err {
+		t.Fatal(err)
+	}
+
+	downloader, mirror := newMirrorTestRepo(t, tempDir, "downloader", primaryPath, secondaryPath)
+	writeTestDataFile(t, downloader, "other.sy", "other")
+	if _, err := downloader.Index(context.Background(), "other", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := downloader.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(downloader.DataPath, "note.sy"))
+	if nil != err || "note content" != string(data) {
+		t.Fatalf("note lost after losing primary [%s, %v]", data, err)
+	}
+
+	if _, err = mirror.Reconcile(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	divergences, err := mirror.Check(context.Background())
+	if nil != err || 0 != len(divergences) {
+		t.Fatalf("mirrors still diverged after reconcile %v [%v]", divergences, err)
+	}
+}
+
+// newRESTTestRepo 创建通过 REST 服务端 endpoint 同步的测试仓库。
+func newRESTTestRepo(t *testing.T, tempDir, name, endpoint string) (repo *Repo) {
+	t.Helper()
+	repo = newPackTestRepo(t, tempDir, name, filepath.Join(tempDir, name, "unused"))
+	conf := *repo.cloud.GetConf()
+	conf.Local = nil
+	conf.REST = &cloud.ConfREST{Endpoint: endpoint, Token: "token"}
+	repo.cloud = cloud.NewREST(&cloud.BaseCloud{Conf: &conf}, nil)
+	return
+}
+
+func TestSyncREST(t *testing.T) {
+	tempDir := t.TempDir()
+	server, err := rest.NewServer(&rest.Conf{Dir: filepath.Join(tempDir, "server"), Token: "token"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	uploader := newRESTTestRepo(t, tempDir, "uploader", httpServer.URL)
+	writeTestDataFile(t, uploader, "note.sy", "note content")
+	if _, err = uploader.Index(context.Background(), "note", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = uploader.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+
+	downloader := newRESTTestRepo(t, tempDir, "downloader", httpServer.URL)
+	writeTestDataFile(t, downloader, "other.sy", "other")
+	if _, err = downloader.Index(context.Background(), "other", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = downloader.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(downloader.DataPath, "note.sy"))
+	if nil != err || "note content" != string(data) {
+		t.Fatalf("note not synced through REST server [%s, %v]", data, err)
+	}
+
+	// 服务端目录可以直接作为 Local 的服务端点使用
+	local := newPackTestRepo(t, tempDir, "local", filepath.Join(tempDir, "server"))
+	writeTestDataFile(t, local, "local.sy", "local")
+	if _, err = local.Index(context.Background(), "local", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = local.Sync(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"note.sy", "other.sy"} {
+		if _, err = os.Stat(filepath.Join(local.DataPath, name)); nil != err {
+			t.Fatalf("file [%s] not synced from REST server directory: %s", name, err)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package syncscenario_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -42,13 +43,15 @@ const (
 )
 
 type syncScenarioCase struct {
-	Name    string              `json:"name"`
-	Skip    string              `json:"skip"`
-	Seed    map[string]string   `json:"seed"`
-	SeedDir string              `json:"seedDir"`
-	Clients []string            `json:"clients"`
-	Steps   []*syncScenarioStep `json:"steps"`
-	Final   syncScenarioFinal   `json:"final"`
+	Name    string               `json:"name"`
+	Skip    string               `json:"skip"`
+	Cloud   string               `json:"cloud"`
+	Seed    map[string]string    `json:"seed"`
+	SeedDir string               `json:"seedDir"`
+	Clients []string             `json:"clients"`
+	Faults  []*syncScenarioFault `json:"faults"`
+	Steps   []*syncScenarioStep  `json:"steps"`
+	Final   syncScenarioFinal    `json:"final"`
 
 	baseDir string
 }
@@ -63,6 +66,14 @@ type syncScenarioStep struct {
 	Memo      string                   `json:"memo"`
 	Minutes   int                      `json:"minutes"`
 	Want      *syncScenarioExpectation `json:"want"`
+	WantErr   bool                     `json:"wantErr"`
+	Fault     *cloud.MemoryFault       `json:"fault"`
+}
+
+// syncScenarioFault 描述了注入到客户端内存云端存储的故障，Client 为空时注入到全部客户端。
+type syncScenarioFault struct {
+	Client string `json:"client"`
+	cloud.MemoryFault
 }
 
 type syncScenarioExpectation struct {
@@ -88,6 +99,7 @@ type syncScenarioEnv struct {
 	t             *testing.T
 	root          string
 	cloudEndpoint string
+	cloudStore    *cloud.MemoryStore // 使用内存云端存储时不为空
 	caseBaseDir   string
 	aesKey        []byte
 }
@@ -100,6 +112,7 @@ type syncScenarioClient struct {
 	historyPath string
 	tempPath    string
 	repo        *dejavu.Repo
+	memory      *cloud.Memory
 }
 
 func TestSyncScenariosFromJSON(t *testing.T) {
@@ -173,6 +186,16 @@ func runSyncScenarioCase(t *testing.T, testCase *syncScenarioCase) {
 
 	env := newSyncScenarioEnv(t)
 	env.caseBaseDir = testCase.baseDir
+	switch testCase.Cloud {
+	case "", "local":
+		if len(testCase.Faults) > 0 {
+			t.Fatalf("case [%s] declares faults but does not use memory cloud", testCase.Name)
+		}
+	case "memory":
+		env.cloudStore = cloud.NewMemoryStore()
+	default:
+		t.Fatalf("case [%s] has unknown cloud [%s]", testCase.Name, testCase.Cloud)
+	}
 	base := env.seedSyncedClient("seed", testCase)
 	clients := map[string]*syncScenarioClient{}
 	for _, clientName := range testCase.Clients {
@@ -185,6 +208,20 @@ func runSyncScenarioCase(t *testing.T, testCase *syncScenarioCase) {
 		clients[clientName] = env.cloneClient(base, clientName)
 	}
 
+	// 故障在克隆客户端之后注入，不影响同步基线
+	for _, fault := range testCase.Faults {
+		matched := false
+		for clientName, client := range clients {
+			if fault.Client == "" || fault.Client == clientName {
+				client.addFault(&fault.MemoryFault)
+				matched = true
+			}
+		}
+		if !matched {
+			t.Fatalf("case [%s] fault references unknown client [%s]", testCase.Name, fault.Client)
+		}
+	}
+
 	for i, step := range testCase.Steps {
 		client := clients[step.Client]
 		if client == nil {
@@ -219,6 +256,13 @@ func runSyncScenarioStep(t *testing.T, client *syncScenarioClient, stepNum int,
 		syncScenarioTouchDir(client.env.t, client.dataPath, syncScenarioBaseTime().Add(time.Duration(step.Minutes)*time.Minute))
 	case "remove":
 		client.removeFile(step.Path)
+	case "fault":
+		if step.Fault == nil {
+			t.Fatalf("[%s] fault step [%d] has empty fault", client.name, stepNum)
+		}
+		client.addFault(step.Fault)
+	case "clear_faults":
+		client.clearFaults()
 	case "remove_cloud_latest":
 		client.removeCloudLatest()
 	case "assert_cloud_latest":
@@ -230,6 +274,10 @@ func runSyncScenarioStep(t *testing.T, client *syncScenarioClient, stepNum int,
 		}
 		client.index(memo)
 	case "sync":
+		if step.WantErr {
+			client.syncFailed()
+			return
+		}
 		result := client.sync()
 		if step.Want != nil {
 			client.assertMergeResult(result, *step.Want)
@@ -360,14 +408,24 @@ func (env *syncScenarioEnv) cloneClient(src *syncScenarioClient, name string) *s
 func (env *syncScenarioEnv) newRepo(client *syncScenarioClient) *dejavu.Repo {
 	env.t.Helper()
 
-	c := cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
-		Dir:    syncScenarioCloudDir,
-		UserID: "0",
-		Local: &cloud.ConfLocal{
-			Endpoint:       env.cloudEndpoint,
-			ConcurrentReqs: 4,
-		},
-	}})
+	var c cloud.Cloud
+	if env.cloudStore != nil {
+		client.memory = cloud.NewMemory(&cloud.BaseCloud{Conf: &cloud.Conf{
+			Dir:      syncScenarioCloudDir,
+			UserID:   "0",
+			RepoPath: client.repoPath,
+		}}, env.cloudStore)
+		c = client.memory
+	} else {
+		c = cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{
+			Dir:    syncScenarioCloudDir,
+			UserID: "0",
+			Local: &cloud.ConfLocal{
+				Endpoint:       env.cloudEndpoint,
+				ConcurrentReqs: 4,
+			},
+		}})
+	}
 
 	repo, err := dejavu.NewRepo(client.dataPath, client.repoPath, client.historyPath, client.tempPath, client.name, client.name, runtime.GOOS, env.aesKey, nil, c)
 	if err != nil {
@@ -400,9 +458,36 @@ func (client *syncScenarioClient) removeFile(relPath string) {
 	}
 }
 
+func (client *syncScenarioClient) addFault(fault *cloud.MemoryFault) {
+	client.env.t.Helper()
+
+	if client.memory == nil {
+		client.env.t.Fatalf("[%s] faults require memory cloud", client.name)
+	}
+	// 每个客户端独立计数
+	f := *fault
+	client.memory.AddFault(&f)
+}
+
+func (client *syncScenarioClient) clearFaults() {
+	client.env.t.Helper()
+
+	if client.memory == nil {
+		client.env.t.Fatalf("[%s] faults require memory cloud", client.name)
+	}
+	client.memory.ClearFaults()
+}
+
 func (client *syncScenarioClient) removeCloudLatest() {
 	client.env.t.Helper()
 
+	if client.memory != nil {
+		if err := cloud.NewMemory(&cloud.BaseCloud{Conf: client.memory.GetConf()}, client.env.cloudStore).RemoveObject("refs/latest"); err != nil {
+			client.env.t.Fatalf("[%s] remove cloud latest failed: %s", client.name, err)
+		}
+		return
+	}
+
 	latestPath := filepath.Join(client.env.cloudEndpoint, syncScenarioCloudDir, "refs", "latest")
 	err := os.Remove(latestPath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -413,6 +498,13 @@ func (client *syncScenarioClient) removeCloudLatest() {
 func (client *syncScenarioClient) assertCloudLatest() {
 	client.env.t.Helper()
 
+	if client.memory != nil {
+		if _, err := cloud.NewMemory(&cloud.BaseCloud{Conf: client.memory.GetConf()}, client.env.cloudStore).Stat(context.Background(), "refs/latest"); err != nil {
+			client.env.t.Fatalf("[%s] stat cloud latest failed: %s", client.name, err)
+		}
+		return
+	}
+
 	latestPath := filepath.Join(client.env.cloudEndpoint, syncScenarioCloudDir, "refs", "latest")
 	if _, err := os.Stat(latestPath); err != nil {
 		client.env.t.Fatalf("[%s] stat cloud latest failed: %s", client.name, err)
@@ -422,7 +514,7 @@ func (client *syncScenarioClient) assertCloudLatest() {
 func (client *syncScenarioClient) index(memo string) {
 	client.env.t.Helper()
 
-	if _, err := client.repo.Index(memo, true, map[string]interface{}{}); err != nil {
+	if _, err := client.repo.Index(context.Background(), memo, true); err != nil {
 		client.env.t.Fatalf("[%s] index failed: %s", client.name, err)
 	}
 }
@@ -430,17 +522,25 @@ func (client *syncScenarioClient) index(memo string) {
 func (client *syncScenarioClient) sync() *dejavu.MergeResult {
 	client.env.t.Helper()
 
-	mergeResult, _, err := client.repo.Sync(map[string]interface{}{})
+	mergeResult, _, err := client.repo.Sync(context.Background())
 	if err != nil {
 		client.env.t.Fatalf("[%s] sync failed: %s", client.name, err)
 	}
 	return mergeResult
 }
 
+func (client *syncScenarioClient) syncFailed() {
+	client.env.t.Helper()
+
+	if _, _, err := client.repo.Sync(context.Background()); err == nil {
+		client.env.t.Fatalf("[%s] expected sync to fail", client.name)
+	}
+}
+
 func (client *syncScenarioClient) syncPrepared() *dejavu.MergeResult {
 	client.env.t.Helper()
 
-	mergeResult, _, err := client.repo.Sync(map[string]interface{}{"skipCloudPreflight": true})
+	mergeResult, _, err := client.repo.Sync(dejavu.WithSkipCloudPreflight(context.Background()))
 	if err != nil {
 		client.env.t.Fatalf("[%s] prepared sync failed: %s", client.name, err)
 	}
@@ -450,12 +550,12 @@ func (client *syncScenarioClient) syncPrepared() *dejavu.MergeResult {
 func (client *syncScenarioClient) prefetch() int {
 	client.env.t.Helper()
 
-	context := map[string]interface{}{}
-	cloudLatest, err := client.repo.GetCloudLatestFast(context)
+	ctx := context.Background()
+	cloudLatest, err := client.repo.GetCloudLatestFast(ctx)
 	if err != nil {
 		client.env.t.Fatalf("[%s] get cloud latest before prepared sync failed: %s", client.name, err)
 	}
-	fetchedFiles, _, err := client.repo.GetSyncCloudFilesWithTraffic(cloudLatest, context)
+	fetchedFiles, _, err := client.repo.GetSyncCloudFilesWithTraffic(ctx, cloudLatest)
 	if err != nil {
 		client.env.t.Fatalf("[%s] prefetch cloud files failed: %s", client.name, err)
 	}
@@ -465,7 +565,7 @@ func (client *syncScenarioClient) prefetch() int {
 func (client *syncScenarioClient) syncDownload() *dejavu.MergeResult {
 	client.env.t.Helper()
 
-	mergeResult, _, err := client.repo.SyncDownload(map[string]interface{}{})
+	mergeResult, _, err := client.repo.SyncDownload(context.Background())
 	if err != nil {
 		client.env.t.Fatalf("[%s] sync download failed: %s", client.name, err)
 	}
@@ -0,0 +1,266 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
+)
+
+// uploadJournalExpiration 为上传日志的有效期，超过有效期的日志中记录的对象可能已经被云端清理。
+const uploadJournalExpiration = 24 * time.Hour
+
+// uploadJournal 记录了同步时上传到云端的对象中已经确认上传成功的对象 ID，每个待上传的目标索引对应一个日志。
+// 同步中断后重新同步同一个目标索引时先确认这些对象仍然位于云端，然后跳过，云端 refs/latest 更新成功后清除日志。
+type uploadJournal struct {
+	path     string
+	uploaded map[string]bool
+	file     *os.File
+	lock     sync.Mutex
+}
+
+// uploadJournalHeader 是上传日志的第一行，后续每行为一个已经上传成功的对象 ID。
+type uploadJournalHeader struct {
+	Target  string `json:"target"`  // 目标索引 ID
+	Base    string `json:"base"`    // 开始上传时的云端最新索引 ID
+	Created int64  `json:"created"` // 创建时间
+}
+
+// openUploadJournal 打开目标索引 target 的上传日志。云端最新索引 base 已经变化或者日志过期时重新创建日志。
+// 上传日志只用于加速，打开失败时返回 nil，不影响上传。
+func (repo *Repo) openUploadJournal(target, base *entity.Index) (ret *uploadJournal) {
+	dir := filepath.Join(repo.Path, "journal")
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		logging.LogWarnf("create upload journal dir [%s] failed: %s", dir, err)
+		return
+	}
+
+	ret = &uploadJournal{path: filepath.Join(dir, "upload-"+target.ID), uploaded: map[string]bool{}}
+	if ret.load(base.ID) {
+		logging.LogInfof("resume upload journal [%s, uploaded=%d]", target.ID, len(ret.uploaded))
+		var err error
+		if ret.file, err = os.OpenFile(ret.path, os.O_WRONLY|os.O_APPEND, 0644); nil != err {
+			logging.LogWarnf("open upload journal [%s] failed: %s", ret.path, err)
+			return nil
+		}
+		return
+	}
+
+	header, err := gulu.JSON.MarshalJSON(&uploadJournalHeader{Target: target.ID, Base: base.ID, Created: time.Now().UnixMilli()})
+	if nil != err {
+		logging.LogWarnf("marshal upload journal header failed: %s", err)
+		return nil
+	}
+	if ret.file, err = os.OpenFile(ret.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); nil != err {
+		logging.LogWarnf("create upload journal [%s] failed: %s", ret.path, err)
+		return nil
+	}
+	if _, err = ret.file.Write(append(header, '\n')); nil != err {
+		logging.LogWarnf("write upload journal [%s] failed: %s", ret.path, err)
+		ret.file.Close()
+		return nil
+	}
+	return
+}
+
+func (journal *uploadJournal) load(baseID string) (ok bool) {
+	file, err := os.Open(journal.path)
+	if nil != err {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return
+	}
+	header := &uploadJournalHeader{}
+	if err = gulu.JSON.UnmarshalJSON(scanner.Bytes(), header); nil != err {
+		logging.LogWarnf("unmarshal upload journal [%s] header failed: %s", journal.path, err)
+		return
+	}
+	if header.Base != baseID || time.Since(time.UnixMilli(header.Created)) > uploadJournalExpiration {
+		logging.LogInfof("discard outdated upload journal [%s]", journal.path)
+		return
+	}
+
+	for scanner.Scan() {
+		// 进程中断时最后一行可能不完整，忽略
+		if id := scanner.Text(); 40 == len(id) {
+			journal.uploaded[id] = true
+		}
+	}
+	ok = true
+	return
+}
+
+// has 判断对象 id 是否已经上传成功。
+func (journal *uploadJournal) has(id string) bool {
+	if nil == journal {
+		return false
+	}
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	return journal.uploaded[id]
+}
+
+// add 记录已经上传成功的对象 ids。
+func (journal *uploadJournal) add(ids ...string) {
+	if nil == journal {
+		return
+	}
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	if nil == journal.file {
+		return
+	}
+
+	var data []byte
+	for _, id := range ids {
+		journal.uploaded[id] = true
+		data = append(data, id...)
+		data = append(data, '\n')
+	}
+	if _, err := journal.file.Write(data); nil != err {
+		logging.LogWarnf("write upload journal [%s] failed: %s", journal.path, err)
+		journal.file.Close()
+		journal.file = nil
+	}
+}
+
+// confirm 确认日志中记录的对象 ids 仍然位于云端，云端缺失的对象从日志中移除，随后重新上传。
+// 同步中断期间其他设备可能清理了云端数据仓库，清理不会更新云端最新索引，所以不能只根据 Base 判断日志是否有效。
+//
+// 为了避免逐个检查对象，按照对象所在的前缀目录列出云端对象，聚合到包文件中的对象使用同步期间缓存的云端包索引确认。
+func (journal *uploadJournal) confirm(repo *Repo, ids []string) (apiGet int, err error) {
+	if nil == journal {
+		return
+	}
+
+	var skipped []string
+	for _, id := range ids {
+		if journal.has(id) {
+			skipped = append(skipped, id)
+		}
+	}
+	if 1 > len(skipped) {
+		return
+	}
+
+	missing, apiGet, err := repo.cloudMissingObjects(skipped)
+	if nil != err {
+		logging.LogErrorf("list cloud journaled objects failed: %s", err)
+		return
+	}
+
+	// 对象可能已经聚合到包文件中
+	missing, gets, err := repo.excludeCloudPacked(missing)
+	apiGet += gets
+	if nil != err {
+		logging.LogErrorf("get cloud journaled packed objects failed: %s", err)
+		return
+	}
+	if 1 > len(missing) {
+		return
+	}
+
+	logging.LogInfof("upload journal [%s] has [%d] objects missing in cloud, uploading them again", journal.path, len(missing))
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	for _, id := range missing {
+		delete(journal.uploaded, id)
+	}
+	return
+}
+
+// cloudMissingObjects 返回 ids 中不是云端松散对象的对象 ID，每个涉及的前缀目录 objects/xx/ 列出一次。
+func (repo *Repo) cloudMissingObjects(ids []string) (ret []string, apiGet int, err error) {
+	prefixes := map[string][]string{}
+	for _, id := range ids {
+		prefixes[id[:2]] = append(prefixes[id[:2]], id)
+	}
+
+	for prefix, prefixIDs := range prefixes {
+		var objInfos map[string]*entity.ObjectInfo
+		objInfos, err = repo.cloud.ListObjects(path.Join("objects", prefix) + "/")
+		apiGet++
+		if nil != err {
+			if !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+				return
+			}
+			err = nil
+		}
+
+		existing := map[string]bool{}
+		for name := range objInfos {
+			existing[prefix+path.Base(name)] = true
+		}
+		for _, id := range prefixIDs {
+			if !existing[id] {
+				ret = append(ret, id)
+			}
+		}
+	}
+	return
+}
+
+// exclude 返回 ids 中尚未上传成功的对象 ID。
+func (journal *uploadJournal) exclude(ids []string) (ret []string) {
+	if nil == journal {
+		return ids
+	}
+
+	for _, id := range ids {
+		if !journal.has(id) {
+			ret = append(ret, id)
+		}
+	}
+	return
+}
+
+func (journal *uploadJournal) close() {
+	if nil == journal {
+		return
+	}
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	if nil != journal.file {
+		journal.file.Close()
+		journal.file = nil
+	}
+}
+
+// removeUploadJournals 在云端引用更新成功后清除所有上传日志。
+func (repo *Repo) removeUploadJournals() {
+	dir := filepath.Join(repo.Path, "journal")
+	if err := os.RemoveAll(dir); nil != err {
+		logging.LogWarnf("remove upload journals [%s] failed: %s", dir, err)
+	}
+}
@@ -0,0 +1,188 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+)
+
+type interruptedUploadCloud struct {
+	*cloud.Local
+	uploads   atomic.Int32
+	checks    atomic.Int32 // 逐个检查是否位于云端的对象数
+	failAfter int32        // 上传对象超过该数量后失败，0 表示不失败
+}
+
+func (c *interruptedUploadCloud) GetChunks(checkChunkIDs []string) (chunkIDs []string, err error) {
+	c.checks.Add(int32(len(checkChunkIDs)))
+	return c.Local.GetChunks(checkChunkIDs)
+}
+
+func (c *interruptedUploadCloud) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	if strings.HasPrefix(filePath, "objects/") {
+		if uploads := c.uploads.Add(1); 0 < c.failAfter && uploads > c.failAfter {
+			err = errors.New("network down")
+			return
+		}
+	}
+	return c.Local.UploadObject(filePath, overwrite)
+}
+
+func TestResumeInterruptedUpload(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	localCloud := repo.cloud.(*cloud.Local)
+	localCloud.GetConf().PackObjects = false
+	interrupted := &interruptedUploadCloud{Local: localCloud, failAfter: 3}
+	repo.cloud = interrupted
+	for i := 0; i < 8; i++ {
+		writeTestDataFile(t, repo, "doc"+strconv.Itoa(i)+".txt", "content "+strconv.Itoa(i))
+	}
+	ctx := context.Background()
+	latest, err := repo.Index(ctx, "interrupted", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// 第一次同步上传了部分对象后中断
+	if _, _, err = repo.Sync(ctx); nil == err {
+		t.Fatal("sync should fail")
+	}
+	journal := &uploadJournal{path: filepath.Join(repo.Path, "journal", "upload-"+latest.ID), uploaded: map[string]bool{}}
+	if !journal.load("") {
+		t.Fatal("upload journal should be kept after interrupted sync")
+	}
+	journaled := len(journal.uploaded)
+	if 1 > journaled {
+		t.Fatal("upload journal should record uploaded objects")
+	}
+	firstUploads := interrupted.uploads.Load()
+
+	// 重新同步时跳过已经上传成功的对象
+	interrupted.failAfter = 0
+	interrupted.uploads.Store(0)
+	if _, _, err = repo.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+	total := len(latest.Files) * 2 // 每个文件一个分块
+	if int(interrupted.uploads.Load()) != total-journaled {
+		t.Fatalf("resumed sync uploaded [%d] objects, first sync tried [%d], expected [%d]", interrupted.uploads.Load(), firstUploads, total-journaled)
+	}
+	if 0 != interrupted.checks.Load() {
+		t.Fatalf("journaled objects should be confirmed by listing, checked [%d] objects one by one", interrupted.checks.Load())
+	}
+	if _, err = os.Stat(filepath.Join(repo.Path, "journal")); !os.IsNotExist(err) {
+		t.Fatalf("upload journal should be removed after cloud ref updated: %v", err)
+	}
+}
+
+func TestUploadJournalOutdated(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := newPackTestRepo(t, tempDir, "a", filepath.Join(tempDir, "cloud"))
+	target := &entity.Index{ID: strings.Repeat("a", 40)}
+	base := &entity.Index{ID: strings.Repeat("b", 40)}
+	objectID := strings.Repeat("c", 40)
+
+	journal := repo.openUploadJournal(target, base)
+	journal.add(objectID)
+	journal.close()
+
+	journal = repo.openUploadJournal(target, base)
+	if !journal.has(objectID) {
+		t.Fatal("upload journal should be resumed")
+	}
+	journal.close()
+
+	// 云端最新索引变化后丢弃日志
+	journal = repo.openUploadJournal(target, &entity.Index{})
+	if journal.has(objectID) {
+		t.Fatal("outdated upload journal should be discarded")
+	}
+	journal.close()
+}
+
+func TestResumeUploadAfterCloudPurged(t *testing.T) {
+	tempDir := t.TempDir()
+	cloudPath := filepath.Join(tempDir, "cloud")
+	repo := newPackTestRepo(t, tempDir, "a", cloudPath)
+	localCloud := repo.cloud.(*cloud.Local)
+	localCloud.GetConf().PackObjects = false
+	interrupted := &interruptedUploadCloud{Local: localCloud}
+	repo.cloud = interrupted
+	ctx := context.Background()
+	writeTestDataFile(t, repo, "base.txt", "base")
+	if _, err := repo.Index(ctx, "base", false); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+
+	interrupted.failAfter = 3
+	interrupted.uploads.Store(0)
+	for i := 0; i < 8; i++ {
+		writeTestDataFile(t, repo, "doc"+strconv.Itoa(i)+".txt", "content "+strconv.Itoa(i))
+	}
+	latest, err := repo.Index(ctx, "interrupted", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = repo.Sync(ctx); nil == err {
+		t.Fatal("sync should fail")
+	}
+
+	// 另一台设备清理云端，中断时上传的对象没有被引用，会被清理
+	other := newPackTestRepo(t, tempDir, "b", cloudPath)
+	if _, err = other.PurgeCloud(ctx); nil != err {
+		t.Fatal(err)
+	}
+
+	// 重新同步时重新上传云端缺失的对象
+	interrupted.failAfter = 0
+	interrupted.uploads.Store(0)
+	if _, _, err = repo.Sync(ctx); nil != err {
+		t.Fatal(err)
+	}
+	total := (len(latest.Files) - 1) * 2 // 每个文件一个分块，不包括已经同步的 base.txt
+	if int(interrupted.uploads.Load()) != total {
+		t.Fatalf("resumed sync uploaded [%d] objects, expected [%d]", interrupted.uploads.Load(), total)
+	}
+
+	var ids []string
+	for _, fileID := range latest.Files {
+		file, getErr := repo.store.GetFile(fileID)
+		if nil != getErr {
+			t.Fatal(getErr)
+		}
+		ids = append(ids, fileID)
+		ids = append(ids, file.Chunks...)
+	}
+	missing, err := localCloud.GetChunks(ids)
+	if nil != err || 0 < len(missing) {
+		t.Fatalf("cloud missing objects %v, err [%v]", missing, err)
+	}
+}